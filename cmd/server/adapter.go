@@ -2,14 +2,19 @@ package server
 
 import (
 	"context"
+	"net/http"
 	"os"
 	"os/user"
 	"path"
 
+	"github.com/barkbay/custom-metrics-router/pkg/accesslog"
+	"github.com/barkbay/custom-metrics-router/pkg/apiserver"
 	"github.com/barkbay/custom-metrics-router/pkg/provider"
 	"github.com/barkbay/custom-metrics-router/pkg/registry"
+	"github.com/barkbay/custom-metrics-router/pkg/tracing"
 	basecmd "github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/cmd"
 	"github.com/spf13/viper"
+	genericapiserver "k8s.io/apiserver/pkg/server"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog"
@@ -18,6 +23,7 @@ import (
 type RoutedAdapter struct {
 	basecmd.AdapterBase
 	*registry.Registry
+	AccessLog *accesslog.Logger
 }
 
 func (r *RoutedAdapter) run(ctx context.Context) {
@@ -25,10 +31,6 @@ func (r *RoutedAdapter) run(ctx context.Context) {
 	if err != nil {
 		klog.Fatalf("failed to parse flags: %v", err)
 	}
-	routedProvider := provider.NewRoutedProvider(r.Registry)
-	r.WithCustomMetrics(routedProvider)
-	r.WithExternalMetrics(routedProvider)
-
 	// Attempt to load the config
 	if _, err := r.ClientConfig(); err != nil && err != rest.ErrNotInCluster {
 		// Not in cluster, attempt to laad the config from a known place
@@ -49,7 +51,28 @@ func (r *RoutedAdapter) run(ctx context.Context) {
 		r.Authorization = nil
 	}
 
-	if err := r.Run(ctx.Done()); err != nil {
+	config, err := r.Config()
+	if err != nil {
+		klog.Fatalf("unable to create custom metrics server configuration: %v", err)
+	}
+	// The trace context of the API server is extracted before the request is handled
+	buildHandlerChain := config.GenericConfig.BuildHandlerChainFunc
+	config.GenericConfig.BuildHandlerChainFunc = func(apiHandler http.Handler, c *genericapiserver.Config) http.Handler {
+		return tracing.Handler(buildHandlerChain(apiHandler, c))
+	}
+
+	// The metrics APIs are not installed by the adapter base, the routed provider is context aware.
+	server, err := r.Server()
+	if err != nil {
+		klog.Fatalf("unable to create custom metrics server: %v", err)
+	}
+	routedProvider := provider.NewRoutedProvider(r.Registry, r.AccessLog)
+	if err := apiserver.InstallMetricsAPIs(server.GenericAPIServer, routedProvider); err != nil {
+		klog.Fatalf("unable to install metrics APIs: %v", err)
+	}
+	apiserver.InstallRoutesEndpoint(server.GenericAPIServer, r.Registry)
+
+	if err := server.GenericAPIServer.PrepareRun().Run(ctx.Done()); err != nil {
 		klog.Fatalf("unable to run custom metrics routedProvider: %v", err)
 	}
 }
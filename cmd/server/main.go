@@ -17,8 +17,12 @@ limitations under the License.
 package server
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -28,13 +32,17 @@ import (
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/klog"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 
+	"github.com/barkbay/custom-metrics-router/pkg/accesslog"
 	mrv1alpha1 "github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
 	"github.com/barkbay/custom-metrics-router/pkg/controller"
+	"github.com/barkbay/custom-metrics-router/pkg/tracing"
 
 	_ "gopkg.in/yaml.v2"
 	//+kubebuilder:scaffold:imports
@@ -62,6 +70,17 @@ func Command() *cobra.Command {
 	cmd.Flags().Bool("anonymous-auth", false, "if true, metrics server authentication and authorization are disabled, only to be used in dev mode")
 	cmd.Flags().String("metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	cmd.Flags().String("health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
+	cmd.Flags().Int("max-concurrent-reconciles", 4, "The maximum number of metrics sources discovered in parallel.")
+	cmd.Flags().Duration("readiness-timeout", 5*time.Minute, "The time after which the server is reported ready even if some metrics sources have not been discovered yet, 0 to wait forever.")
+	cmd.Flags().Bool("readiness-require-sync", false, "if true, the server is only reported ready once the discovery of every metrics source has succeeded.")
+	cmd.Flags().Duration("drain-timeout", 30*time.Second, "The maximum time to wait for the requests in progress to complete when a metrics source is deleted, 0 to disable draining.")
+	cmd.Flags().Bool("auto-discovery", false, "if true, metrics sources are created for the services which back the metrics APIServices, or which are labelled for discovery.")
+	cmd.Flags().Float64("access-log-sampling-ratio", 1, "The ratio of the successful requests for metric values which are logged, failed requests are always logged.")
+	cmd.Flags().Int("access-log-verbosity", 2, "The log level at which the requests for metric values are logged.")
+	cmd.Flags().String("access-log-file", "", "If set, the requests for metric values are written in JSON to this file instead of the logs, - for the standard output.")
+	cmd.Flags().String("tracing-endpoint", "", "The URL of an OTLP/HTTP receiver, for example http://otel-collector:4318, to which the traces are sent. Tracing is disabled if empty.")
+	cmd.Flags().Float64("tracing-sampling-ratio", 1, "The ratio of the requests traced, if the caller has not already decided whether the request is traced.")
+	cmd.Flags().String("router-service", "metrics-router/metrics-apiserver", "The namespace and name of the service of the router, ignored by the auto-discovery.")
 	// Register adapter flags
 	cmd.Flags().AddFlagSet(adapter.Flags())
 	adapter.FlagSet.AddGoFlagSet(flag.CommandLine) // make sure you get the klog flags
@@ -76,6 +95,15 @@ func doRun(cmd *cobra.Command, _ []string) {
 		os.Exit(1)
 	}
 
+	shutdownTracing, err := tracing.Setup(tracing.Options{
+		Endpoint:      viper.GetString("tracing-endpoint"),
+		SamplingRatio: viper.GetFloat64("tracing-sampling-ratio"),
+	})
+	if err != nil {
+		setupLog.Error(err, "unable to set up tracing")
+		os.Exit(1)
+	}
+
 	ctrlOpts := ctrl.Options{
 		Scheme:                 scheme,
 		MetricsBindAddress:     viper.GetString("metrics-bind-address"),
@@ -89,18 +117,44 @@ func doRun(cmd *cobra.Command, _ []string) {
 	}
 
 	// Create a new routes registry
-	registry, err := controller.SetupMetricsSourceController(mgr)
+	routerService, err := parseNamespacedName(viper.GetString("router-service"))
+	if err != nil {
+		setupLog.Error(err, "invalid router service")
+		os.Exit(1)
+	}
+	registry, readiness, err := controller.SetupMetricsSourceController(mgr, controller.Options{
+		MaxConcurrentReconciles: viper.GetInt("max-concurrent-reconciles"),
+		Readiness: controller.ReadinessOptions{
+			Timeout:     viper.GetDuration("readiness-timeout"),
+			RequireSync: viper.GetBool("readiness-require-sync"),
+		},
+		DrainTimeout: viper.GetDuration("drain-timeout"),
+		AutoDiscovery: controller.AutoDiscoveryOptions{
+			Enabled:       viper.GetBool("auto-discovery"),
+			RouterService: routerService,
+		},
+	})
 	if err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "MetricsSource")
 		os.Exit(1)
 	}
 	// Set adapter registry
 	adapter.Registry = registry
+	adapter.AccessLog, err = accesslog.NewLogger(accesslog.Options{
+		SamplingRatio: viper.GetFloat64("access-log-sampling-ratio"),
+		Verbosity:     klog.Level(viper.GetInt("access-log-verbosity")),
+		File:          viper.GetString("access-log-file"),
+	})
+	if err != nil {
+		setupLog.Error(err, "unable to set up access log")
+		os.Exit(1)
+	}
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
 	}
-	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
+	// Not ready until the initial routing table is built
+	if err := mgr.AddReadyzCheck("readyz", readiness); err != nil {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
@@ -113,4 +167,19 @@ func doRun(cmd *cobra.Command, _ []string) {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
+	// Export the spans not exported yet
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		setupLog.Error(err, "failed to export traces")
+	}
+}
+
+// parseNamespacedName parses a namespace and a name in the form namespace/name.
+func parseNamespacedName(value string) (types.NamespacedName, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return types.NamespacedName{}, fmt.Errorf("%q is not in the form namespace/name", value)
+	}
+	return types.NamespacedName{Namespace: parts[0], Name: parts[1]}, nil
 }
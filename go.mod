@@ -3,17 +3,26 @@ module github.com/barkbay/custom-metrics-router
 go 1.16
 
 require (
+	github.com/golang/protobuf v1.5.2
 	github.com/kubernetes-sigs/custom-metrics-apiserver v0.0.0-20210603131538-559674576232
 	github.com/onsi/ginkgo v1.16.4
 	github.com/onsi/gomega v1.13.0
+	github.com/prometheus/client_golang v1.11.0
+	github.com/prometheus/client_model v0.2.0
+	github.com/prometheus/common v0.26.0
 	github.com/spf13/cobra v1.1.1
 	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/spf13/viper v1.7.0
-	github.com/stretchr/testify v1.7.0 // indirect
+	github.com/stretchr/testify v1.7.0
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba
+	google.golang.org/grpc v1.27.1
 	gopkg.in/yaml.v2 v2.4.0
 	k8s.io/api v0.22.0-alpha.3
 	k8s.io/apimachinery v0.22.0-alpha.3
-	k8s.io/apiserver v0.22.0-alpha.3 // indirect
+	k8s.io/apiserver v0.22.0-alpha.3
 	k8s.io/client-go v0.22.0-alpha.3
 	k8s.io/klog v1.0.0
 	k8s.io/metrics v0.21.1
@@ -0,0 +1,267 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package accesslog records the requests for metric values served by the router. Successful requests are sampled,
+// failed requests are always logged. Requests are either logged by klog, or written in JSON to a dedicated file.
+package accesslog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/metrics"
+	"k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/klog"
+)
+
+// Entry is a request for metric values.
+type Entry struct {
+	Time      time.Time
+	User      string
+	API       string
+	Operation string
+	Metric    string
+	Namespace string
+	// Name is the name of the object described by the metric, if the custom metric is requested by name.
+	Name string
+	// Selector is the label selector of the objects described by the metric, if the custom metric is requested by
+	// selector.
+	Selector       string
+	MetricSelector string
+
+	// lock protects the fields set while the request is served.
+	lock sync.Mutex
+	// Source is the metrics source the request has been routed to.
+	Source string
+	// Attempts is the number of requests sent to the metrics backend.
+	Attempts int
+	// Coalesced is true if the request has shared the backend call of an identical concurrent request.
+	Coalesced bool
+	// Cache is the result of the lookup in the value cache of the metrics source: hit, miss or stale. It is empty if
+	// the values of the metrics source are not cached.
+	Cache string
+}
+
+type entryKey struct{}
+
+// FromContext returns the entry of the request being served, or nil if the request is not logged.
+func FromContext(ctx context.Context) *Entry {
+	entry, _ := ctx.Value(entryKey{}).(*Entry)
+	return entry
+}
+
+// SetSource records the metrics source the request has been routed to.
+func (e *Entry) SetSource(sourceName string) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.Source = sourceName
+}
+
+// AddAttempt records a request sent to the metrics backend.
+func (e *Entry) AddAttempt() {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.Attempts++
+}
+
+// SetCache records the result of the lookup in the value cache of the metrics source.
+func (e *Entry) SetCache(result string) {
+	if e == nil {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.Cache = result
+}
+
+// CoalescedWith records that the request has shared the backend call of another request.
+func (e *Entry) CoalescedWith(other *Entry) {
+	if e == nil || other == nil || e == other {
+		return
+	}
+	other.lock.Lock()
+	source, attempts, cache := other.Source, other.Attempts, other.Cache
+	other.lock.Unlock()
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.Source, e.Attempts, e.Cache, e.Coalesced = source, attempts, cache, true
+}
+
+// Options configures the access log.
+type Options struct {
+	// SamplingRatio is the ratio of the successful requests which are logged.
+	SamplingRatio float64
+	// Verbosity is the klog verbosity at which the requests are logged, if they are not written to File.
+	Verbosity klog.Level
+	// File, if set, is the file to which the requests are written in JSON, one request per line. "-" is the standard
+	// output.
+	File string
+}
+
+// Logger writes the access log.
+type Logger struct {
+	options Options
+	// out is the writer of the JSON access log, the requests are logged by klog if nil.
+	out  io.Writer
+	lock sync.Mutex
+	// sample returns true if a successful request must be logged.
+	sample func() bool
+}
+
+// NewLogger returns a Logger configured with the given options.
+func NewLogger(options Options) (*Logger, error) {
+	l := &Logger{options: options}
+	l.sample = func() bool { return rand.Float64() < l.options.SamplingRatio } //nolint:gosec
+	switch options.File {
+	case "":
+	case "-":
+		l.out = os.Stdout
+	default:
+		file, err := os.OpenFile(options.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open access log file: %v", err)
+		}
+		l.out = file
+	}
+	return l, nil
+}
+
+// Start records the start of a request. The entry is stored in the returned context, so that it can be completed while
+// the request is served.
+func (l *Logger) Start(ctx context.Context, entry *Entry) context.Context {
+	if l == nil {
+		return ctx
+	}
+	entry.Time = time.Now()
+	if user, ok := request.UserFrom(ctx); ok {
+		entry.User = user.GetName()
+	}
+	return context.WithValue(ctx, entryKey{}, entry)
+}
+
+// Log logs a request once it has been served, if it has been sampled.
+func (l *Logger) Log(entry *Entry, err error) {
+	if l == nil || (err == nil && !l.sample()) {
+		return
+	}
+	duration := time.Since(entry.Time)
+	entry.lock.Lock()
+	record := record{
+		Time:           entry.Time.UTC().Format(time.RFC3339Nano),
+		User:           entry.User,
+		API:            entry.API,
+		Operation:      entry.Operation,
+		Metric:         entry.Metric,
+		Namespace:      entry.Namespace,
+		Name:           entry.Name,
+		Selector:       entry.Selector,
+		MetricSelector: entry.MetricSelector,
+		Source:         entry.Source,
+		Attempts:       entry.Attempts,
+		Coalesced:      entry.Coalesced,
+		Cache:          entry.Cache,
+		Code:           metrics.Code(err),
+		Duration:       duration.Seconds(),
+		duration:       duration,
+	}
+	entry.lock.Unlock()
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	if l.out == nil {
+		if klog.V(l.options.Verbosity) {
+			klog.InfoDepth(1, record.String())
+		}
+		return
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		klog.Errorf("failed to encode access log entry: %v", err)
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if _, err := l.out.Write(append(line, '\n')); err != nil {
+		klog.Errorf("failed to write access log entry: %v", err)
+	}
+}
+
+// record is an entry of the access log, as it is written.
+type record struct {
+	Time           string  `json:"time"`
+	User           string  `json:"user,omitempty"`
+	API            string  `json:"api"`
+	Operation      string  `json:"operation"`
+	Metric         string  `json:"metric"`
+	Namespace      string  `json:"namespace,omitempty"`
+	Name           string  `json:"name,omitempty"`
+	Selector       string  `json:"selector,omitempty"`
+	MetricSelector string  `json:"metricSelector,omitempty"`
+	Source         string  `json:"source,omitempty"`
+	Attempts       int     `json:"attempts"`
+	Coalesced      bool    `json:"coalesced"`
+	Cache          string  `json:"cache,omitempty"`
+	Code           string  `json:"code"`
+	Duration       float64 `json:"durationSeconds"`
+	Error          string  `json:"error,omitempty"`
+
+	duration time.Duration
+}
+
+// String formats the record as key=value pairs, the values are quoted if needed.
+func (r record) String() string {
+	var b strings.Builder
+	b.WriteString("access")
+	for _, kv := range []struct {
+		key   string
+		value interface{}
+	}{
+		{"user", r.User}, {"api", r.API}, {"operation", r.Operation}, {"metric", r.Metric},
+		{"namespace", r.Namespace}, {"name", r.Name}, {"selector", r.Selector}, {"metricSelector", r.MetricSelector},
+		{"source", r.Source}, {"attempts", r.Attempts}, {"coalesced", r.Coalesced}, {"cache", r.Cache},
+		{"code", r.Code}, {"duration", r.duration}, {"error", r.Error},
+	} {
+		if s, ok := kv.value.(string); ok {
+			if s == "" {
+				continue
+			}
+			kv.value = quote(s)
+		}
+		fmt.Fprintf(&b, " %s=%v", kv.key, kv.value)
+	}
+	return b.String()
+}
+
+func quote(s string) string {
+	if strings.ContainsAny(s, " \"=,") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package accesslog
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apiserver/pkg/authentication/user"
+	"k8s.io/apiserver/pkg/endpoints/request"
+)
+
+func newTestLogger(sampled bool) (*Logger, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	return &Logger{out: out, sample: func() bool { return sampled }}, out
+}
+
+func records(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	t.Helper()
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		record := map[string]interface{}{}
+		assert.NoError(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestLogger_Log(t *testing.T) {
+	notFound := apierrors.NewNotFound(schema.GroupResource{Resource: "pods"}, "foo")
+	tests := []struct {
+		name    string
+		sampled bool
+		err     error
+		want    map[string]interface{}
+	}{
+		{
+			name:    "Successful request is logged if sampled",
+			sampled: true,
+			want:    map[string]interface{}{"code": "200", "source": "prometheus", "attempts": 1.0},
+		},
+		{
+			name:    "Successful request is not logged if not sampled",
+			sampled: false,
+		},
+		{
+			name:    "Failed request is always logged",
+			sampled: false,
+			err:     notFound,
+			want:    map[string]interface{}{"code": "404", "error": notFound.Error()},
+		},
+		{
+			name:    "Unknown error",
+			sampled: true,
+			err:     errors.New("boom"),
+			want:    map[string]interface{}{"code": "500", "error": "boom"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, out := newTestLogger(tt.sampled)
+			ctx := request.WithUser(context.Background(), &user.DefaultInfo{Name: "system:serviceaccount:kube-system:horizontal-pod-autoscaler"})
+			ctx = l.Start(ctx, &Entry{API: "custom", Operation: "get_by_selector", Metric: "pods/foo", Namespace: "default", Selector: "app=foo"})
+			entry := FromContext(ctx)
+			if tt.err == nil {
+				entry.SetSource("prometheus")
+				entry.AddAttempt()
+			}
+			l.Log(entry, tt.err)
+
+			got := records(t, out)
+			if tt.want == nil {
+				assert.Empty(t, got)
+				return
+			}
+			assert.Len(t, got, 1)
+			for k, v := range tt.want {
+				assert.Equal(t, v, got[0][k], k)
+			}
+			assert.Equal(t, "system:serviceaccount:kube-system:horizontal-pod-autoscaler", got[0]["user"])
+			assert.Equal(t, "custom", got[0]["api"])
+			assert.Equal(t, "get_by_selector", got[0]["operation"])
+			assert.Equal(t, "pods/foo", got[0]["metric"])
+			assert.Equal(t, "default", got[0]["namespace"])
+			assert.Equal(t, "app=foo", got[0]["selector"])
+			assert.NotEmpty(t, got[0]["time"])
+		})
+	}
+}
+
+func TestEntry_CoalescedWith(t *testing.T) {
+	leader, follower := &Entry{}, &Entry{}
+	leader.SetSource("prometheus")
+	leader.AddAttempt()
+	leader.AddAttempt()
+	leader.SetCache("miss")
+	follower.CoalescedWith(leader)
+	assert.Equal(t, "prometheus", follower.Source)
+	assert.Equal(t, 2, follower.Attempts)
+	assert.Equal(t, "miss", follower.Cache)
+	assert.True(t, follower.Coalesced)
+	assert.False(t, leader.Coalesced)
+
+	// Requests which are not logged have no entry
+	var notLogged *Entry
+	notLogged.SetSource("prometheus")
+	notLogged.AddAttempt()
+	notLogged.SetCache("hit")
+	notLogged.CoalescedWith(leader)
+	assert.Nil(t, FromContext(context.Background()))
+}
+
+func TestRecord_String(t *testing.T) {
+	r := record{API: "external", Operation: "get", Metric: "queue length", Selector: "queue=foo,env=prod", Code: "200"}
+	assert.Equal(t, `access api=external operation=get metric="queue length" selector="queue=foo,env=prod" attempts=0 coalesced=false code=200 duration=0s`, r.String())
+}
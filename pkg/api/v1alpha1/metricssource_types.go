@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -55,12 +56,272 @@ func (sbp *ServiceBackendPort) String() string {
 	return strconv.Itoa(int(sbp.Port()))
 }
 
+var (
+	defaultConsecutiveErrors int32 = 5
+	defaultEjectionTime            = 30 * time.Second
+)
+
+// LoadBalancing represents a declarative configuration of the client side load balancing across the ready endpoints
+// of the service.
+type LoadBalancing struct {
+	// ConsecutiveErrors is the number of consecutive errors after which an endpoint is ejected from the load balancing pool.
+	// Defaults to 5.
+	// +kubebuilder:validation:Minimum=1
+	ConsecutiveErrors *int32 `json:"consecutiveErrors,omitempty"`
+	// EjectionTime is the duration during which an ejected endpoint does not receive any request. Defaults to 30s.
+	EjectionTime *metav1.Duration `json:"ejectionTime,omitempty"`
+}
+
+func (lb *LoadBalancing) MaxConsecutiveErrors() int {
+	if lb == nil || lb.ConsecutiveErrors == nil {
+		return int(defaultConsecutiveErrors)
+	}
+	return int(*lb.ConsecutiveErrors)
+}
+
+func (lb *LoadBalancing) BaseEjectionTime() time.Duration {
+	if lb == nil || lb.EjectionTime == nil {
+		return defaultEjectionTime
+	}
+	return lb.EjectionTime.Duration
+}
+
+var (
+	defaultBreakerConsecutiveFailures int32 = 5
+	defaultBreakerMinimumRequests     int32 = 20
+	defaultBreakerInterval                  = 60 * time.Second
+	defaultBreakerOpenDuration              = 30 * time.Second
+)
+
+// CircuitBreaker represents a declarative configuration of the circuit breaker which protects an overloaded metrics
+// backend. While the circuit breaker is open, requests are sent to the next metrics source serving the metric, if any,
+// or fail immediately.
+type CircuitBreaker struct {
+	// Disabled disables the circuit breaker, requests are always sent to the metrics backend.
+	Disabled bool `json:"disabled,omitempty"`
+	// ConsecutiveFailures is the number of consecutive failed requests after which the circuit breaker is opened.
+	// Defaults to 5.
+	// +kubebuilder:validation:Minimum=1
+	ConsecutiveFailures *int32 `json:"consecutiveFailures,omitempty"`
+	// FailureRatePercent is the percentage of failed requests, during Interval, above which the circuit breaker is opened.
+	// The failure rate is not evaluated until MinimumRequests have been sent. Disabled if not set.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	FailureRatePercent *int32 `json:"failureRatePercent,omitempty"`
+	// MinimumRequests is the number of requests required to evaluate the failure rate. Defaults to 20.
+	MinimumRequests *int32 `json:"minimumRequests,omitempty"`
+	// Interval is the period after which the failure rate is reset. Defaults to 60s.
+	Interval *metav1.Duration `json:"interval,omitempty"`
+	// OpenDuration is the duration during which the circuit breaker remains open, before a trial request is allowed.
+	// Defaults to 30s.
+	OpenDuration *metav1.Duration `json:"openDuration,omitempty"`
+}
+
+func (cb *CircuitBreaker) IsDisabled() bool {
+	return cb != nil && cb.Disabled
+}
+
+func (cb *CircuitBreaker) MaxConsecutiveFailures() int {
+	if cb == nil || cb.ConsecutiveFailures == nil {
+		return int(defaultBreakerConsecutiveFailures)
+	}
+	return int(*cb.ConsecutiveFailures)
+}
+
+// MaxFailureRate returns the failure rate threshold as a percentage, 0 means that the failure rate is not evaluated.
+func (cb *CircuitBreaker) MaxFailureRate() int {
+	if cb == nil || cb.FailureRatePercent == nil {
+		return 0
+	}
+	return int(*cb.FailureRatePercent)
+}
+
+func (cb *CircuitBreaker) MinRequests() int {
+	if cb == nil || cb.MinimumRequests == nil {
+		return int(defaultBreakerMinimumRequests)
+	}
+	return int(*cb.MinimumRequests)
+}
+
+func (cb *CircuitBreaker) FailureRateInterval() time.Duration {
+	if cb == nil || cb.Interval == nil {
+		return defaultBreakerInterval
+	}
+	return cb.Interval.Duration
+}
+
+func (cb *CircuitBreaker) OpenStateDuration() time.Duration {
+	if cb == nil || cb.OpenDuration == nil {
+		return defaultBreakerOpenDuration
+	}
+	return cb.OpenDuration.Duration
+}
+
+var (
+	defaultQueueLength  int32 = 100
+	defaultQueueTimeout       = 5 * time.Second
+)
+
+// RateLimits represents a declarative configuration of the limits enforced on the requests sent to a metrics backend,
+// including the discovery requests. Requests which cannot be sent immediately wait in a bounded queue, they are
+// rejected with a 429 status code if the queue is full or if they cannot be sent before QueueTimeout.
+type RateLimits struct {
+	// MaxInFlight is the maximum number of concurrent requests sent to the metrics backend. Not limited if not set.
+	// +kubebuilder:validation:Minimum=1
+	MaxInFlight *int32 `json:"maxInFlight,omitempty"`
+	// QPS is the maximum number of requests per second sent to the metrics backend. Not limited if not set.
+	// +kubebuilder:validation:Minimum=1
+	QPS *int32 `json:"qps,omitempty"`
+	// Burst is the maximum number of requests which can be sent at once when QPS is set. Defaults to QPS.
+	// +kubebuilder:validation:Minimum=1
+	Burst *int32 `json:"burst,omitempty"`
+	// QueueLength is the maximum number of requests waiting to be sent. Defaults to 100.
+	// +kubebuilder:validation:Minimum=0
+	QueueLength *int32 `json:"queueLength,omitempty"`
+	// QueueTimeout is the maximum duration a request waits before being sent. Defaults to 5s.
+	QueueTimeout *metav1.Duration `json:"queueTimeout,omitempty"`
+}
+
+// MaxInFlightRequests returns the maximum number of concurrent requests, 0 means that it is not limited.
+func (rl *RateLimits) MaxInFlightRequests() int {
+	if rl == nil || rl.MaxInFlight == nil {
+		return 0
+	}
+	return int(*rl.MaxInFlight)
+}
+
+// MaxQPS returns the maximum number of requests per second, 0 means that it is not limited.
+func (rl *RateLimits) MaxQPS() int {
+	if rl == nil || rl.QPS == nil {
+		return 0
+	}
+	return int(*rl.QPS)
+}
+
+func (rl *RateLimits) MaxBurst() int {
+	if rl == nil {
+		return 0
+	}
+	if rl.Burst == nil {
+		return rl.MaxQPS()
+	}
+	return int(*rl.Burst)
+}
+
+func (rl *RateLimits) MaxQueueLength() int {
+	if rl == nil || rl.QueueLength == nil {
+		return int(defaultQueueLength)
+	}
+	return int(*rl.QueueLength)
+}
+
+func (rl *RateLimits) MaxQueueTimeout() time.Duration {
+	if rl == nil || rl.QueueTimeout == nil {
+		return defaultQueueTimeout
+	}
+	return rl.QueueTimeout.Duration
+}
+
+var (
+	defaultCacheTTL                = 10 * time.Second
+	defaultCacheMaxEntries   int32 = 1000
+	defaultCacheStaleIfError       = time.Minute
+)
+
+// ValueCache represents a declarative configuration of the cache of the metric values returned by a metrics source.
+// Cached values are served without sending a request to the metrics backend.
+type ValueCache struct {
+	// TTL is the duration during which a value is served from the cache. Defaults to 10s.
+	TTL *metav1.Duration `json:"ttl,omitempty"`
+	// MaxEntries is the maximum number of values in the cache, the least recently used values are evicted first.
+	// Defaults to 1000.
+	// +kubebuilder:validation:Minimum=1
+	MaxEntries *int32 `json:"maxEntries,omitempty"`
+	// StaleIfError is the duration, after the expiration of a value, during which the value is still served if the
+	// metrics backend fails. Defaults to 1m, set to 0s to disable.
+	StaleIfError *metav1.Duration `json:"staleIfError,omitempty"`
+}
+
+func (vc *ValueCache) EntriesTTL() time.Duration {
+	if vc == nil || vc.TTL == nil {
+		return defaultCacheTTL
+	}
+	return vc.TTL.Duration
+}
+
+func (vc *ValueCache) MaxCacheEntries() int {
+	if vc == nil || vc.MaxEntries == nil {
+		return int(defaultCacheMaxEntries)
+	}
+	return int(*vc.MaxEntries)
+}
+
+func (vc *ValueCache) StaleDuration() time.Duration {
+	if vc == nil || vc.StaleIfError == nil {
+		return defaultCacheStaleIfError
+	}
+	return vc.StaleIfError.Duration
+}
+
+var (
+	defaultRemovalAlertThreshold      int32 = 50
+	defaultRemovalProtectionThreshold int32 = 50
+	defaultRemovalConfirmations       int32 = 3
+)
+
+// DiscoveryPolicy represents a declarative configuration of how the changes of the metrics served by a metrics source
+// are handled.
+type DiscoveryPolicy struct {
+	// RemovalAlertThreshold is the percentage of the metrics of the metrics source which, if removed by a single
+	// discovery, triggers a warning Event. Defaults to 50.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	RemovalAlertThreshold *int32 `json:"removalAlertThreshold,omitempty"`
+	// RemovalProtectionThreshold is the percentage of the metrics of the metrics source which, if removed by a single
+	// discovery, are still served until the removal is confirmed. The removal of all the metrics is always confirmed.
+	// Defaults to 50.
+	// +kubebuilder:validation:Minimum=1
+	// +kubebuilder:validation:Maximum=100
+	RemovalProtectionThreshold *int32 `json:"removalProtectionThreshold,omitempty"`
+	// RemovalConfirmations is the number of consecutive discoveries which must remove more metrics than the protection
+	// threshold before the removal is applied. 1 disables the protection. Defaults to 3.
+	// +kubebuilder:validation:Minimum=1
+	RemovalConfirmations *int32 `json:"removalConfirmations,omitempty"`
+}
+
+func (dp *DiscoveryPolicy) RemovalAlertPercent() int {
+	if dp == nil || dp.RemovalAlertThreshold == nil {
+		return int(defaultRemovalAlertThreshold)
+	}
+	return int(*dp.RemovalAlertThreshold)
+}
+
+func (dp *DiscoveryPolicy) RemovalProtectionPercent() int {
+	if dp == nil || dp.RemovalProtectionThreshold == nil {
+		return int(defaultRemovalProtectionThreshold)
+	}
+	return int(*dp.RemovalProtectionThreshold)
+}
+
+func (dp *DiscoveryPolicy) RequiredRemovalConfirmations() int {
+	if dp == nil || dp.RemovalConfirmations == nil {
+		return int(defaultRemovalConfirmations)
+	}
+	return int(*dp.RemovalConfirmations)
+}
+
 // MetricsServiceBackend represents an declarative configuration of the MetricsServiceBackend to get the metrics from.
 type MetricsServiceBackend struct {
 	Namespace string             `json:"namespace,omitempty"`
 	Name      string             `json:"name,omitempty"`
 	Scheme    corev1.URIScheme   `json:"scheme,omitempty"`
 	Port      ServiceBackendPort `json:"port,omitempty"`
+	// CABundle is a PEM encoded CA bundle used to verify the certificate of the service. The CA of the K8S API server
+	// is used if not set.
+	CABundle []byte `json:"caBundle,omitempty"`
+	// LoadBalancing, if set, balances the requests across the ready endpoints of the service, as listed in its
+	// EndpointSlices, instead of sending them to the service virtual IP.
+	LoadBalancing *LoadBalancing `json:"loadBalancing,omitempty"`
 }
 
 func (m MetricsServiceBackend) NamespacedName() types.NamespacedName {
@@ -78,7 +339,119 @@ func (m MetricsServiceBackend) scheme() corev1.URIScheme {
 }
 
 func (m MetricsServiceBackend) URL() string {
-	return fmt.Sprintf("%s://%s.%s.svc:%d", strings.ToLower(string(m.scheme())), m.Name, m.Namespace, m.Port.Port())
+	return fmt.Sprintf("%s://%s:%d", strings.ToLower(string(m.scheme())), m.ServerName(), m.Port.Port())
+}
+
+// ServerName is the DNS name of the service, it is used to verify the certificate presented by the endpoints.
+func (m MetricsServiceBackend) ServerName() string {
+	return fmt.Sprintf("%s.%s.svc", m.Name, m.Namespace)
+}
+
+func (m MetricsServiceBackend) HasLoadBalancing() bool {
+	return m.LoadBalancing != nil
+}
+
+// PrometheusBackend represents a declarative configuration of a Prometheus server queried directly by the router.
+// Metrics are declared with rules which map a metric name to a PromQL query.
+type PrometheusBackend struct {
+	// URL of the Prometheus HTTP API, for example http://prometheus.monitoring.svc:9090
+	URL string `json:"url"`
+	// CustomMetrics are the rules of the custom metrics served by this Prometheus server.
+	CustomMetrics []PrometheusCustomMetricRule `json:"customMetrics,omitempty"`
+	// ExternalMetrics are the rules of the external metrics served by this Prometheus server.
+	ExternalMetrics []PrometheusExternalMetricRule `json:"externalMetrics,omitempty"`
+}
+
+// PrometheusCustomMetricRule maps a custom metric, describing a Kubernetes resource, to a PromQL query.
+type PrometheusCustomMetricRule struct {
+	// Name of the custom metric.
+	Name string `json:"name"`
+	// Resource described by the metric, in the form resource.group, for example pods or deployments.apps
+	Resource string `json:"resource"`
+	// Namespaced is true if the described resource is namespaced. Defaults to true.
+	Namespaced *bool `json:"namespaced,omitempty"`
+	// Query is a Go template of the PromQL query. The following fields are available:
+	//  - .Namespace is the namespace of the described objects, empty if the resource is not namespaced.
+	//  - .Names is a regular expression which matches the names of the described objects, escaped to be used in a
+	//    double-quoted string.
+	//  - .LabelMatchers are the PromQL label matchers built from the metric selector, for example method="GET"
+	// Example: sum(rate(http_requests_total{namespace="{{.Namespace}}",pod=~"{{.Names}}"}[2m])) by (pod)
+	Query string `json:"query"`
+	// ObjectLabel is the label of the query results which holds the name of the described objects, for example pod
+	ObjectLabel string `json:"objectLabel"`
+}
+
+func (r PrometheusCustomMetricRule) IsNamespaced() bool {
+	return r.Namespaced == nil || *r.Namespaced
+}
+
+// PrometheusExternalMetricRule maps an external metric to a PromQL query.
+type PrometheusExternalMetricRule struct {
+	// Name of the external metric.
+	Name string `json:"name"`
+	// Query is a Go template of the PromQL query. The following fields are available:
+	//  - .Namespace is the namespace of the request.
+	//  - .LabelMatchers are the PromQL label matchers built from the metric selector, for example queue="orders"
+	// The labels of each result are returned as the labels of the metric values.
+	// Example: sum(rabbitmq_queue_messages{ {{- .LabelMatchers -}} }) by (queue)
+	Query string `json:"query"`
+}
+
+// ExternalScalerBackend represents a declarative configuration of a KEDA external scaler, called with the
+// externalscaler.ExternalScaler gRPC protocol. An external scaler only serves external metrics.
+type ExternalScalerBackend struct {
+	// Address of the gRPC server of the scaler, in the form host:port, for example my-scaler.keda.svc:6000
+	Address string `json:"address"`
+	// TLS enables TLS on the connection to the scaler. The certificate is not verified if InsecureSkipTLSVerify is set.
+	TLS bool `json:"tls,omitempty"`
+	// ScalerMetadata is sent to the scaler in each request, as the metadata of the scaled object.
+	ScalerMetadata map[string]string `json:"scalerMetadata,omitempty"`
+	// Metrics maps the metrics of the scaler to external metrics. If empty, all the metrics of the scaler are served
+	// with their original names.
+	Metrics []ExternalScalerMetric `json:"metrics,omitempty"`
+}
+
+// ExternalScalerMetric maps a metric of an external scaler to an external metric.
+type ExternalScalerMetric struct {
+	// ScalerMetricName is the name of the metric, as returned by the scaler.
+	ScalerMetricName string `json:"scalerMetricName"`
+	// Name of the external metric. Defaults to ScalerMetricName.
+	Name string `json:"name,omitempty"`
+}
+
+func (m ExternalScalerMetric) ExternalMetricName() string {
+	if m.Name == "" {
+		return m.ScalerMetricName
+	}
+	return m.Name
+}
+
+// WebhookBackend represents a declarative configuration of an HTTP endpoint which computes the metric values. The
+// format of the requests and of the responses is described in the README.
+type WebhookBackend struct {
+	// URL of the webhook, the metric values are requested with a POST request.
+	URL string `json:"url"`
+	// DiscoveryURL, if set, is requested with a GET request to list the metrics served by the webhook. CustomMetrics
+	// and ExternalMetrics are ignored.
+	DiscoveryURL string `json:"discoveryURL,omitempty"`
+	// CustomMetrics is the static list of the custom metrics served by the webhook.
+	CustomMetrics []WebhookCustomMetric `json:"customMetrics,omitempty"`
+	// ExternalMetrics is the static list of the names of the external metrics served by the webhook.
+	ExternalMetrics []string `json:"externalMetrics,omitempty"`
+}
+
+// WebhookCustomMetric is a custom metric served by a webhook.
+type WebhookCustomMetric struct {
+	// Name of the custom metric.
+	Name string `json:"name"`
+	// Resource described by the metric, in the form resource.group, for example pods or deployments.apps
+	Resource string `json:"resource"`
+	// Namespaced is true if the described resource is namespaced. Defaults to true.
+	Namespaced *bool `json:"namespaced,omitempty"`
+}
+
+func (m WebhookCustomMetric) IsNamespaced() bool {
+	return m.Namespaced == nil || *m.Namespaced
 }
 
 type MetricTypes []MetricType
@@ -104,17 +477,66 @@ func (m MetricTypes) HasExternalMetrics() bool {
 type MetricsSourceSpec struct {
 	// Service is the K8S service to be called by the router.
 	MetricsServiceBackend MetricsServiceBackend `json:"service,omitempty"`
-	InsecureSkipTLSVerify bool                  `json:"insecureSkipTLSVerify,omitempty"`
-	Priority              int                   `json:"priority"`
-	MetricTypes           MetricTypes           `json:"metricTypes"`
+	// Prometheus, if set, is a Prometheus server queried directly by the router. Service is ignored.
+	Prometheus *PrometheusBackend `json:"prometheus,omitempty"`
+	// ExternalScaler, if set, is a KEDA external scaler called by the router. Service is ignored.
+	ExternalScaler *ExternalScalerBackend `json:"externalScaler,omitempty"`
+	// Webhook, if set, is an HTTP endpoint called by the router. Service is ignored.
+	Webhook               *WebhookBackend `json:"webhook,omitempty"`
+	InsecureSkipTLSVerify bool            `json:"insecureSkipTLSVerify,omitempty"`
+	Priority              int             `json:"priority"`
+	MetricTypes           MetricTypes     `json:"metricTypes"`
+	// CircuitBreaker configures the circuit breaker of the metrics source. A circuit breaker with the default settings
+	// is used if not set.
+	CircuitBreaker *CircuitBreaker `json:"circuitBreaker,omitempty"`
+	// RateLimits limits the requests sent to the metrics backend. Requests are not limited if not set.
+	RateLimits *RateLimits `json:"rateLimits,omitempty"`
+	// Cache enables the cache of the metric values returned by the metrics backend. Values are not cached if not set.
+	Cache *ValueCache `json:"cache,omitempty"`
+	// Discovery configures how the changes of the metrics served by the metrics source are handled.
+	Discovery *DiscoveryPolicy `json:"discovery,omitempty"`
+}
+
+// HasServiceBackend returns true if the metrics are read from the K8S service, and not from one of the other backends.
+func (s MetricsSourceSpec) HasServiceBackend() bool {
+	return s.Prometheus == nil && s.ExternalScaler == nil && s.Webhook == nil
 }
 
+// CircuitBreakerState is the state of the circuit breaker of a metrics source.
+type CircuitBreakerState string
+
+const (
+	// CircuitBreakerClosed means that the requests are sent to the metrics backend.
+	CircuitBreakerClosed = CircuitBreakerState("Closed")
+	// CircuitBreakerOpen means that the requests are not sent to the metrics backend.
+	CircuitBreakerOpen = CircuitBreakerState("Open")
+	// CircuitBreakerHalfOpen means that a trial request is allowed to check if the metrics backend has recovered.
+	CircuitBreakerHalfOpen = CircuitBreakerState("HalfOpen")
+)
+
 // MetricsSourceStatus defines the observed state of MetricsSource
 type MetricsSourceStatus struct {
 	Synced       bool   `json:"synced"`
 	MetricsCount int    `json:"metricsCount"`
 	Service      string `json:"service"`
 	Port         int    `json:"port"`
+	// CircuitBreaker is the state of the circuit breaker of the metrics source.
+	CircuitBreaker CircuitBreakerState `json:"circuitBreaker,omitempty"`
+	// Degraded is true if the last discovery has removed too many metrics: the previous metrics are still served until
+	// the removal is confirmed.
+	Degraded bool `json:"degraded,omitempty"`
+	// History holds the last discoveries which have changed the metrics served by the metrics source, oldest first.
+	History []DiscoveryRecord `json:"history,omitempty"`
+}
+
+// DiscoveryRecord is a discovery which has changed the metrics served by a metrics source.
+type DiscoveryRecord struct {
+	Time    metav1.Time `json:"time"`
+	Added   int         `json:"added"`
+	Removed int         `json:"removed"`
+	// AddedSamples and RemovedSamples are some of the metrics added and removed.
+	AddedSamples   []string `json:"addedSamples,omitempty"`
+	RemovedSamples []string `json:"removedSamples,omitempty"`
 }
 
 //+kubebuilder:object:root=true
@@ -124,6 +546,8 @@ type MetricsSourceStatus struct {
 // +kubebuilder:printcolumn:name="Port",type=integer,JSONPath=`.status.port`
 // +kubebuilder:printcolumn:name="Synced",type=boolean,JSONPath=`.status.synced`
 // +kubebuilder:printcolumn:name="Metrics",type=integer,JSONPath=`.status.metricsCount`
+// +kubebuilder:printcolumn:name="Circuit Breaker",type=string,JSONPath=`.status.circuitBreaker`
+// +kubebuilder:printcolumn:name="Degraded",type=boolean,JSONPath=`.status.degraded`
 
 // MetricsSource is the Schema for the metricssources API
 type MetricsSource struct {
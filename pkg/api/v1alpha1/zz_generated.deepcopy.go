@@ -21,9 +21,173 @@ limitations under the License.
 package v1alpha1
 
 import (
+	"k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *CircuitBreaker) DeepCopyInto(out *CircuitBreaker) {
+	*out = *in
+	if in.ConsecutiveFailures != nil {
+		in, out := &in.ConsecutiveFailures, &out.ConsecutiveFailures
+		*out = new(int32)
+		**out = **in
+	}
+	if in.FailureRatePercent != nil {
+		in, out := &in.FailureRatePercent, &out.FailureRatePercent
+		*out = new(int32)
+		**out = **in
+	}
+	if in.MinimumRequests != nil {
+		in, out := &in.MinimumRequests, &out.MinimumRequests
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Interval != nil {
+		in, out := &in.Interval, &out.Interval
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.OpenDuration != nil {
+		in, out := &in.OpenDuration, &out.OpenDuration
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new CircuitBreaker.
+func (in *CircuitBreaker) DeepCopy() *CircuitBreaker {
+	if in == nil {
+		return nil
+	}
+	out := new(CircuitBreaker)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DiscoveryPolicy) DeepCopyInto(out *DiscoveryPolicy) {
+	*out = *in
+	if in.RemovalAlertThreshold != nil {
+		in, out := &in.RemovalAlertThreshold, &out.RemovalAlertThreshold
+		*out = new(int32)
+		**out = **in
+	}
+	if in.RemovalProtectionThreshold != nil {
+		in, out := &in.RemovalProtectionThreshold, &out.RemovalProtectionThreshold
+		*out = new(int32)
+		**out = **in
+	}
+	if in.RemovalConfirmations != nil {
+		in, out := &in.RemovalConfirmations, &out.RemovalConfirmations
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DiscoveryPolicy.
+func (in *DiscoveryPolicy) DeepCopy() *DiscoveryPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(DiscoveryPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *DiscoveryRecord) DeepCopyInto(out *DiscoveryRecord) {
+	*out = *in
+	in.Time.DeepCopyInto(&out.Time)
+	if in.AddedSamples != nil {
+		in, out := &in.AddedSamples, &out.AddedSamples
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+	if in.RemovedSamples != nil {
+		in, out := &in.RemovedSamples, &out.RemovedSamples
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new DiscoveryRecord.
+func (in *DiscoveryRecord) DeepCopy() *DiscoveryRecord {
+	if in == nil {
+		return nil
+	}
+	out := new(DiscoveryRecord)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExternalScalerBackend) DeepCopyInto(out *ExternalScalerBackend) {
+	*out = *in
+	if in.ScalerMetadata != nil {
+		in, out := &in.ScalerMetadata, &out.ScalerMetadata
+		*out = make(map[string]string, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+	if in.Metrics != nil {
+		in, out := &in.Metrics, &out.Metrics
+		*out = make([]ExternalScalerMetric, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExternalScalerBackend.
+func (in *ExternalScalerBackend) DeepCopy() *ExternalScalerBackend {
+	if in == nil {
+		return nil
+	}
+	out := new(ExternalScalerBackend)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ExternalScalerMetric) DeepCopyInto(out *ExternalScalerMetric) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ExternalScalerMetric.
+func (in *ExternalScalerMetric) DeepCopy() *ExternalScalerMetric {
+	if in == nil {
+		return nil
+	}
+	out := new(ExternalScalerMetric)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *LoadBalancing) DeepCopyInto(out *LoadBalancing) {
+	*out = *in
+	if in.ConsecutiveErrors != nil {
+		in, out := &in.ConsecutiveErrors, &out.ConsecutiveErrors
+		*out = new(int32)
+		**out = **in
+	}
+	if in.EjectionTime != nil {
+		in, out := &in.EjectionTime, &out.EjectionTime
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new LoadBalancing.
+func (in *LoadBalancing) DeepCopy() *LoadBalancing {
+	if in == nil {
+		return nil
+	}
+	out := new(LoadBalancing)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in MetricTypes) DeepCopyInto(out *MetricTypes) {
 	{
@@ -47,6 +211,16 @@ func (in MetricTypes) DeepCopy() MetricTypes {
 func (in *MetricsServiceBackend) DeepCopyInto(out *MetricsServiceBackend) {
 	*out = *in
 	in.Port.DeepCopyInto(&out.Port)
+	if in.CABundle != nil {
+		in, out := &in.CABundle, &out.CABundle
+		*out = make([]byte, len(*in))
+		copy(*out, *in)
+	}
+	if in.LoadBalancing != nil {
+		in, out := &in.LoadBalancing, &out.LoadBalancing
+		*out = new(LoadBalancing)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MetricsServiceBackend.
@@ -65,7 +239,7 @@ func (in *MetricsSource) DeepCopyInto(out *MetricsSource) {
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
 	in.Spec.DeepCopyInto(&out.Spec)
-	out.Status = in.Status
+	in.Status.DeepCopyInto(&out.Status)
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MetricsSource.
@@ -122,11 +296,46 @@ func (in *MetricsSourceList) DeepCopyObject() runtime.Object {
 func (in *MetricsSourceSpec) DeepCopyInto(out *MetricsSourceSpec) {
 	*out = *in
 	in.MetricsServiceBackend.DeepCopyInto(&out.MetricsServiceBackend)
+	if in.Prometheus != nil {
+		in, out := &in.Prometheus, &out.Prometheus
+		*out = new(PrometheusBackend)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.ExternalScaler != nil {
+		in, out := &in.ExternalScaler, &out.ExternalScaler
+		*out = new(ExternalScalerBackend)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Webhook != nil {
+		in, out := &in.Webhook, &out.Webhook
+		*out = new(WebhookBackend)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.MetricTypes != nil {
 		in, out := &in.MetricTypes, &out.MetricTypes
 		*out = make(MetricTypes, len(*in))
 		copy(*out, *in)
 	}
+	if in.CircuitBreaker != nil {
+		in, out := &in.CircuitBreaker, &out.CircuitBreaker
+		*out = new(CircuitBreaker)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.RateLimits != nil {
+		in, out := &in.RateLimits, &out.RateLimits
+		*out = new(RateLimits)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Cache != nil {
+		in, out := &in.Cache, &out.Cache
+		*out = new(ValueCache)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Discovery != nil {
+		in, out := &in.Discovery, &out.Discovery
+		*out = new(DiscoveryPolicy)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MetricsSourceSpec.
@@ -142,6 +351,13 @@ func (in *MetricsSourceSpec) DeepCopy() *MetricsSourceSpec {
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *MetricsSourceStatus) DeepCopyInto(out *MetricsSourceStatus) {
 	*out = *in
+	if in.History != nil {
+		in, out := &in.History, &out.History
+		*out = make([]DiscoveryRecord, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new MetricsSourceStatus.
@@ -154,6 +370,108 @@ func (in *MetricsSourceStatus) DeepCopy() *MetricsSourceStatus {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PrometheusBackend) DeepCopyInto(out *PrometheusBackend) {
+	*out = *in
+	if in.CustomMetrics != nil {
+		in, out := &in.CustomMetrics, &out.CustomMetrics
+		*out = make([]PrometheusCustomMetricRule, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.ExternalMetrics != nil {
+		in, out := &in.ExternalMetrics, &out.ExternalMetrics
+		*out = make([]PrometheusExternalMetricRule, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PrometheusBackend.
+func (in *PrometheusBackend) DeepCopy() *PrometheusBackend {
+	if in == nil {
+		return nil
+	}
+	out := new(PrometheusBackend)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PrometheusCustomMetricRule) DeepCopyInto(out *PrometheusCustomMetricRule) {
+	*out = *in
+	if in.Namespaced != nil {
+		in, out := &in.Namespaced, &out.Namespaced
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PrometheusCustomMetricRule.
+func (in *PrometheusCustomMetricRule) DeepCopy() *PrometheusCustomMetricRule {
+	if in == nil {
+		return nil
+	}
+	out := new(PrometheusCustomMetricRule)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *PrometheusExternalMetricRule) DeepCopyInto(out *PrometheusExternalMetricRule) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new PrometheusExternalMetricRule.
+func (in *PrometheusExternalMetricRule) DeepCopy() *PrometheusExternalMetricRule {
+	if in == nil {
+		return nil
+	}
+	out := new(PrometheusExternalMetricRule)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *RateLimits) DeepCopyInto(out *RateLimits) {
+	*out = *in
+	if in.MaxInFlight != nil {
+		in, out := &in.MaxInFlight, &out.MaxInFlight
+		*out = new(int32)
+		**out = **in
+	}
+	if in.QPS != nil {
+		in, out := &in.QPS, &out.QPS
+		*out = new(int32)
+		**out = **in
+	}
+	if in.Burst != nil {
+		in, out := &in.Burst, &out.Burst
+		*out = new(int32)
+		**out = **in
+	}
+	if in.QueueLength != nil {
+		in, out := &in.QueueLength, &out.QueueLength
+		*out = new(int32)
+		**out = **in
+	}
+	if in.QueueTimeout != nil {
+		in, out := &in.QueueTimeout, &out.QueueTimeout
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new RateLimits.
+func (in *RateLimits) DeepCopy() *RateLimits {
+	if in == nil {
+		return nil
+	}
+	out := new(RateLimits)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *ServiceBackendPort) DeepCopyInto(out *ServiceBackendPort) {
 	*out = *in
@@ -173,3 +491,80 @@ func (in *ServiceBackendPort) DeepCopy() *ServiceBackendPort {
 	in.DeepCopyInto(out)
 	return out
 }
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ValueCache) DeepCopyInto(out *ValueCache) {
+	*out = *in
+	if in.TTL != nil {
+		in, out := &in.TTL, &out.TTL
+		*out = new(v1.Duration)
+		**out = **in
+	}
+	if in.MaxEntries != nil {
+		in, out := &in.MaxEntries, &out.MaxEntries
+		*out = new(int32)
+		**out = **in
+	}
+	if in.StaleIfError != nil {
+		in, out := &in.StaleIfError, &out.StaleIfError
+		*out = new(v1.Duration)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ValueCache.
+func (in *ValueCache) DeepCopy() *ValueCache {
+	if in == nil {
+		return nil
+	}
+	out := new(ValueCache)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WebhookBackend) DeepCopyInto(out *WebhookBackend) {
+	*out = *in
+	if in.CustomMetrics != nil {
+		in, out := &in.CustomMetrics, &out.CustomMetrics
+		*out = make([]WebhookCustomMetric, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.ExternalMetrics != nil {
+		in, out := &in.ExternalMetrics, &out.ExternalMetrics
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WebhookBackend.
+func (in *WebhookBackend) DeepCopy() *WebhookBackend {
+	if in == nil {
+		return nil
+	}
+	out := new(WebhookBackend)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *WebhookCustomMetric) DeepCopyInto(out *WebhookCustomMetric) {
+	*out = *in
+	if in.Namespaced != nil {
+		in, out := &in.Namespaced, &out.Namespaced
+		*out = new(bool)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new WebhookCustomMetric.
+func (in *WebhookCustomMetric) DeepCopy() *WebhookCustomMetric {
+	if in == nil {
+		return nil
+	}
+	out := new(WebhookCustomMetric)
+	in.DeepCopyInto(out)
+	return out
+}
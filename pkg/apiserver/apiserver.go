@@ -0,0 +1,150 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package apiserver installs the custom and external metrics APIs. It mirrors the installation done by
+// custom-metrics-apiserver, except that the context of the API requests is given to the metrics providers.
+package apiserver
+
+import (
+	cmapiserver "github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/apiserver"
+	specificapi "github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/apiserver/installer"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	genericapi "k8s.io/apiserver/pkg/endpoints"
+	"k8s.io/apiserver/pkg/endpoints/discovery"
+	"k8s.io/apiserver/pkg/registry/rest"
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+
+	"github.com/barkbay/custom-metrics-router/pkg/provider"
+)
+
+// InstallMetricsAPIs registers the custom and the external metrics APIs in the given server.
+func InstallMetricsAPIs(server *genericapiserver.GenericAPIServer, metricsProvider provider.FullMetricsProvider) error {
+	if err := installCustomMetricsAPI(server, metricsProvider); err != nil {
+		return err
+	}
+	return installExternalMetricsAPI(server, metricsProvider)
+}
+
+func installCustomMetricsAPI(server *genericapiserver.GenericAPIServer, cmProvider provider.CustomMetricsProvider) error {
+	groupInfo := genericapiserver.NewDefaultAPIGroupInfo(custom_metrics.GroupName, cmapiserver.Scheme, runtime.NewParameterCodec(cmapiserver.Scheme), cmapiserver.Codecs)
+	container := server.Handler.GoRestfulContainer
+
+	// Register custom metrics REST handler for all supported API versions.
+	for versionIndex, mainGroupVer := range groupInfo.PrioritizedVersions {
+		cmAPI := metricsAPI(&groupInfo, mainGroupVer, newCustomMetricsREST(cmProvider), &customMetricsResourceLister{provider: cmProvider})
+		cmAPI.Handlers = &specificapi.CMHandlers{}
+		if err := cmAPI.InstallREST(container); err != nil {
+			return err
+		}
+		if versionIndex == 0 {
+			addDiscovery(server, mainGroupVer)
+		}
+	}
+	return nil
+}
+
+func installExternalMetricsAPI(server *genericapiserver.GenericAPIServer, emProvider provider.ExternalMetricsProvider) error {
+	groupInfo := genericapiserver.NewDefaultAPIGroupInfo(external_metrics.GroupName, cmapiserver.Scheme, metav1.ParameterCodec, cmapiserver.Codecs)
+
+	mainGroupVer := groupInfo.PrioritizedVersions[0]
+	emAPI := metricsAPI(&groupInfo, mainGroupVer, newExternalMetricsREST(emProvider), &externalMetricsResourceLister{provider: emProvider})
+	emAPI.Handlers = &specificapi.EMHandlers{}
+	if err := emAPI.InstallREST(server.Handler.GoRestfulContainer); err != nil {
+		return err
+	}
+	addDiscovery(server, mainGroupVer)
+	return nil
+}
+
+func addDiscovery(server *genericapiserver.GenericAPIServer, mainGroupVer schema.GroupVersion) {
+	groupVersion := metav1.GroupVersionForDiscovery{
+		GroupVersion: mainGroupVer.String(),
+		Version:      mainGroupVer.Version,
+	}
+	apiGroup := metav1.APIGroup{
+		Name:             mainGroupVer.Group,
+		Versions:         []metav1.GroupVersionForDiscovery{groupVersion},
+		PreferredVersion: groupVersion,
+	}
+	server.DiscoveryGroupManager.AddGroup(apiGroup)
+	server.Handler.GoRestfulContainer.Add(discovery.NewAPIGroupHandler(server.Serializer, apiGroup).WebService())
+}
+
+func metricsAPI(
+	groupInfo *genericapiserver.APIGroupInfo,
+	groupVersion schema.GroupVersion,
+	storage rest.Storage,
+	lister discovery.APIResourceLister,
+) *specificapi.MetricsAPIGroupVersion {
+	return &specificapi.MetricsAPIGroupVersion{
+		DynamicStorage: storage,
+		APIGroupVersion: &genericapi.APIGroupVersion{
+			Root:             genericapiserver.APIGroupPrefix,
+			GroupVersion:     groupVersion,
+			MetaGroupVersion: groupInfo.MetaGroupVersion,
+
+			ParameterCodec:  groupInfo.ParameterCodec,
+			Serializer:      groupInfo.NegotiatedSerializer,
+			Creater:         groupInfo.Scheme,
+			Convertor:       groupInfo.Scheme,
+			UnsafeConvertor: runtime.UnsafeObjectConvertor(groupInfo.Scheme),
+			Typer:           groupInfo.Scheme,
+			Linker:          runtime.SelfLinker(meta.NewAccessor()),
+		},
+		ResourceLister: lister,
+	}
+}
+
+type customMetricsResourceLister struct {
+	provider provider.CustomMetricsProvider
+}
+
+func (l *customMetricsResourceLister) ListAPIResources() []metav1.APIResource {
+	metrics := l.provider.ListAllMetrics()
+	resources := make([]metav1.APIResource, len(metrics))
+	for i, metric := range metrics {
+		resources[i] = metav1.APIResource{
+			Name:       metric.GroupResource.String() + "/" + metric.Metric,
+			Namespaced: metric.Namespaced,
+			Kind:       "MetricValueList",
+			Verbs:      metav1.Verbs{"get"},
+		}
+	}
+	return resources
+}
+
+type externalMetricsResourceLister struct {
+	provider provider.ExternalMetricsProvider
+}
+
+func (l *externalMetricsResourceLister) ListAPIResources() []metav1.APIResource {
+	metrics := l.provider.ListAllExternalMetrics()
+	resources := make([]metav1.APIResource, len(metrics))
+	for i, metric := range metrics {
+		resources[i] = metav1.APIResource{
+			Name:       metric.Metric,
+			Namespaced: true,
+			Kind:       "ExternalMetricValueList",
+			Verbs:      metav1.Verbs{"get"},
+		}
+	}
+	return resources
+}
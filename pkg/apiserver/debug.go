@@ -0,0 +1,97 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	genericapiserver "k8s.io/apiserver/pkg/server"
+	"k8s.io/klog"
+
+	"github.com/barkbay/custom-metrics-router/pkg/registry"
+)
+
+// RoutesPath is the path of the endpoint which exposes the routes of the metrics.
+const RoutesPath = "/debug/routes"
+
+// routesLister returns the routes of the metrics, it is implemented by the registry.
+type routesLister interface {
+	Routes(filter registry.RoutesFilter) []registry.Route
+}
+
+// InstallRoutesEndpoint registers the endpoint which exposes the routes of the metrics in the given server. As the other
+// non resource URLs, the requests are authenticated and authorized by the server.
+func InstallRoutesEndpoint(server *genericapiserver.GenericAPIServer, routes *registry.Registry) {
+	server.Handler.NonGoRestfulMux.Handle(RoutesPath, routesHandler{routes: routes})
+}
+
+// routesHandler serves the routes of the metrics in JSON, or as a table if the format parameter is "table". The routes
+// can be filtered with the metric, source and namespace parameters.
+type routesHandler struct {
+	routes routesLister
+}
+
+func (h routesHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := req.URL.Query()
+	routes := h.routes.Routes(registry.RoutesFilter{
+		Metric:    query.Get("metric"),
+		Source:    query.Get("source"),
+		Namespace: query.Get("namespace"),
+	})
+	switch format := query.Get("format"); format {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(routes); err != nil {
+			klog.Errorf("failed to write routes: %v", err)
+		}
+	case "table":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeRoutesTable(w, routes)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported format %q, must be json or table", format), http.StatusBadRequest)
+	}
+}
+
+// writeRoutesTable writes a line for each metrics source of each route, the metrics sources of a route are listed in
+// the order in which they are tried.
+func writeRoutesTable(w http.ResponseWriter, routes []registry.Route) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "API\tMETRIC\tRANK\tSOURCE\tPRIORITY\tCIRCUIT BREAKER\tAVAILABLE\tLAST SYNC")
+	for _, route := range routes {
+		for i, source := range route.Sources {
+			lastSync := "<never>"
+			if !source.LastSync.IsZero() {
+				lastSync = source.LastSync.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%d\t%s\t%s\t%s\n",
+				route.API, route.Metric, i+1, source.Name, source.Priority, source.CircuitBreaker,
+				strconv.FormatBool(source.Available), lastSync)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		klog.Errorf("failed to write routes: %v", err)
+	}
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/barkbay/custom-metrics-router/pkg/registry"
+)
+
+type fakeRoutes struct {
+	filter registry.RoutesFilter
+	routes []registry.Route
+}
+
+func (f *fakeRoutes) Routes(filter registry.RoutesFilter) []registry.Route {
+	f.filter = filter
+	return f.routes
+}
+
+func TestRoutesHandler(t *testing.T) {
+	routes := []registry.Route{
+		{
+			API:        "external",
+			Metric:     "queue_length",
+			Namespaced: true,
+			Sources: []registry.RouteSource{
+				{Name: "keda", Priority: 10, CircuitBreaker: v1alpha1.CircuitBreakerOpen},
+				{Name: "prometheus", CircuitBreaker: v1alpha1.CircuitBreakerClosed, Available: true, LastSync: time.Date(2021, 6, 24, 7, 12, 19, 0, time.UTC)},
+			},
+		},
+	}
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		wantCode   int
+		wantFilter registry.RoutesFilter
+		wantBody   string
+	}{
+		{
+			name:       "JSON",
+			target:     "/debug/routes?metric=queue_length&source=keda&namespace=default",
+			wantCode:   http.StatusOK,
+			wantFilter: registry.RoutesFilter{Metric: "queue_length", Source: "keda", Namespace: "default"},
+		},
+		{
+			name:     "Table",
+			target:   "/debug/routes?format=table",
+			wantCode: http.StatusOK,
+			wantBody: `API       METRIC        RANK  SOURCE      PRIORITY  CIRCUIT BREAKER  AVAILABLE  LAST SYNC
+external  queue_length  1     keda        10        Open             false      <never>
+external  queue_length  2     prometheus  0         Closed           true       2021-06-24T07:12:19Z
+`,
+		},
+		{
+			name:     "Unknown format",
+			target:   "/debug/routes?format=yaml",
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "Method not allowed",
+			method:   http.MethodPost,
+			target:   "/debug/routes",
+			wantCode: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lister := &fakeRoutes{routes: routes}
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			w := httptest.NewRecorder()
+			routesHandler{routes: lister}.ServeHTTP(w, httptest.NewRequest(method, tt.target, nil))
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			assert.Equal(t, tt.wantFilter, lister.filter)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, w.Body.String())
+				return
+			}
+			var got []registry.Route
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+			assert.Equal(t, routes, got)
+		})
+	}
+}
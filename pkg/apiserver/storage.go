@@ -0,0 +1,169 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"fmt"
+
+	cmrest "github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/apiserver/registry/rest"
+	cmprovider "github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/apiserver/pkg/registry/rest"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+
+	"github.com/barkbay/custom-metrics-router/pkg/provider"
+)
+
+// customMetricsREST is the storage of the custom metrics API.
+type customMetricsREST struct {
+	cmProvider provider.CustomMetricsProvider
+}
+
+var _ rest.Storage = &customMetricsREST{}
+var _ cmrest.ListerWithOptions = &customMetricsREST{}
+
+func newCustomMetricsREST(cmProvider provider.CustomMetricsProvider) *customMetricsREST {
+	return &customMetricsREST{cmProvider: cmProvider}
+}
+
+func (r *customMetricsREST) New() runtime.Object {
+	return &custom_metrics.MetricValue{}
+}
+
+func (r *customMetricsREST) NewList() runtime.Object {
+	return &custom_metrics.MetricValueList{}
+}
+
+func (r *customMetricsREST) NewListOptions() (runtime.Object, bool, string) {
+	return &custom_metrics.MetricListOptions{}, true, "metricName"
+}
+
+func (r *customMetricsREST) List(ctx context.Context, options *metainternalversion.ListOptions, metricOpts runtime.Object) (runtime.Object, error) {
+	metricOptions, ok := metricOpts.(*custom_metrics.MetricListOptions)
+	if !ok {
+		return nil, fmt.Errorf("invalid options object: %#v", options)
+	}
+
+	// populate the label selector, defaulting to all
+	selector := labels.Everything()
+	if options != nil && options.LabelSelector != nil {
+		selector = options.LabelSelector
+	}
+
+	metricLabelSelector := labels.Everything()
+	if metricOptions != nil && len(metricOptions.MetricLabelSelector) > 0 {
+		sel, err := labels.Parse(metricOptions.MetricLabelSelector)
+		if err != nil {
+			return nil, err
+		}
+		metricLabelSelector = sel
+	}
+
+	// grab the name, if present, from the field selector list options
+	// (this is how the list handler logic injects it)
+	name := "*"
+	if options != nil && options.FieldSelector != nil {
+		if nameMatch, required := options.FieldSelector.RequiresExactMatch("metadata.name"); required {
+			name = nameMatch
+		}
+	}
+
+	namespace := genericapirequest.NamespaceValue(ctx)
+
+	requestInfo, ok := genericapirequest.RequestInfoFrom(ctx)
+	if !ok {
+		return nil, fmt.Errorf("unable to get resource and metric name from request")
+	}
+
+	resourceRaw := requestInfo.Resource
+	metricName := requestInfo.Subresource
+
+	groupResource := schema.ParseGroupResource(resourceRaw)
+
+	// handle metrics describing namespaces
+	if namespace != "" && resourceRaw == "metrics" {
+		// namespace-describing metrics have a path of /namespaces/$NS/metrics/$metric,
+		groupResource = schema.GroupResource{Resource: "namespaces"}
+		metricName = name
+		name = namespace
+		namespace = ""
+	}
+
+	info := cmprovider.CustomMetricInfo{
+		GroupResource: groupResource,
+		Metric:        metricName,
+		Namespaced:    namespace != "",
+	}
+
+	// handle namespaced and root metrics
+	if name == "*" {
+		return r.cmProvider.GetMetricBySelector(ctx, namespace, selector, info, metricLabelSelector)
+	}
+	singleRes, err := r.cmProvider.GetMetricByName(ctx, types.NamespacedName{Namespace: namespace, Name: name}, info, metricLabelSelector)
+	if err != nil {
+		return nil, err
+	}
+	return &custom_metrics.MetricValueList{
+		Items: []custom_metrics.MetricValue{*singleRes},
+	}, nil
+}
+
+// externalMetricsREST is the storage of the external metrics API.
+type externalMetricsREST struct {
+	emProvider provider.ExternalMetricsProvider
+	rest.TableConvertor
+}
+
+var _ rest.Storage = &externalMetricsREST{}
+var _ rest.Lister = &externalMetricsREST{}
+
+func newExternalMetricsREST(emProvider provider.ExternalMetricsProvider) *externalMetricsREST {
+	return &externalMetricsREST{emProvider: emProvider}
+}
+
+func (r *externalMetricsREST) New() runtime.Object {
+	return &external_metrics.ExternalMetricValue{}
+}
+
+func (r *externalMetricsREST) NewList() runtime.Object {
+	return &external_metrics.ExternalMetricValueList{}
+}
+
+func (r *externalMetricsREST) List(ctx context.Context, options *metainternalversion.ListOptions) (runtime.Object, error) {
+	// populate the label selector, defaulting to all
+	metricSelector := labels.Everything()
+	if options != nil && options.LabelSelector != nil {
+		metricSelector = options.LabelSelector
+	}
+
+	namespace := genericapirequest.NamespaceValue(ctx)
+
+	requestInfo, ok := genericapirequest.RequestInfoFrom(ctx)
+	if !ok {
+		return nil, fmt.Errorf("unable to get resource and metric name from request")
+	}
+	metricName := requestInfo.Resource
+
+	return r.emProvider.GetExternalMetric(ctx, namespace, metricSelector, cmprovider.ExternalMetricInfo{Metric: metricName})
+}
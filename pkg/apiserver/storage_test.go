@@ -0,0 +1,205 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package apiserver
+
+import (
+	"context"
+	"testing"
+
+	cmprovider "github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	"github.com/stretchr/testify/assert"
+	metainternalversion "k8s.io/apimachinery/pkg/apis/meta/internalversion"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	genericapirequest "k8s.io/apiserver/pkg/endpoints/request"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+type requestKey struct{}
+
+// call is a call received by fakeProvider.
+type call struct {
+	method         string
+	namespace      string
+	name           string
+	selector       string
+	metricSelector string
+	customMetric   cmprovider.CustomMetricInfo
+	externalMetric cmprovider.ExternalMetricInfo
+	// request is the value of requestKey in the context given to the provider.
+	request interface{}
+}
+
+// fakeProvider records the calls it receives.
+type fakeProvider struct {
+	calls []call
+}
+
+func (f *fakeProvider) GetMetricByName(ctx context.Context, name types.NamespacedName, info cmprovider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	f.calls = append(f.calls, call{method: "GetMetricByName", namespace: name.Namespace, name: name.Name, metricSelector: metricSelector.String(), customMetric: info, request: ctx.Value(requestKey{})})
+	return &custom_metrics.MetricValue{DescribedObject: custom_metrics.ObjectReference{Name: name.Name}}, nil
+}
+
+func (f *fakeProvider) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info cmprovider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	f.calls = append(f.calls, call{method: "GetMetricBySelector", namespace: namespace, selector: selector.String(), metricSelector: metricSelector.String(), customMetric: info, request: ctx.Value(requestKey{})})
+	return &custom_metrics.MetricValueList{}, nil
+}
+
+func (f *fakeProvider) ListAllMetrics() []cmprovider.CustomMetricInfo {
+	return nil
+}
+
+func (f *fakeProvider) GetExternalMetric(ctx context.Context, namespace string, metricSelector labels.Selector, info cmprovider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
+	f.calls = append(f.calls, call{method: "GetExternalMetric", namespace: namespace, metricSelector: metricSelector.String(), externalMetric: info, request: ctx.Value(requestKey{})})
+	return &external_metrics.ExternalMetricValueList{}, nil
+}
+
+func (f *fakeProvider) ListAllExternalMetrics() []cmprovider.ExternalMetricInfo {
+	return nil
+}
+
+// requestContext returns the context of an API request, as set by the API server handlers.
+func requestContext(namespace, resource, subresource string) context.Context {
+	ctx := context.WithValue(context.Background(), requestKey{}, "request")
+	ctx = genericapirequest.WithRequestInfo(ctx, &genericapirequest.RequestInfo{Resource: resource, Subresource: subresource})
+	return genericapirequest.WithNamespace(ctx, namespace)
+}
+
+func TestCustomMetricsREST_List(t *testing.T) {
+	pods := schema.GroupResource{Resource: "pods"}
+	byName := &metainternalversion.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", "pod1")}
+	tests := []struct {
+		name          string
+		ctx           context.Context
+		options       *metainternalversion.ListOptions
+		metricOptions *custom_metrics.MetricListOptions
+		want          call
+		wantErr       bool
+	}{
+		{
+			name:    "namespaced object by name",
+			ctx:     requestContext("ns", "pods", "http_requests"),
+			options: byName,
+			metricOptions: &custom_metrics.MetricListOptions{
+				MetricLabelSelector: "method=GET",
+			},
+			want: call{
+				method: "GetMetricByName", namespace: "ns", name: "pod1", metricSelector: "method=GET",
+				customMetric: cmprovider.CustomMetricInfo{GroupResource: pods, Namespaced: true, Metric: "http_requests"},
+			},
+		},
+		{
+			name:          "namespaced objects by selector",
+			ctx:           requestContext("ns", "pods", "http_requests"),
+			options:       &metainternalversion.ListOptions{LabelSelector: labels.SelectorFromSet(labels.Set{"app": "foo"})},
+			metricOptions: &custom_metrics.MetricListOptions{},
+			want: call{
+				method: "GetMetricBySelector", namespace: "ns", selector: "app=foo",
+				customMetric: cmprovider.CustomMetricInfo{GroupResource: pods, Namespaced: true, Metric: "http_requests"},
+			},
+		},
+		{
+			name:          "root scoped objects",
+			ctx:           requestContext("", "nodes", "cpu_temperature"),
+			metricOptions: &custom_metrics.MetricListOptions{},
+			want: call{
+				method:       "GetMetricBySelector",
+				customMetric: cmprovider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "nodes"}, Metric: "cpu_temperature"},
+			},
+		},
+		{
+			name: "metric describing a namespace",
+			// /namespaces/ns/metrics/queue_length
+			ctx: requestContext("ns", "metrics", ""),
+			options: &metainternalversion.ListOptions{
+				FieldSelector: fields.OneTermEqualSelector("metadata.name", "queue_length"),
+			},
+			metricOptions: &custom_metrics.MetricListOptions{},
+			want: call{
+				method: "GetMetricByName", name: "ns",
+				customMetric: cmprovider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Metric: "queue_length"},
+			},
+		},
+		{
+			name:          "invalid metric selector",
+			ctx:           requestContext("ns", "pods", "http_requests"),
+			metricOptions: &custom_metrics.MetricListOptions{MetricLabelSelector: "a in"},
+			wantErr:       true,
+		},
+		{
+			name:          "no request info",
+			ctx:           context.Background(),
+			metricOptions: &custom_metrics.MetricListOptions{},
+			wantErr:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeProvider{}
+			_, err := newCustomMetricsREST(fake).List(tt.ctx, tt.options, tt.metricOptions)
+			if tt.wantErr {
+				assert.Error(t, err)
+				assert.Empty(t, fake.calls)
+				return
+			}
+			assert.NoError(t, err)
+			if tt.want.metricSelector == "" {
+				tt.want.metricSelector = labels.Everything().String()
+			}
+			if tt.want.method == "GetMetricBySelector" && tt.want.selector == "" {
+				tt.want.selector = labels.Everything().String()
+			}
+			// The context of the request is given to the provider
+			tt.want.request = "request"
+			assert.Equal(t, []call{tt.want}, fake.calls)
+		})
+	}
+}
+
+func TestCustomMetricsREST_List_ByName(t *testing.T) {
+	fake := &fakeProvider{}
+	result, err := newCustomMetricsREST(fake).List(
+		requestContext("ns", "pods", "http_requests"),
+		&metainternalversion.ListOptions{FieldSelector: fields.OneTermEqualSelector("metadata.name", "pod1")},
+		&custom_metrics.MetricListOptions{},
+	)
+	assert.NoError(t, err)
+	// The value of a single object is returned in a list
+	assert.Equal(t, &custom_metrics.MetricValueList{
+		Items: []custom_metrics.MetricValue{{DescribedObject: custom_metrics.ObjectReference{Name: "pod1"}}},
+	}, result)
+}
+
+func TestExternalMetricsREST_List(t *testing.T) {
+	fake := &fakeProvider{}
+	_, err := newExternalMetricsREST(fake).List(
+		requestContext("ns", "queue_length", ""),
+		&metainternalversion.ListOptions{LabelSelector: labels.SelectorFromSet(labels.Set{"queue": "orders"})},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, []call{{
+		method: "GetExternalMetric", namespace: "ns", metricSelector: "queue=orders",
+		externalMetric: cmprovider.ExternalMetricInfo{Metric: "queue_length"},
+		request:        "request",
+	}}, fake.calls)
+
+	_, err = newExternalMetricsREST(fake).List(context.Background(), nil)
+	assert.Error(t, err)
+}
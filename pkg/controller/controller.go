@@ -18,35 +18,96 @@ package controller
 
 import (
 	"context"
+	"fmt"
 	"reflect"
 	"time"
 
 	"github.com/barkbay/custom-metrics-router/pkg/registry"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/klog"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	crcontroller "sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	mrv1alpha1 "github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
 )
 
-func SetupMetricsSourceController(mgr ctrl.Manager) (*registry.Registry, error) {
+// Options configures the MetricsSource controller.
+type Options struct {
+	// MaxConcurrentReconciles is the maximum number of metrics sources discovered in parallel.
+	MaxConcurrentReconciles int
+	// Readiness configures the readiness check returned by SetupMetricsSourceController.
+	Readiness ReadinessOptions
+	// AutoDiscovery configures the creation of MetricsSources for the metrics adapters registered in the cluster.
+	AutoDiscovery AutoDiscoveryOptions
+	// DrainTimeout is the maximum time to wait for the requests in progress to complete when a metrics source is
+	// deleted, zero to not wait.
+	DrainTimeout time.Duration
+}
+
+// SetupMetricsSourceController registers the MetricsSource controller. It returns the registry of the routes, and a
+// readiness check which fails until the initial routing table is built.
+func SetupMetricsSourceController(mgr ctrl.Manager, options Options) (*registry.Registry, healthz.Checker, error) {
 	k8sClient := mgr.GetClient()
 
 	// Create a new routes registry
-	registry := registry.NewRegistry(mgr.GetConfig(), k8sClient.RESTMapper())
+	registry := registry.NewRegistry(mgr.GetConfig())
 
 	// Create the reconciler
 	reconciler := &MetricsSourceReconciler{
-		Client:   k8sClient,
-		Scheme:   mgr.GetScheme(),
-		registry: registry,
+		Client:                  k8sClient,
+		Scheme:                  mgr.GetScheme(),
+		registry:                registry,
+		circuitBreakerEvents:    make(chan event.GenericEvent, 100),
+		MaxConcurrentReconciles: options.MaxConcurrentReconciles,
+		readiness:               newInitialSyncChecker(k8sClient, options.Readiness),
+		events:                  newEventRecorder(mgr.GetEventRecorderFor("metrics-router"), k8sClient),
+		DrainTimeout:            options.DrainTimeout,
 	}
 
+	// Update the status of a MetricsSource when the state of its circuit breaker changes
+	registry.OnCircuitBreakerStateChange(func(sourceName string, _ mrv1alpha1.CircuitBreakerState) {
+		select {
+		case reconciler.circuitBreakerEvents <- event.GenericEvent{Object: &mrv1alpha1.MetricsSource{ObjectMeta: metav1.ObjectMeta{Name: sourceName}}}:
+		default:
+			klog.Warningf("dropped circuit breaker event for metrics source %s", sourceName)
+		}
+	})
+
+	// Record the changes of the routes as Events on the MetricsSources
+	registry.OnSourceChanges(reconciler.events.sourceChanges)
+
 	// Register the reconciler
-	return registry, reconciler.SetupWithManager(mgr)
+	if err := reconciler.SetupWithManager(mgr); err != nil {
+		return nil, nil, err
+	}
+	if err := reconciler.setupCircuitBreakerController(mgr); err != nil {
+		return nil, nil, err
+	}
+
+	if options.AutoDiscovery.Enabled {
+		discoveryReconciler := &DiscoveryReconciler{
+			Client:        k8sClient,
+			routerService: options.AutoDiscovery.RouterService,
+		}
+		if err := discoveryReconciler.SetupWithManager(mgr); err != nil {
+			return nil, nil, err
+		}
+	}
+	return registry, reconciler.readiness.Check, nil
 }
 
 // MetricsSourceReconciler reconciles a MetricsSource object
@@ -54,8 +115,32 @@ type MetricsSourceReconciler struct {
 	client.Client
 	registry *registry.Registry
 	Scheme   *runtime.Scheme
+
+	// circuitBreakerEvents receives an event each time the circuit breaker of a metrics source changes its state.
+	circuitBreakerEvents chan event.GenericEvent
+
+	// MaxConcurrentReconciles is the maximum number of metrics sources reconciled in parallel. A metrics source is never
+	// reconciled by more than one worker at a time, and the routes do not depend on the order in which the metrics
+	// sources are discovered: they are always sorted by priority and then by name.
+	MaxConcurrentReconciles int
+
+	// readiness is notified of the discovery attempts.
+	readiness *initialSyncChecker
+	// events records Events on the MetricsSources.
+	events *eventRecorder
+
+	// DrainTimeout is the maximum time to wait for the requests in progress to complete when a metrics source is
+	// deleted.
+	DrainTimeout time.Duration
 }
 
+// degradedResyncPeriod is the period at which the metrics of a source are discovered while a removal of metrics is
+// held.
+const degradedResyncPeriod = 30 * time.Second
+
+// DrainFinalizer is set on the MetricsSources to drain the requests in progress before they are deleted.
+const DrainFinalizer = "metricsrouter.io/drain"
+
 //+kubebuilder:rbac:groups=metricsrouter.io,resources=metricssources,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=metricsrouter.io,resources=metricssources/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=metricsrouter.io,resources=metricssources/finalizers,verbs=update
@@ -71,43 +156,169 @@ func (r *MetricsSourceReconciler) Reconcile(ctx context.Context, req ctrl.Reques
 	// Get the Metrics source
 	metricsSource := &mrv1alpha1.MetricsSource{}
 	err := r.Client.Get(context.Background(), req.NamespacedName, metricsSource)
-	if errors.IsNotFound(err) || metricsSource.IsMarkedForDeletion() {
+	if errors.IsNotFound(err) {
 		r.registry.DeleteSource(req.Name)
 		return ctrl.Result{}, nil
 	}
 	if err != nil {
 		return ctrl.Result{}, err
 	}
+	if metricsSource.IsMarkedForDeletion() {
+		return ctrl.Result{}, r.finalize(ctx, metricsSource)
+	}
+	// The finalizer gives a chance to drain the requests in progress before the metrics source is deleted. It is only
+	// set if the requests are drained, and removed once draining is disabled.
+	hasFinalizer := controllerutil.ContainsFinalizer(metricsSource, DrainFinalizer)
+	if drain := r.DrainTimeout > 0; drain != hasFinalizer {
+		if drain {
+			controllerutil.AddFinalizer(metricsSource, DrainFinalizer)
+		} else {
+			controllerutil.RemoveFinalizer(metricsSource, DrainFinalizer)
+		}
+		if err := r.Client.Update(ctx, metricsSource); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
 
-	metricCount, err := r.registry.AddOrUpdateSource(*metricsSource)
+	if metricsSource.Spec.HasServiceBackend() && metricsSource.Spec.MetricsServiceBackend.HasLoadBalancing() {
+		// Endpoints must be known before the first discovery requests are sent.
+		if err := syncEndpoints(ctx, r.Client, r.registry, *metricsSource); err != nil {
+			r.readiness.discovered(metricsSource.Name, false)
+			return ctrl.Result{}, err
+		}
+	}
+
+	metricCount, err := r.registry.AddOrUpdateSource(ctx, *metricsSource)
+	r.readiness.discovered(metricsSource.Name, err == nil)
+	pendingRemoval, degraded := r.registry.PendingRemoval(metricsSource.Name)
 	newStatus := mrv1alpha1.MetricsSourceStatus{
-		Synced:       err == nil,
-		MetricsCount: metricCount,
-		Service:      metricsSource.Spec.MetricsServiceBackend.NamespacedName().String(),
-		Port:         int(metricsSource.Spec.MetricsServiceBackend.Port.Port()),
+		Synced:         err == nil,
+		MetricsCount:   metricCount,
+		Service:        metricsSource.Spec.MetricsServiceBackend.NamespacedName().String(),
+		Port:           int(metricsSource.Spec.MetricsServiceBackend.Port.Port()),
+		CircuitBreaker: r.registry.CircuitBreakerState(metricsSource.Name),
+		Degraded:       degraded,
+		History:        mergeHistory(metricsSource.Status.History, r.registry.DiscoveryHistory(metricsSource.Name)),
+	}
+	if prometheus := metricsSource.Spec.Prometheus; prometheus != nil {
+		newStatus.Service = prometheus.URL
+		newStatus.Port = 0
+	}
+	if scaler := metricsSource.Spec.ExternalScaler; scaler != nil {
+		newStatus.Service = scaler.Address
+		newStatus.Port = 0
+	}
+	if webhook := metricsSource.Spec.Webhook; webhook != nil {
+		newStatus.Service = webhook.URL
+		newStatus.Port = 0
 	}
 	// Always attempt to update the status
 	if err != nil {
-		_ = r.updateStatus(metricsSource, newStatus)
+		r.events.event(metricsSource, corev1.EventTypeWarning, ReasonDiscoveryFailed, err.Error())
+		_ = r.updateStatus(ctx, metricsSource, newStatus)
 		return ctrl.Result{}, err
 	}
 	klog.Infof("%d metrics loaded from %s", metricCount, req)
+	if degraded {
+		// Confirm or cancel the removal sooner
+		r.events.pendingRemoval(metricsSource, pendingRemoval)
+		return ctrl.Result{RequeueAfter: degradedResyncPeriod}, r.updateStatus(ctx, metricsSource, newStatus)
+	}
 	return ctrl.Result{
 		RequeueAfter: 5 * time.Minute, // reload metric list every 5 minutes by default
-	}, r.updateStatus(metricsSource, newStatus)
+	}, r.updateStatus(ctx, metricsSource, newStatus)
 }
 
-func (r *MetricsSourceReconciler) updateStatus(metricsSource *mrv1alpha1.MetricsSource, newStatus mrv1alpha1.MetricsSourceStatus) error {
+// finalize drains the requests in progress of a metrics source being deleted, and then removes the finalizer.
+func (r *MetricsSourceReconciler) finalize(ctx context.Context, metricsSource *mrv1alpha1.MetricsSource) error {
+	if !controllerutil.ContainsFinalizer(metricsSource, DrainFinalizer) || r.DrainTimeout <= 0 {
+		r.registry.DeleteSource(metricsSource.Name)
+	} else {
+		drainCtx, cancel := context.WithTimeout(ctx, r.DrainTimeout)
+		defer cancel()
+		if err := r.registry.DrainSource(drainCtx, metricsSource.Name); err != nil {
+			r.events.event(metricsSource, corev1.EventTypeWarning, ReasonDrainTimeout,
+				fmt.Sprintf("requests still in progress after %s: %v", r.DrainTimeout, err))
+		}
+	}
+	if !controllerutil.ContainsFinalizer(metricsSource, DrainFinalizer) {
+		return nil
+	}
+	controllerutil.RemoveFinalizer(metricsSource, DrainFinalizer)
+	return r.Client.Update(ctx, metricsSource)
+}
+
+// mergeHistory merges the discovery history persisted in the status with the one held by the registry, which starts
+// empty when the router is restarted.
+func mergeHistory(persisted, recent []mrv1alpha1.DiscoveryRecord) []mrv1alpha1.DiscoveryRecord {
+	var history []mrv1alpha1.DiscoveryRecord
+	for _, record := range persisted {
+		if len(recent) == 0 || record.Time.Before(&recent[0].Time) {
+			history = append(history, record)
+		}
+	}
+	history = append(history, recent...)
+	if len(history) > registry.MaxDiscoveryHistory {
+		history = history[len(history)-registry.MaxDiscoveryHistory:]
+	}
+	return history
+}
+
+// updateStatus patches the status of a metrics source. The state of the circuit breaker is owned by
+// reconcileCircuitBreaker, it is only reported here if it has never been.
+func (r *MetricsSourceReconciler) updateStatus(ctx context.Context, metricsSource *mrv1alpha1.MetricsSource, newStatus mrv1alpha1.MetricsSourceStatus) error {
+	if metricsSource.Status.CircuitBreaker != "" {
+		newStatus.CircuitBreaker = metricsSource.Status.CircuitBreaker
+	}
 	if reflect.DeepEqual(metricsSource.Status, newStatus) {
 		return nil
 	}
+	patch := client.MergeFrom(metricsSource.DeepCopy())
 	metricsSource.Status = newStatus
-	return r.Client.Status().Update(context.Background(), metricsSource)
+	return r.Client.Status().Patch(ctx, metricsSource, patch)
+}
+
+// reconcileCircuitBreaker reports the state of the circuit breaker of a metrics source in its status. The metrics of the
+// source are not discovered again.
+func (r *MetricsSourceReconciler) reconcileCircuitBreaker(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	metricsSource := &mrv1alpha1.MetricsSource{}
+	if err := r.Client.Get(ctx, req.NamespacedName, metricsSource); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	state := r.registry.CircuitBreakerState(metricsSource.Name)
+	if metricsSource.IsMarkedForDeletion() || metricsSource.Status.CircuitBreaker == state {
+		return ctrl.Result{}, nil
+	}
+	patch := client.MergeFrom(metricsSource.DeepCopy())
+	metricsSource.Status.CircuitBreaker = state
+	return ctrl.Result{}, r.Client.Status().Patch(ctx, metricsSource, patch)
+}
+
+// setupCircuitBreakerController registers the controller which updates the status of the MetricsSources when the state
+// of their circuit breaker changes.
+func (r *MetricsSourceReconciler) setupCircuitBreakerController(mgr ctrl.Manager) error {
+	c, err := crcontroller.New("metricssource-circuitbreaker", mgr, crcontroller.Options{
+		Reconciler: reconcile.Func(r.reconcileCircuitBreaker),
+	})
+	if err != nil {
+		return err
+	}
+	return c.Watch(&source.Channel{Source: r.circuitBreakerEvents}, &handler.EnqueueRequestForObject{})
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *MetricsSourceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &mrv1alpha1.MetricsSource{}, serviceIndex, indexService); err != nil {
+		return err
+	}
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&mrv1alpha1.MetricsSource{}).
+		// The updates of the status, like the ones of the state of the circuit breaker, do not trigger a discovery
+		For(&mrv1alpha1.MetricsSource{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		// Resync the metrics sources, and the endpoints to which their requests are balanced, as soon as their backend
+		// is created, updated or becomes reachable
+		Watches(&source.Kind{Type: &corev1.Service{}}, handler.EnqueueRequestsFromMapFunc(r.mapService)).
+		Watches(&source.Kind{Type: &discoveryv1.EndpointSlice{}}, handler.EnqueueRequestsFromMapFunc(r.mapEndpointSlice)).
+		Watches(&source.Kind{Type: newAPIService()}, handler.EnqueueRequestsFromMapFunc(r.mapAPIService)).
+		WithOptions(crcontroller.Options{MaxConcurrentReconciles: r.MaxConcurrentReconciles}).
 		Complete(r)
 }
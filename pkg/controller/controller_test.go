@@ -0,0 +1,219 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	mrv1alpha1 "github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+)
+
+func TestMetricsSourceReconciler_Finalizer(t *testing.T) {
+	now := metav1.Now()
+	webhookSource := func(finalizers ...string) *mrv1alpha1.MetricsSource {
+		return &mrv1alpha1.MetricsSource{
+			ObjectMeta: metav1.ObjectMeta{Name: "source1", Finalizers: finalizers},
+			Spec: mrv1alpha1.MetricsSourceSpec{
+				MetricTypes: mrv1alpha1.MetricTypes{mrv1alpha1.ExternalMetrics},
+				Webhook:     &mrv1alpha1.WebhookBackend{URL: "http://127.0.0.1:1"},
+			},
+		}
+	}
+	tests := []struct {
+		name          string
+		metricsSource *mrv1alpha1.MetricsSource
+		drainTimeout  time.Duration
+		wantFinalizer bool
+	}{
+		{
+			name:          "finalizer is added",
+			metricsSource: webhookSource(),
+			drainTimeout:  time.Second,
+			wantFinalizer: true,
+		},
+		{
+			name:          "finalizer is not added if draining is disabled",
+			metricsSource: webhookSource(),
+		},
+		{
+			name:          "finalizer is removed if draining is disabled",
+			metricsSource: webhookSource(DrainFinalizer),
+		},
+		{
+			name: "finalizer is removed once the metrics source is drained",
+			metricsSource: &mrv1alpha1.MetricsSource{
+				ObjectMeta: metav1.ObjectMeta{Name: "source1", DeletionTimestamp: &now, Finalizers: []string{DrainFinalizer, "other"}},
+			},
+			drainTimeout: time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme := runtime.NewScheme()
+			assert.NoError(t, mrv1alpha1.AddToScheme(scheme))
+			c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(tt.metricsSource).Build()
+			r := &MetricsSourceReconciler{
+				Client:       c,
+				registry:     registry.NewRegistry(&rest.Config{}),
+				readiness:    newInitialSyncChecker(c, ReadinessOptions{}),
+				events:       newEventRecorder(record.NewFakeRecorder(100), c),
+				DrainTimeout: tt.drainTimeout,
+			}
+			// Discovery errors are not relevant
+			_, _ = r.Reconcile(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Name: tt.metricsSource.Name}})
+
+			metricsSource := &mrv1alpha1.MetricsSource{}
+			err := c.Get(context.Background(), client.ObjectKeyFromObject(tt.metricsSource), metricsSource)
+			assert.False(t, errors.IsNotFound(err))
+			assert.Equal(t, tt.wantFinalizer, containsString(metricsSource.Finalizers, DrainFinalizer))
+		})
+	}
+}
+
+func TestMetricsSourceReconciler_reconcileCircuitBreaker(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, mrv1alpha1.AddToScheme(scheme))
+	metricsSource := &mrv1alpha1.MetricsSource{
+		ObjectMeta: metav1.ObjectMeta{Name: "source1"},
+		Status: mrv1alpha1.MetricsSourceStatus{
+			Synced:         true,
+			MetricsCount:   42,
+			CircuitBreaker: mrv1alpha1.CircuitBreakerOpen,
+		},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(metricsSource).Build()
+	r := &MetricsSourceReconciler{
+		Client:   c,
+		registry: registry.NewRegistry(&rest.Config{}),
+	}
+
+	// Only the state of the circuit breaker is updated, the metrics are not discovered again
+	_, err := r.reconcileCircuitBreaker(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Name: "source1"}})
+	assert.NoError(t, err)
+	got := &mrv1alpha1.MetricsSource{}
+	assert.NoError(t, c.Get(context.Background(), client.ObjectKeyFromObject(metricsSource), got))
+	assert.Equal(t, mrv1alpha1.MetricsSourceStatus{
+		Synced:         true,
+		MetricsCount:   42,
+		CircuitBreaker: mrv1alpha1.CircuitBreakerClosed,
+	}, got.Status)
+	assert.Empty(t, r.registry.ListAllCustomMetrics())
+
+	// Deleted metrics sources are ignored
+	_, err = r.reconcileCircuitBreaker(context.Background(), ctrl.Request{NamespacedName: types.NamespacedName{Name: "unknown"}})
+	assert.NoError(t, err)
+}
+
+func TestMetricsSourceReconciler_updateStatus(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, mrv1alpha1.AddToScheme(scheme))
+	metricsSource := &mrv1alpha1.MetricsSource{
+		ObjectMeta: metav1.ObjectMeta{Name: "source1"},
+		Status:     mrv1alpha1.MetricsSourceStatus{CircuitBreaker: mrv1alpha1.CircuitBreakerClosed},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(metricsSource).Build()
+	r := &MetricsSourceReconciler{Client: c}
+	stale := &mrv1alpha1.MetricsSource{}
+	assert.NoError(t, c.Get(context.Background(), client.ObjectKeyFromObject(metricsSource), stale))
+
+	// The state of the circuit breaker changes while the metrics source is reconciled
+	opened := stale.DeepCopy()
+	opened.Status.CircuitBreaker = mrv1alpha1.CircuitBreakerOpen
+	assert.NoError(t, c.Status().Update(context.Background(), opened))
+
+	// The state of the circuit breaker is not overwritten by the stale metrics source
+	assert.NoError(t, r.updateStatus(context.Background(), stale, mrv1alpha1.MetricsSourceStatus{
+		Synced:         true,
+		MetricsCount:   42,
+		CircuitBreaker: mrv1alpha1.CircuitBreakerClosed,
+	}))
+	got := &mrv1alpha1.MetricsSource{}
+	assert.NoError(t, c.Get(context.Background(), client.ObjectKeyFromObject(metricsSource), got))
+	assert.Equal(t, mrv1alpha1.MetricsSourceStatus{
+		Synced:         true,
+		MetricsCount:   42,
+		CircuitBreaker: mrv1alpha1.CircuitBreakerOpen,
+	}, got.Status)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMergeHistory(t *testing.T) {
+	at := func(minutes int) mrv1alpha1.DiscoveryRecord {
+		return mrv1alpha1.DiscoveryRecord{Time: metav1.NewTime(time.Unix(0, 0).Add(time.Duration(minutes) * time.Minute))}
+	}
+	records := func(minutes ...int) []mrv1alpha1.DiscoveryRecord {
+		var history []mrv1alpha1.DiscoveryRecord
+		for _, m := range minutes {
+			history = append(history, at(m))
+		}
+		return history
+	}
+	tests := []struct {
+		name      string
+		persisted []mrv1alpha1.DiscoveryRecord
+		recent    []mrv1alpha1.DiscoveryRecord
+		want      []mrv1alpha1.DiscoveryRecord
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:      "router restarted",
+			persisted: records(1, 2),
+			want:      records(1, 2),
+		},
+		{
+			name:      "overlapping records",
+			persisted: records(1, 2, 3),
+			recent:    records(2, 3, 4),
+			want:      records(1, 2, 3, 4),
+		},
+		{
+			name:      "history is bounded",
+			persisted: records(1, 2, 3, 4, 5, 6, 7, 8, 9),
+			recent:    records(10, 11, 12),
+			want:      records(3, 4, 5, 6, 7, 8, 9, 10, 11, 12),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, mergeHistory(tt.persisted, tt.recent))
+		})
+	}
+}
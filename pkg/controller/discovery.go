@@ -0,0 +1,267 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	mrv1alpha1 "github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+)
+
+const (
+	// ManagedByLabel is set on the MetricsSources created by the auto-discovery. A MetricsSource without this label is
+	// never updated by the auto-discovery.
+	ManagedByLabel = "metricsrouter.io/managed-by"
+	// ManagedByAutoDiscovery is the value of ManagedByLabel on the MetricsSources created by the auto-discovery.
+	ManagedByAutoDiscovery = "auto-discovery"
+
+	// DiscoverLabel, if set to true on a Service, creates a MetricsSource for this Service.
+	DiscoverLabel = "metricsrouter.io/discover"
+	// MetricTypesAnnotation is a comma separated list of the metric types served by a Service labelled for discovery,
+	// CustomMetrics and ExternalMetrics are assumed if not set.
+	MetricTypesAnnotation = "metricsrouter.io/metric-types"
+)
+
+// metricTypesByGroup is the type of metrics served by the APIServices of each metrics API group.
+var metricTypesByGroup = map[string]mrv1alpha1.MetricType{
+	"custom.metrics.k8s.io":   mrv1alpha1.CustomMetrics,
+	"external.metrics.k8s.io": mrv1alpha1.ExternalMetrics,
+}
+
+// AutoDiscoveryOptions configures the auto-discovery of the metrics sources.
+type AutoDiscoveryOptions struct {
+	// Enabled creates and updates a MetricsSource for each Service which backs a metrics APIService, or which is
+	// labelled for discovery.
+	Enabled bool
+	// RouterService is the Service of the router, the APIServices backed by the router are ignored.
+	RouterService types.NamespacedName
+}
+
+// DiscoveryReconciler creates and updates the MetricsSources of the metrics adapters already registered in the
+// cluster. The MetricsSources are never deleted by the auto-discovery: the metrics APIServices are expected to be
+// updated to be backed by the router once the MetricsSources exist.
+type DiscoveryReconciler struct {
+	client.Client
+	routerService types.NamespacedName
+}
+
+// discoveredBackend is the configuration of a metrics source, as read from the APIServices and the Service.
+type discoveredBackend struct {
+	metricTypes           mrv1alpha1.MetricTypes
+	port                  *int32
+	caBundle              []byte
+	insecureSkipTLSVerify bool
+}
+
+func (d *discoveredBackend) addMetricType(metricType mrv1alpha1.MetricType) {
+	d.metricTypes = withMetricType(d.metricTypes, metricType)
+}
+
+// withMetricType adds a metric type to a list if it is not already there.
+func withMetricType(metricTypes mrv1alpha1.MetricTypes, metricType mrv1alpha1.MetricType) mrv1alpha1.MetricTypes {
+	for _, t := range metricTypes {
+		if t == metricType {
+			return metricTypes
+		}
+	}
+	return append(metricTypes, metricType)
+}
+
+// discoveredSourceName returns the name of the MetricsSource of a Service.
+func discoveredSourceName(service types.NamespacedName) string {
+	return fmt.Sprintf("%s-%s", service.Namespace, service.Name)
+}
+
+// Reconcile creates or updates the MetricsSource of a Service.
+func (r *DiscoveryReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	if req.NamespacedName == r.routerService {
+		return ctrl.Result{}, nil
+	}
+	backend, err := r.discover(ctx, req.NamespacedName)
+	if err != nil || backend == nil {
+		return ctrl.Result{}, err
+	}
+
+	metricsSource := &mrv1alpha1.MetricsSource{}
+	err = r.Client.Get(ctx, types.NamespacedName{Name: discoveredSourceName(req.NamespacedName)}, metricsSource)
+	if errors.IsNotFound(err) {
+		metricsSource = &mrv1alpha1.MetricsSource{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   discoveredSourceName(req.NamespacedName),
+				Labels: map[string]string{ManagedByLabel: ManagedByAutoDiscovery},
+			},
+		}
+		backend.applyTo(metricsSource, req.NamespacedName)
+		klog.Infof("Create metrics source %s discovered from service %s", metricsSource.Name, req.NamespacedName)
+		return ctrl.Result{}, r.Client.Create(ctx, metricsSource)
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if metricsSource.Labels[ManagedByLabel] != ManagedByAutoDiscovery {
+		klog.V(2).Infof("metrics source %s is not managed by the auto-discovery, not updating it", metricsSource.Name)
+		return ctrl.Result{}, nil
+	}
+	updated := metricsSource.DeepCopy()
+	backend.applyTo(updated, req.NamespacedName)
+	if reflect.DeepEqual(metricsSource.Spec, updated.Spec) {
+		return ctrl.Result{}, nil
+	}
+	klog.Infof("Update metrics source %s discovered from service %s", metricsSource.Name, req.NamespacedName)
+	return ctrl.Result{}, r.Client.Update(ctx, updated)
+}
+
+// applyTo updates the spec of a MetricsSource. Settings are only added: once the router is installed the APIServices
+// are backed by the router, the settings read from them before must be preserved.
+func (d *discoveredBackend) applyTo(metricsSource *mrv1alpha1.MetricsSource, service types.NamespacedName) {
+	spec := &metricsSource.Spec
+	spec.MetricsServiceBackend.Namespace = service.Namespace
+	spec.MetricsServiceBackend.Name = service.Name
+	if d.port != nil {
+		spec.MetricsServiceBackend.Port.Number = d.port
+	}
+	if len(d.caBundle) > 0 {
+		spec.MetricsServiceBackend.CABundle = d.caBundle
+	}
+	if d.insecureSkipTLSVerify {
+		spec.InsecureSkipTLSVerify = true
+	}
+	for _, metricType := range d.metricTypes {
+		spec.MetricTypes = withMetricType(spec.MetricTypes, metricType)
+	}
+	sort.Slice(spec.MetricTypes, func(i, j int) bool { return spec.MetricTypes[i] < spec.MetricTypes[j] })
+}
+
+// discover reads the configuration of the metrics source of a Service from the APIServices it backs, and from the
+// Service itself if it is labelled for discovery. It returns nil if the Service does not serve any metrics.
+func (r *DiscoveryReconciler) discover(ctx context.Context, serviceName types.NamespacedName) (*discoveredBackend, error) {
+	backend := &discoveredBackend{}
+	apiServices := &unstructured.UnstructuredList{}
+	apiServices.SetGroupVersionKind(apiServiceGVK.GroupVersion().WithKind(apiServiceGVK.Kind + "List"))
+	if err := r.Client.List(ctx, apiServices); err != nil {
+		return nil, err
+	}
+	// Read the CA bundle from the APIServices in a predictable order
+	sort.Slice(apiServices.Items, func(i, j int) bool { return apiServices.Items[i].GetName() < apiServices.Items[j].GetName() })
+	for _, apiService := range apiServices.Items {
+		if apiServiceBackend(&apiService) != serviceName {
+			continue
+		}
+		group, _, _ := unstructured.NestedString(apiService.Object, "spec", "group")
+		metricType, ok := metricTypesByGroup[group]
+		if !ok {
+			continue
+		}
+		backend.addMetricType(metricType)
+		if port, found, _ := unstructured.NestedInt64(apiService.Object, "spec", "service", "port"); found && backend.port == nil {
+			p := int32(port)
+			backend.port = &p
+		}
+		if caBundle, _, _ := unstructured.NestedString(apiService.Object, "spec", "caBundle"); caBundle != "" && backend.caBundle == nil {
+			// caBundle is base64 encoded in the unstructured object
+			decoded, err := base64.StdEncoding.DecodeString(caBundle)
+			if err != nil {
+				klog.Warningf("invalid CA bundle in APIService %s: %v", apiService.GetName(), err)
+			} else {
+				backend.caBundle = decoded
+			}
+		}
+		if insecure, _, _ := unstructured.NestedBool(apiService.Object, "spec", "insecureSkipTLSVerify"); insecure {
+			backend.insecureSkipTLSVerify = true
+		}
+	}
+
+	service := &corev1.Service{}
+	err := r.Client.Get(ctx, serviceName, service)
+	if err != nil && !errors.IsNotFound(err) {
+		return nil, err
+	}
+	if err == nil && service.Labels[DiscoverLabel] == "true" {
+		for _, metricType := range serviceMetricTypes(service) {
+			backend.addMetricType(metricType)
+		}
+	}
+	if len(backend.metricTypes) == 0 {
+		return nil, nil
+	}
+	return backend, nil
+}
+
+// serviceMetricTypes returns the metric types served by a Service labelled for discovery.
+func serviceMetricTypes(service *corev1.Service) []mrv1alpha1.MetricType {
+	annotation, ok := service.Annotations[MetricTypesAnnotation]
+	if !ok {
+		return []mrv1alpha1.MetricType{mrv1alpha1.CustomMetrics, mrv1alpha1.ExternalMetrics}
+	}
+	var metricTypes []mrv1alpha1.MetricType
+	for _, value := range strings.Split(annotation, ",") {
+		switch metricType := mrv1alpha1.MetricType(strings.TrimSpace(value)); metricType {
+		case mrv1alpha1.CustomMetrics, mrv1alpha1.ExternalMetrics:
+			metricTypes = append(metricTypes, metricType)
+		default:
+			klog.Warningf("unknown metric type %q in annotation %s of service %s/%s", value, MetricTypesAnnotation, service.Namespace, service.Name)
+		}
+	}
+	return metricTypes
+}
+
+// apiServiceBackend returns the Service which backs an APIService, an empty name if the APIService is served locally.
+func apiServiceBackend(apiService *unstructured.Unstructured) types.NamespacedName {
+	namespace, _, _ := unstructured.NestedString(apiService.Object, "spec", "service", "namespace")
+	name, _, _ := unstructured.NestedString(apiService.Object, "spec", "service", "name")
+	return types.NamespacedName{Namespace: namespace, Name: name}
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *DiscoveryReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("discovery").
+		For(&corev1.Service{}).
+		Watches(
+			&source.Kind{Type: newAPIService()},
+			handler.EnqueueRequestsFromMapFunc(func(o client.Object) []reconcile.Request {
+				apiService, ok := o.(*unstructured.Unstructured)
+				if !ok {
+					return nil
+				}
+				service := apiServiceBackend(apiService)
+				if service.Name == "" {
+					// Local APIService, served by the K8S API server
+					return nil
+				}
+				return []reconcile.Request{{NamespacedName: service}}
+			}),
+		).
+		Complete(r)
+}
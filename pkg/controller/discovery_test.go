@@ -0,0 +1,204 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	mrv1alpha1 "github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+)
+
+// "ca" base64 encoded
+const fakeCABundle = "Y2E="
+
+func fakeAPIService(group string, service map[string]interface{}) *unstructured.Unstructured {
+	apiService := newAPIService()
+	apiService.SetName("v1beta1." + group)
+	spec := map[string]interface{}{"group": group, "version": "v1beta1"}
+	if service != nil {
+		spec["service"] = service
+		spec["caBundle"] = fakeCABundle
+	}
+	apiService.Object["spec"] = spec
+	return apiService
+}
+
+func TestDiscoveryReconciler(t *testing.T) {
+	prometheusAdapter := types.NamespacedName{Namespace: "monitoring", Name: "prometheus-adapter"}
+	int32Ptr := func(i int32) *int32 { return &i }
+	tests := []struct {
+		name     string
+		service  types.NamespacedName
+		objects  []client.Object
+		want     *mrv1alpha1.MetricsSource
+		wantName string
+	}{
+		{
+			name:    "metrics source created from the APIServices",
+			service: prometheusAdapter,
+			objects: []client.Object{
+				fakeAPIService("custom.metrics.k8s.io", map[string]interface{}{"namespace": "monitoring", "name": "prometheus-adapter", "port": int64(6443)}),
+				fakeAPIService("external.metrics.k8s.io", map[string]interface{}{"namespace": "monitoring", "name": "prometheus-adapter", "port": int64(6443)}),
+				fakeAPIService("apps", nil),
+			},
+			want: &mrv1alpha1.MetricsSource{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "monitoring-prometheus-adapter",
+					Labels: map[string]string{ManagedByLabel: ManagedByAutoDiscovery},
+				},
+				Spec: mrv1alpha1.MetricsSourceSpec{
+					MetricsServiceBackend: mrv1alpha1.MetricsServiceBackend{
+						Namespace: "monitoring",
+						Name:      "prometheus-adapter",
+						Port:      mrv1alpha1.ServiceBackendPort{Number: int32Ptr(6443)},
+						CABundle:  []byte("ca"),
+					},
+					MetricTypes: mrv1alpha1.MetricTypes{mrv1alpha1.CustomMetrics, mrv1alpha1.ExternalMetrics},
+				},
+			},
+		},
+		{
+			name:    "metrics source created from a labelled service",
+			service: types.NamespacedName{Namespace: "keda", Name: "keda-metrics-apiserver"},
+			objects: []client.Object{
+				&corev1.Service{ObjectMeta: metav1.ObjectMeta{
+					Namespace:   "keda",
+					Name:        "keda-metrics-apiserver",
+					Labels:      map[string]string{DiscoverLabel: "true"},
+					Annotations: map[string]string{MetricTypesAnnotation: "ExternalMetrics"},
+				}},
+			},
+			want: &mrv1alpha1.MetricsSource{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "keda-keda-metrics-apiserver",
+					Labels: map[string]string{ManagedByLabel: ManagedByAutoDiscovery},
+				},
+				Spec: mrv1alpha1.MetricsSourceSpec{
+					MetricsServiceBackend: mrv1alpha1.MetricsServiceBackend{Namespace: "keda", Name: "keda-metrics-apiserver"},
+					MetricTypes:           mrv1alpha1.MetricTypes{mrv1alpha1.ExternalMetrics},
+				},
+			},
+		},
+		{
+			name:    "settings are preserved once the APIService is backed by the router",
+			service: prometheusAdapter,
+			objects: []client.Object{
+				fakeAPIService("external.metrics.k8s.io", map[string]interface{}{"namespace": "monitoring", "name": "prometheus-adapter"}),
+				&mrv1alpha1.MetricsSource{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:   "monitoring-prometheus-adapter",
+						Labels: map[string]string{ManagedByLabel: ManagedByAutoDiscovery},
+					},
+					Spec: mrv1alpha1.MetricsSourceSpec{
+						MetricsServiceBackend: mrv1alpha1.MetricsServiceBackend{
+							Namespace: "monitoring",
+							Name:      "prometheus-adapter",
+							CABundle:  []byte("previous ca"),
+						},
+						MetricTypes: mrv1alpha1.MetricTypes{mrv1alpha1.CustomMetrics},
+						Priority:    10,
+					},
+				},
+			},
+			want: &mrv1alpha1.MetricsSource{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "monitoring-prometheus-adapter",
+					Labels: map[string]string{ManagedByLabel: ManagedByAutoDiscovery},
+				},
+				Spec: mrv1alpha1.MetricsSourceSpec{
+					MetricsServiceBackend: mrv1alpha1.MetricsServiceBackend{
+						Namespace: "monitoring",
+						Name:      "prometheus-adapter",
+						CABundle:  []byte("ca"),
+					},
+					MetricTypes: mrv1alpha1.MetricTypes{mrv1alpha1.CustomMetrics, mrv1alpha1.ExternalMetrics},
+					Priority:    10,
+				},
+			},
+		},
+		{
+			name:    "metrics source not managed by the auto-discovery",
+			service: prometheusAdapter,
+			objects: []client.Object{
+				fakeAPIService("external.metrics.k8s.io", map[string]interface{}{"namespace": "monitoring", "name": "prometheus-adapter"}),
+				&mrv1alpha1.MetricsSource{
+					ObjectMeta: metav1.ObjectMeta{Name: "monitoring-prometheus-adapter"},
+					Spec: mrv1alpha1.MetricsSourceSpec{
+						MetricsServiceBackend: mrv1alpha1.MetricsServiceBackend{Namespace: "monitoring", Name: "prometheus-adapter"},
+						MetricTypes:           mrv1alpha1.MetricTypes{mrv1alpha1.CustomMetrics},
+					},
+				},
+			},
+			want: &mrv1alpha1.MetricsSource{
+				ObjectMeta: metav1.ObjectMeta{Name: "monitoring-prometheus-adapter"},
+				Spec: mrv1alpha1.MetricsSourceSpec{
+					MetricsServiceBackend: mrv1alpha1.MetricsServiceBackend{Namespace: "monitoring", Name: "prometheus-adapter"},
+					MetricTypes:           mrv1alpha1.MetricTypes{mrv1alpha1.CustomMetrics},
+				},
+			},
+		},
+		{
+			name:     "APIServices backed by the router are ignored",
+			service:  types.NamespacedName{Namespace: "metrics-router", Name: "metrics-apiserver"},
+			objects:  []client.Object{fakeAPIService("custom.metrics.k8s.io", map[string]interface{}{"namespace": "metrics-router", "name": "metrics-apiserver"})},
+			wantName: "metrics-router-metrics-apiserver",
+		},
+		{
+			name:     "service without metrics",
+			service:  types.NamespacedName{Namespace: "default", Name: "kubernetes"},
+			objects:  []client.Object{&corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "kubernetes"}}},
+			wantName: "default-kubernetes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme := runtime.NewScheme()
+			assert.NoError(t, clientgoscheme.AddToScheme(scheme))
+			assert.NoError(t, mrv1alpha1.AddToScheme(scheme))
+			c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(tt.objects...).Build()
+			r := &DiscoveryReconciler{
+				Client:        c,
+				routerService: types.NamespacedName{Namespace: "metrics-router", Name: "metrics-apiserver"},
+			}
+			_, err := r.Reconcile(context.Background(), ctrl.Request{NamespacedName: tt.service})
+			assert.NoError(t, err)
+
+			metricsSource := &mrv1alpha1.MetricsSource{}
+			if tt.want == nil {
+				err := c.Get(context.Background(), types.NamespacedName{Name: tt.wantName}, metricsSource)
+				assert.True(t, errors.IsNotFound(err), "unexpected metrics source: %v", err)
+				return
+			}
+			assert.NoError(t, c.Get(context.Background(), types.NamespacedName{Name: tt.want.Name}, metricsSource))
+			assert.Equal(t, tt.want.Labels, metricsSource.Labels)
+			assert.Equal(t, tt.want.Spec, metricsSource.Spec)
+		})
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"net"
+	"strconv"
+
+	"github.com/barkbay/custom-metrics-router/pkg/registry"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	mrv1alpha1 "github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+)
+
+//+kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch
+//+kubebuilder:rbac:groups=discovery.k8s.io,resources=endpointslices,verbs=get;list;watch
+
+// syncEndpoints reads the ready endpoints of the backend of a metrics source from its EndpointSlices and update them in
+// the registry.
+func syncEndpoints(ctx context.Context, c client.Client, registry *registry.Registry, metricsSource mrv1alpha1.MetricsSource) error {
+	backend := metricsSource.Spec.MetricsServiceBackend
+	addresses, err := readyEndpoints(ctx, c, backend)
+	if err != nil {
+		return err
+	}
+	registry.UpdateEndpoints(metricsSource.Name, backend, addresses)
+	return nil
+}
+
+// readyEndpoints returns the addresses, in the form host:port, of the ready endpoints of a backend.
+func readyEndpoints(ctx context.Context, c client.Client, backend mrv1alpha1.MetricsServiceBackend) ([]string, error) {
+	service := &corev1.Service{}
+	err := c.Get(ctx, backend.NamespacedName(), service)
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Get the name of the service port, it is used to get the target port from the EndpointSlices.
+	portName, found := "", false
+	for _, port := range service.Spec.Ports {
+		if port.Port == backend.Port.Port() {
+			portName, found = port.Name, true
+			break
+		}
+	}
+	if !found {
+		klog.Warningf("port %d not found in service %s", backend.Port.Port(), backend.NamespacedName())
+		return nil, nil
+	}
+
+	endpointSlices := &discoveryv1.EndpointSliceList{}
+	if err := c.List(
+		ctx,
+		endpointSlices,
+		client.InNamespace(backend.Namespace),
+		client.MatchingLabels{discoveryv1.LabelServiceName: backend.Name},
+	); err != nil {
+		return nil, err
+	}
+
+	var addresses []string
+	for _, endpointSlice := range endpointSlices.Items {
+		port := endpointSlicePort(endpointSlice, portName)
+		if port == nil {
+			continue
+		}
+		for _, endpoint := range endpointSlice.Endpoints {
+			// Endpoints must be considered as ready if the condition is unknown.
+			if endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready {
+				continue
+			}
+			for _, address := range endpoint.Addresses {
+				addresses = append(addresses, net.JoinHostPort(address, strconv.Itoa(int(*port))))
+			}
+		}
+	}
+	return addresses, nil
+}
+
+func endpointSlicePort(endpointSlice discoveryv1.EndpointSlice, portName string) *int32 {
+	for _, port := range endpointSlice.Ports {
+		name := ""
+		if port.Name != nil {
+			name = *port.Name
+		}
+		if name == portName && port.Port != nil {
+			return port.Port
+		}
+	}
+	return nil
+}
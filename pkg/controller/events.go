@@ -0,0 +1,250 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/registry"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	mrv1alpha1 "github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+)
+
+// Reasons of the Events recorded on the MetricsSources.
+const (
+	ReasonDiscoveryFailed  = "DiscoveryFailed"
+	ReasonMetricsAdded     = "MetricsAdded"
+	ReasonMetricsRemoved   = "MetricsRemoved"
+	ReasonMetricsGained    = "MetricsGained"
+	ReasonMetricsLost      = "MetricsLost"
+	ReasonPriorityConflict = "PriorityConflict"
+	ReasonDrainTimeout     = "DrainTimeout"
+	ReasonMetricsRemoval   = "MassMetricsRemoval"
+	ReasonRemovalHeld      = "MetricsRemovalHeld"
+)
+
+const (
+	// eventsInterval is the minimum interval between two identical Events on a MetricsSource.
+	eventsInterval = 30 * time.Minute
+	// maxSamples is the maximum number of metrics listed in an Event.
+	maxSamples = 5
+)
+
+// eventKey identifies the Events with the same reason on a MetricsSource. The message is not part of the key: it holds
+// counts and samples of metrics which may change on each resync.
+type eventKey struct {
+	sourceName, reason string
+}
+
+// recordedEvent is the last Event recorded for an eventKey.
+type recordedEvent struct {
+	time time.Time
+	// pending is the latest Event not recorded since then, it is recorded once eventsInterval has elapsed.
+	pending *pendingEvent
+}
+
+type pendingEvent struct {
+	eventType, message string
+}
+
+// eventRecorder records Events on the MetricsSources. An Event with a given reason is recorded at most once per
+// eventsInterval on a MetricsSource, so that resyncs do not spam the same Events. Only the latest of the Events not
+// recorded during the interval is kept, it is recorded once the interval has elapsed.
+type eventRecorder struct {
+	record.EventRecorder
+	client.Reader
+
+	now func() time.Time
+	// afterFunc calls f once d has elapsed.
+	afterFunc func(d time.Duration, f func())
+
+	lock     sync.Mutex
+	recorded map[eventKey]*recordedEvent
+}
+
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+func newEventRecorder(recorder record.EventRecorder, reader client.Reader) *eventRecorder {
+	return &eventRecorder{
+		EventRecorder: recorder,
+		Reader:        reader,
+		now:           time.Now,
+		afterFunc:     func(d time.Duration, f func()) { time.AfterFunc(d, f) },
+		recorded:      make(map[eventKey]*recordedEvent),
+	}
+}
+
+// allow returns true if no Event with the same reason has been recorded on the MetricsSource during the last
+// eventsInterval. Otherwise the Event is kept to be recorded once the interval has elapsed, in place of the ones
+// previously kept.
+func (e *eventRecorder) allow(key eventKey, eventType, message string) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	now := e.now()
+	if last, ok := e.recorded[key]; ok && now.Sub(last.time) < eventsInterval {
+		if last.pending == nil {
+			e.afterFunc(last.time.Add(eventsInterval).Sub(now), func() { e.flush(key) })
+		}
+		last.pending = &pendingEvent{eventType: eventType, message: message}
+		return false
+	}
+	if len(e.recorded) > 1024 {
+		for k, last := range e.recorded {
+			if now.Sub(last.time) >= eventsInterval && last.pending == nil {
+				delete(e.recorded, k)
+			}
+		}
+	}
+	e.recorded[key] = &recordedEvent{time: now}
+	return true
+}
+
+// flush records the latest Event kept for an eventKey, if any.
+func (e *eventRecorder) flush(key eventKey) {
+	e.lock.Lock()
+	last, ok := e.recorded[key]
+	if !ok || last.pending == nil {
+		e.lock.Unlock()
+		return
+	}
+	pending := last.pending
+	last.pending = nil
+	e.lock.Unlock()
+	e.eventByName(key.sourceName, pending.eventType, key.reason, pending.message)
+}
+
+// event records an Event on a MetricsSource.
+func (e *eventRecorder) event(metricsSource *mrv1alpha1.MetricsSource, eventType, reason, message string) {
+	if !e.allow(eventKey{sourceName: metricsSource.Name, reason: reason}, eventType, message) {
+		return
+	}
+	e.EventRecorder.Event(metricsSource, eventType, reason, message)
+}
+
+// eventByName records an Event on a MetricsSource, if it still exists.
+func (e *eventRecorder) eventByName(sourceName string, eventType, reason, message string) {
+	metricsSource := &mrv1alpha1.MetricsSource{}
+	if err := e.Reader.Get(context.Background(), types.NamespacedName{Name: sourceName}, metricsSource); err != nil {
+		klog.V(2).Infof("not recording %s event on metrics source %s: %v", reason, sourceName, err)
+		return
+	}
+	e.event(metricsSource, eventType, reason, message)
+}
+
+// samples returns a short description of a list of metrics.
+func samples(metrics []string) string {
+	if len(metrics) <= maxSamples {
+		return strings.Join(metrics, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(metrics[:maxSamples], ", "), len(metrics)-maxSamples)
+}
+
+// pendingRemoval records an Event describing a removal of metrics which is held until it is confirmed.
+func (e *eventRecorder) pendingRemoval(metricsSource *mrv1alpha1.MetricsSource, removal registry.PendingRemoval) {
+	e.event(metricsSource, corev1.EventTypeWarning, ReasonRemovalHeld,
+		fmt.Sprintf("%d metrics out of %d not discovered anymore but still served, removal confirmed %d/%d times: %s",
+			len(removal.Removed), removal.PreviousCount, removal.Confirmations, removal.RequiredConfirmations,
+			samples(removal.Removed)))
+}
+
+// sourceChanges records the Events describing the changes of the routes after a metrics source has been updated or
+// deleted.
+func (e *eventRecorder) sourceChanges(changes registry.SourceChanges) {
+	if len(changes.AddedMetrics) > 0 {
+		e.eventByName(changes.SourceName, corev1.EventTypeNormal, ReasonMetricsAdded,
+			fmt.Sprintf("%d metrics added: %s", len(changes.AddedMetrics), samples(changes.AddedMetrics)))
+	}
+	if changes.RemovalAlert() {
+		e.eventByName(changes.SourceName, corev1.EventTypeWarning, ReasonMetricsRemoval,
+			fmt.Sprintf("%d metrics out of %d removed, more than %d%%: %s", len(changes.RemovedMetrics), changes.PreviousCount,
+				changes.RemovalAlertThreshold, samples(changes.RemovedMetrics)))
+	} else if len(changes.RemovedMetrics) > 0 {
+		e.eventByName(changes.SourceName, corev1.EventTypeNormal, ReasonMetricsRemoved,
+			fmt.Sprintf("%d metrics removed: %s", len(changes.RemovedMetrics), samples(changes.RemovedMetrics)))
+	}
+
+	// Group the route changes by source
+	type route struct{ from, to string }
+	routes := make(map[route][]string)
+	var routeKeys []route
+	for _, change := range changes.Routes {
+		key := route{from: change.From, to: change.To}
+		if _, ok := routes[key]; !ok {
+			routeKeys = append(routeKeys, key)
+		}
+		routes[key] = append(routes[key], change.Metric)
+	}
+	// A single Event per reason is recorded on a MetricsSource, the messages of the groups are joined
+	var merged eventBatch
+	for _, r := range routeKeys {
+		metrics := routes[r]
+		merged.add(r.to, corev1.EventTypeNormal, ReasonMetricsGained,
+			fmt.Sprintf("%d metrics now served by this source instead of %s: %s", len(metrics), r.from, samples(metrics)))
+		merged.add(r.from, corev1.EventTypeNormal, ReasonMetricsLost,
+			fmt.Sprintf("%d metrics now served by %s: %s", len(metrics), r.to, samples(metrics)))
+	}
+
+	// Group the conflicts by sources
+	conflicts := make(map[string][]string)
+	var conflictKeys []string
+	for _, conflict := range changes.Conflicts {
+		key := fmt.Sprintf("%s with the same priority %d, %s is used", strings.Join(conflict.Sources, ", "), conflict.Priority, conflict.Sources[0])
+		if _, ok := conflicts[key]; !ok {
+			conflictKeys = append(conflictKeys, key)
+		}
+		conflicts[key] = append(conflicts[key], conflict.Metric)
+	}
+	for _, key := range conflictKeys {
+		metrics := conflicts[key]
+		merged.add(changes.SourceName, corev1.EventTypeWarning, ReasonPriorityConflict,
+			fmt.Sprintf("%d metrics served by %s: %s", len(metrics), key, samples(metrics)))
+	}
+	for _, event := range merged.events {
+		e.eventByName(event.key.sourceName, event.eventType, event.key.reason, strings.Join(event.messages, "; "))
+	}
+}
+
+// eventBatch merges the Events with the same reason on a MetricsSource.
+type eventBatch struct {
+	events []*batchedEvent
+}
+
+type batchedEvent struct {
+	key       eventKey
+	eventType string
+	messages  []string
+}
+
+func (b *eventBatch) add(sourceName, eventType, reason, message string) {
+	key := eventKey{sourceName: sourceName, reason: reason}
+	for _, event := range b.events {
+		if event.key == key {
+			event.messages = append(event.messages, message)
+			return
+		}
+	}
+	b.events = append(b.events, &batchedEvent{key: key, eventType: eventType, messages: []string{message}})
+}
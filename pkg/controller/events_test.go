@@ -0,0 +1,141 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/registry"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	mrv1alpha1 "github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+)
+
+func recordedEvents(recorder *record.FakeRecorder) []string {
+	var events []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+func TestEventRecorder_sourceChanges(t *testing.T) {
+	scheme := runtime.NewScheme()
+	assert.NoError(t, mrv1alpha1.AddToScheme(scheme))
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+		&mrv1alpha1.MetricsSource{ObjectMeta: metav1.ObjectMeta{Name: "source1"}},
+		&mrv1alpha1.MetricsSource{ObjectMeta: metav1.ObjectMeta{Name: "source2"}},
+	).Build()
+	fakeRecorder := record.NewFakeRecorder(100)
+	recorder := newEventRecorder(fakeRecorder, c)
+	now := time.Now()
+	recorder.now = func() time.Time { return now }
+	var timers []func()
+	recorder.afterFunc = func(_ time.Duration, f func()) { timers = append(timers, f) }
+
+	changes := registry.SourceChanges{
+		SourceName:   "source1",
+		AddedMetrics: []string{"m1", "m2", "m3", "m4", "m5", "m6", "m7"},
+		Routes: []registry.RouteChange{
+			{Metric: "m1", From: "source2", To: "source1"},
+			{Metric: "m2", From: "source2", To: "source1"},
+			// Deleted source
+			{Metric: "m3", From: "source3", To: "source1"},
+		},
+		Conflicts: []registry.PriorityConflict{
+			{Metric: "m4", Priority: 5, Sources: []string{"source1", "source2"}},
+			{Metric: "m5", Priority: 5, Sources: []string{"source1", "source2"}},
+		},
+	}
+	recorder.sourceChanges(changes)
+	assert.Equal(t, []string{
+		"Normal MetricsAdded 7 metrics added: m1, m2, m3, m4, m5 and 2 more",
+		"Normal MetricsGained 2 metrics now served by this source instead of source2: m1, m2; 1 metrics now served by this source instead of source3: m3",
+		"Normal MetricsLost 2 metrics now served by source1: m1, m2",
+		"Warning PriorityConflict 2 metrics served by source1, source2 with the same priority 5, source1 is used: m4, m5",
+	}, recordedEvents(fakeRecorder))
+
+	// Same reasons on the next resyncs, with other counts and samples: only the latest Events are kept
+	now = now.Add(5 * time.Minute)
+	recorder.sourceChanges(changes)
+	recorder.sourceChanges(registry.SourceChanges{SourceName: "source1", AddedMetrics: []string{"m8"}})
+	assert.Empty(t, recordedEvents(fakeRecorder))
+	assert.Len(t, timers, 4)
+
+	// Another change
+	recorder.sourceChanges(registry.SourceChanges{SourceName: "source1", RemovedMetrics: []string{"m7"}})
+	assert.Equal(t, []string{"Normal MetricsRemoved 1 metrics removed: m7"}, recordedEvents(fakeRecorder))
+
+	// Most of the metrics are removed
+	recorder.sourceChanges(registry.SourceChanges{
+		SourceName:            "source1",
+		RemovedMetrics:        []string{"m1", "m2", "m3", "m4"},
+		PreviousCount:         6,
+		RemovalAlertThreshold: 50,
+	})
+	assert.Equal(t, []string{"Warning MassMetricsRemoval 4 metrics out of 6 removed, more than 50%: m1, m2, m3, m4"}, recordedEvents(fakeRecorder))
+
+	// The latest Events kept are recorded once the interval has elapsed
+	now = now.Add(eventsInterval)
+	for _, timer := range timers {
+		timer()
+	}
+	assert.Equal(t, []string{
+		"Normal MetricsAdded 1 metrics added: m8",
+		"Normal MetricsGained 2 metrics now served by this source instead of source2: m1, m2; 1 metrics now served by this source instead of source3: m3",
+		"Normal MetricsLost 2 metrics now served by source1: m1, m2",
+		"Warning PriorityConflict 2 metrics served by source1, source2 with the same priority 5, source1 is used: m4, m5",
+	}, recordedEvents(fakeRecorder))
+
+	// Events are recorded again once the interval has elapsed
+	now = now.Add(eventsInterval)
+	recorder.sourceChanges(registry.SourceChanges{SourceName: "source1", Conflicts: changes.Conflicts})
+	assert.Len(t, recordedEvents(fakeRecorder), 1)
+}
+
+func TestEventRecorder_pendingRemoval(t *testing.T) {
+	source := &mrv1alpha1.MetricsSource{ObjectMeta: metav1.ObjectMeta{Name: "source1"}}
+	fakeRecorder := record.NewFakeRecorder(100)
+	recorder := newEventRecorder(fakeRecorder, fake.NewClientBuilder().Build())
+	removal := registry.PendingRemoval{
+		Removed:               []string{"m1", "m2"},
+		PreviousCount:         2,
+		Confirmations:         1,
+		RequiredConfirmations: 3,
+	}
+	var timers []func()
+	recorder.afterFunc = func(_ time.Duration, f func()) { timers = append(timers, f) }
+	recorder.pendingRemoval(source, removal)
+	// The next confirmations are only recorded once the interval has elapsed, the latest one is kept
+	removal.Confirmations++
+	recorder.pendingRemoval(source, removal)
+	removal.Confirmations++
+	recorder.pendingRemoval(source, removal)
+	assert.Equal(t, []string{
+		"Warning MetricsRemovalHeld 2 metrics out of 2 not discovered anymore but still served, removal confirmed 1/3 times: m1, m2",
+	}, recordedEvents(fakeRecorder))
+	assert.Len(t, timers, 1)
+}
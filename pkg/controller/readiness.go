@@ -0,0 +1,113 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	mrv1alpha1 "github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+)
+
+// ReadinessOptions configures the readiness check of the router.
+type ReadinessOptions struct {
+	// Timeout is the time after which the router is reported ready, even if some metrics sources have not been
+	// discovered yet. Zero means no timeout.
+	Timeout time.Duration
+	// RequireSync requires the discovery of the metrics sources to succeed, not only to have been attempted.
+	RequireSync bool
+}
+
+// initialSyncChecker reports the router as not ready until the initial routing table is built, that is until a
+// discovery has been attempted for every metrics source. Once ready, the router never goes back to not ready.
+type initialSyncChecker struct {
+	client.Reader
+	ReadinessOptions
+
+	start time.Time
+	now   func() time.Time
+
+	lock sync.Mutex
+	// attempts holds the result of the last discovery of each metrics source, true if it succeeded.
+	attempts map[string]bool
+	ready    bool
+}
+
+func newInitialSyncChecker(reader client.Reader, options ReadinessOptions) *initialSyncChecker {
+	return &initialSyncChecker{
+		Reader:           reader,
+		ReadinessOptions: options,
+		start:            time.Now(),
+		now:              time.Now,
+		attempts:         make(map[string]bool),
+	}
+}
+
+// discovered records the result of a discovery of a metrics source.
+func (c *initialSyncChecker) discovered(sourceName string, synced bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.attempts[sourceName] = synced
+}
+
+// Check implements healthz.Checker.
+func (c *initialSyncChecker) Check(req *http.Request) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.ready {
+		return nil
+	}
+	err := c.pending(req.Context())
+	if err == nil {
+		klog.Info("initial routing table is synced")
+		c.ready = true
+		return nil
+	}
+	if c.Timeout > 0 && c.now().Sub(c.start) > c.Timeout {
+		klog.Warningf("routing table is not synced after %s, reporting ready: %v", c.Timeout, err)
+		c.ready = true
+		return nil
+	}
+	return err
+}
+
+// pending returns an error if a metrics source has not been discovered yet. Must be called with the lock held.
+func (c *initialSyncChecker) pending(ctx context.Context) error {
+	metricsSources := &mrv1alpha1.MetricsSourceList{}
+	if err := c.Reader.List(ctx, metricsSources); err != nil {
+		return fmt.Errorf("failed to list metrics sources: %w", err)
+	}
+	for _, metricsSource := range metricsSources.Items {
+		if metricsSource.IsMarkedForDeletion() {
+			continue
+		}
+		synced, attempted := c.attempts[metricsSource.Name]
+		if !attempted {
+			return fmt.Errorf("metrics source %s has not been discovered yet", metricsSource.Name)
+		}
+		if c.RequireSync && !synced {
+			return fmt.Errorf("metrics source %s is not synced", metricsSource.Name)
+		}
+	}
+	return nil
+}
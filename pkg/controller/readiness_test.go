@@ -0,0 +1,110 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	mrv1alpha1 "github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+)
+
+func TestInitialSyncChecker(t *testing.T) {
+	now := metav1.Now()
+	metricsSources := []client.Object{
+		&mrv1alpha1.MetricsSource{ObjectMeta: metav1.ObjectMeta{Name: "source1"}},
+		&mrv1alpha1.MetricsSource{ObjectMeta: metav1.ObjectMeta{Name: "source2"}},
+		&mrv1alpha1.MetricsSource{ObjectMeta: metav1.ObjectMeta{Name: "deleted", DeletionTimestamp: &now, Finalizers: []string{"test"}}},
+	}
+	tests := []struct {
+		name      string
+		options   ReadinessOptions
+		attempts  map[string]bool
+		elapsed   time.Duration
+		wantReady bool
+	}{
+		{
+			name:      "no discovery attempted",
+			wantReady: false,
+		},
+		{
+			name:      "some metrics sources not discovered",
+			attempts:  map[string]bool{"source1": true},
+			wantReady: false,
+		},
+		{
+			name:      "all metrics sources discovered",
+			attempts:  map[string]bool{"source1": true, "source2": false},
+			wantReady: true,
+		},
+		{
+			name:      "sync required",
+			options:   ReadinessOptions{RequireSync: true},
+			attempts:  map[string]bool{"source1": true, "source2": false},
+			wantReady: false,
+		},
+		{
+			name:      "all metrics sources synced",
+			options:   ReadinessOptions{RequireSync: true},
+			attempts:  map[string]bool{"source1": true, "source2": true},
+			wantReady: true,
+		},
+		{
+			name:      "timeout not expired",
+			options:   ReadinessOptions{Timeout: time.Minute},
+			attempts:  map[string]bool{"source1": true},
+			elapsed:   30 * time.Second,
+			wantReady: false,
+		},
+		{
+			name:      "timeout expired",
+			options:   ReadinessOptions{Timeout: time.Minute},
+			attempts:  map[string]bool{"source1": true},
+			elapsed:   2 * time.Minute,
+			wantReady: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme := runtime.NewScheme()
+			assert.NoError(t, mrv1alpha1.AddToScheme(scheme))
+			c := newInitialSyncChecker(fake.NewClientBuilder().WithScheme(scheme).WithObjects(metricsSources...).Build(), tt.options)
+			c.now = func() time.Time { return c.start.Add(tt.elapsed) }
+			for name, synced := range tt.attempts {
+				c.discovered(name, synced)
+			}
+			req, err := http.NewRequest(http.MethodGet, "/readyz", nil)
+			assert.NoError(t, err)
+			err = c.Check(req)
+			assert.Equal(t, tt.wantReady, err == nil, "unexpected readiness: %v", err)
+
+			if tt.wantReady {
+				// The router stays ready once the initial routing table is synced
+				c.discovered("source1", false)
+				c.RequireSync = true
+				assert.NoError(t, c.Check(req))
+			}
+		})
+	}
+}
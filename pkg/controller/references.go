@@ -0,0 +1,102 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	mrv1alpha1 "github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+)
+
+// apiServiceGVK is the kind of the APIService objects. They are read as unstructured objects, only the service they
+// reference is used.
+var apiServiceGVK = schema.GroupVersionKind{Group: "apiregistration.k8s.io", Version: "v1", Kind: "APIService"}
+
+func newAPIService() *unstructured.Unstructured {
+	apiService := &unstructured.Unstructured{}
+	apiService.SetGroupVersionKind(apiServiceGVK)
+	return apiService
+}
+
+//+kubebuilder:rbac:groups=apiregistration.k8s.io,resources=apiservices,verbs=get;list;watch
+
+// serviceIndex indexes the MetricsSources by the service, in the form namespace/name, they read their metrics from.
+const serviceIndex = "spec.service"
+
+// indexService returns the service referenced by a MetricsSource, if any.
+func indexService(o client.Object) []string {
+	metricsSource, ok := o.(*mrv1alpha1.MetricsSource)
+	if !ok || !metricsSource.Spec.HasServiceBackend() {
+		return nil
+	}
+	return []string{metricsSource.Spec.MetricsServiceBackend.NamespacedName().String()}
+}
+
+// metricsSourcesForService returns the MetricsSources which read their metrics from a service.
+func (r *MetricsSourceReconciler) metricsSourcesForService(service types.NamespacedName) []reconcile.Request {
+	metricsSources := &mrv1alpha1.MetricsSourceList{}
+	if err := r.Client.List(context.Background(), metricsSources, client.MatchingFields{serviceIndex: service.String()}); err != nil {
+		klog.Errorf("failed to list metrics sources referencing service %s: %v", service, err)
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, metricsSource := range metricsSources.Items {
+		// Only the cache of the manager maintains the index, the reference is checked again for the other clients.
+		if !metricsSource.Spec.HasServiceBackend() || metricsSource.Spec.MetricsServiceBackend.NamespacedName() != service {
+			continue
+		}
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: metricsSource.Name}})
+	}
+	return requests
+}
+
+// mapService maps a Service to the MetricsSources which reference it. The endpoints of the Service are synced when the
+// MetricsSources are reconciled.
+func (r *MetricsSourceReconciler) mapService(o client.Object) []reconcile.Request {
+	return r.metricsSourcesForService(types.NamespacedName{Namespace: o.GetNamespace(), Name: o.GetName()})
+}
+
+// mapEndpointSlice maps an EndpointSlice to the MetricsSources which reference its service.
+func (r *MetricsSourceReconciler) mapEndpointSlice(o client.Object) []reconcile.Request {
+	serviceName, ok := o.GetLabels()[discoveryv1.LabelServiceName]
+	if !ok {
+		return nil
+	}
+	return r.metricsSourcesForService(types.NamespacedName{Namespace: o.GetNamespace(), Name: serviceName})
+}
+
+// mapAPIService maps an APIService to the MetricsSources which reference the service of the APIService.
+func (r *MetricsSourceReconciler) mapAPIService(o client.Object) []reconcile.Request {
+	apiService, ok := o.(*unstructured.Unstructured)
+	if !ok {
+		return nil
+	}
+	service := apiServiceBackend(apiService)
+	if service.Name == "" {
+		// Local APIService, served by the K8S API server
+		return nil
+	}
+	return r.metricsSourcesForService(service)
+}
@@ -0,0 +1,141 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	mrv1alpha1 "github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+)
+
+func TestMetricsSourceReconciler_mapReferences(t *testing.T) {
+	metricsSources := []client.Object{
+		&mrv1alpha1.MetricsSource{
+			ObjectMeta: metav1.ObjectMeta{Name: "prometheus-adapter"},
+			Spec: mrv1alpha1.MetricsSourceSpec{
+				MetricsServiceBackend: mrv1alpha1.MetricsServiceBackend{Namespace: "monitoring", Name: "prometheus-adapter"},
+			},
+		},
+		&mrv1alpha1.MetricsSource{
+			ObjectMeta: metav1.ObjectMeta{Name: "prometheus-adapter-fallback"},
+			Spec: mrv1alpha1.MetricsSourceSpec{
+				MetricsServiceBackend: mrv1alpha1.MetricsServiceBackend{Namespace: "monitoring", Name: "prometheus-adapter"},
+				Priority:              -1,
+			},
+		},
+		&mrv1alpha1.MetricsSource{
+			ObjectMeta: metav1.ObjectMeta{Name: "webhook"},
+			Spec: mrv1alpha1.MetricsSourceSpec{
+				// The service is ignored
+				MetricsServiceBackend: mrv1alpha1.MetricsServiceBackend{Namespace: "monitoring", Name: "prometheus-adapter"},
+				Webhook:               &mrv1alpha1.WebhookBackend{URL: "https://webhook.example.com"},
+			},
+		},
+		&mrv1alpha1.MetricsSource{
+			ObjectMeta: metav1.ObjectMeta{Name: "keda"},
+			Spec: mrv1alpha1.MetricsSourceSpec{
+				MetricsServiceBackend: mrv1alpha1.MetricsServiceBackend{Namespace: "keda", Name: "keda-metrics-apiserver"},
+			},
+		},
+	}
+	scheme := runtime.NewScheme()
+	assert.NoError(t, mrv1alpha1.AddToScheme(scheme))
+	r := &MetricsSourceReconciler{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(metricsSources...).Build()}
+
+	apiService := func(service map[string]interface{}) client.Object {
+		apiService := newAPIService()
+		apiService.SetName("v1beta1.custom.metrics.k8s.io")
+		if service != nil {
+			apiService.Object["spec"] = map[string]interface{}{"service": service}
+		}
+		return apiService
+	}
+	prometheusAdapter := []reconcile.Request{
+		{NamespacedName: types.NamespacedName{Name: "prometheus-adapter"}},
+		{NamespacedName: types.NamespacedName{Name: "prometheus-adapter-fallback"}},
+	}
+	tests := []struct {
+		name   string
+		mapper func(client.Object) []reconcile.Request
+		object client.Object
+		want   []reconcile.Request
+	}{
+		{
+			name:   "service",
+			mapper: r.mapService,
+			object: &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "monitoring", Name: "prometheus-adapter"}},
+			want:   prometheusAdapter,
+		},
+		{
+			name:   "unrelated service",
+			mapper: r.mapService,
+			object: &corev1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "prometheus-adapter"}},
+		},
+		{
+			name:   "endpoint slice",
+			mapper: r.mapEndpointSlice,
+			object: &discoveryv1.EndpointSlice{ObjectMeta: metav1.ObjectMeta{
+				Namespace: "keda",
+				Name:      "keda-metrics-apiserver-x7k2p",
+				Labels:    map[string]string{discoveryv1.LabelServiceName: "keda-metrics-apiserver"},
+			}},
+			want: []reconcile.Request{{NamespacedName: types.NamespacedName{Name: "keda"}}},
+		},
+		{
+			name:   "endpoint slice without service",
+			mapper: r.mapEndpointSlice,
+			object: &discoveryv1.EndpointSlice{ObjectMeta: metav1.ObjectMeta{Namespace: "keda", Name: "keda-metrics-apiserver-x7k2p"}},
+		},
+		{
+			name:   "APIService",
+			mapper: r.mapAPIService,
+			object: apiService(map[string]interface{}{"namespace": "monitoring", "name": "prometheus-adapter"}),
+			want:   prometheusAdapter,
+		},
+		{
+			name:   "local APIService",
+			mapper: r.mapAPIService,
+			object: apiService(nil),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ElementsMatch(t, tt.want, tt.mapper(tt.object))
+		})
+	}
+}
+
+func TestIndexService(t *testing.T) {
+	service := mrv1alpha1.MetricsServiceBackend{Namespace: "monitoring", Name: "prometheus-adapter"}
+	assert.Equal(t, []string{"monitoring/prometheus-adapter"}, indexService(&mrv1alpha1.MetricsSource{
+		Spec: mrv1alpha1.MetricsSourceSpec{MetricsServiceBackend: service},
+	}))
+	// The service of a MetricsSource with another backend is not indexed
+	assert.Empty(t, indexService(&mrv1alpha1.MetricsSource{
+		Spec: mrv1alpha1.MetricsSourceSpec{MetricsServiceBackend: service, Webhook: &mrv1alpha1.WebhookBackend{URL: "https://webhook.example.com"}},
+	}))
+}
@@ -0,0 +1,176 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package metrics holds the Prometheus metrics of the router. They are registered in the controller-runtime
+// registry and exposed on the address set with --metrics-bind-address.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const namespace = "metrics_router"
+
+var (
+	// CircuitBreakerState is the state of the circuit breaker of each metrics source.
+	CircuitBreakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "circuit_breaker",
+			Name:      "state",
+			Help:      "State of the circuit breaker of a metrics source: 0 is closed, 1 is open, 2 is half-open.",
+		},
+		[]string{"source"},
+	)
+
+	// CacheRequests is the number of requests served by the value cache of each metrics source, by result: hit, miss
+	// or stale. A stale value is an expired value served because the metrics backend failed.
+	CacheRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "value_cache",
+			Name:      "requests_total",
+			Help:      "Number of requests to the value cache of a metrics source, by result: hit, miss or stale.",
+		},
+		[]string{"source", "result"},
+	)
+
+	// CoalescerRequests is the number of requests for metric values received by the router, by metric type. Requests
+	// which have shared the backend call of an identical concurrent request are counted with coalesced="true".
+	CoalescerRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "coalescer",
+			Name:      "requests_total",
+			Help:      "Number of requests for metric values, coalesced is true if the request has shared the backend call of an identical concurrent request.",
+		},
+		[]string{"metric_type", "coalesced"},
+	)
+
+	// Requests is the number of requests for metric values routed to each metrics source, by API (custom or external),
+	// operation and status code. Requests for metrics which are not served by any metrics source are counted with an
+	// empty source.
+	Requests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "requests_total",
+			Help:      "Number of requests for metric values routed to a metrics source, by API, operation and status code.",
+		},
+		[]string{"source", "api", "operation", "code"},
+	)
+
+	// RequestDuration is the time taken to serve the requests routed to each metrics source, including the time spent
+	// in the cache, in the rate limiters and in the circuit breaker.
+	RequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "request_duration_seconds",
+			Help:      "Time taken to serve the requests for metric values routed to a metrics source, by API, operation and status code.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"source", "api", "operation", "code"},
+	)
+
+	// DiscoveryDuration is the time taken to discover the metrics served by each metrics source, by result: success or
+	// error.
+	DiscoveryDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "discovery",
+			Name:      "duration_seconds",
+			Help:      "Time taken to discover the metrics served by a metrics source, by result: success or error.",
+			Buckets:   prometheus.DefBuckets,
+		},
+		[]string{"source", "result"},
+	)
+
+	// SourceMetrics is the number of metrics served by each metrics source, by API.
+	SourceMetrics = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "source",
+			Name:      "metrics",
+			Help:      "Number of metrics served by a metrics source, by API.",
+		},
+		[]string{"source", "api"},
+	)
+
+	// RoutedMetrics is the number of metrics served by at least one metrics source, by API.
+	RoutedMetrics = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "routed_metrics",
+			Help:      "Number of metrics served by at least one metrics source, by API.",
+		},
+		[]string{"api"},
+	)
+)
+
+// APIs of the metrics.
+const (
+	CustomMetricsAPI   = "custom"
+	ExternalMetricsAPI = "external"
+)
+
+// Operations of the requests for metric values.
+const (
+	GetByName     = "get_by_name"
+	GetBySelector = "get_by_selector"
+	Get           = "get"
+)
+
+// Results of the discoveries.
+const (
+	DiscoverySuccess = "success"
+	DiscoveryError   = "error"
+)
+
+// Results of the requests to the value cache.
+const (
+	CacheHit   = "hit"
+	CacheMiss  = "miss"
+	CacheStale = "stale"
+)
+
+// Code returns the status code of the response to a request which has returned err. Requests cancelled by the client
+// are reported with the non-standard 499 code.
+func Code(err error) string {
+	if err == nil {
+		return strconv.Itoa(http.StatusOK)
+	}
+	if errors.Is(err, context.Canceled) {
+		return "499"
+	}
+	var status apierrors.APIStatus
+	if errors.As(err, &status) && status.Status().Code != 0 {
+		return strconv.Itoa(int(status.Status().Code))
+	}
+	return strconv.Itoa(http.StatusInternalServerError)
+}
+
+func init() {
+	metrics.Registry.MustRegister(
+		CircuitBreakerState, CacheRequests, CoalescerRequests,
+		Requests, RequestDuration, DiscoveryDuration, SourceMetrics, RoutedMetrics,
+	)
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/accesslog"
+	"github.com/barkbay/custom-metrics-router/pkg/metrics"
+	"github.com/barkbay/custom-metrics-router/pkg/registry"
+	"github.com/barkbay/custom-metrics-router/pkg/tracing"
+	"go.opentelemetry.io/otel/trace"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	customMetricType   = "custom"
+	externalMetricType = "external"
+)
+
+// metricType returns the type of the metric requested, used as a label of the coalescer metrics.
+func metricType(key registry.RequestKey) string {
+	if key.ExternalMetric != "" {
+		return externalMetricType
+	}
+	return customMetricType
+}
+
+// call is a backend call shared by identical concurrent requests.
+type call struct {
+	done  chan struct{}
+	value runtime.Object
+	err   error
+	// waiters is the number of requests waiting for the result.
+	waiters int
+	cancel  context.CancelFunc
+	// entry is the access log entry of the request which started the call, it is completed by the registry.
+	entry *accesslog.Entry
+}
+
+// coalescer deduplicates identical concurrent requests: only one backend call is in flight for a given request, its
+// result is shared by all the requests received while it is in flight.
+type coalescer struct {
+	lock  sync.Mutex
+	calls map[registry.RequestKey]*call
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{calls: make(map[registry.RequestKey]*call)}
+}
+
+// do calls f, unless an identical call is already in flight. The context given to f is not cancelled with the context
+// of the request which started the call, but once all the requests waiting for the result are gone. It has the deadline
+// of the request which started the call, if any, so that the backend call does not outlive the API server timeout.
+func (c *coalescer) do(ctx context.Context, key registry.RequestKey, f func(ctx context.Context) (runtime.Object, error)) (runtime.Object, error) {
+	c.lock.Lock()
+	cl, coalesced := c.calls[key]
+	if coalesced {
+		cl.waiters++
+	} else {
+		var callCtx context.Context
+		var cancel context.CancelFunc
+		if deadline, ok := ctx.Deadline(); ok {
+			callCtx, cancel = context.WithDeadline(detachedContext{ctx}, deadline)
+		} else {
+			callCtx, cancel = context.WithCancel(detachedContext{ctx})
+		}
+		cl = &call{done: make(chan struct{}), waiters: 1, cancel: cancel, entry: accesslog.FromContext(ctx)}
+		c.calls[key] = cl
+		go func() {
+			defer cancel()
+			cl.value, cl.err = f(callCtx)
+			c.lock.Lock()
+			if c.calls[key] == cl {
+				delete(c.calls, key)
+			}
+			c.lock.Unlock()
+			close(cl.done)
+		}()
+	}
+	c.lock.Unlock()
+	metrics.CoalescerRequests.WithLabelValues(metricType(key), strconv.FormatBool(coalesced)).Inc()
+	// The backend call of a coalesced request is traced in the trace of the request which started it.
+	trace.SpanFromContext(ctx).SetAttributes(tracing.CoalescedKey.Bool(coalesced))
+
+	select {
+	case <-cl.done:
+		if coalesced {
+			accesslog.FromContext(ctx).CoalescedWith(cl.entry)
+		}
+		if coalesced && cl.err == nil {
+			// The value is owned by the request which started the call.
+			return cl.value.DeepCopyObject(), cl.err
+		}
+		return cl.value, cl.err
+	case <-ctx.Done():
+		c.lock.Lock()
+		cl.waiters--
+		if cl.waiters == 0 {
+			// Nobody is waiting for the result anymore.
+			cl.cancel()
+			if c.calls[key] == cl {
+				delete(c.calls, key)
+			}
+		}
+		c.lock.Unlock()
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, apierrors.NewTimeoutError("timed out while waiting for the metrics backend", 0)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// detachedContext holds the values of a request context, but it is not cancelled with it.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
@@ -0,0 +1,182 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package provider
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/metrics"
+	"github.com/barkbay/custom-metrics-router/pkg/registry"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// fakeBackend blocks the calls until release is closed, it counts the calls and records their contexts.
+type fakeBackend struct {
+	calls   int32
+	release chan struct{}
+	ctxs    chan context.Context
+	err     error
+}
+
+func newFakeBackend() *fakeBackend {
+	return &fakeBackend{release: make(chan struct{}), ctxs: make(chan context.Context, 10)}
+}
+
+func (f *fakeBackend) call(ctx context.Context) (runtime.Object, error) {
+	atomic.AddInt32(&f.calls, 1)
+	f.ctxs <- ctx
+	select {
+	case <-f.release:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &external_metrics.ExternalMetricValueList{Items: []external_metrics.ExternalMetricValue{{MetricName: "queue"}}}, nil
+}
+
+// waiters returns the number of requests waiting for the result of the call of the given request.
+func (c *coalescer) waiters(key registry.RequestKey) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if cl, ok := c.calls[key]; ok {
+		return cl.waiters
+	}
+	return 0
+}
+
+var queueKey = registry.ExternalMetricKey("queue", "ns", labels.Everything())
+
+func Test_coalescer_sharedCall(t *testing.T) {
+	tests := []struct {
+		name       string
+		backendErr error
+	}{
+		{name: "value is shared"},
+		{name: "error is shared", backendErr: errors.New("backend failure")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newCoalescer()
+			backend := newFakeBackend()
+			backend.err = tt.backendErr
+			coalesced := testutil.ToFloat64(metrics.CoalescerRequests.WithLabelValues(externalMetricType, "true"))
+
+			var wg sync.WaitGroup
+			results := make([]runtime.Object, 5)
+			errs := make([]error, 5)
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					results[i], errs[i] = c.do(context.Background(), queueKey, backend.call)
+				}(i)
+			}
+			assert.Eventually(t, func() bool { return c.waiters(queueKey) == 5 }, 5*time.Second, time.Millisecond)
+			// Another request is not coalesced
+			otherKey := queueKey
+			otherKey.Namespace = "other-ns"
+			go func() { _, _ = c.do(context.Background(), otherKey, backend.call) }()
+			assert.Eventually(t, func() bool { return atomic.LoadInt32(&backend.calls) == 2 }, 5*time.Second, time.Millisecond)
+
+			close(backend.release)
+			wg.Wait()
+			for i := range results {
+				if tt.backendErr != nil {
+					assert.Equal(t, tt.backendErr, errs[i])
+					continue
+				}
+				assert.NoError(t, errs[i])
+				assert.Equal(t, "queue", results[i].(*external_metrics.ExternalMetricValueList).Items[0].MetricName)
+				// Each request gets its own copy
+				for j := 0; j < i; j++ {
+					assert.NotSame(t, results[i], results[j])
+				}
+			}
+			assert.Equal(t, float64(4), testutil.ToFloat64(metrics.CoalescerRequests.WithLabelValues(externalMetricType, "true"))-coalesced)
+
+			// The call is not shared once completed
+			_, _ = c.do(context.Background(), queueKey, backend.call)
+			assert.Equal(t, int32(3), atomic.LoadInt32(&backend.calls))
+		})
+	}
+}
+
+func Test_coalescer_cancellation(t *testing.T) {
+	c := newCoalescer()
+	backend := newFakeBackend()
+
+	// The first request is cancelled, the call is not cancelled while another request is waiting
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	result1 := make(chan error)
+	go func() {
+		_, err := c.do(ctx1, queueKey, backend.call)
+		result1 <- err
+	}()
+	callCtx := <-backend.ctxs
+	ctx2, cancel2 := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel2()
+	result2 := make(chan error)
+	go func() {
+		_, err := c.do(ctx2, queueKey, backend.call)
+		result2 <- err
+	}()
+	assert.Eventually(t, func() bool { return c.waiters(queueKey) == 2 }, 5*time.Second, time.Millisecond)
+
+	cancel1()
+	assert.Equal(t, context.Canceled, <-result1)
+	assert.NoError(t, callCtx.Err())
+
+	// The last request times out, the call is cancelled
+	err := <-result2
+	assert.True(t, apierrors.IsTimeout(err), "Timeout expected, got %v", err)
+	assert.Eventually(t, func() bool { return callCtx.Err() != nil }, 5*time.Second, time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&backend.calls))
+}
+
+func Test_coalescer_deadline(t *testing.T) {
+	c := newCoalescer()
+	backend := newFakeBackend()
+	close(backend.release)
+
+	// The backend call has the deadline of the request which started it
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := c.do(ctx, queueKey, backend.call)
+	assert.NoError(t, err)
+	wantDeadline, _ := ctx.Deadline()
+	deadline, ok := (<-backend.ctxs).Deadline()
+	assert.True(t, ok)
+	assert.Equal(t, wantDeadline, deadline)
+
+	// Requests without a deadline
+	_, err = c.do(context.Background(), queueKey, backend.call)
+	assert.NoError(t, err)
+	_, ok = (<-backend.ctxs).Deadline()
+	assert.False(t, ok)
+}
@@ -17,57 +17,151 @@ limitations under the License.
 package provider
 
 import (
-	"fmt"
+	"context"
 
+	"github.com/barkbay/custom-metrics-router/pkg/accesslog"
+	"github.com/barkbay/custom-metrics-router/pkg/metrics"
 	"github.com/barkbay/custom-metrics-router/pkg/registry"
+	"github.com/barkbay/custom-metrics-router/pkg/tracing"
 	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/metrics/pkg/apis/custom_metrics"
 	"k8s.io/metrics/pkg/apis/external_metrics"
 )
 
+// CustomMetricsProvider is a context aware version of provider.CustomMetricsProvider.
+// The context is the one of the API request, it is cancelled when the client goes away.
+type CustomMetricsProvider interface {
+	GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error)
+	GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error)
+	ListAllMetrics() []provider.CustomMetricInfo
+}
+
+// ExternalMetricsProvider is a context aware version of provider.ExternalMetricsProvider.
+type ExternalMetricsProvider interface {
+	GetExternalMetric(ctx context.Context, namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error)
+	ListAllExternalMetrics() []provider.ExternalMetricInfo
+}
+
 type FullMetricsProvider interface {
-	provider.CustomMetricsProvider
-	provider.ExternalMetricsProvider
+	CustomMetricsProvider
+	ExternalMetricsProvider
 }
 
 type routedMetricsProvider struct {
 	registry *registry.Registry
+	// coalescer shares the backend calls between identical concurrent requests.
+	coalescer *coalescer
+	// accessLog, if not nil, logs the requests.
+	accessLog *accesslog.Logger
 }
 
-func NewRoutedProvider(customMetricRoutes *registry.Registry) FullMetricsProvider {
+func NewRoutedProvider(customMetricRoutes *registry.Registry, accessLog *accesslog.Logger) FullMetricsProvider {
 	return &routedMetricsProvider{
-		registry: customMetricRoutes,
+		registry:  customMetricRoutes,
+		coalescer: newCoalescer(),
+		accessLog: accessLog,
+	}
+}
+
+// start starts the span and the access log entry of a request for metric values. The metrics source the request is
+// routed to is added by the registry. The returned function must be called with the result of the request.
+func (r routedMetricsProvider) start(ctx context.Context, spanName string, entry *accesslog.Entry) (context.Context, func(err error)) {
+	ctx, span := tracing.Tracer().Start(ctx, "MetricsProvider."+spanName, trace.WithAttributes(
+		tracing.APIKey.String(entry.API),
+		tracing.MetricKey.String(entry.Metric),
+		tracing.NamespaceKey.String(entry.Namespace),
+	))
+	ctx = r.accessLog.Start(ctx, entry)
+	return ctx, func(err error) {
+		r.accessLog.Log(entry, err)
+		tracing.End(span, err)
 	}
 }
 
-func (r routedMetricsProvider) GetMetricByName(name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
-	backend, err := r.registry.GetMetricsBackend(info)
+// notRouted records a request which has not been routed to any metrics source. The requests routed to a metrics source
+// are recorded by the registry.
+func notRouted(api, operation string, err error) error {
+	metrics.Requests.WithLabelValues("", api, operation, metrics.Code(err)).Inc()
+	return err
+}
+
+func (r routedMetricsProvider) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (_ *custom_metrics.MetricValue, err error) {
+	ctx, done := r.start(ctx, "GetMetricByName", &accesslog.Entry{
+		API:            metrics.CustomMetricsAPI,
+		Operation:      metrics.GetByName,
+		Metric:         info.String(),
+		Namespace:      name.Namespace,
+		Name:           name.Name,
+		MetricSelector: registry.SelectorString(metricSelector),
+	})
+	defer func() { done(err) }()
+	key := registry.CustomMetricByNameKey(name, info, metricSelector)
+	value, err := r.coalescer.do(ctx, key, func(ctx context.Context) (runtime.Object, error) {
+		backend, err := r.registry.GetMetricsBackend(info)
+		if err != nil {
+			return nil, notRouted(metrics.CustomMetricsAPI, metrics.GetByName, err)
+		}
+		return backend.GetMetricByName(ctx, name, info, metricSelector)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get metrics backend: %v", err)
+		return nil, err
 	}
-	return backend.GetMetricByName(name, info, metricSelector)
+	return value.(*custom_metrics.MetricValue), nil
 }
 
-func (r routedMetricsProvider) GetMetricBySelector(namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
-	backend, err := r.registry.GetMetricsBackend(info)
+func (r routedMetricsProvider) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (_ *custom_metrics.MetricValueList, err error) {
+	ctx, done := r.start(ctx, "GetMetricBySelector", &accesslog.Entry{
+		API:            metrics.CustomMetricsAPI,
+		Operation:      metrics.GetBySelector,
+		Metric:         info.String(),
+		Namespace:      namespace,
+		Selector:       registry.SelectorString(selector),
+		MetricSelector: registry.SelectorString(metricSelector),
+	})
+	defer func() { done(err) }()
+	key := registry.CustomMetricBySelectorKey(namespace, selector, info, metricSelector)
+	value, err := r.coalescer.do(ctx, key, func(ctx context.Context) (runtime.Object, error) {
+		backend, err := r.registry.GetMetricsBackend(info)
+		if err != nil {
+			return nil, notRouted(metrics.CustomMetricsAPI, metrics.GetBySelector, err)
+		}
+		return backend.GetMetricBySelector(ctx, namespace, selector, info, metricSelector)
+	})
 	if err != nil {
 		return nil, err
 	}
-	return backend.GetMetricBySelector(namespace, selector, info, metricSelector)
+	return value.(*custom_metrics.MetricValueList), nil
 }
 
 func (r routedMetricsProvider) ListAllMetrics() []provider.CustomMetricInfo {
 	return r.registry.ListAllCustomMetrics()
 }
 
-func (r routedMetricsProvider) GetExternalMetric(namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (*external_metrics.ExternalMetricValueList, error) {
-	backend, err := r.registry.GetExternalMetricsBackend(info)
+func (r routedMetricsProvider) GetExternalMetric(ctx context.Context, namespace string, metricSelector labels.Selector, info provider.ExternalMetricInfo) (_ *external_metrics.ExternalMetricValueList, err error) {
+	ctx, done := r.start(ctx, "GetExternalMetric", &accesslog.Entry{
+		API:            metrics.ExternalMetricsAPI,
+		Operation:      metrics.Get,
+		Metric:         info.Metric,
+		Namespace:      namespace,
+		MetricSelector: registry.SelectorString(metricSelector),
+	})
+	defer func() { done(err) }()
+	key := registry.ExternalMetricKey(info.Metric, namespace, metricSelector)
+	value, err := r.coalescer.do(ctx, key, func(ctx context.Context) (runtime.Object, error) {
+		backend, err := r.registry.GetExternalMetricsBackend(info)
+		if err != nil {
+			return nil, notRouted(metrics.ExternalMetricsAPI, metrics.Get, err)
+		}
+		return backend.GetExternalMetric(ctx, info.Metric, namespace, metricSelector)
+	})
 	if err != nil {
 		return nil, err
 	}
-	return backend.GetExternalMetric(info.Metric, namespace, metricSelector)
+	return value.(*external_metrics.ExternalMetricValueList), nil
 }
 
 func (r routedMetricsProvider) ListAllExternalMetrics() []provider.ExternalMetricInfo {
@@ -0,0 +1,318 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/barkbay/custom-metrics-router/pkg/metrics"
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// stateValues are the values of the circuit breaker state metric.
+var stateValues = map[v1alpha1.CircuitBreakerState]float64{
+	v1alpha1.CircuitBreakerClosed:   0,
+	v1alpha1.CircuitBreakerOpen:     1,
+	v1alpha1.CircuitBreakerHalfOpen: 2,
+}
+
+// circuitBreaker stops sending requests to a metrics backend after too many failures.
+// Once the open duration has elapsed, a single trial request is allowed: the circuit breaker is closed if it succeeds,
+// otherwise it is opened again.
+type circuitBreaker struct {
+	sourceName string
+
+	lock sync.Mutex
+
+	disabled            bool
+	maxConsecutive      int
+	maxFailureRate      int
+	minRequests         int
+	failureRateInterval time.Duration
+	openDuration        time.Duration
+
+	state v1alpha1.CircuitBreakerState
+	// consecutiveFailures, requests and failures are only tracked while the circuit breaker is closed.
+	consecutiveFailures int
+	requests, failures  int
+	intervalStart       time.Time
+	// openedAt is the last time the circuit breaker has been opened.
+	openedAt time.Time
+	// trial is true while the trial request of the half-open state is in flight.
+	trial bool
+
+	now           func() time.Time
+	onStateChange func(sourceName string, state v1alpha1.CircuitBreakerState)
+}
+
+func newCircuitBreaker(sourceName string, config *v1alpha1.CircuitBreaker) *circuitBreaker {
+	cb := &circuitBreaker{
+		sourceName: sourceName,
+		state:      v1alpha1.CircuitBreakerClosed,
+		now:        time.Now,
+	}
+	cb.configure(config)
+	cb.intervalStart = cb.now()
+	metrics.CircuitBreakerState.WithLabelValues(sourceName).Set(stateValues[cb.state])
+	return cb
+}
+
+func (cb *circuitBreaker) configure(config *v1alpha1.CircuitBreaker) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	cb.disabled = config.IsDisabled()
+	cb.maxConsecutive = config.MaxConsecutiveFailures()
+	cb.maxFailureRate = config.MaxFailureRate()
+	cb.minRequests = config.MinRequests()
+	cb.failureRateInterval = config.FailureRateInterval()
+	cb.openDuration = config.OpenStateDuration()
+	if cb.disabled && cb.state != v1alpha1.CircuitBreakerClosed {
+		cb.setState(v1alpha1.CircuitBreakerClosed)
+	}
+}
+
+// currentState returns the state of the circuit breaker. An open circuit breaker is moved to the half-open state once
+// the open duration has elapsed. Must be called with the lock held.
+func (cb *circuitBreaker) currentState() v1alpha1.CircuitBreakerState {
+	if cb.state == v1alpha1.CircuitBreakerOpen && !cb.now().Before(cb.openedAt.Add(cb.openDuration)) {
+		cb.setState(v1alpha1.CircuitBreakerHalfOpen)
+	}
+	return cb.state
+}
+
+// setState must be called with the lock held.
+func (cb *circuitBreaker) setState(state v1alpha1.CircuitBreakerState) {
+	if cb.state == state {
+		return
+	}
+	klog.Infof("circuit breaker of metrics source %s: %s -> %s", cb.sourceName, cb.state, state)
+	cb.state = state
+	cb.consecutiveFailures, cb.requests, cb.failures = 0, 0, 0
+	cb.intervalStart = cb.now()
+	cb.trial = false
+	if state == v1alpha1.CircuitBreakerOpen {
+		cb.openedAt = cb.now()
+	}
+	metrics.CircuitBreakerState.WithLabelValues(cb.sourceName).Set(stateValues[state])
+	if cb.onStateChange != nil {
+		cb.onStateChange(cb.sourceName, state)
+	}
+}
+
+// State returns the current state of the circuit breaker.
+func (cb *circuitBreaker) State() v1alpha1.CircuitBreakerState {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	return cb.currentState()
+}
+
+// available returns true if a request would be allowed by the circuit breaker.
+func (cb *circuitBreaker) available() bool {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if cb.disabled {
+		return true
+	}
+	switch cb.currentState() {
+	case v1alpha1.CircuitBreakerOpen:
+		return false
+	case v1alpha1.CircuitBreakerHalfOpen:
+		return !cb.trial
+	}
+	return true
+}
+
+// allow returns an error if the request must not be sent to the backend. Otherwise, the returned function must be
+// called with the outcome of the request.
+func (cb *circuitBreaker) allow() (func(err error), error) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if cb.disabled {
+		return func(error) {}, nil
+	}
+	switch cb.currentState() {
+	case v1alpha1.CircuitBreakerOpen:
+		return nil, cb.openError()
+	case v1alpha1.CircuitBreakerHalfOpen:
+		if cb.trial {
+			// A trial request is already in flight
+			return nil, cb.openError()
+		}
+		cb.trial = true
+		return cb.doneTrial, nil
+	}
+	return cb.done, nil
+}
+
+func (cb *circuitBreaker) openError() error {
+	return sourceUnavailable(cb.sourceName, "circuit breaker is open")
+}
+
+// done records the outcome of a request sent while the circuit breaker was closed.
+func (cb *circuitBreaker) done(err error) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if cb.currentState() != v1alpha1.CircuitBreakerClosed {
+		// The circuit breaker has been opened in the meantime
+		return
+	}
+	if now := cb.now(); !now.Before(cb.intervalStart.Add(cb.failureRateInterval)) {
+		cb.requests, cb.failures = 0, 0
+		cb.intervalStart = now
+	}
+	cb.requests++
+	if !isBackendFailure(err) {
+		cb.consecutiveFailures = 0
+		return
+	}
+	cb.failures++
+	cb.consecutiveFailures++
+	if cb.consecutiveFailures >= cb.maxConsecutive {
+		klog.Warningf("metrics source %s failed %d consecutive times: %v", cb.sourceName, cb.consecutiveFailures, err)
+		cb.setState(v1alpha1.CircuitBreakerOpen)
+		return
+	}
+	if cb.maxFailureRate > 0 && cb.requests >= cb.minRequests && cb.failures*100 >= cb.maxFailureRate*cb.requests {
+		klog.Warningf("metrics source %s failed %d times out of %d requests: %v", cb.sourceName, cb.failures, cb.requests, err)
+		cb.setState(v1alpha1.CircuitBreakerOpen)
+	}
+}
+
+// doneTrial records the outcome of the trial request sent while the circuit breaker was half-open.
+func (cb *circuitBreaker) doneTrial(err error) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if cb.state != v1alpha1.CircuitBreakerHalfOpen {
+		return
+	}
+	if isBackendFailure(err) {
+		cb.setState(v1alpha1.CircuitBreakerOpen)
+		return
+	}
+	cb.setState(v1alpha1.CircuitBreakerClosed)
+}
+
+// isBackendFailure returns true if the error is a sign that the backend is not healthy.
+// Requests cancelled by the client and errors returned for invalid requests are not considered as failures.
+func isBackendFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var status apierrors.APIStatus
+	if errors.As(err, &status) {
+		code := status.Status().Code
+		return code >= http.StatusInternalServerError || code == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// circuitBreakerClient is a MetricsClient which sends the requests for metric values through a circuit breaker. The
+// discovery requests are not: they must not be rejected while the circuit breaker is open, nor use the trial request of
+// the half-open state.
+type circuitBreakerClient struct {
+	MetricsClient
+	breaker *circuitBreaker
+}
+
+var _ MetricsClient = &circuitBreakerClient{}
+
+func (c *circuitBreakerClient) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, selector labels.Selector) (*custom_metrics.MetricValue, error) {
+	done, err := c.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+	result, err := c.MetricsClient.GetMetricByName(ctx, name, info, selector)
+	done(err)
+	return result, err
+}
+
+func (c *circuitBreakerClient) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	done, err := c.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+	result, err := c.MetricsClient.GetMetricBySelector(ctx, namespace, selector, info, metricSelector)
+	done(err)
+	return result, err
+}
+
+func (c *circuitBreakerClient) GetExternalMetric(ctx context.Context, name, namespace string, selector labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
+	done, err := c.breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+	result, err := c.MetricsClient.GetExternalMetric(ctx, name, namespace, selector)
+	done(err)
+	return result, err
+}
+
+// circuitBreakers holds the circuit breakers of the metrics sources. They are indexed by the name of the metrics source
+// so their state is preserved when a metrics source is updated.
+type circuitBreakers struct {
+	lock     sync.Mutex
+	breakers map[string]*circuitBreaker
+
+	onStateChange func(sourceName string, state v1alpha1.CircuitBreakerState)
+}
+
+func newCircuitBreakers() *circuitBreakers {
+	return &circuitBreakers{breakers: make(map[string]*circuitBreaker)}
+}
+
+// get returns the circuit breaker of the given metrics source, it is created if it does not exist yet. The state of a
+// circuit breaker is preserved across the updates of the metrics source: the configuration of an existing circuit
+// breaker is not updated, configure must be called once the update of the metrics source has succeeded.
+func (c *circuitBreakers) get(sourceName string, config *v1alpha1.CircuitBreaker) *circuitBreaker {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	breaker, ok := c.breakers[sourceName]
+	if !ok {
+		breaker = newCircuitBreaker(sourceName, config)
+		breaker.onStateChange = c.onStateChange
+		c.breakers[sourceName] = breaker
+	}
+	return breaker
+}
+
+// state returns the state of the circuit breaker of the given metrics source.
+func (c *circuitBreakers) state(sourceName string) v1alpha1.CircuitBreakerState {
+	c.lock.Lock()
+	breaker, ok := c.breakers[sourceName]
+	c.lock.Unlock()
+	if !ok {
+		return v1alpha1.CircuitBreakerClosed
+	}
+	return breaker.State()
+}
+
+func (c *circuitBreakers) delete(sourceName string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	delete(c.breakers, sourceName)
+	metrics.CircuitBreakerState.DeleteLabelValues(sourceName)
+}
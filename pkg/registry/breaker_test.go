@@ -0,0 +1,211 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var errBackend = errors.New("connection refused")
+
+// newTestCircuitBreaker returns a circuit breaker and a function to advance its clock.
+func newTestCircuitBreaker(config *v1alpha1.CircuitBreaker) (*circuitBreaker, func(d time.Duration)) {
+	now := time.Now()
+	cb := newCircuitBreaker("test", config)
+	cb.now = func() time.Time { return now }
+	cb.intervalStart = now
+	return cb, func(d time.Duration) { now = now.Add(d) }
+}
+
+// send simulates a request with the given outcome, it returns the error returned by the circuit breaker if the
+// request has not been allowed.
+func send(cb *circuitBreaker, err error) error {
+	done, allowErr := cb.allow()
+	if allowErr != nil {
+		return allowErr
+	}
+	done(err)
+	return nil
+}
+
+func Test_circuitBreaker_consecutiveFailures(t *testing.T) {
+	cb, advance := newTestCircuitBreaker(&v1alpha1.CircuitBreaker{ConsecutiveFailures: int32Ptr(3)})
+	var changes []v1alpha1.CircuitBreakerState
+	cb.onStateChange = func(_ string, state v1alpha1.CircuitBreakerState) { changes = append(changes, state) }
+
+	// A success resets the consecutive failures
+	assert.NoError(t, send(cb, errBackend))
+	assert.NoError(t, send(cb, errBackend))
+	assert.NoError(t, send(cb, nil))
+	assert.NoError(t, send(cb, errBackend))
+	assert.NoError(t, send(cb, errBackend))
+	assert.Equal(t, v1alpha1.CircuitBreakerClosed, cb.State())
+	assert.NoError(t, send(cb, errBackend))
+	assert.Equal(t, v1alpha1.CircuitBreakerOpen, cb.State())
+
+	// Requests fail fast while the circuit breaker is open
+	err := send(cb, nil)
+	assert.True(t, apierrors.IsServiceUnavailable(err))
+	assert.False(t, cb.available())
+
+	// A single trial request is allowed once the open duration has elapsed
+	advance(30 * time.Second)
+	assert.True(t, cb.available())
+	done, err := cb.allow()
+	assert.NoError(t, err)
+	assert.Equal(t, v1alpha1.CircuitBreakerHalfOpen, cb.State())
+	assert.False(t, cb.available())
+	assert.Error(t, send(cb, nil))
+
+	// The trial request fails, the circuit breaker is opened again
+	done(errBackend)
+	assert.Equal(t, v1alpha1.CircuitBreakerOpen, cb.State())
+
+	// The next trial request succeeds
+	advance(30 * time.Second)
+	assert.NoError(t, send(cb, nil))
+	assert.Equal(t, v1alpha1.CircuitBreakerClosed, cb.State())
+	assert.Equal(t, []v1alpha1.CircuitBreakerState{
+		v1alpha1.CircuitBreakerOpen,
+		v1alpha1.CircuitBreakerHalfOpen,
+		v1alpha1.CircuitBreakerOpen,
+		v1alpha1.CircuitBreakerHalfOpen,
+		v1alpha1.CircuitBreakerClosed,
+	}, changes)
+}
+
+func Test_circuitBreaker_failureRate(t *testing.T) {
+	cb, advance := newTestCircuitBreaker(&v1alpha1.CircuitBreaker{
+		ConsecutiveFailures: int32Ptr(100),
+		FailureRatePercent:  int32Ptr(50),
+		MinimumRequests:     int32Ptr(10),
+		Interval:            &metav1.Duration{Duration: time.Minute},
+	})
+	// 4 failures out of 8 requests, the minimum number of requests is not reached
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, send(cb, nil))
+		assert.NoError(t, send(cb, errBackend))
+	}
+	assert.Equal(t, v1alpha1.CircuitBreakerClosed, cb.State())
+
+	// The failure rate is reset after the interval
+	advance(time.Minute)
+	for i := 0; i < 4; i++ {
+		assert.NoError(t, send(cb, nil))
+		assert.NoError(t, send(cb, errBackend))
+	}
+	assert.Equal(t, v1alpha1.CircuitBreakerClosed, cb.State())
+	assert.NoError(t, send(cb, nil))
+	assert.NoError(t, send(cb, errBackend))
+	// 5 failures out of 10 requests
+	assert.Equal(t, v1alpha1.CircuitBreakerOpen, cb.State())
+}
+
+func Test_circuitBreaker_ignoredErrors(t *testing.T) {
+	cb, _ := newTestCircuitBreaker(&v1alpha1.CircuitBreaker{ConsecutiveFailures: int32Ptr(1)})
+	// Cancelled requests and client errors are not backend failures
+	assert.NoError(t, send(cb, context.Canceled))
+	assert.NoError(t, send(cb, apierrors.NewNotFound(schema.GroupResource{Resource: "pods"}, "foo")))
+	assert.NoError(t, send(cb, apierrors.NewBadRequest("invalid selector")))
+	assert.Equal(t, v1alpha1.CircuitBreakerClosed, cb.State())
+	assert.NoError(t, send(cb, apierrors.NewInternalError(fmt.Errorf("overloaded"))))
+	assert.Equal(t, v1alpha1.CircuitBreakerOpen, cb.State())
+}
+
+func Test_circuitBreaker_disabled(t *testing.T) {
+	cb, _ := newTestCircuitBreaker(&v1alpha1.CircuitBreaker{Disabled: true, ConsecutiveFailures: int32Ptr(1)})
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, send(cb, errBackend))
+	}
+	assert.Equal(t, v1alpha1.CircuitBreakerClosed, cb.State())
+}
+
+func TestRegistry_CircuitBreakerFailover(t *testing.T) {
+	fakeRegistry := newFakeRegistry().
+		servedExternalMetrics("primary", "metric1").
+		servedExternalMetrics("secondary", "metric1")
+	for name, priority := range map[string]int{"primary": 100, "secondary": 10} {
+		_, err := fakeRegistry.registry.AddOrUpdateSource(context.Background(), v1alpha1.MetricsSource{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1alpha1.MetricsSourceSpec{
+				Priority:              priority,
+				MetricTypes:           v1alpha1.MetricTypes{v1alpha1.ExternalMetrics},
+				MetricsServiceBackend: v1alpha1.MetricsServiceBackend{Name: name},
+				CircuitBreaker:        &v1alpha1.CircuitBreaker{ConsecutiveFailures: int32Ptr(1)},
+			},
+		})
+		assert.NoError(t, err)
+	}
+	assertMetricsExpectations(t, fakeRegistry.registry, []expectation{
+		{metricType: v1alpha1.ExternalMetrics, metricName: "metric1", expectedSourceName: "primary"},
+	})
+
+	// Open the circuit breaker of the primary source
+	fakeRegistry.registry.breakers.breakers["primary"].done(errBackend)
+	assert.Equal(t, v1alpha1.CircuitBreakerOpen, fakeRegistry.registry.CircuitBreakerState("primary"))
+	assertMetricsExpectations(t, fakeRegistry.registry, []expectation{
+		{metricType: v1alpha1.ExternalMetrics, metricName: "metric1", expectedSourceName: "secondary"},
+	})
+
+	// Open the circuit breaker of the secondary source, requests to the primary source fail fast
+	fakeRegistry.registry.breakers.breakers["secondary"].done(errBackend)
+	backend, err := fakeRegistry.registry.GetExternalMetricsBackend(fakeExternalMetricList("metric1")[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "primary", backend.GetBackend().Name)
+	_, err = backend.GetExternalMetric(context.Background(), "metric1", "ns", nil)
+	assert.True(t, apierrors.IsServiceUnavailable(err))
+
+	// Discovery requests are not sent through the circuit breaker, nor change its state
+	fakeRegistry.fakeClientProvider.clients["primary"].externalMetricsErr = errBackend
+	_, err = fakeRegistry.registry.AddOrUpdateSource(context.Background(), v1alpha1.MetricsSource{
+		ObjectMeta: metav1.ObjectMeta{Name: "primary"},
+		Spec: v1alpha1.MetricsSourceSpec{
+			Priority:              100,
+			MetricTypes:           v1alpha1.MetricTypes{v1alpha1.ExternalMetrics},
+			MetricsServiceBackend: v1alpha1.MetricsServiceBackend{Name: "primary"},
+			CircuitBreaker:        &v1alpha1.CircuitBreaker{ConsecutiveFailures: int32Ptr(1)},
+		},
+	})
+	assert.Contains(t, err.Error(), errBackend.Error())
+	assert.Equal(t, v1alpha1.CircuitBreakerOpen, fakeRegistry.registry.CircuitBreakerState("primary"))
+	fakeRegistry.fakeClientProvider.clients["primary"].externalMetricsErr = nil
+	fakeRegistry.registry.breakers.breakers["primary"].openedAt = time.Time{}
+	assert.Equal(t, v1alpha1.CircuitBreakerHalfOpen, fakeRegistry.registry.CircuitBreakerState("primary"))
+	_, err = fakeRegistry.registry.AddOrUpdateSource(context.Background(), v1alpha1.MetricsSource{
+		ObjectMeta: metav1.ObjectMeta{Name: "primary"},
+		Spec: v1alpha1.MetricsSourceSpec{
+			Priority:              100,
+			MetricTypes:           v1alpha1.MetricTypes{v1alpha1.ExternalMetrics},
+			MetricsServiceBackend: v1alpha1.MetricsServiceBackend{Name: "primary"},
+			CircuitBreaker:        &v1alpha1.CircuitBreaker{ConsecutiveFailures: int32Ptr(1)},
+		},
+	})
+	assert.NoError(t, err)
+	// The trial request of the half-open state is still available
+	assert.Equal(t, v1alpha1.CircuitBreakerHalfOpen, fakeRegistry.registry.CircuitBreakerState("primary"))
+	assert.True(t, fakeRegistry.registry.breakers.breakers["primary"].available())
+}
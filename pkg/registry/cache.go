@@ -0,0 +1,236 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/accesslog"
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/barkbay/custom-metrics-router/pkg/metrics"
+	"github.com/barkbay/custom-metrics-router/pkg/tracing"
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+type cacheEntry struct {
+	key      RequestKey
+	value    runtime.Object
+	storedAt time.Time
+}
+
+// valueCache is a bounded LRU cache of the metric values returned by a metrics source.
+type valueCache struct {
+	sourceName string
+	config     v1alpha1.ValueCache
+
+	ttl        time.Duration
+	stale      time.Duration
+	maxEntries int
+	now        func() time.Time
+
+	lock    sync.Mutex
+	entries map[RequestKey]*list.Element
+	// lru holds the entries, the most recently used first.
+	lru *list.List
+}
+
+func newValueCache(sourceName string, config v1alpha1.ValueCache) *valueCache {
+	return &valueCache{
+		sourceName: sourceName,
+		config:     config,
+		ttl:        config.EntriesTTL(),
+		stale:      config.StaleDuration(),
+		maxEntries: config.MaxCacheEntries(),
+		now:        time.Now,
+		entries:    make(map[RequestKey]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// get returns a copy of a cached value. fresh is false if the value has expired but can still be served if the
+// metrics backend fails.
+func (c *valueCache) get(key RequestKey) (value runtime.Object, fresh bool, ok bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return nil, false, false
+	}
+	entry := element.Value.(*cacheEntry)
+	age := c.now().Sub(entry.storedAt)
+	if age >= c.ttl+c.stale {
+		c.lru.Remove(element)
+		delete(c.entries, key)
+		return nil, false, false
+	}
+	c.lru.MoveToFront(element)
+	return entry.value.DeepCopyObject(), age < c.ttl, true
+}
+
+// add stores a copy of a value, the least recently used value is evicted if the cache is full.
+func (c *valueCache) add(key RequestKey, value runtime.Object) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	entry := &cacheEntry{key: key, value: value.DeepCopyObject(), storedAt: c.now()}
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *valueCache) len() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.lru.Len()
+}
+
+// fetch returns the cached value if it has not expired, otherwise the value is requested to the metrics backend with
+// f. An expired value is returned if the metrics backend fails, until the stale duration has elapsed.
+func (c *valueCache) fetch(ctx context.Context, metricName string, key RequestKey, f func() (runtime.Object, error)) (runtime.Object, error) {
+	cached, fresh, ok := c.get(key)
+	if ok && fresh {
+		c.record(ctx, metricName, metrics.CacheHit)
+		return cached, nil
+	}
+	value, err := f()
+	if err != nil {
+		if ok && isBackendFailure(err) {
+			klog.V(2).Infof("metrics source %s: serving stale value of %s: %v", c.sourceName, metricName, err)
+			c.record(ctx, metricName, metrics.CacheStale)
+			return cached, nil
+		}
+		c.record(ctx, metricName, metrics.CacheMiss)
+		return nil, err
+	}
+	c.record(ctx, metricName, metrics.CacheMiss)
+	c.add(key, value)
+	return value, nil
+}
+
+// record records the result of a cache lookup in the metrics, the span and the access log entry of the request.
+func (c *valueCache) record(ctx context.Context, metricName, result string) {
+	metrics.CacheRequests.WithLabelValues(c.sourceName, result).Inc()
+	trace.SpanFromContext(ctx).SetAttributes(tracing.CacheKey.String(result))
+	accesslog.FromContext(ctx).SetCache(result)
+	klog.V(4).Infof("metrics source %s: metric=%s cache=%s", c.sourceName, metricName, result)
+}
+
+// cachedClient is a MetricsClient which serves the metric values from a cache. Discovery requests are not cached.
+type cachedClient struct {
+	MetricsClient
+	cache *valueCache
+}
+
+var _ MetricsClient = &cachedClient{}
+
+func (c *cachedClient) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	key := CustomMetricByNameKey(name, info, metricSelector)
+	value, err := c.cache.fetch(ctx, info.Metric, key, func() (runtime.Object, error) {
+		return c.MetricsClient.GetMetricByName(ctx, name, info, metricSelector)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*custom_metrics.MetricValue), nil
+}
+
+func (c *cachedClient) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	key := CustomMetricBySelectorKey(namespace, selector, info, metricSelector)
+	value, err := c.cache.fetch(ctx, info.Metric, key, func() (runtime.Object, error) {
+		return c.MetricsClient.GetMetricBySelector(ctx, namespace, selector, info, metricSelector)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*custom_metrics.MetricValueList), nil
+}
+
+func (c *cachedClient) GetExternalMetric(ctx context.Context, name, namespace string, metricSelector labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
+	key := ExternalMetricKey(name, namespace, metricSelector)
+	value, err := c.cache.fetch(ctx, name, key, func() (runtime.Object, error) {
+		return c.MetricsClient.GetExternalMetric(ctx, name, namespace, metricSelector)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(*external_metrics.ExternalMetricValueList), nil
+}
+
+// valueCaches holds the value caches of the metrics sources, indexed by the name of the metrics source. A cache is
+// shared by all the clients of a metrics source, it is only replaced if its configuration is updated.
+type valueCaches struct {
+	lock   sync.Mutex
+	caches map[string]*valueCache
+}
+
+func newValueCaches() *valueCaches {
+	return &valueCaches{caches: make(map[string]*valueCache)}
+}
+
+// prepare returns the cache to be used with the given configuration, or nil if the values of the metrics source are
+// not cached. The current cache is reused if its configuration is not updated. The cache is only used for the requests
+// of the metrics source once it has been registered with set.
+func (v *valueCaches) prepare(sourceName string, config *v1alpha1.ValueCache) *valueCache {
+	if config == nil {
+		return nil
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	cache, ok := v.caches[sourceName]
+	if ok && equality.Semantic.DeepEqual(cache.config, *config) {
+		return cache
+	}
+	return newValueCache(sourceName, *config.DeepCopy())
+}
+
+// set registers the cache of a metrics source, a nil cache means that the values are not cached.
+func (v *valueCaches) set(sourceName string, cache *valueCache) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if cache == nil {
+		delete(v.caches, sourceName)
+		return
+	}
+	v.caches[sourceName] = cache
+}
+
+func (v *valueCaches) delete(sourceName string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	delete(v.caches, sourceName)
+	for _, result := range []string{metrics.CacheHit, metrics.CacheMiss, metrics.CacheStale} {
+		metrics.CacheRequests.DeleteLabelValues(sourceName, result)
+	}
+}
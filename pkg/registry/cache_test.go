@@ -0,0 +1,240 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/accesslog"
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/barkbay/custom-metrics-router/pkg/metrics"
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// countingClient is a MetricsClient which returns the number of calls as the value of the external metrics.
+type countingClient struct {
+	MetricsClient
+	calls int64
+	// err, if set, is returned instead of the value.
+	err error
+}
+
+func (c *countingClient) GetExternalMetric(_ context.Context, name, _ string, _ labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return &external_metrics.ExternalMetricValueList{
+		Items: []external_metrics.ExternalMetricValue{{MetricName: name, Value: *resource.NewQuantity(c.calls, resource.DecimalSI)}},
+	}, nil
+}
+
+// newTestCachedClient returns a cached client and a function to move the clock of the cache forward.
+func newTestCachedClient(config v1alpha1.ValueCache) (*cachedClient, *countingClient, func(time.Duration)) {
+	backend := &countingClient{}
+	cache := newValueCache("source1", config)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	return &cachedClient{MetricsClient: backend, cache: cache}, backend, func(d time.Duration) { now = now.Add(d) }
+}
+
+func getValue(t *testing.T, client MetricsClient, name string, selector labels.Selector) (int64, error) {
+	t.Helper()
+	values, err := client.GetExternalMetric(context.Background(), name, "ns", selector)
+	if err != nil {
+		return 0, err
+	}
+	return values.Items[0].Value.Value(), nil
+}
+
+func Test_cachedClient_ttl(t *testing.T) {
+	client, backend, tick := newTestCachedClient(v1alpha1.ValueCache{
+		TTL:          &metav1.Duration{Duration: 10 * time.Second},
+		StaleIfError: &metav1.Duration{Duration: 0},
+	})
+	hits := testutil.ToFloat64(metrics.CacheRequests.WithLabelValues("source1", metrics.CacheHit))
+	misses := testutil.ToFloat64(metrics.CacheRequests.WithLabelValues("source1", metrics.CacheMiss))
+
+	value, err := getValue(t, client, "metric1", labels.Everything())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), value)
+
+	// Served from the cache
+	tick(5 * time.Second)
+	value, err = getValue(t, client, "metric1", labels.Everything())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), value)
+
+	// Requests with another metric selector are cached separately
+	value, err = getValue(t, client, "metric1", labels.SelectorFromSet(labels.Set{"queue": "orders"}))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), value)
+
+	// Expired
+	tick(5 * time.Second)
+	value, err = getValue(t, client, "metric1", labels.Everything())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), value)
+
+	assert.Equal(t, int64(3), backend.calls)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.CacheRequests.WithLabelValues("source1", metrics.CacheHit))-hits)
+	assert.Equal(t, float64(3), testutil.ToFloat64(metrics.CacheRequests.WithLabelValues("source1", metrics.CacheMiss))-misses)
+}
+
+func Test_cachedClient_maxEntries(t *testing.T) {
+	client, backend, _ := newTestCachedClient(v1alpha1.ValueCache{MaxEntries: int32Ptr(2)})
+	for _, name := range []string{"metric1", "metric2", "metric1", "metric3"} {
+		_, err := getValue(t, client, name, labels.Everything())
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 2, client.cache.len())
+	assert.Equal(t, int64(3), backend.calls)
+	// metric2 is the least recently used value, it has been evicted
+	_, err := getValue(t, client, "metric2", labels.Everything())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), backend.calls)
+	// metric3 is still cached
+	_, err = getValue(t, client, "metric3", labels.Everything())
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), backend.calls)
+}
+
+func Test_cachedClient_accessLog(t *testing.T) {
+	client, _, _ := newTestCachedClient(v1alpha1.ValueCache{})
+	// The result of the cache lookup is recorded in the access log entry of the request
+	get := func() string {
+		entry := &accesslog.Entry{}
+		ctx := (&accesslog.Logger{}).Start(context.Background(), entry)
+		_, err := client.GetExternalMetric(ctx, "metric1", "ns", labels.Everything())
+		assert.NoError(t, err)
+		return entry.Cache
+	}
+	assert.Equal(t, metrics.CacheMiss, get())
+	assert.Equal(t, metrics.CacheHit, get())
+}
+
+func Test_cachedClient_staleIfError(t *testing.T) {
+	tests := []struct {
+		name      string
+		err       error
+		elapsed   time.Duration
+		wantValue bool
+	}{
+		{
+			name:      "backend failure",
+			err:       apierrors.NewServiceUnavailable("backend is down"),
+			elapsed:   30 * time.Second,
+			wantValue: true,
+		},
+		{
+			name:      "request throttled",
+			err:       sourceThrottled("source1", time.Second, "too many requests"),
+			elapsed:   30 * time.Second,
+			wantValue: true,
+		},
+		{
+			name:    "stale value is too old",
+			err:     apierrors.NewServiceUnavailable("backend is down"),
+			elapsed: 2 * time.Minute,
+		},
+		{
+			name:    "metric not found",
+			err:     apierrors.NewNotFound(schema.GroupResource{}, "metric1"),
+			elapsed: 30 * time.Second,
+		},
+		{
+			name:    "request cancelled",
+			err:     context.Canceled,
+			elapsed: 30 * time.Second,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, backend, tick := newTestCachedClient(v1alpha1.ValueCache{
+				TTL:          &metav1.Duration{Duration: 10 * time.Second},
+				StaleIfError: &metav1.Duration{Duration: time.Minute},
+			})
+			_, err := getValue(t, client, "metric1", labels.Everything())
+			assert.NoError(t, err)
+
+			tick(tt.elapsed)
+			backend.err = tt.err
+			value, err := getValue(t, client, "metric1", labels.Everything())
+			if !tt.wantValue {
+				assert.True(t, errors.Is(err, tt.err), "expected error %v, got %v", tt.err, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1), value)
+		})
+	}
+}
+
+func TestRegistry_ValueCache(t *testing.T) {
+	fakeRegistry := newFakeRegistry().servedCustomMetrics("source1", "metric1")
+	source := v1alpha1.MetricsSource{
+		ObjectMeta: metav1.ObjectMeta{Name: "source1"},
+		Spec: v1alpha1.MetricsSourceSpec{
+			MetricTypes:           v1alpha1.MetricTypes{v1alpha1.CustomMetrics},
+			MetricsServiceBackend: v1alpha1.MetricsServiceBackend{Name: "source1"},
+			Cache:                 &v1alpha1.ValueCache{},
+		},
+	}
+	_, err := fakeRegistry.registry.AddOrUpdateSource(context.Background(), source)
+	assert.NoError(t, err)
+	cache := fakeRegistry.registry.caches.caches["source1"]
+
+	info := provider.CustomMetricInfo{Metric: "metric1"}
+	backend, err := fakeRegistry.registry.GetMetricsBackend(info)
+	assert.NoError(t, err)
+	value, err := backend.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "ns", Name: "pod1"}, info, labels.Everything())
+	assert.NoError(t, err)
+	assert.Equal(t, "pod1", value.DescribedObject.Name)
+	assert.Equal(t, 1, cache.len())
+	// Cached values cannot be altered by the callers
+	value.DescribedObject.Name = "altered"
+	value, err = backend.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "ns", Name: "pod1"}, info, labels.Everything())
+	assert.NoError(t, err)
+	assert.Equal(t, "pod1", value.DescribedObject.Name)
+
+	// The cache is preserved while its configuration is not updated
+	_, err = fakeRegistry.registry.AddOrUpdateSource(context.Background(), source)
+	assert.NoError(t, err)
+	assert.Same(t, cache, fakeRegistry.registry.caches.caches["source1"])
+
+	// The cache is removed if it is disabled
+	source.Spec.Cache = nil
+	_, err = fakeRegistry.registry.AddOrUpdateSource(context.Background(), source)
+	assert.NoError(t, err)
+	assert.Empty(t, fakeRegistry.registry.caches.caches)
+	backend, err = fakeRegistry.registry.GetMetricsBackend(info)
+	assert.NoError(t, err)
+	_, isCached := backend.(*cachedClient)
+	assert.False(t, isCached)
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"sort"
+
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+)
+
+// SourceChanges describes how the routes have changed after a metrics source has been updated or deleted.
+type SourceChanges struct {
+	SourceName string
+	// AddedMetrics and RemovedMetrics are the metrics added to, or removed from, the metrics served by the source.
+	AddedMetrics, RemovedMetrics []string
+	// Routes are the metrics for which the preferred metrics source has changed from a source to another one.
+	Routes []RouteChange
+	// Conflicts are the metrics served by the source and by other ones with the same, highest, priority.
+	Conflicts []PriorityConflict
+
+	// PreviousCount is the number of metrics served by the source before the change.
+	PreviousCount int
+	// RemovalAlertThreshold is the percentage of PreviousCount above which the removed metrics must be reported, 0 if
+	// they must not be reported.
+	RemovalAlertThreshold int
+}
+
+// RemovalAlert returns true if more metrics than the alert threshold have been removed.
+func (s SourceChanges) RemovalAlert() bool {
+	return s.RemovalAlertThreshold > 0 && s.PreviousCount > 0 &&
+		len(s.RemovedMetrics)*100 > s.RemovalAlertThreshold*s.PreviousCount
+}
+
+// IsEmpty returns true if nothing has changed.
+func (s SourceChanges) IsEmpty() bool {
+	return len(s.AddedMetrics) == 0 && len(s.RemovedMetrics) == 0 && len(s.Routes) == 0 && len(s.Conflicts) == 0
+}
+
+// RouteChange is a metric now served by another metrics source.
+type RouteChange struct {
+	Metric   string
+	From, To string
+}
+
+// PriorityConflict is a metric served by several metrics sources with the same priority. The sources are sorted by
+// name, the first one is used.
+type PriorityConflict struct {
+	Metric   string
+	Priority int
+	Sources  []string
+}
+
+func customMetricName(info provider.CustomMetricInfo) string {
+	return info.String()
+}
+
+func externalMetricName(info provider.ExternalMetricInfo) string {
+	return info.Metric + "(external)"
+}
+
+// preferredSource returns the name of the preferred metrics source, regardless of the state of the circuit breakers.
+func (c cachedMetricSources) preferredSource() string {
+	if len(c) == 0 {
+		return ""
+	}
+	return c[0].sourceName
+}
+
+// conflict returns the metrics sources which have the same priority as the preferred one.
+func (c cachedMetricSources) conflict() (int, []string) {
+	if len(c) < 2 || c[0].priority != c[1].priority {
+		return 0, nil
+	}
+	var sources []string
+	for _, source := range c {
+		if source.priority == c[0].priority {
+			sources = append(sources, source.sourceName)
+		}
+	}
+	return c[0].priority, sources
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// diffRoutes computes the changes between two routing tables, for the metrics served by a metrics source in either of
+// them.
+func diffRoutes(sourceName string, old, new *routingTable) SourceChanges {
+	oldSource, newSource := old.sources[sourceName], new.sources[sourceName]
+	changes := SourceChanges{
+		SourceName:    sourceName,
+		PreviousCount: len(oldSource.customMetricInfos) + len(oldSource.externalMetricInfos),
+	}
+
+	route := func(metric string, before, after cachedMetricSources, served bool) {
+		if from, to := before.preferredSource(), after.preferredSource(); from != to && from != "" && to != "" {
+			changes.Routes = append(changes.Routes, RouteChange{Metric: metric, From: from, To: to})
+		}
+		if priority, sources := after.conflict(); served && containsString(sources, sourceName) {
+			changes.Conflicts = append(changes.Conflicts, PriorityConflict{Metric: metric, Priority: priority, Sources: sources})
+		}
+	}
+
+	for info := range oldSource.customMetricInfos {
+		if _, served := newSource.customMetricInfos[info]; !served {
+			changes.RemovedMetrics = append(changes.RemovedMetrics, customMetricName(info))
+			route(customMetricName(info), old.customMetrics[info], new.customMetrics[info], false)
+		}
+	}
+	for info := range newSource.customMetricInfos {
+		if _, served := oldSource.customMetricInfos[info]; !served {
+			changes.AddedMetrics = append(changes.AddedMetrics, customMetricName(info))
+		}
+		route(customMetricName(info), old.customMetrics[info], new.customMetrics[info], true)
+	}
+	for info := range oldSource.externalMetricInfos {
+		if _, served := newSource.externalMetricInfos[info]; !served {
+			changes.RemovedMetrics = append(changes.RemovedMetrics, externalMetricName(info))
+			route(externalMetricName(info), old.externalMetrics[info], new.externalMetrics[info], false)
+		}
+	}
+	for info := range newSource.externalMetricInfos {
+		if _, served := oldSource.externalMetricInfos[info]; !served {
+			changes.AddedMetrics = append(changes.AddedMetrics, externalMetricName(info))
+		}
+		route(externalMetricName(info), old.externalMetrics[info], new.externalMetrics[info], true)
+	}
+
+	// Maps are not ordered, sort the changes so that the samples are stable.
+	sort.Strings(changes.AddedMetrics)
+	sort.Strings(changes.RemovedMetrics)
+	sort.Slice(changes.Routes, func(i, j int) bool { return changes.Routes[i].Metric < changes.Routes[j].Metric })
+	sort.Slice(changes.Conflicts, func(i, j int) bool { return changes.Conflicts[i].Metric < changes.Conflicts[j].Metric })
+	return changes
+}
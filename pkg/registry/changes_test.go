@@ -0,0 +1,129 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRegistry_OnSourceChanges(t *testing.T) {
+	fakeRegistry := newFakeRegistry().
+		servedCustomMetrics("source1", "metric1", "metric2").
+		servedCustomMetrics("source2", "metric2", "metric3").
+		servedCustomMetrics("source3", "metric3").
+		servedExternalMetrics("source3", "metric4")
+	var changes []SourceChanges
+	fakeRegistry.registry.OnSourceChanges(func(c SourceChanges) { changes = append(changes, c) })
+	addSource := func(name string, priority int) {
+		_, err := fakeRegistry.registry.AddOrUpdateSource(context.Background(), v1alpha1.MetricsSource{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1alpha1.MetricsSourceSpec{
+				MetricTypes:           v1alpha1.MetricTypes{v1alpha1.CustomMetrics, v1alpha1.ExternalMetrics},
+				MetricsServiceBackend: v1alpha1.MetricsServiceBackend{Name: name},
+				Priority:              priority,
+			},
+		})
+		assert.NoError(t, err)
+	}
+
+	addSource("source1", 0)
+	addSource("source2", 10)
+	addSource("source3", 10)
+	// Resync without any change
+	addSource("source1", 0)
+	fakeRegistry.registry.DeleteSource("source2")
+
+	assert.Equal(t, []SourceChanges{
+		{
+			SourceName:            "source1",
+			AddedMetrics:          []string{"/metric1", "/metric2"},
+			RemovalAlertThreshold: 50,
+		},
+		{
+			SourceName:            "source2",
+			AddedMetrics:          []string{"/metric2", "/metric3"},
+			Routes:                []RouteChange{{Metric: "/metric2", From: "source1", To: "source2"}},
+			RemovalAlertThreshold: 50,
+		},
+		{
+			SourceName:            "source3",
+			AddedMetrics:          []string{"/metric3", "metric4(external)"},
+			Conflicts:             []PriorityConflict{{Metric: "/metric3", Priority: 10, Sources: []string{"source2", "source3"}}},
+			RemovalAlertThreshold: 50,
+		},
+		{
+			SourceName:     "source2",
+			RemovedMetrics: []string{"/metric2", "/metric3"},
+			Routes: []RouteChange{
+				{Metric: "/metric2", From: "source2", To: "source1"},
+				{Metric: "/metric3", From: "source2", To: "source3"},
+			},
+			PreviousCount: 2,
+		},
+	}, changes)
+}
+
+func TestRegistry_DiscoveryHistory(t *testing.T) {
+	fakeRegistry := newFakeRegistry().servedCustomMetrics("source1", "metric1", "metric2", "metric3", "metric4", "metric5", "metric6")
+	var changes []SourceChanges
+	fakeRegistry.registry.OnSourceChanges(func(c SourceChanges) { changes = append(changes, c) })
+	resync := func() {
+		_, err := fakeRegistry.registry.AddOrUpdateSource(context.Background(), v1alpha1.MetricsSource{
+			ObjectMeta: metav1.ObjectMeta{Name: "source1"},
+			Spec: v1alpha1.MetricsSourceSpec{
+				MetricTypes:           v1alpha1.MetricTypes{v1alpha1.CustomMetrics},
+				MetricsServiceBackend: v1alpha1.MetricsServiceBackend{Name: "source1"},
+				// Removals are applied right away
+				Discovery: &v1alpha1.DiscoveryPolicy{RemovalConfirmations: int32Ptr(1)},
+			},
+		})
+		assert.NoError(t, err)
+	}
+	resync()
+	// Resyncs without any change are not recorded
+	resync()
+	fakeClient := fakeRegistry.fakeClientProvider.clients["source1"]
+	fakeClient.customMetrics = []string{"metric1", "metric2", "metric3", "metric7"}
+	resync()
+	fakeClient.customMetrics = []string{"metric1"}
+	resync()
+
+	history := fakeRegistry.registry.DiscoveryHistory("source1")
+	assert.Len(t, history, 3)
+	for i := range history {
+		assert.False(t, history[i].Time.IsZero())
+		history[i].Time = metav1.Time{}
+	}
+	assert.Equal(t, []v1alpha1.DiscoveryRecord{
+		{Added: 6, AddedSamples: []string{"/metric1", "/metric2", "/metric3", "/metric4", "/metric5"}},
+		{Added: 1, Removed: 3, AddedSamples: []string{"/metric7"}, RemovedSamples: []string{"/metric4", "/metric5", "/metric6"}},
+		{Removed: 3, RemovedSamples: []string{"/metric2", "/metric3", "/metric7"}},
+	}, history)
+
+	// 3 metrics out of 6 is not more than the default threshold, 3 out of 4 is
+	assert.Len(t, changes, 3)
+	assert.False(t, changes[1].RemovalAlert())
+	assert.True(t, changes[2].RemovalAlert())
+
+	fakeRegistry.registry.DeleteSource("source1")
+	assert.Empty(t, fakeRegistry.registry.DiscoveryHistory("source1"))
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"sort"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/barkbay/custom-metrics-router/pkg/metrics"
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Route is a metric served by the router, with the metrics sources which serve it.
+type Route struct {
+	// API is either metrics.CustomMetricsAPI or metrics.ExternalMetricsAPI.
+	API    string `json:"api"`
+	Metric string `json:"metric"`
+	// Namespaced is true if the metric can be requested in a namespace. External metrics are always namespaced.
+	Namespaced bool `json:"namespaced"`
+	// Sources are the candidate metrics sources, in the order in which they are tried.
+	Sources []RouteSource `json:"sources"`
+}
+
+// RouteSource is a metrics source which serves a metric.
+type RouteSource struct {
+	Name     string `json:"name"`
+	Priority int    `json:"priority"`
+	// CircuitBreaker is the state of the circuit breaker of the metrics source.
+	CircuitBreaker v1alpha1.CircuitBreakerState `json:"circuitBreaker"`
+	// Available is false if the requests are not sent to the metrics source, they fail over to the next one.
+	Available bool `json:"available"`
+	// LastSync is the time of the last discovery applied to the metrics source.
+	LastSync time.Time `json:"lastSync"`
+}
+
+// RoutesFilter selects the routes returned by Registry.Routes. Empty fields match all the routes.
+type RoutesFilter struct {
+	// Metric is the name of the metric, without the group resource of the custom metrics.
+	Metric string
+	// Source selects the metrics served by the given metrics source.
+	Source string
+	// Namespace selects the metrics which can be requested in a namespace: the external metrics, the custom metrics of
+	// namespaced resources and the custom metrics describing the namespaces themselves. The routes do not depend on the
+	// namespace, the other root scoped custom metrics are excluded.
+	Namespace string
+}
+
+// Routes returns the metrics served by the router, sorted by API and metric, with the metrics sources which serve them.
+func (r *Registry) Routes(filter RoutesFilter) []Route {
+	routes := r.currentRoutes()
+	result := make([]Route, 0, len(routes.customMetrics)+len(routes.externalMetrics))
+	for info, sources := range routes.customMetrics {
+		if filter.matches(info.Metric, inNamespace(info), sources) {
+			result = append(result, Route{
+				API:        metrics.CustomMetricsAPI,
+				Metric:     info.String(),
+				Namespaced: info.Namespaced,
+				Sources:    routeSources(sources),
+			})
+		}
+	}
+	for info, sources := range routes.externalMetrics {
+		if filter.matches(info.Metric, true, sources) {
+			result = append(result, Route{
+				API:        metrics.ExternalMetricsAPI,
+				Metric:     info.Metric,
+				Namespaced: true,
+				Sources:    routeSources(sources),
+			})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].API != result[j].API {
+			return result[i].API < result[j].API
+		}
+		return result[i].Metric < result[j].Metric
+	})
+	return result
+}
+
+// inNamespace returns true if a custom metric can be requested in a namespace. The metrics of the namespaces are root
+// scoped, but they are requested in the namespace they describe: /namespaces/$NS/metrics/$metric.
+func inNamespace(info provider.CustomMetricInfo) bool {
+	return info.Namespaced || info.GroupResource == schema.GroupResource{Resource: "namespaces"}
+}
+
+func (f RoutesFilter) matches(metric string, namespaced bool, sources cachedMetricSources) bool {
+	if f.Metric != "" && f.Metric != metric {
+		return false
+	}
+	if f.Namespace != "" && !namespaced {
+		return false
+	}
+	if f.Source == "" {
+		return true
+	}
+	for _, source := range sources {
+		if source.sourceName == f.Source {
+			return true
+		}
+	}
+	return false
+}
+
+func routeSources(sources cachedMetricSources) []RouteSource {
+	result := make([]RouteSource, len(sources))
+	for i, source := range sources {
+		state := v1alpha1.CircuitBreakerClosed
+		if source.breaker != nil {
+			state = source.breaker.State()
+		}
+		result[i] = RouteSource{
+			Name:           source.sourceName,
+			Priority:       source.priority,
+			CircuitBreaker: state,
+			Available:      source.available(),
+			LastSync:       source.syncTime,
+		}
+	}
+	return result
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"sync"
+
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// closer is implemented by the clients which hold connections to be released once they are no longer used.
+type closer interface {
+	Close()
+}
+
+// inFlightRequests counts the requests in progress of a metrics source.
+type inFlightRequests struct {
+	lock  sync.Mutex
+	count int
+	// idle, if not nil, is closed once there is no more request in progress.
+	idle chan struct{}
+}
+
+func (i *inFlightRequests) add() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.count++
+}
+
+func (i *inFlightRequests) done() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.count--
+	if i.count == 0 && i.idle != nil {
+		close(i.idle)
+		i.idle = nil
+	}
+}
+
+// wait blocks until there is no more request in progress, or until the context is done.
+func (i *inFlightRequests) wait(ctx context.Context) error {
+	i.lock.Lock()
+	if i.count == 0 {
+		i.lock.Unlock()
+		return nil
+	}
+	if i.idle == nil {
+		i.idle = make(chan struct{})
+	}
+	idle := i.idle
+	i.lock.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sourcesInFlightRequests holds the requests in progress of the metrics sources, indexed by the name of the metrics
+// source. The counter of a metrics source is kept across its updates, until it is deleted.
+type sourcesInFlightRequests struct {
+	lock     sync.Mutex
+	requests map[string]*inFlightRequests
+}
+
+func newSourcesInFlightRequests() *sourcesInFlightRequests {
+	return &sourcesInFlightRequests{requests: make(map[string]*inFlightRequests)}
+}
+
+func (s *sourcesInFlightRequests) get(sourceName string) *inFlightRequests {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	requests, ok := s.requests[sourceName]
+	if !ok {
+		requests = &inFlightRequests{}
+		s.requests[sourceName] = requests
+	}
+	return requests
+}
+
+func (s *sourcesInFlightRequests) delete(sourceName string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.requests, sourceName)
+}
+
+// trackedClient is a MetricsClient which counts the requests in progress. A request is counted before checking that the
+// metrics source is still routed: a request which has looked up the metrics source before it has been drained is
+// either waited for by the drain, or rejected, it is never sent with a closed client.
+type trackedClient struct {
+	MetricsClient
+	sourceName string
+	inFlight   *inFlightRequests
+	// routed returns true if the metrics source is still in the routing table.
+	routed func() bool
+}
+
+var _ MetricsClient = &trackedClient{}
+
+// start counts a request in progress, the returned function must be called once the request is completed.
+func (c *trackedClient) start() (func(), error) {
+	c.inFlight.add()
+	if c.routed != nil && !c.routed() {
+		c.inFlight.done()
+		return nil, sourceUnavailable(c.sourceName, "metrics source has been deleted")
+	}
+	return c.inFlight.done, nil
+}
+
+func (c *trackedClient) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	done, err := c.start()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return c.MetricsClient.GetMetricByName(ctx, name, info, metricSelector)
+}
+
+func (c *trackedClient) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	done, err := c.start()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return c.MetricsClient.GetMetricBySelector(ctx, namespace, selector, info, metricSelector)
+}
+
+func (c *trackedClient) GetExternalMetric(ctx context.Context, name, namespace string, metricSelector labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
+	done, err := c.start()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return c.MetricsClient.GetExternalMetric(ctx, name, namespace, metricSelector)
+}
+
+// DrainSource stops routing the requests to a metrics source, and waits for the requests in progress to complete
+// before deleting it. The metrics source is deleted even if the context is done before the requests are completed, the
+// error of the context is then returned.
+func (r *Registry) DrainSource(ctx context.Context, sourceName string) error {
+	klog.Infof("Drain metrics source %s", sourceName)
+	var removed *cachedMetricSource
+	func() {
+		var changes SourceChanges
+		defer func() { r.notifySourceChanges(&changes) }()
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		changes, removed = r.removeRoutes(sourceName)
+	}()
+	err := r.inFlight.get(sourceName).wait(ctx)
+	if err != nil {
+		klog.Warningf("metrics source %s deleted while requests are still in progress: %v", sourceName, err)
+	}
+	r.DeleteSource(sourceName)
+	// Closing the client may interrupt the requests in progress, like the gRPC calls to an external scaler.
+	if removed != nil {
+		removed.closeClient()
+	}
+	return err
+}
+
+// removeRoutes removes a metrics source from the routing table, and discards its updates in progress. The removed
+// metrics source, if any, is returned: its client must be closed by the caller. Must be called with the lock held.
+func (r *Registry) removeRoutes(sourceName string) (SourceChanges, *cachedMetricSource) {
+	delete(r.updates, sourceName)
+	routes := r.currentRoutes()
+	newRoutes := routes.withoutSource(sourceName)
+	r.routes.Store(newRoutes)
+	observeRoutes(sourceName, newRoutes)
+	changes := diffRoutes(sourceName, routes, newRoutes)
+	if source, ok := routes.sources[sourceName]; ok {
+		return changes, &source
+	}
+	return changes, nil
+}
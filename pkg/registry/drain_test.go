@@ -0,0 +1,150 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func newDrainedSource(name string) v1alpha1.MetricsSource {
+	return v1alpha1.MetricsSource{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: v1alpha1.MetricsSourceSpec{
+			MetricTypes:           v1alpha1.MetricTypes{v1alpha1.CustomMetrics},
+			MetricsServiceBackend: v1alpha1.MetricsServiceBackend{Name: name},
+		},
+	}
+}
+
+func TestRegistry_DrainSource(t *testing.T) {
+	tests := []struct {
+		name string
+		// complete completes the request in progress while the metrics source is drained.
+		complete bool
+		wantErr  error
+	}{
+		{
+			name:     "requests in progress are completed",
+			complete: true,
+		},
+		{
+			name:    "drain timeout",
+			wantErr: context.DeadlineExceeded,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeRegistry := newFakeRegistry().servedCustomMetrics("source1", "metric1")
+			_, err := fakeRegistry.registry.AddOrUpdateSource(context.Background(), newDrainedSource("source1"))
+			assert.NoError(t, err)
+			fakeClient := fakeRegistry.fakeClientProvider.clients["source1"]
+			fakeClient.wait = make(chan struct{})
+
+			// Start a request
+			client, err := fakeRegistry.registry.GetMetricsBackend(provider.CustomMetricInfo{Metric: "metric1"})
+			assert.NoError(t, err)
+			requestCtx, cancelRequest := context.WithCancel(context.Background())
+			defer cancelRequest()
+			request := make(chan error)
+			go func() {
+				_, err := client.GetMetricByName(requestCtx, types.NamespacedName{Name: "pod1"}, provider.CustomMetricInfo{Metric: "metric1"}, nil)
+				request <- err
+			}()
+			assert.Eventually(t, func() bool { return fakeClient.Waiting() == 1 }, 5*time.Second, time.Millisecond)
+
+			timeout := 100 * time.Millisecond
+			if tt.complete {
+				timeout = 5 * time.Second
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			drained := make(chan error)
+			go func() { drained <- fakeRegistry.registry.DrainSource(ctx, "source1") }()
+
+			// New requests are not routed to the metrics source anymore
+			assert.Eventually(t, func() bool {
+				_, err := fakeRegistry.registry.GetMetricsBackend(provider.CustomMetricInfo{Metric: "metric1"})
+				return apierrors.IsNotFound(err)
+			}, 5*time.Second, time.Millisecond)
+
+			if tt.complete {
+				select {
+				case <-drained:
+					t.Fatal("metrics source drained while a request is in progress")
+				case <-time.After(50 * time.Millisecond):
+				}
+				// The client is not closed while the backend call is in progress
+				assert.Equal(t, 0, fakeClient.Closed())
+				assert.Equal(t, 1, fakeClient.Waiting())
+				close(fakeClient.wait)
+				assert.NoError(t, <-request)
+			}
+			assert.Equal(t, tt.wantErr, <-drained)
+			assert.Equal(t, 1, fakeClient.Closed())
+			assert.Empty(t, fakeRegistry.registry.ListAllCustomMetrics())
+		})
+	}
+}
+
+func TestRegistry_DrainSource_LateRequest(t *testing.T) {
+	fakeRegistry := newFakeRegistry().servedCustomMetrics("source1", "metric1")
+	_, err := fakeRegistry.registry.AddOrUpdateSource(context.Background(), newDrainedSource("source1"))
+	assert.NoError(t, err)
+	fakeClient := fakeRegistry.fakeClientProvider.clients["source1"]
+
+	// The metrics source is looked up before the drain, but the request is only sent once the drain is completed
+	client, err := fakeRegistry.registry.GetMetricsBackend(provider.CustomMetricInfo{Metric: "metric1"})
+	assert.NoError(t, err)
+	assert.NoError(t, fakeRegistry.registry.DrainSource(context.Background(), "source1"))
+	assert.Equal(t, 1, fakeClient.Closed())
+
+	// The request is rejected instead of being sent with the closed client
+	_, err = client.GetMetricByName(context.Background(), types.NamespacedName{Name: "pod1"}, provider.CustomMetricInfo{Metric: "metric1"}, nil)
+	assert.True(t, apierrors.IsServiceUnavailable(err))
+	assert.Equal(t, 0, fakeRegistry.registry.inFlight.get("source1").count)
+}
+
+func TestRegistry_AddOrUpdateSource_ClosesClients(t *testing.T) {
+	fakeRegistry := newFakeRegistry().servedCustomMetrics("source1", "metric1")
+	fakeClient := fakeRegistry.fakeClientProvider.clients["source1"]
+	_, err := fakeRegistry.registry.AddOrUpdateSource(context.Background(), newDrainedSource("source1"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, fakeClient.Closed())
+
+	// The previous client is closed once replaced
+	_, err = fakeRegistry.registry.AddOrUpdateSource(context.Background(), newDrainedSource("source1"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, fakeClient.Closed())
+
+	// The new client is closed if the update fails
+	fakeClient.customMetricsErr = apierrors.NewServiceUnavailable("backend is down")
+	_, err = fakeRegistry.registry.AddOrUpdateSource(context.Background(), newDrainedSource("source1"))
+	assert.Error(t, err)
+	assert.Equal(t, 2, fakeClient.Closed())
+
+	fakeRegistry.registry.DeleteSource("source1")
+	assert.Equal(t, 3, fakeClient.Closed())
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"k8s.io/klog"
+)
+
+// endpoint is a single address, in the form host:port, of a service.
+type endpoint struct {
+	address string
+
+	consecutiveErrors int
+	ejectedUntil      time.Time
+}
+
+func (e *endpoint) isEjected(now time.Time) bool {
+	return now.Before(e.ejectedUntil)
+}
+
+// endpointsBalancer distributes the requests across the ready endpoints of a service.
+// Endpoints which fail consecutively are ejected for a while.
+type endpointsBalancer struct {
+	lock sync.Mutex
+
+	consecutiveErrors int
+	ejectionTime      time.Duration
+
+	endpoints []*endpoint
+	next      int
+
+	now func() time.Time
+}
+
+func newEndpointsBalancer(loadBalancing *v1alpha1.LoadBalancing) *endpointsBalancer {
+	return &endpointsBalancer{
+		consecutiveErrors: loadBalancing.MaxConsecutiveErrors(),
+		ejectionTime:      loadBalancing.BaseEjectionTime(),
+		now:               time.Now,
+	}
+}
+
+func (b *endpointsBalancer) configure(loadBalancing *v1alpha1.LoadBalancing) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.consecutiveErrors = loadBalancing.MaxConsecutiveErrors()
+	b.ejectionTime = loadBalancing.BaseEjectionTime()
+}
+
+// setEndpoints updates the list of the ready endpoints. The state of the endpoints which are still
+// part of the list is preserved.
+func (b *endpointsBalancer) setEndpoints(addresses []string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	existing := make(map[string]*endpoint, len(b.endpoints))
+	for _, e := range b.endpoints {
+		existing[e.address] = e
+	}
+	endpoints := make([]*endpoint, len(addresses))
+	for i, address := range addresses {
+		if e, ok := existing[address]; ok {
+			endpoints[i] = e
+			continue
+		}
+		endpoints[i] = &endpoint{address: address}
+	}
+	b.endpoints = endpoints
+}
+
+// pick returns the next endpoint which is not ejected, or nil if there is no such endpoint.
+func (b *endpointsBalancer) pick() *endpoint {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := b.now()
+	for i := 0; i < len(b.endpoints); i++ {
+		e := b.endpoints[(b.next+i)%len(b.endpoints)]
+		if e.isEjected(now) {
+			continue
+		}
+		b.next = (b.next + i + 1) % len(b.endpoints)
+		return e
+	}
+	return nil
+}
+
+// report records the outcome of a request sent to an endpoint.
+func (b *endpointsBalancer) report(e *endpoint, success bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if success {
+		e.consecutiveErrors = 0
+		return
+	}
+	e.consecutiveErrors++
+	if e.consecutiveErrors >= b.consecutiveErrors {
+		klog.Warningf("endpoint %s ejected for %s after %d consecutive errors", e.address, b.ejectionTime, e.consecutiveErrors)
+		e.consecutiveErrors = 0
+		e.ejectedUntil = b.now().Add(b.ejectionTime)
+	}
+}
+
+// wrap returns a http.RoundTripper which sends the requests to the endpoints of the service.
+// The original request is sent to the service if all the endpoints are ejected or if the list of endpoints is not known yet.
+func (b *endpointsBalancer) wrap(rt http.RoundTripper) http.RoundTripper {
+	return &balancedRoundTripper{balancer: b, delegate: rt}
+}
+
+type balancedRoundTripper struct {
+	balancer *endpointsBalancer
+	delegate http.RoundTripper
+}
+
+func (rt *balancedRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	e := rt.balancer.pick()
+	if e == nil {
+		return rt.delegate.RoundTrip(req)
+	}
+	endpointReq := req.Clone(req.Context())
+	endpointReq.URL.Host = e.address
+	// Preserve the service name as the host header
+	if endpointReq.Host == "" {
+		endpointReq.Host = req.URL.Host
+	}
+	resp, err := rt.delegate.RoundTrip(endpointReq)
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		// The request has been cancelled by the client, it says nothing about the health of the endpoint.
+		return resp, err
+	}
+	rt.balancer.report(e, err == nil && resp.StatusCode < http.StatusInternalServerError)
+	return resp, err
+}
+
+// endpointsBalancers holds the balancers of the services for which load balancing is enabled.
+// Balancers are indexed by the service URL and are shared by all the clients of a given service. A balancer is removed
+// once no metrics source uses it anymore.
+type endpointsBalancers struct {
+	lock      sync.Mutex
+	balancers map[string]*endpointsBalancer
+	// sources holds the URL of the service used by each metrics source.
+	sources map[string]string
+}
+
+func newEndpointsBalancers() *endpointsBalancers {
+	return &endpointsBalancers{
+		balancers: make(map[string]*endpointsBalancer),
+		sources:   make(map[string]string),
+	}
+}
+
+// get returns the balancer of the service used by a metrics source, it is created if it does not exist yet.
+func (e *endpointsBalancers) get(sourceName string, backend v1alpha1.MetricsServiceBackend) *endpointsBalancer {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if url, ok := e.sources[sourceName]; ok && url != backend.URL() {
+		// The metrics source now uses another service
+		e.releaseLocked(sourceName)
+	}
+	e.sources[sourceName] = backend.URL()
+	balancer, ok := e.balancers[backend.URL()]
+	if !ok {
+		balancer = newEndpointsBalancer(backend.LoadBalancing)
+		e.balancers[backend.URL()] = balancer
+		return balancer
+	}
+	balancer.configure(backend.LoadBalancing)
+	return balancer
+}
+
+// release records that a metrics source does not use its service anymore. The balancer of the service is removed if
+// it is not used by any other metrics source.
+func (e *endpointsBalancers) release(sourceName string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.releaseLocked(sourceName)
+}
+
+func (e *endpointsBalancers) releaseLocked(sourceName string) {
+	url, ok := e.sources[sourceName]
+	if !ok {
+		return
+	}
+	delete(e.sources, sourceName)
+	for _, other := range e.sources {
+		if other == url {
+			return
+		}
+	}
+	delete(e.balancers, url)
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func int32Ptr(i int32) *int32 {
+	return &i
+}
+
+func newTestBalancer(now *time.Time, addresses ...string) *endpointsBalancer {
+	balancer := newEndpointsBalancer(&v1alpha1.LoadBalancing{
+		ConsecutiveErrors: int32Ptr(2),
+		EjectionTime:      &metav1.Duration{Duration: time.Minute},
+	})
+	balancer.now = func() time.Time { return *now }
+	balancer.setEndpoints(addresses)
+	return balancer
+}
+
+func pickN(b *endpointsBalancer, n int) []string {
+	var picked []string
+	for i := 0; i < n; i++ {
+		e := b.pick()
+		if e == nil {
+			picked = append(picked, "")
+			continue
+		}
+		picked = append(picked, e.address)
+	}
+	return picked
+}
+
+func TestEndpointsBalancer_pick(t *testing.T) {
+	now := time.Now()
+	balancer := newTestBalancer(&now, "10.0.0.1:6443", "10.0.0.2:6443", "10.0.0.3:6443")
+	assert.Equal(t, []string{"10.0.0.1:6443", "10.0.0.2:6443", "10.0.0.3:6443", "10.0.0.1:6443"}, pickN(balancer, 4))
+
+	// Eject the second endpoint
+	second := balancer.endpoints[1]
+	balancer.report(second, false)
+	assert.False(t, second.isEjected(now), "endpoint should not be ejected after a single error")
+	balancer.report(second, false)
+	assert.True(t, second.isEjected(now), "endpoint should be ejected after 2 consecutive errors")
+	assert.Equal(t, []string{"10.0.0.3:6443", "10.0.0.1:6443", "10.0.0.3:6443"}, pickN(balancer, 3))
+
+	// Ejection is preserved when the endpoints are updated
+	balancer.setEndpoints([]string{"10.0.0.2:6443", "10.0.0.4:6443"})
+	assert.Equal(t, []string{"10.0.0.4:6443", "10.0.0.4:6443"}, pickN(balancer, 2))
+
+	// Endpoint is back once the ejection time has elapsed
+	now = now.Add(2 * time.Minute)
+	assert.ElementsMatch(t, []string{"10.0.0.2:6443", "10.0.0.4:6443"}, pickN(balancer, 2))
+}
+
+func TestEndpointsBalancer_reportSuccess(t *testing.T) {
+	now := time.Now()
+	balancer := newTestBalancer(&now, "10.0.0.1:6443")
+	e := balancer.endpoints[0]
+	balancer.report(e, false)
+	balancer.report(e, true)
+	balancer.report(e, false)
+	assert.False(t, e.isEjected(now), "errors must be consecutive to eject an endpoint")
+}
+
+func TestEndpointsBalancer_noEndpoint(t *testing.T) {
+	now := time.Now()
+	balancer := newTestBalancer(&now)
+	assert.Nil(t, balancer.pick())
+
+	balancer.setEndpoints([]string{"10.0.0.1:6443"})
+	e := balancer.pick()
+	balancer.report(e, false)
+	balancer.report(e, false)
+	assert.Nil(t, balancer.pick(), "all endpoints are ejected")
+}
+
+func TestBalancedRoundTripper(t *testing.T) {
+	var healthyHosts []string
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		healthyHosts = append(healthyHosts, r.Host)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer healthy.Close()
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthy.Close()
+
+	healthyURL, _ := url.Parse(healthy.URL)
+	unhealthyURL, _ := url.Parse(unhealthy.URL)
+	now := time.Now()
+	balancer := newTestBalancer(&now, unhealthyURL.Host, healthyURL.Host)
+	client := &http.Client{Transport: balancer.wrap(http.DefaultTransport)}
+
+	var statuses []int
+	for i := 0; i < 6; i++ {
+		resp, err := client.Get("http://metrics-apiserver.custom-metrics.svc:6443/apis")
+		assert.NoError(t, err)
+		statuses = append(statuses, resp.StatusCode)
+		_ = resp.Body.Close()
+	}
+	// unhealthy endpoint is ejected after 2 errors
+	assert.Equal(t, []int{503, 200, 503, 200, 200, 200}, statuses)
+	// service name is used as the host header
+	for _, host := range healthyHosts {
+		assert.Equal(t, "metrics-apiserver.custom-metrics.svc:6443", host)
+	}
+}
+
+func TestBalancedRoundTripper_cancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	now := time.Now()
+	balancer := newTestBalancer(&now, serverURL.Host)
+	client := &http.Client{Transport: balancer.wrap(http.DefaultTransport)}
+
+	// Requests cancelled by the client are not endpoint failures
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://metrics-apiserver.custom-metrics.svc:6443/apis", nil)
+		assert.NoError(t, err)
+		_, err = client.Do(req)
+		assert.Error(t, err)
+		cancel()
+	}
+	assert.Equal(t, []string{serverURL.Host}, pickN(balancer, 1))
+}
+
+func TestEndpointsBalancers_release(t *testing.T) {
+	loadBalancing := &v1alpha1.LoadBalancing{}
+	backend1 := v1alpha1.MetricsServiceBackend{Namespace: "ns", Name: "service1", LoadBalancing: loadBalancing}
+	backend2 := v1alpha1.MetricsServiceBackend{Namespace: "ns", Name: "service2", LoadBalancing: loadBalancing}
+	balancers := newEndpointsBalancers()
+
+	// A balancer is shared by the metrics sources of a service
+	balancer := balancers.get("source1", backend1)
+	assert.Same(t, balancer, balancers.get("source2", backend1))
+	balancers.release("source1")
+	assert.Len(t, balancers.balancers, 1)
+	assert.Same(t, balancer, balancers.get("source2", backend1))
+
+	// The balancer is removed once the service is not used anymore
+	balancers.get("source2", backend2)
+	assert.Len(t, balancers.balancers, 1)
+	assert.NotContains(t, balancers.balancers, backend1.URL())
+	balancers.release("source2")
+	assert.Empty(t, balancers.balancers)
+	assert.Empty(t, balancers.sources)
+
+	// Unknown metrics sources are ignored
+	balancers.release("source3")
+}
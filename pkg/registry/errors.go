@@ -0,0 +1,105 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Errors returned by the router are StatusErrors, so that the clients of the metrics APIs, like the HPA controller,
+// get a meaningful status code and reason:
+//  - NotFound if no metrics source is serving the requested metric.
+//  - ServiceUnavailable if the metrics source cannot be reached, or if its circuit breaker is open.
+//  - TooManyRequests if the request has been rejected by the rate limits of the metrics source.
+//  - Timeout if the metrics source did not answer before the deadline of the request.
+//  - the status code and the reason returned by the metrics backend otherwise.
+
+// metricNotFound is returned when a metric is not served by any metrics source.
+func metricNotFound(metricType, metricName string) error {
+	return &apierrors.StatusError{
+		ErrStatus: metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusNotFound,
+			Reason:  metav1.StatusReasonNotFound,
+			Message: fmt.Sprintf("%s %s is not provided by any metrics backend", metricType, metricName),
+		}}
+}
+
+// sourceUnavailable is returned when the requests cannot be sent to a metrics source.
+func sourceUnavailable(sourceName string, format string, args ...interface{}) error {
+	return &apierrors.StatusError{
+		ErrStatus: metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusServiceUnavailable,
+			Reason:  metav1.StatusReasonServiceUnavailable,
+			Message: fmt.Sprintf("metrics source %s: %s", sourceName, fmt.Sprintf(format, args...)),
+		}}
+}
+
+// sourceThrottled is returned when a request is rejected by the rate limits of a metrics source. The Retry-After header
+// of the response is set from retryAfter.
+func sourceThrottled(sourceName string, retryAfter time.Duration, format string, args ...interface{}) error {
+	retryAfterSeconds := int(math.Ceil(retryAfter.Seconds()))
+	if retryAfterSeconds < 1 {
+		retryAfterSeconds = 1
+	}
+	return apierrors.NewTooManyRequests(fmt.Sprintf("metrics source %s: %s", sourceName, fmt.Sprintf(format, args...)), retryAfterSeconds)
+}
+
+// backendError translates an error returned while calling a metrics backend into a StatusError. The status code and
+// the reason returned by the backend are preserved, the name of the metrics source is added to the message.
+// Errors caused by the cancellation of the request are returned as is.
+func backendError(sourceName string, err error) error {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return err
+	}
+	var status apierrors.APIStatus
+	if errors.As(err, &status) {
+		errStatus := status.Status()
+		errStatus.Message = fmt.Sprintf("metrics source %s: %s", sourceName, errStatus.Message)
+		return &apierrors.StatusError{ErrStatus: errStatus}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &apierrors.StatusError{
+			ErrStatus: metav1.Status{
+				Status:  metav1.StatusFailure,
+				Code:    http.StatusGatewayTimeout,
+				Reason:  metav1.StatusReasonTimeout,
+				Message: fmt.Sprintf("metrics source %s: %v", sourceName, err),
+			}}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return sourceUnavailable(sourceName, "%v", err)
+	}
+	return &apierrors.StatusError{
+		ErrStatus: metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusInternalServerError,
+			Reason:  metav1.StatusReasonInternalError,
+			Message: fmt.Sprintf("metrics source %s: %v", sourceName, err),
+		}}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func Test_backendError(t *testing.T) {
+	tests := []struct {
+		name        string
+		err         error
+		wantCode    int32
+		wantReason  metav1.StatusReason
+		wantMessage string
+	}{
+		{
+			name:        "Backend NotFound is preserved",
+			err:         apierrors.NewNotFound(schema.GroupResource{Resource: "pods"}, "foo"),
+			wantCode:    http.StatusNotFound,
+			wantReason:  metav1.StatusReasonNotFound,
+			wantMessage: `metrics source source1: pods "foo" not found`,
+		},
+		{
+			name:        "Backend Forbidden is preserved",
+			err:         apierrors.NewForbidden(schema.GroupResource{Resource: "pods"}, "foo", errors.New("denied")),
+			wantCode:    http.StatusForbidden,
+			wantReason:  metav1.StatusReasonForbidden,
+			wantMessage: `metrics source source1: pods "foo" is forbidden: denied`,
+		},
+		{
+			name:        "Backend TooManyRequests is preserved",
+			err:         apierrors.NewTooManyRequests("slow down", 1),
+			wantCode:    http.StatusTooManyRequests,
+			wantReason:  metav1.StatusReasonTooManyRequests,
+			wantMessage: "metrics source source1: slow down",
+		},
+		{
+			name:        "Deadline exceeded",
+			err:         &url.Error{Op: "Get", URL: "https://backend", Err: context.DeadlineExceeded},
+			wantCode:    http.StatusGatewayTimeout,
+			wantReason:  metav1.StatusReasonTimeout,
+			wantMessage: `metrics source source1: Get "https://backend": context deadline exceeded`,
+		},
+		{
+			name:        "Backend not reachable",
+			err:         &url.Error{Op: "Get", URL: "https://backend", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}},
+			wantCode:    http.StatusServiceUnavailable,
+			wantReason:  metav1.StatusReasonServiceUnavailable,
+			wantMessage: `metrics source source1: Get "https://backend": dial tcp: connection refused`,
+		},
+		{
+			name:        "Unexpected error",
+			err:         errors.New("unexpected response"),
+			wantCode:    http.StatusInternalServerError,
+			wantReason:  metav1.StatusReasonInternalError,
+			wantMessage: "metrics source source1: unexpected response",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := backendError("source1", tt.err)
+			statusErr, ok := err.(*apierrors.StatusError)
+			if !ok {
+				t.Fatalf("backendError() = %T, want *StatusError", err)
+			}
+			assert.Equal(t, tt.wantCode, statusErr.ErrStatus.Code)
+			assert.Equal(t, tt.wantReason, statusErr.ErrStatus.Reason)
+			assert.Equal(t, tt.wantMessage, statusErr.ErrStatus.Message)
+		})
+	}
+}
+
+func Test_backendError_cancelled(t *testing.T) {
+	err := &url.Error{Op: "Get", URL: "https://backend", Err: context.Canceled}
+	assert.Equal(t, err, backendError("source1", err))
+	assert.Nil(t, backendError("source1", nil))
+}
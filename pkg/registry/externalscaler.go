@@ -0,0 +1,254 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/barkbay/custom-metrics-router/pkg/externalscaler"
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// scalerClient is a MetricsClient which gets the external metrics values from a KEDA external scaler.
+type scalerClient struct {
+	sourceName string
+	client     externalscaler.ExternalScalerClient
+	metadata   map[string]string
+	// metrics maps the external metric names to the names of the metrics of the scaler, nil if all the metrics of the
+	// scaler are served with their original names.
+	metrics map[string]string
+	// release, if not nil, releases the connection to the scaler.
+	release func()
+}
+
+var _ MetricsClient = &scalerClient{}
+
+func newScalerClient(sourceName string, backend v1alpha1.ExternalScalerBackend, conn grpc.ClientConnInterface) *scalerClient {
+	c := &scalerClient{
+		sourceName: sourceName,
+		client:     externalscaler.NewExternalScalerClient(conn),
+		metadata:   backend.ScalerMetadata,
+	}
+	if len(backend.Metrics) > 0 {
+		c.metrics = make(map[string]string, len(backend.Metrics))
+		for _, metric := range backend.Metrics {
+			c.metrics[metric.ExternalMetricName()] = metric.ScalerMetricName
+		}
+	}
+	return c
+}
+
+// Close releases the connection to the scaler, it is closed once it is no longer used by any client.
+func (c *scalerClient) Close() {
+	if c.release != nil {
+		c.release()
+	}
+}
+
+func (c *scalerClient) GetBackend() v1alpha1.MetricsServiceBackend {
+	return v1alpha1.MetricsServiceBackend{}
+}
+
+// scaledObjectRef is the reference sent to the scaler: the scaled object is the metrics source, in the namespace of
+// the request.
+func (c *scalerClient) scaledObjectRef(namespace string) *externalscaler.ScaledObjectRef {
+	return &externalscaler.ScaledObjectRef{
+		Name:           c.sourceName,
+		Namespace:      namespace,
+		ScalerMetadata: c.metadata,
+	}
+}
+
+// ListCustomMetricInfos returns an empty list, external scalers only serve external metrics.
+func (c *scalerClient) ListCustomMetricInfos(_ context.Context) (map[provider.CustomMetricInfo]struct{}, error) {
+	return map[provider.CustomMetricInfo]struct{}{}, nil
+}
+
+func (c *scalerClient) GetMetricByName(_ context.Context, _ types.NamespacedName, info provider.CustomMetricInfo, _ labels.Selector) (*custom_metrics.MetricValue, error) {
+	return nil, metricNotFound("custom metric", info.Metric)
+}
+
+func (c *scalerClient) GetMetricBySelector(_ context.Context, _ string, _ labels.Selector, info provider.CustomMetricInfo, _ labels.Selector) (*custom_metrics.MetricValueList, error) {
+	return nil, metricNotFound("custom metric", info.Metric)
+}
+
+func (c *scalerClient) ListExternalMetrics(ctx context.Context) (map[provider.ExternalMetricInfo]struct{}, error) {
+	spec, err := c.client.GetMetricSpec(ctx, c.scaledObjectRef(""))
+	if err != nil {
+		return nil, c.scalerError(ctx, err)
+	}
+	infos := make(map[provider.ExternalMetricInfo]struct{}, len(spec.MetricSpecs))
+	for _, metricSpec := range spec.MetricSpecs {
+		if c.metrics == nil {
+			infos[provider.ExternalMetricInfo{Metric: metricSpec.MetricName}] = struct{}{}
+			continue
+		}
+		for externalMetricName, scalerMetricName := range c.metrics {
+			if scalerMetricName == metricSpec.MetricName {
+				infos[provider.ExternalMetricInfo{Metric: externalMetricName}] = struct{}{}
+			}
+		}
+	}
+	return infos, nil
+}
+
+// GetExternalMetric gets the value of a metric from the scaler. The metric selector is not sent to the scaler, the
+// metrics are only selected by the scaler metadata.
+func (c *scalerClient) GetExternalMetric(ctx context.Context, name, namespace string, _ labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
+	scalerMetricName := name
+	if c.metrics != nil {
+		var ok bool
+		if scalerMetricName, ok = c.metrics[name]; !ok {
+			return nil, metricNotFound("external metric", name)
+		}
+	}
+	response, err := c.client.GetMetrics(ctx, &externalscaler.GetMetricsRequest{
+		ScaledObjectRef: c.scaledObjectRef(namespace),
+		MetricName:      scalerMetricName,
+	})
+	if err != nil {
+		return nil, c.scalerError(ctx, err)
+	}
+	now := metav1.NewTime(time.Now())
+	values := make([]external_metrics.ExternalMetricValue, 0, len(response.MetricValues))
+	for _, value := range response.MetricValues {
+		if value.MetricName != "" && value.MetricName != scalerMetricName {
+			continue
+		}
+		values = append(values, external_metrics.ExternalMetricValue{
+			MetricName: name,
+			Timestamp:  now,
+			Value:      scalerValue(value),
+		})
+	}
+	return &external_metrics.ExternalMetricValueList{Items: values}, nil
+}
+
+// scalerValue returns the value of a metric, MetricValueFloat is preferred if set by the scaler.
+func scalerValue(value *externalscaler.MetricValue) resource.Quantity {
+	if value.MetricValueFloat != 0 && !math.IsNaN(value.MetricValueFloat) && !math.IsInf(value.MetricValueFloat, 0) {
+		return *resource.NewMilliQuantity(int64(math.Round(value.MetricValueFloat*1000)), resource.DecimalSI)
+	}
+	return *resource.NewQuantity(value.MetricValue, resource.DecimalSI)
+}
+
+// scalerError translates an error returned by a scaler into a StatusError.
+func (c *scalerClient) scalerError(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return backendError(c.sourceName, ctx.Err())
+	}
+	s, ok := status.FromError(err)
+	if !ok {
+		return backendError(c.sourceName, err)
+	}
+	errStatus := metav1.Status{
+		Status:  metav1.StatusFailure,
+		Message: fmt.Sprintf("metrics source %s: %s", c.sourceName, s.Message()),
+	}
+	switch s.Code() {
+	case codes.InvalidArgument:
+		errStatus.Code, errStatus.Reason = http.StatusBadRequest, metav1.StatusReasonBadRequest
+	case codes.NotFound:
+		errStatus.Code, errStatus.Reason = http.StatusNotFound, metav1.StatusReasonNotFound
+	case codes.ResourceExhausted:
+		return sourceThrottled(c.sourceName, time.Second, "%s", s.Message())
+	case codes.DeadlineExceeded:
+		errStatus.Code, errStatus.Reason = http.StatusGatewayTimeout, metav1.StatusReasonTimeout
+	case codes.Unavailable:
+		errStatus.Code, errStatus.Reason = http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable
+	default:
+		errStatus.Code, errStatus.Reason = http.StatusInternalServerError, metav1.StatusReasonInternalError
+	}
+	return &apierrors.StatusError{ErrStatus: errStatus}
+}
+
+// scalerConnections holds the gRPC connections to the external scalers. Connections are indexed by the address of the
+// scaler and its TLS settings, they are shared by all the clients of a given scaler.
+type scalerConnections struct {
+	lock        sync.Mutex
+	connections map[string]*scalerConnection
+}
+
+// scalerConnection is a connection shared by the clients of a scaler.
+type scalerConnection struct {
+	conn *grpc.ClientConn
+	// refs is the number of clients using the connection.
+	refs int
+}
+
+func newScalerConnections() *scalerConnections {
+	return &scalerConnections{connections: make(map[string]*scalerConnection)}
+}
+
+// get returns a connection to the given scaler, it is created if it does not exist yet. Connections are established
+// in the background, the errors are returned by the requests. The returned function must be called once the
+// connection is no longer used, the connection is closed when it is no longer used by any client.
+func (s *scalerConnections) get(backend v1alpha1.ExternalScalerBackend, insecure bool) (*grpc.ClientConn, func(), error) {
+	key := fmt.Sprintf("%s/tls=%t/insecure=%t", backend.Address, backend.TLS, insecure)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	connection, ok := s.connections[key]
+	if !ok {
+		transportCredentials := grpc.WithInsecure()
+		if backend.TLS {
+			transportCredentials = grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{InsecureSkipVerify: insecure})) //nolint:gosec
+		}
+		conn, err := grpc.Dial(backend.Address, transportCredentials, backendInterceptors())
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create gRPC connection to %s: %v", backend.Address, err)
+		}
+		connection = &scalerConnection{conn: conn}
+		s.connections[key] = connection
+	}
+	connection.refs++
+	var once sync.Once
+	return connection.conn, func() { once.Do(func() { s.release(key, connection) }) }, nil
+}
+
+func (s *scalerConnections) release(key string, connection *scalerConnection) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	connection.refs--
+	if connection.refs > 0 {
+		return
+	}
+	if s.connections[key] == connection {
+		delete(s.connections, key)
+	}
+	if err := connection.conn.Close(); err != nil {
+		klog.V(2).Infof("failed to close gRPC connection to %s: %v", connection.conn.Target(), err)
+	}
+}
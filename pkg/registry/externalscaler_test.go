@@ -0,0 +1,202 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/barkbay/custom-metrics-router/pkg/externalscaler"
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// fakeScaler is an in-process external scaler. It returns the same values for all the scaled objects.
+type fakeScaler struct {
+	address string
+
+	lock sync.Mutex
+	// lastRequest is the last GetMetrics request received by the scaler.
+	lastRequest *externalscaler.GetMetricsRequest
+	metricSpecs []*externalscaler.MetricSpec
+	values      []*externalscaler.MetricValue
+	// err, if set, is returned by all the requests.
+	err error
+}
+
+func newFakeScaler(t *testing.T) (*fakeScaler, func()) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	f := &fakeScaler{address: listener.Addr().String()}
+	server := grpc.NewServer()
+	externalscaler.RegisterExternalScalerServer(server, f)
+	go func() { _ = server.Serve(listener) }()
+	return f, server.Stop
+}
+
+func (f *fakeScaler) GetMetricSpec(_ context.Context, _ *externalscaler.ScaledObjectRef) (*externalscaler.GetMetricSpecResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &externalscaler.GetMetricSpecResponse{MetricSpecs: f.metricSpecs}, nil
+}
+
+func (f *fakeScaler) GetMetrics(_ context.Context, request *externalscaler.GetMetricsRequest) (*externalscaler.GetMetricsResponse, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.lastRequest = request
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &externalscaler.GetMetricsResponse{MetricValues: f.values}, nil
+}
+
+func newTestScalerClient(t *testing.T, backend v1alpha1.ExternalScalerBackend) *scalerClient {
+	t.Helper()
+	conn, release, err := newScalerConnections().get(backend, false)
+	assert.NoError(t, err)
+	t.Cleanup(release)
+	return newScalerClient("scaler", backend, conn)
+}
+
+func TestScalerClient_ListExternalMetrics(t *testing.T) {
+	scaler, stop := newFakeScaler(t)
+	defer stop()
+	scaler.metricSpecs = []*externalscaler.MetricSpec{
+		{MetricName: "queue-length", TargetSize: 10},
+		{MetricName: "queue-age", TargetSize: 60},
+	}
+
+	// All the metrics of the scaler are served if there is no mapping
+	client := newTestScalerClient(t, v1alpha1.ExternalScalerBackend{Address: scaler.address})
+	metrics, err := client.ListExternalMetrics(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[provider.ExternalMetricInfo]struct{}{{Metric: "queue-length"}: {}, {Metric: "queue-age"}: {}}, metrics)
+
+	// Only the mapped metrics which exist in the scaler are served
+	client = newTestScalerClient(t, v1alpha1.ExternalScalerBackend{
+		Address: scaler.address,
+		Metrics: []v1alpha1.ExternalScalerMetric{
+			{ScalerMetricName: "queue-length", Name: "orders_queue_length"},
+			{ScalerMetricName: "queue-age"},
+			{ScalerMetricName: "unknown"},
+		},
+	})
+	metrics, err = client.ListExternalMetrics(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[provider.ExternalMetricInfo]struct{}{{Metric: "orders_queue_length"}: {}, {Metric: "queue-age"}: {}}, metrics)
+
+	// The scaler is not reachable
+	stop()
+	_, err = client.ListExternalMetrics(context.Background())
+	assert.True(t, apierrors.IsServiceUnavailable(err), "ServiceUnavailable expected, got %v", err)
+}
+
+func TestScalerClient_GetExternalMetric(t *testing.T) {
+	scaler, stop := newFakeScaler(t)
+	defer stop()
+	client := newTestScalerClient(t, v1alpha1.ExternalScalerBackend{
+		Address:        scaler.address,
+		ScalerMetadata: map[string]string{"queue": "orders"},
+		Metrics:        []v1alpha1.ExternalScalerMetric{{ScalerMetricName: "queue-length", Name: "orders_queue_length"}},
+	})
+
+	tests := []struct {
+		name      string
+		values    []*externalscaler.MetricValue
+		err       error
+		wantMilli []int64
+		assertErr func(error) bool
+	}{
+		{
+			name:      "integer value",
+			values:    []*externalscaler.MetricValue{{MetricName: "queue-length", MetricValue: 42}},
+			wantMilli: []int64{42000},
+		},
+		{
+			name:      "float value is preferred",
+			values:    []*externalscaler.MetricValue{{MetricName: "queue-length", MetricValue: 1, MetricValueFloat: 1.5}},
+			wantMilli: []int64{1500},
+		},
+		{
+			name: "values of other metrics are ignored",
+			values: []*externalscaler.MetricValue{
+				{MetricName: "queue-age", MetricValue: 60},
+				{MetricName: "queue-length", MetricValue: 3},
+			},
+			wantMilli: []int64{3000},
+		},
+		{
+			name:      "scaler error",
+			err:       status.Error(codes.Unavailable, "broker is down"),
+			assertErr: apierrors.IsServiceUnavailable,
+		},
+		{
+			name:      "scaler is overloaded",
+			err:       status.Error(codes.ResourceExhausted, "slow down"),
+			assertErr: apierrors.IsTooManyRequests,
+		},
+		{
+			name:      "invalid metadata",
+			err:       status.Error(codes.InvalidArgument, "queue is required"),
+			assertErr: apierrors.IsBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scaler.lock.Lock()
+			scaler.values, scaler.err = tt.values, tt.err
+			scaler.lock.Unlock()
+
+			values, err := client.GetExternalMetric(context.Background(), "orders_queue_length", "ns", labels.Everything())
+			if tt.assertErr != nil {
+				assert.True(t, tt.assertErr(err), "unexpected error: %v", err)
+				return
+			}
+			assert.NoError(t, err)
+			var milliValues []int64
+			for _, value := range values.Items {
+				assert.Equal(t, "orders_queue_length", value.MetricName)
+				milliValues = append(milliValues, value.Value.MilliValue())
+			}
+			assert.Equal(t, tt.wantMilli, milliValues)
+
+			// The scaled object is the metrics source, in the namespace of the request
+			scaler.lock.Lock()
+			defer scaler.lock.Unlock()
+			assert.Equal(t, "queue-length", scaler.lastRequest.MetricName)
+			assert.Equal(t, "scaler", scaler.lastRequest.ScaledObjectRef.Name)
+			assert.Equal(t, "ns", scaler.lastRequest.ScaledObjectRef.Namespace)
+			assert.Equal(t, map[string]string{"queue": "orders"}, scaler.lastRequest.ScaledObjectRef.ScalerMetadata)
+		})
+	}
+
+	// Unknown metric
+	_, err := client.GetExternalMetric(context.Background(), "queue-length", "ns", labels.Everything())
+	assert.True(t, apierrors.IsNotFound(err), "NotFound expected, got %v", err)
+}
@@ -17,7 +17,8 @@ limitations under the License.
 package registry
 
 import (
-	"sync"
+	"context"
+	"sync/atomic"
 	"testing"
 
 	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
@@ -37,7 +38,8 @@ type fakeRegistry struct {
 
 // addCustomMetrics adds some pre-existing custom metrics in the registry
 func (f *fakeRegistry) addCustomMetrics(sourceName string, priority int, metricsName ...string) *fakeRegistry {
-	metricSource, ok := f.registry.cachedMetricsSourcesBySource[sourceName]
+	routes := f.registry.currentRoutes()
+	metricSource, ok := routes.sources[sourceName]
 	if !ok {
 		metricSource = cachedMetricSource{
 			client: &fakeMetricsClient{
@@ -51,27 +53,20 @@ func (f *fakeRegistry) addCustomMetrics(sourceName string, priority int, metrics
 			customMetricInfos:   make(map[provider.CustomMetricInfo]struct{}),
 			externalMetricInfos: make(map[provider.ExternalMetricInfo]struct{}),
 		}
-		f.registry.cachedMetricsSourcesBySource[sourceName] = metricSource
 	}
 
 	for _, metricName := range metricsName {
 		metricInfo := provider.CustomMetricInfo{Metric: metricName}
 		metricSource.customMetricInfos[metricInfo] = struct{}{}
-
-		customMetrics := f.registry.customMetrics[metricInfo]
-		if customMetrics == nil {
-			customMetrics = ptr(make([]cachedMetricSource, 0))
-			f.registry.customMetrics[metricInfo] = customMetrics
-		}
-		customMetrics = ptr(append(*customMetrics, metricSource))
-		f.registry.customMetrics[metricInfo] = customMetrics
 	}
+	f.registry.routes.Store(routes.withSource(metricSource))
 	return f
 }
 
 // addCustomMetrics adds some pre-existing custom metrics in the registry
 func (f *fakeRegistry) addExternalMetrics(sourceName string, priority int, metricsName ...string) *fakeRegistry {
-	metricSource, ok := f.registry.cachedMetricsSourcesBySource[sourceName]
+	routes := f.registry.currentRoutes()
+	metricSource, ok := routes.sources[sourceName]
 	if !ok {
 		metricSource = cachedMetricSource{
 			client: &fakeMetricsClient{
@@ -86,21 +81,13 @@ func (f *fakeRegistry) addExternalMetrics(sourceName string, priority int, metri
 			customMetricInfos:   make(map[provider.CustomMetricInfo]struct{}),
 			externalMetricInfos: make(map[provider.ExternalMetricInfo]struct{}),
 		}
-		f.registry.cachedMetricsSourcesBySource[sourceName] = metricSource
 	}
 
 	for _, metricName := range metricsName {
 		metricInfo := provider.ExternalMetricInfo{Metric: metricName}
 		metricSource.externalMetricInfos[metricInfo] = struct{}{}
-
-		externalMetrics := f.registry.externalMetrics[metricInfo]
-		if externalMetrics == nil {
-			externalMetrics = ptr(make([]cachedMetricSource, 0))
-			f.registry.externalMetrics[metricInfo] = externalMetrics
-		}
-		externalMetrics = ptr(append(*externalMetrics, metricSource))
-		f.registry.externalMetrics[metricInfo] = externalMetrics
 	}
+	f.registry.routes.Store(routes.withSource(metricSource))
 	return f
 }
 
@@ -114,15 +101,24 @@ func (f *fakeRegistry) servedExternalMetrics(source string, metricNames ...strin
 	return f
 }
 
-func ptr(c cachedMetricSources) *cachedMetricSources {
-	return &c
-}
-
 type fakeMetricsClient struct {
 	name            string
 	backend         v1alpha1.MetricsServiceBackend
 	customMetrics   []string
 	externalMetrics []string
+
+	// wait, if not nil, blocks the requests until it is closed or until the context of the request is done.
+	wait chan struct{}
+	// cancelled is the number of requests which have been interrupted because their context was done.
+	cancelled int32
+	// waiting is the number of requests currently blocked by wait.
+	waiting int32
+	// closed is the number of times the client has been closed.
+	closed int32
+
+	// customMetricsErr and externalMetricsErr, if set, are returned by the discovery requests.
+	customMetricsErr   error
+	externalMetricsErr error
 }
 
 var _ MetricsClient = &fakeMetricsClient{}
@@ -133,8 +129,8 @@ type fakeMetricsClientsProvider struct {
 
 var _ MetricsClientProvider = &fakeMetricsClientsProvider{}
 
-func (fmcp *fakeMetricsClientsProvider) NewClient(_ bool, msb v1alpha1.MetricsServiceBackend) (MetricsClient, error) {
-	return fmcp.clients[msb.Name], nil
+func (fmcp *fakeMetricsClientsProvider) NewClient(source v1alpha1.MetricsSource) (MetricsClient, error) {
+	return fmcp.clients[source.Spec.MetricsServiceBackend.Name], nil
 }
 
 func (fmcp *fakeMetricsClientsProvider) exposeCustomMetric(sourceName string, metricsNames ...string) {
@@ -171,19 +167,76 @@ func (c *fakeMetricsClient) GetBackend() v1alpha1.MetricsServiceBackend {
 	return c.backend
 }
 
-func (fcp *fakeMetricsClient) GetMetricByName(types.NamespacedName, provider.CustomMetricInfo, labels.Selector) (*custom_metrics.MetricValue, error) {
-	panic("not implemented")
+// serve simulates a call to a backend, it returns an error if the context is done before the response is available.
+func (fcp *fakeMetricsClient) serve(ctx context.Context) error {
+	if fcp.wait == nil {
+		return ctx.Err()
+	}
+	atomic.AddInt32(&fcp.waiting, 1)
+	defer atomic.AddInt32(&fcp.waiting, -1)
+	select {
+	case <-fcp.wait:
+		return nil
+	case <-ctx.Done():
+		atomic.AddInt32(&fcp.cancelled, 1)
+		return ctx.Err()
+	}
+}
+
+// Waiting returns the number of requests currently blocked.
+func (fcp *fakeMetricsClient) Waiting() int {
+	return int(atomic.LoadInt32(&fcp.waiting))
+}
+
+func (fcp *fakeMetricsClient) Close() {
+	atomic.AddInt32(&fcp.closed, 1)
+}
+
+// Closed returns the number of times the client has been closed.
+func (fcp *fakeMetricsClient) Closed() int {
+	return int(atomic.LoadInt32(&fcp.closed))
 }
 
-func (fcp *fakeMetricsClient) GetMetricBySelector(string, labels.Selector, provider.CustomMetricInfo, labels.Selector) (*custom_metrics.MetricValueList, error) {
-	panic("not implemented")
+// Cancelled returns the number of requests which have been interrupted because their context was done.
+func (fcp *fakeMetricsClient) Cancelled() int {
+	return int(atomic.LoadInt32(&fcp.cancelled))
 }
 
-func (fcp *fakeMetricsClient) GetExternalMetric(string, string, labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
-	panic("not implemented")
+func (fcp *fakeMetricsClient) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, _ labels.Selector) (*custom_metrics.MetricValue, error) {
+	if err := fcp.serve(ctx); err != nil {
+		return nil, err
+	}
+	return &custom_metrics.MetricValue{
+		DescribedObject: custom_metrics.ObjectReference{Namespace: name.Namespace, Name: name.Name},
+		Metric:          custom_metrics.MetricIdentifier{Name: info.Metric},
+	}, nil
 }
 
-func (fcp *fakeMetricsClient) ListCustomMetricInfos() (map[provider.CustomMetricInfo]struct{}, error) {
+func (fcp *fakeMetricsClient) GetMetricBySelector(ctx context.Context, _ string, _ labels.Selector, info provider.CustomMetricInfo, _ labels.Selector) (*custom_metrics.MetricValueList, error) {
+	if err := fcp.serve(ctx); err != nil {
+		return nil, err
+	}
+	return &custom_metrics.MetricValueList{
+		Items: []custom_metrics.MetricValue{{Metric: custom_metrics.MetricIdentifier{Name: info.Metric}}},
+	}, nil
+}
+
+func (fcp *fakeMetricsClient) GetExternalMetric(ctx context.Context, name string, _ string, _ labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
+	if err := fcp.serve(ctx); err != nil {
+		return nil, err
+	}
+	return &external_metrics.ExternalMetricValueList{
+		Items: []external_metrics.ExternalMetricValue{{MetricName: name}},
+	}, nil
+}
+
+func (fcp *fakeMetricsClient) ListCustomMetricInfos(ctx context.Context) (map[provider.CustomMetricInfo]struct{}, error) {
+	if err := fcp.serve(ctx); err != nil {
+		return nil, err
+	}
+	if fcp.customMetricsErr != nil {
+		return nil, fcp.customMetricsErr
+	}
 	customMetrics := make(map[provider.CustomMetricInfo]struct{})
 	for _, cm := range fcp.customMetrics {
 		customMetrics[provider.CustomMetricInfo{
@@ -195,7 +248,13 @@ func (fcp *fakeMetricsClient) ListCustomMetricInfos() (map[provider.CustomMetric
 	return customMetrics, nil
 }
 
-func (fcp *fakeMetricsClient) ListExternalMetrics() (map[provider.ExternalMetricInfo]struct{}, error) {
+func (fcp *fakeMetricsClient) ListExternalMetrics(ctx context.Context) (map[provider.ExternalMetricInfo]struct{}, error) {
+	if err := fcp.serve(ctx); err != nil {
+		return nil, err
+	}
+	if fcp.externalMetricsErr != nil {
+		return nil, fcp.externalMetricsErr
+	}
 	externalMetrics := make(map[provider.ExternalMetricInfo]struct{})
 	for _, cm := range fcp.externalMetrics {
 		externalMetrics[provider.ExternalMetricInfo{
@@ -205,17 +264,39 @@ func (fcp *fakeMetricsClient) ListExternalMetrics() (map[provider.ExternalMetric
 	return externalMetrics, nil
 }
 
+// unwrap returns the client decorated by the registry.
+func unwrap(client MetricsClient) MetricsClient {
+	for {
+		switch c := client.(type) {
+		case *instrumentedClient:
+			client = c.MetricsClient
+		case *trackedClient:
+			client = c.MetricsClient
+		case *cachedClient:
+			client = c.MetricsClient
+		case *limitedClient:
+			client = c.MetricsClient
+		case *circuitBreakerClient:
+			client = c.MetricsClient
+		default:
+			return client
+		}
+	}
+}
+
 func newFakeRegistry() *fakeRegistry {
 	fakeClientProvider := &fakeMetricsClientsProvider{
 		clients: make(map[string]*fakeMetricsClient),
 	}
 	return &fakeRegistry{
 		registry: &Registry{
-			lock:                         sync.RWMutex{},
-			cachedMetricsSourcesBySource: make(map[string]cachedMetricSource),
-			customMetrics:                make(map[provider.CustomMetricInfo]*cachedMetricSources),
-			externalMetrics:              make(map[provider.ExternalMetricInfo]*cachedMetricSources),
-			clientProvider:               fakeClientProvider,
+			updates:        make(map[string]uint64),
+			clientProvider: fakeClientProvider,
+			endpoints:      newEndpointsBalancers(),
+			breakers:       newCircuitBreakers(),
+			limiters:       newSourceLimiters(),
+			caches:         newValueCaches(),
+			inFlight:       newSourcesInFlightRequests(),
 		},
 		fakeClientProvider: fakeClientProvider,
 	}
@@ -284,6 +365,7 @@ func assertCustomMetric(t *testing.T, registry *Registry, expectated expectation
 	}
 	// Check that the appropriate backend has been selected
 	assert.NotNil(t, backend)
+	backend = unwrap(backend)
 	fakeMetricsClient, ok := backend.(*fakeMetricsClient)
 	if !ok {
 		t.Errorf("fakeMetricsClient implementation expected")
@@ -310,6 +392,7 @@ func assertExternalMetric(t *testing.T, registry *Registry, expectated expectati
 	}
 	// Check that the appropriate backend has been selected
 	assert.NotNil(t, backend)
+	backend = unwrap(backend)
 	fakeMetricsClient, ok := backend.(*fakeMetricsClient)
 	if !ok {
 		t.Errorf("fakeMetricsClient implementation expected")
@@ -0,0 +1,76 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// MaxDiscoveryHistory is the number of discoveries kept in the history of a metrics source.
+	MaxDiscoveryHistory = 10
+	// maxDiscoverySamples is the maximum number of metrics listed in a discovery record.
+	maxDiscoverySamples = 5
+)
+
+func firstSamples(metrics []string) []string {
+	if len(metrics) > maxDiscoverySamples {
+		metrics = metrics[:maxDiscoverySamples]
+	}
+	if len(metrics) == 0 {
+		return nil
+	}
+	return append([]string(nil), metrics...)
+}
+
+// recordDiscovery adds a discovery to the history of a metrics source if it has added or removed some metrics. Must be
+// called with the lock held.
+func (r *Registry) recordDiscovery(changes SourceChanges) {
+	if len(changes.AddedMetrics) == 0 && len(changes.RemovedMetrics) == 0 {
+		return
+	}
+	if r.history == nil {
+		r.history = make(map[string][]v1alpha1.DiscoveryRecord)
+	}
+	history := append(r.history[changes.SourceName], v1alpha1.DiscoveryRecord{
+		// Records are stored in the status with a precision of one second.
+		Time:           metav1.NewTime(time.Now().Truncate(time.Second)),
+		Added:          len(changes.AddedMetrics),
+		Removed:        len(changes.RemovedMetrics),
+		AddedSamples:   firstSamples(changes.AddedMetrics),
+		RemovedSamples: firstSamples(changes.RemovedMetrics),
+	})
+	if len(history) > MaxDiscoveryHistory {
+		history = history[len(history)-MaxDiscoveryHistory:]
+	}
+	r.history[changes.SourceName] = history
+}
+
+// DiscoveryHistory returns the last discoveries which have changed the metrics served by a metrics source, oldest
+// first.
+func (r *Registry) DiscoveryHistory(sourceName string) []v1alpha1.DiscoveryRecord {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	history := make([]v1alpha1.DiscoveryRecord, len(r.history[sourceName]))
+	for i := range r.history[sourceName] {
+		r.history[sourceName][i].DeepCopyInto(&history[i])
+	}
+	return history
+}
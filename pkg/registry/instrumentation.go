@@ -0,0 +1,132 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/accesslog"
+	"github.com/barkbay/custom-metrics-router/pkg/metrics"
+	"github.com/barkbay/custom-metrics-router/pkg/tracing"
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// instrumentedClient is a MetricsClient which records the number and the duration of the requests routed to a metrics
+// source, and traces them.
+type instrumentedClient struct {
+	MetricsClient
+	sourceName string
+}
+
+var _ MetricsClient = &instrumentedClient{}
+
+// start starts the span of a request to the metrics source. The returned function must be called with the result of
+// the request.
+func (c *instrumentedClient) start(ctx context.Context, api, operation, spanName string) (context.Context, func(err error)) {
+	start := time.Now()
+	// The metrics source is also recorded in the span and in the access log entry of the request received by the router.
+	trace.SpanFromContext(ctx).SetAttributes(tracing.SourceKey.String(c.sourceName))
+	accesslog.FromContext(ctx).SetSource(c.sourceName)
+	ctx, span := tracing.Tracer().Start(ctx, "MetricsSource."+spanName, trace.WithAttributes(tracing.SourceKey.String(c.sourceName)))
+	return ctx, func(err error) {
+		code := metrics.Code(err)
+		metrics.Requests.WithLabelValues(c.sourceName, api, operation, code).Inc()
+		metrics.RequestDuration.WithLabelValues(c.sourceName, api, operation, code).Observe(time.Since(start).Seconds())
+		tracing.End(span, err)
+	}
+}
+
+func (c *instrumentedClient) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (value *custom_metrics.MetricValue, err error) {
+	ctx, done := c.start(ctx, metrics.CustomMetricsAPI, metrics.GetByName, "GetMetricByName")
+	defer func() { done(err) }()
+	return c.MetricsClient.GetMetricByName(ctx, name, info, metricSelector)
+}
+
+func (c *instrumentedClient) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (values *custom_metrics.MetricValueList, err error) {
+	ctx, done := c.start(ctx, metrics.CustomMetricsAPI, metrics.GetBySelector, "GetMetricBySelector")
+	defer func() { done(err) }()
+	return c.MetricsClient.GetMetricBySelector(ctx, namespace, selector, info, metricSelector)
+}
+
+func (c *instrumentedClient) GetExternalMetric(ctx context.Context, name, namespace string, metricSelector labels.Selector) (values *external_metrics.ExternalMetricValueList, err error) {
+	ctx, done := c.start(ctx, metrics.ExternalMetricsAPI, metrics.Get, "GetExternalMetric")
+	defer func() { done(err) }()
+	return c.MetricsClient.GetExternalMetric(ctx, name, namespace, metricSelector)
+}
+
+// backendTransport returns the RoundTripper used to send the requests to a metrics backend. Each request is traced, and
+// counted as an attempt in the access log entry of the request being served.
+func backendTransport(delegate http.RoundTripper) http.RoundTripper {
+	return &attemptsTransport{delegate: tracing.Transport(delegate)}
+}
+
+type attemptsTransport struct {
+	delegate http.RoundTripper
+}
+
+func (t *attemptsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	accesslog.FromContext(req.Context()).AddAttempt()
+	return t.delegate.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the idle connections of the delegate RoundTripper.
+func (t *attemptsTransport) CloseIdleConnections() {
+	if c, ok := t.delegate.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// backendInterceptors returns the interceptors of the gRPC calls sent to a metrics backend, they are the counterpart of
+// backendTransport.
+func backendInterceptors() grpc.DialOption {
+	countAttempts := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		accesslog.FromContext(ctx).AddAttempt()
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+	return grpc.WithChainUnaryInterceptor(countAttempts, tracing.UnaryClientInterceptor())
+}
+
+// observeDiscovery records the duration of a discovery.
+func observeDiscovery(sourceName string, start time.Time, err error) {
+	result := metrics.DiscoverySuccess
+	if err != nil {
+		result = metrics.DiscoveryError
+	}
+	metrics.DiscoveryDuration.WithLabelValues(sourceName, result).Observe(time.Since(start).Seconds())
+}
+
+// observeRoutes records the number of metrics served by a metrics source, and by all the metrics sources, once the
+// routing table has been updated. The metrics of a deleted metrics source are removed.
+func observeRoutes(sourceName string, routes *routingTable) {
+	if source, ok := routes.sources[sourceName]; ok {
+		metrics.SourceMetrics.WithLabelValues(sourceName, metrics.CustomMetricsAPI).Set(float64(len(source.customMetricInfos)))
+		metrics.SourceMetrics.WithLabelValues(sourceName, metrics.ExternalMetricsAPI).Set(float64(len(source.externalMetricInfos)))
+	} else {
+		metrics.SourceMetrics.DeleteLabelValues(sourceName, metrics.CustomMetricsAPI)
+		metrics.SourceMetrics.DeleteLabelValues(sourceName, metrics.ExternalMetricsAPI)
+	}
+	metrics.RoutedMetrics.WithLabelValues(metrics.CustomMetricsAPI).Set(float64(len(routes.customMetrics)))
+	metrics.RoutedMetrics.WithLabelValues(metrics.ExternalMetricsAPI).Set(float64(len(routes.externalMetrics)))
+}
@@ -0,0 +1,158 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/barkbay/custom-metrics-router/pkg/accesslog"
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/barkbay/custom-metrics-router/pkg/metrics"
+	"github.com/barkbay/custom-metrics-router/pkg/tracing"
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// sampleCount returns the number of observations of a histogram.
+func sampleCount(t *testing.T, observer prometheus.Observer) uint64 {
+	t.Helper()
+	m := &dto.Metric{}
+	assert.NoError(t, observer.(prometheus.Metric).Write(m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestRegistry_Instrumentation(t *testing.T) {
+	fakeRegistry := newFakeRegistry().
+		servedCustomMetrics("instrumented", "metric1", "metric2").
+		servedExternalMetrics("instrumented", "external1")
+	// The metrics are global: the counters are compared with their values before the requests
+	discoveries := sampleCount(t, metrics.DiscoveryDuration.WithLabelValues("instrumented", metrics.DiscoverySuccess))
+	succeeded := testutil.ToFloat64(metrics.Requests.WithLabelValues("instrumented", metrics.CustomMetricsAPI, metrics.GetByName, "200"))
+	cancelled := testutil.ToFloat64(metrics.Requests.WithLabelValues("instrumented", metrics.CustomMetricsAPI, metrics.GetByName, "499"))
+	_, err := fakeRegistry.registry.AddOrUpdateSource(context.Background(), v1alpha1.MetricsSource{
+		ObjectMeta: metav1.ObjectMeta{Name: "instrumented"},
+		Spec: v1alpha1.MetricsSourceSpec{
+			MetricTypes:           v1alpha1.MetricTypes{v1alpha1.CustomMetrics, v1alpha1.ExternalMetrics},
+			MetricsServiceBackend: v1alpha1.MetricsServiceBackend{Name: "instrumented"},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, discoveries+1, sampleCount(t, metrics.DiscoveryDuration.WithLabelValues("instrumented", metrics.DiscoverySuccess)))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.SourceMetrics.WithLabelValues("instrumented", metrics.CustomMetricsAPI)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.SourceMetrics.WithLabelValues("instrumented", metrics.ExternalMetricsAPI)))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.RoutedMetrics.WithLabelValues(metrics.CustomMetricsAPI)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.RoutedMetrics.WithLabelValues(metrics.ExternalMetricsAPI)))
+
+	info := provider.CustomMetricInfo{Metric: "metric1"}
+	backend, err := fakeRegistry.registry.GetMetricsBackend(info)
+	assert.NoError(t, err)
+	_, err = backend.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "ns", Name: "pod1"}, info, labels.Everything())
+	assert.NoError(t, err)
+	// Request cancelled by the client
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = backend.GetMetricByName(ctx, types.NamespacedName{Namespace: "ns", Name: "pod1"}, info, labels.Everything())
+	assert.Error(t, err)
+	assert.Equal(t, succeeded+1, testutil.ToFloat64(metrics.Requests.WithLabelValues("instrumented", metrics.CustomMetricsAPI, metrics.GetByName, "200")))
+	assert.Equal(t, cancelled+1, testutil.ToFloat64(metrics.Requests.WithLabelValues("instrumented", metrics.CustomMetricsAPI, metrics.GetByName, "499")))
+
+	// The gauges of a deleted metrics source are removed
+	sourceMetrics := testutil.CollectAndCount(metrics.SourceMetrics)
+	fakeRegistry.registry.DeleteSource("instrumented")
+	assert.Equal(t, sourceMetrics-2, testutil.CollectAndCount(metrics.SourceMetrics))
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.RoutedMetrics.WithLabelValues(metrics.CustomMetricsAPI)))
+}
+
+func TestRegistry_Tracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tracing.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer tracing.SetTracerProvider(trace.NewNoopTracerProvider())
+	fakeRegistry := newFakeRegistry().servedExternalMetrics("traced", "external1")
+	_, err := fakeRegistry.registry.AddOrUpdateSource(context.Background(), v1alpha1.MetricsSource{
+		ObjectMeta: metav1.ObjectMeta{Name: "traced"},
+		Spec: v1alpha1.MetricsSourceSpec{
+			MetricTypes:           v1alpha1.MetricTypes{v1alpha1.ExternalMetrics},
+			MetricsServiceBackend: v1alpha1.MetricsServiceBackend{Name: "traced"},
+		},
+	})
+	assert.NoError(t, err)
+
+	backend, err := fakeRegistry.registry.GetExternalMetricsBackend(provider.ExternalMetricInfo{Metric: "external1"})
+	assert.NoError(t, err)
+	ctx, request := tracing.Tracer().Start(context.Background(), "request")
+	_, err = backend.GetExternalMetric(ctx, "external1", "ns", labels.Everything())
+	assert.NoError(t, err)
+	request.End()
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 2)
+	assert.Equal(t, "MetricsSource.GetExternalMetric", spans[0].Name)
+	assert.Equal(t, request.SpanContext().SpanID(), spans[0].Parent.SpanID())
+	assert.Equal(t, []attribute.KeyValue{tracing.SourceKey.String("traced")}, spans[0].Attributes)
+	// The metrics source is also recorded in the span of the request
+	assert.Equal(t, []attribute.KeyValue{tracing.SourceKey.String("traced")}, spans[1].Attributes)
+}
+
+func TestRegistry_AccessLog(t *testing.T) {
+	accessLog, err := accesslog.NewLogger(accesslog.Options{SamplingRatio: 1})
+	assert.NoError(t, err)
+	fakeRegistry := newFakeRegistry().servedExternalMetrics("logged", "external1")
+	_, err = fakeRegistry.registry.AddOrUpdateSource(context.Background(), v1alpha1.MetricsSource{
+		ObjectMeta: metav1.ObjectMeta{Name: "logged"},
+		Spec: v1alpha1.MetricsSourceSpec{
+			MetricTypes:           v1alpha1.MetricTypes{v1alpha1.ExternalMetrics},
+			MetricsServiceBackend: v1alpha1.MetricsServiceBackend{Name: "logged"},
+		},
+	})
+	assert.NoError(t, err)
+
+	// The metrics source is recorded in the entry of the request
+	backend, err := fakeRegistry.registry.GetExternalMetricsBackend(provider.ExternalMetricInfo{Metric: "external1"})
+	assert.NoError(t, err)
+	ctx := accessLog.Start(context.Background(), &accesslog.Entry{})
+	_, err = backend.GetExternalMetric(ctx, "external1", "ns", labels.Everything())
+	assert.NoError(t, err)
+	assert.Equal(t, "logged", accesslog.FromContext(ctx).Source)
+
+	// Each request sent to the backend is counted as an attempt
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: backendTransport(http.DefaultTransport)}
+	for i := 0; i < 2; i++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		assert.NoError(t, err)
+		resp, err := client.Do(req)
+		assert.NoError(t, err)
+		resp.Body.Close()
+	}
+	assert.Equal(t, 2, accesslog.FromContext(ctx).Attempts)
+}
@@ -0,0 +1,260 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// sourceLimiter enforces the rate limits of a metrics source. Requests which cannot be sent immediately wait in a
+// bounded queue.
+type sourceLimiter struct {
+	sourceName string
+	config     v1alpha1.RateLimits
+
+	// inFlight is a semaphore which holds a token for each request in flight, nil if the number of requests in flight
+	// is not limited.
+	inFlight chan struct{}
+	// rate is the QPS limiter, nil if the QPS is not limited.
+	rate *rate.Limiter
+
+	queueLength  int
+	queueTimeout time.Duration
+
+	lock    sync.Mutex
+	waiting int
+}
+
+func newSourceLimiter(sourceName string, config v1alpha1.RateLimits) *sourceLimiter {
+	l := &sourceLimiter{
+		sourceName:   sourceName,
+		config:       config,
+		queueLength:  config.MaxQueueLength(),
+		queueTimeout: config.MaxQueueTimeout(),
+	}
+	if maxInFlight := config.MaxInFlightRequests(); maxInFlight > 0 {
+		l.inFlight = make(chan struct{}, maxInFlight)
+	}
+	if qps := config.MaxQPS(); qps > 0 {
+		l.rate = rate.NewLimiter(rate.Limit(qps), config.MaxBurst())
+	}
+	return l
+}
+
+// enqueue reserves a place in the wait queue, it returns false if the queue is full.
+func (l *sourceLimiter) enqueue() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.waiting >= l.queueLength {
+		return false
+	}
+	l.waiting++
+	return true
+}
+
+func (l *sourceLimiter) dequeue() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.waiting--
+}
+
+func (l *sourceLimiter) release() {
+	if l.inFlight != nil {
+		<-l.inFlight
+	}
+}
+
+// tryAcquire attempts to get an in flight token without waiting.
+func (l *sourceLimiter) tryAcquire() bool {
+	if l.inFlight == nil {
+		return true
+	}
+	select {
+	case l.inFlight <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// acquire waits until a request can be sent to the metrics backend. The returned function must be called once the
+// request is completed. A TooManyRequests error is returned if the request is rejected. A request waits at most the
+// queue timeout, the delay imposed by the QPS limit included: it is rejected up front if the delay exceeds the timeout.
+func (l *sourceLimiter) acquire(ctx context.Context) (func(), error) {
+	var delay time.Duration
+	var reservation *rate.Reservation
+	if l.rate != nil {
+		reservation = l.rate.Reserve()
+		delay = reservation.Delay()
+		if delay > l.queueTimeout {
+			reservation.Cancel()
+			return nil, sourceThrottled(l.sourceName, delay, "QPS limit of %d exceeded", l.config.MaxQPS())
+		}
+	}
+	cancel := func() {
+		if reservation != nil {
+			reservation.Cancel()
+		}
+	}
+
+	// Fast path, the request can be sent immediately
+	if delay == 0 && l.tryAcquire() {
+		return l.release, nil
+	}
+
+	if !l.enqueue() {
+		cancel()
+		return nil, sourceThrottled(l.sourceName, l.queueTimeout, "too many requests waiting to be sent")
+	}
+	defer l.dequeue()
+	// The timeout covers the whole wait, the delay imposed by the QPS limit and the wait for an in flight token.
+	timeout := time.NewTimer(l.queueTimeout)
+	defer timeout.Stop()
+
+	if delay > 0 {
+		wait := time.NewTimer(delay)
+		defer wait.Stop()
+		select {
+		case <-wait.C:
+		case <-ctx.Done():
+			cancel()
+			return nil, ctx.Err()
+		case <-timeout.C:
+			cancel()
+			return nil, sourceThrottled(l.sourceName, l.queueTimeout, "QPS limit of %d exceeded", l.config.MaxQPS())
+		}
+	}
+	if l.inFlight == nil {
+		return l.release, nil
+	}
+	select {
+	case l.inFlight <- struct{}{}:
+		return l.release, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-timeout.C:
+		return nil, sourceThrottled(l.sourceName, l.queueTimeout, "limit of %d requests in flight exceeded", l.config.MaxInFlightRequests())
+	}
+}
+
+// limitedClient is a MetricsClient which enforces the rate limits of a metrics source.
+type limitedClient struct {
+	MetricsClient
+	limiter *sourceLimiter
+}
+
+var _ MetricsClient = &limitedClient{}
+
+func (c *limitedClient) ListCustomMetricInfos(ctx context.Context) (map[provider.CustomMetricInfo]struct{}, error) {
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return c.MetricsClient.ListCustomMetricInfos(ctx)
+}
+
+func (c *limitedClient) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, selector labels.Selector) (*custom_metrics.MetricValue, error) {
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return c.MetricsClient.GetMetricByName(ctx, name, info, selector)
+}
+
+func (c *limitedClient) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return c.MetricsClient.GetMetricBySelector(ctx, namespace, selector, info, metricSelector)
+}
+
+func (c *limitedClient) ListExternalMetrics(ctx context.Context) (map[provider.ExternalMetricInfo]struct{}, error) {
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return c.MetricsClient.ListExternalMetrics(ctx)
+}
+
+func (c *limitedClient) GetExternalMetric(ctx context.Context, name, namespace string, selector labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
+	release, err := c.limiter.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return c.MetricsClient.GetExternalMetric(ctx, name, namespace, selector)
+}
+
+// sourceLimiters holds the limiters of the metrics sources, indexed by the name of the metrics source. A limiter is
+// shared by all the clients of a metrics source, it is only replaced if the limits are updated.
+type sourceLimiters struct {
+	lock     sync.Mutex
+	limiters map[string]*sourceLimiter
+}
+
+func newSourceLimiters() *sourceLimiters {
+	return &sourceLimiters{limiters: make(map[string]*sourceLimiter)}
+}
+
+// prepare returns the limiter to be used with the given limits, or nil if the requests to the metrics source are not
+// limited. The current limiter is reused if the limits are not updated. The limiter is only used for the requests of
+// the metrics source once it has been registered with set.
+func (s *sourceLimiters) prepare(sourceName string, config *v1alpha1.RateLimits) *sourceLimiter {
+	if config == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	limiter, ok := s.limiters[sourceName]
+	if ok && equality.Semantic.DeepEqual(limiter.config, *config) {
+		return limiter
+	}
+	return newSourceLimiter(sourceName, *config.DeepCopy())
+}
+
+// set registers the limiter of a metrics source, a nil limiter means that the requests are not limited.
+func (s *sourceLimiters) set(sourceName string, limiter *sourceLimiter) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if limiter == nil {
+		delete(s.limiters, sourceName)
+		return
+	}
+	s.limiters[sourceName] = limiter
+}
+
+func (s *sourceLimiters) delete(sourceName string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.limiters, sourceName)
+}
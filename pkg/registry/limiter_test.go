@@ -0,0 +1,174 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func assertThrottled(t *testing.T, err error, retryAfterSeconds int32) {
+	t.Helper()
+	if !assert.True(t, apierrors.IsTooManyRequests(err), "TooManyRequests expected, got %v", err) {
+		return
+	}
+	statusErr := err.(*apierrors.StatusError)
+	assert.Equal(t, retryAfterSeconds, statusErr.ErrStatus.Details.RetryAfterSeconds)
+}
+
+func Test_sourceLimiter_maxInFlight(t *testing.T) {
+	limiter := newSourceLimiter("source1", v1alpha1.RateLimits{
+		MaxInFlight:  int32Ptr(2),
+		QueueLength:  int32Ptr(1),
+		QueueTimeout: &metav1.Duration{Duration: 2 * time.Second},
+	})
+	release1, err := limiter.acquire(context.Background())
+	assert.NoError(t, err)
+	release2, err := limiter.acquire(context.Background())
+	assert.NoError(t, err)
+
+	// The third request waits in the queue until a request is completed
+	acquired := make(chan error)
+	go func() {
+		release, err := limiter.acquire(context.Background())
+		if err == nil {
+			defer release()
+		}
+		acquired <- err
+	}()
+	assert.Eventually(t, func() bool {
+		limiter.lock.Lock()
+		defer limiter.lock.Unlock()
+		return limiter.waiting == 1
+	}, 5*time.Second, time.Millisecond)
+
+	// The queue is full, the fourth request is rejected
+	_, err = limiter.acquire(context.Background())
+	assertThrottled(t, err, 2)
+
+	release1()
+	assert.NoError(t, <-acquired)
+	release2()
+}
+
+func Test_sourceLimiter_queueTimeout(t *testing.T) {
+	limiter := newSourceLimiter("source1", v1alpha1.RateLimits{
+		MaxInFlight:  int32Ptr(1),
+		QueueTimeout: &metav1.Duration{Duration: 10 * time.Millisecond},
+	})
+	release, err := limiter.acquire(context.Background())
+	assert.NoError(t, err)
+	defer release()
+	_, err = limiter.acquire(context.Background())
+	assertThrottled(t, err, 1)
+}
+
+func Test_sourceLimiter_cancelled(t *testing.T) {
+	limiter := newSourceLimiter("source1", v1alpha1.RateLimits{MaxInFlight: int32Ptr(1)})
+	release, err := limiter.acquire(context.Background())
+	assert.NoError(t, err)
+	defer release()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = limiter.acquire(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 0, limiter.waiting)
+}
+
+func Test_sourceLimiter_qps(t *testing.T) {
+	limiter := newSourceLimiter("source1", v1alpha1.RateLimits{
+		QPS:          int32Ptr(1),
+		Burst:        int32Ptr(2),
+		QueueTimeout: &metav1.Duration{Duration: 100 * time.Millisecond},
+	})
+	// Burst
+	for i := 0; i < 2; i++ {
+		release, err := limiter.acquire(context.Background())
+		assert.NoError(t, err)
+		release()
+	}
+	// The next token is available in 1s, after the queue timeout
+	_, err := limiter.acquire(context.Background())
+	assertThrottled(t, err, 1)
+}
+
+func Test_sourceLimiter_qpsAndMaxInFlight(t *testing.T) {
+	limiter := newSourceLimiter("source1", v1alpha1.RateLimits{
+		QPS:          int32Ptr(2),
+		Burst:        int32Ptr(1),
+		MaxInFlight:  int32Ptr(1),
+		QueueTimeout: &metav1.Duration{Duration: 600 * time.Millisecond},
+	})
+	release, err := limiter.acquire(context.Background())
+	assert.NoError(t, err)
+	defer release()
+
+	// The next token is available in 500ms, then the request waits for the request in flight until the queue timeout
+	// is reached: the delay imposed by the QPS limit is part of the queue timeout.
+	start := time.Now()
+	_, err = limiter.acquire(context.Background())
+	assertThrottled(t, err, 1)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestRegistry_RateLimits(t *testing.T) {
+	fakeRegistry := newFakeRegistry().servedExternalMetrics("source1", "metric1")
+	rateLimits := &v1alpha1.RateLimits{
+		MaxInFlight:  int32Ptr(1),
+		QueueLength:  int32Ptr(0),
+		QueueTimeout: &metav1.Duration{Duration: time.Second},
+	}
+	source := v1alpha1.MetricsSource{
+		ObjectMeta: metav1.ObjectMeta{Name: "source1"},
+		Spec: v1alpha1.MetricsSourceSpec{
+			MetricTypes:           v1alpha1.MetricTypes{v1alpha1.ExternalMetrics},
+			MetricsServiceBackend: v1alpha1.MetricsServiceBackend{Name: "source1"},
+			RateLimits:            rateLimits,
+		},
+	}
+	_, err := fakeRegistry.registry.AddOrUpdateSource(context.Background(), source)
+	assert.NoError(t, err)
+	limiter := fakeRegistry.registry.limiters.limiters["source1"]
+
+	// The limiter is preserved while the limits are not updated
+	_, err = fakeRegistry.registry.AddOrUpdateSource(context.Background(), source)
+	assert.NoError(t, err)
+	assert.Same(t, limiter, fakeRegistry.registry.limiters.limiters["source1"])
+
+	// Block the only request allowed in flight
+	release, err := limiter.acquire(context.Background())
+	assert.NoError(t, err)
+	backend, err := fakeRegistry.registry.GetExternalMetricsBackend(fakeExternalMetricList("metric1")[0])
+	assert.NoError(t, err)
+	_, err = backend.GetExternalMetric(context.Background(), "metric1", "ns", nil)
+	assertThrottled(t, err, 1)
+	// Discovery requests are also limited
+	_, err = fakeRegistry.registry.AddOrUpdateSource(context.Background(), source)
+	assert.Error(t, err)
+	// Rejected requests are not failures for the circuit breaker
+	assert.Equal(t, v1alpha1.CircuitBreakerClosed, fakeRegistry.registry.CircuitBreakerState("source1"))
+	release()
+
+	_, err = backend.GetExternalMetric(context.Background(), "metric1", "ns", nil)
+	assert.NoError(t, err)
+}
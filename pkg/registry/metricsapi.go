@@ -0,0 +1,171 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	cmint "k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/custom_metrics/v1beta1"
+	"k8s.io/metrics/pkg/apis/custom_metrics/v1beta2"
+	externalMetricsAPI "k8s.io/metrics/pkg/apis/external_metrics/v1beta1"
+	cmClient "k8s.io/metrics/pkg/client/custom_metrics"
+	cmScheme "k8s.io/metrics/pkg/client/custom_metrics/scheme"
+)
+
+// The clients provided by k8s.io/metrics do not accept a context, requests sent to the metrics servers could
+// not be cancelled. The clients in this file are context aware versions of these clients.
+
+var versionConverter = cmClient.NewMetricConverter()
+
+// customMetricsClient is a client for a given version of the custom metrics API.
+type customMetricsClient struct {
+	client  rest.Interface
+	version schema.GroupVersion
+}
+
+func newCustomMetricsClient(baseConfig *rest.Config, version schema.GroupVersion) (*customMetricsClient, error) {
+	config := rest.CopyConfig(baseConfig)
+	config.APIPath = "/apis"
+	if config.UserAgent == "" {
+		config.UserAgent = rest.DefaultKubernetesUserAgent()
+	}
+	config.GroupVersion = &version
+	config.NegotiatedSerializer = cmScheme.Codecs.WithoutConversion()
+	client, err := rest.RESTClientFor(config)
+	if err != nil {
+		return nil, err
+	}
+	return &customMetricsClient{client: client, version: version}, nil
+}
+
+// getForObject returns the value of a metric for a single object.
+func (c *customMetricsClient) getForObject(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*v1beta2.MetricValue, error) {
+	params, err := versionConverter.ConvertListOptionsToVersion(&cmint.MetricListOptions{
+		MetricLabelSelector: metricSelector.String(),
+	}, c.version)
+	if err != nil {
+		return nil, err
+	}
+
+	request := c.client.Get()
+	if info.GroupResource == (schema.GroupResource{Resource: "namespaces"}) {
+		// namespace-describing metrics have a path of /namespaces/$NS/metrics/$metric
+		request = request.Resource("metrics").Namespace(name.Name).Name(info.Metric)
+	} else {
+		if info.Namespaced {
+			request = request.Namespace(name.Namespace)
+		}
+		request = request.Resource(info.GroupResource.String()).Name(name.Name).SubResource(info.Metric)
+	}
+	result := request.VersionedParams(params, cmScheme.ParameterCodec).Do(ctx)
+
+	res, err := toMetricValueList(result)
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Items) != 1 {
+		return nil, fmt.Errorf("the custom metrics API server returned %v results when we asked for exactly one", len(res.Items))
+	}
+	return &res.Items[0], nil
+}
+
+// getForObjects returns the value of a metric for all the objects matching a selector.
+func (c *customMetricsClient) getForObjects(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*v1beta2.MetricValueList, error) {
+	// we can't wildcard-fetch for namespaces
+	if info.GroupResource == (schema.GroupResource{Resource: "namespaces"}) {
+		return nil, fmt.Errorf("cannot fetch metrics for multiple namespaces at once")
+	}
+
+	params, err := versionConverter.ConvertListOptionsToVersion(&cmint.MetricListOptions{
+		LabelSelector:       selector.String(),
+		MetricLabelSelector: metricSelector.String(),
+	}, c.version)
+	if err != nil {
+		return nil, err
+	}
+
+	request := c.client.Get()
+	if info.Namespaced {
+		request = request.Namespace(namespace)
+	}
+	result := request.
+		Resource(info.GroupResource.String()).
+		Name(v1beta1.AllObjects).
+		SubResource(info.Metric).
+		VersionedParams(params, cmScheme.ParameterCodec).
+		Do(ctx)
+
+	return toMetricValueList(result)
+}
+
+func toMetricValueList(result rest.Result) (*v1beta2.MetricValueList, error) {
+	metricObj, err := versionConverter.ConvertResultToVersion(result, v1beta2.SchemeGroupVersion)
+	if err != nil {
+		return nil, err
+	}
+	res, ok := metricObj.(*v1beta2.MetricValueList)
+	if !ok {
+		return nil, fmt.Errorf("the custom metrics API server didn't return MetricValueList, the type is %v", reflect.TypeOf(metricObj))
+	}
+	return res, nil
+}
+
+// externalMetricsClient is a client for the external metrics API.
+type externalMetricsClient struct {
+	client rest.Interface
+}
+
+func newExternalMetricsClient(baseConfig *rest.Config) (*externalMetricsClient, error) {
+	config := rest.CopyConfig(baseConfig)
+	config.APIPath = "/apis"
+	if config.UserAgent == "" {
+		config.UserAgent = rest.DefaultKubernetesUserAgent()
+	}
+	config.GroupVersion = &externalMetricsAPI.SchemeGroupVersion
+	config.NegotiatedSerializer = scheme.Codecs.WithoutConversion()
+	client, err := rest.RESTClientFor(config)
+	if err != nil {
+		return nil, err
+	}
+	return &externalMetricsClient{client: client}, nil
+}
+
+func (c *externalMetricsClient) list(ctx context.Context, namespace, metricName string, metricSelector labels.Selector) (*externalMetricsAPI.ExternalMetricValueList, error) {
+	res := &externalMetricsAPI.ExternalMetricValueList{}
+	err := c.client.Get().
+		Namespace(namespace).
+		Resource(metricName).
+		VersionedParams(&metav1.ListOptions{
+			LabelSelector: metricSelector.String(),
+		}, metav1.ParameterCodec).
+		Do(ctx).
+		Into(res)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
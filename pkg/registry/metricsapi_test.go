@@ -0,0 +1,148 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/metrics/pkg/apis/custom_metrics/v1beta2"
+	externalMetricsAPI "k8s.io/metrics/pkg/apis/external_metrics/v1beta1"
+)
+
+// recordingMetricsServer records the requests it receives and replies with a single metric value.
+func recordingMetricsServer(t *testing.T, requests *[]string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests = append(*requests, r.URL.RequestURI())
+		var obj interface{}
+		if strings.HasPrefix(r.URL.Path, "/apis/custom.metrics.k8s.io/") {
+			obj = v1beta2.MetricValueList{
+				TypeMeta: metav1.TypeMeta{Kind: "MetricValueList", APIVersion: "custom.metrics.k8s.io/v1beta2"},
+				Items:    []v1beta2.MetricValue{{}},
+			}
+		} else {
+			obj = externalMetricsAPI.ExternalMetricValueList{
+				TypeMeta: metav1.TypeMeta{Kind: "ExternalMetricValueList", APIVersion: "external.metrics.k8s.io/v1beta1"},
+				Items:    []externalMetricsAPI.ExternalMetricValue{{}},
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		assert.NoError(t, json.NewEncoder(w).Encode(obj))
+	}))
+}
+
+func TestCustomMetricsClient_getForObject(t *testing.T) {
+	tests := []struct {
+		name           string
+		object         types.NamespacedName
+		info           provider.CustomMetricInfo
+		metricSelector labels.Selector
+		want           string
+	}{
+		{
+			name:           "namespaced object",
+			object:         types.NamespacedName{Namespace: "ns", Name: "mypod"},
+			info:           provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests"},
+			metricSelector: labels.SelectorFromSet(labels.Set{"method": "GET"}),
+			want:           "/apis/custom.metrics.k8s.io/v1beta2/namespaces/ns/pods/mypod/http_requests?metricLabelSelector=method%3DGET",
+		},
+		{
+			name:           "root scoped object",
+			object:         types.NamespacedName{Name: "node1"},
+			info:           provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "nodes"}, Metric: "cpu_temperature"},
+			metricSelector: labels.Everything(),
+			want:           "/apis/custom.metrics.k8s.io/v1beta2/nodes/node1/cpu_temperature",
+		},
+		{
+			name:           "object with a group",
+			object:         types.NamespacedName{Namespace: "ns", Name: "web"},
+			info:           provider.CustomMetricInfo{GroupResource: schema.GroupResource{Group: "apps", Resource: "deployments"}, Namespaced: true, Metric: "http_requests"},
+			metricSelector: labels.Everything(),
+			want:           "/apis/custom.metrics.k8s.io/v1beta2/namespaces/ns/deployments.apps/web/http_requests",
+		},
+		{
+			name:           "namespace",
+			object:         types.NamespacedName{Name: "ns"},
+			info:           provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Metric: "queue_length"},
+			metricSelector: labels.Everything(),
+			want:           "/apis/custom.metrics.k8s.io/v1beta2/namespaces/ns/metrics/queue_length",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests []string
+			server := recordingMetricsServer(t, &requests)
+			defer server.Close()
+			client, err := newCustomMetricsClient(&rest.Config{Host: server.URL}, v1beta2.SchemeGroupVersion)
+			assert.NoError(t, err)
+			_, err = client.getForObject(context.Background(), tt.object, tt.info, tt.metricSelector)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{tt.want}, requests)
+		})
+	}
+}
+
+func TestCustomMetricsClient_getForObjects(t *testing.T) {
+	var requests []string
+	server := recordingMetricsServer(t, &requests)
+	defer server.Close()
+	client, err := newCustomMetricsClient(&rest.Config{Host: server.URL}, v1beta2.SchemeGroupVersion)
+	assert.NoError(t, err)
+
+	pods := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests"}
+	_, err = client.getForObjects(context.Background(), "ns", labels.SelectorFromSet(labels.Set{"app": "web"}), pods, labels.Everything())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"/apis/custom.metrics.k8s.io/v1beta2/namespaces/ns/pods/%2A/http_requests?labelSelector=app%3Dweb"}, requests)
+
+	// Metrics of several namespaces cannot be fetched at once
+	namespaces := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Metric: "queue_length"}
+	_, err = client.getForObjects(context.Background(), "", labels.Everything(), namespaces, labels.Everything())
+	assert.Error(t, err)
+	assert.Len(t, requests, 1)
+}
+
+func TestExternalMetricsClient_list(t *testing.T) {
+	var requests []string
+	server := recordingMetricsServer(t, &requests)
+	defer server.Close()
+	client, err := newExternalMetricsClient(&rest.Config{Host: server.URL})
+	assert.NoError(t, err)
+
+	values, err := client.list(context.Background(), "ns", "queue_length", labels.SelectorFromSet(labels.Set{"queue": "orders"}))
+	assert.NoError(t, err)
+	assert.Len(t, values.Items, 1)
+	assert.Equal(t, []string{"/apis/external.metrics.k8s.io/v1beta1/namespaces/ns/queue_length?labelSelector=queue%3Dorders"}, requests)
+
+	// Requests are not sent once the context is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = client.list(ctx, "ns", "queue_length", labels.Everything())
+	assert.Error(t, err)
+	assert.Len(t, requests, 1)
+}
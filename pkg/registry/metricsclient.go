@@ -17,56 +17,64 @@ limitations under the License.
 package registry
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
 	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
-	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/discovery"
-	cachedDiscovery "k8s.io/client-go/discovery/cached"
 	"k8s.io/client-go/rest"
 	"k8s.io/klog"
 	"k8s.io/metrics/pkg/apis/custom_metrics"
 	customMetricsAPI "k8s.io/metrics/pkg/apis/custom_metrics/v1beta1"
-	"k8s.io/metrics/pkg/apis/custom_metrics/v1beta2"
 	"k8s.io/metrics/pkg/apis/external_metrics"
 	externalMetricsAPI "k8s.io/metrics/pkg/apis/external_metrics/v1beta1"
 	cmClient "k8s.io/metrics/pkg/client/custom_metrics"
-	emClient "k8s.io/metrics/pkg/client/external_metrics"
 )
 
+// MetricsClient is a client for a metrics source. The context given to each method is the one of the request
+// received by the router: backend requests are cancelled if the original request is cancelled or if its deadline is exceeded.
 type MetricsClient interface {
 	GetBackend() v1alpha1.MetricsServiceBackend
 
-	ListCustomMetricInfos() (map[provider.CustomMetricInfo]struct{}, error)
-	GetMetricByName(name types.NamespacedName, info provider.CustomMetricInfo, selector labels.Selector) (*custom_metrics.MetricValue, error)
-	GetMetricBySelector(namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error)
+	ListCustomMetricInfos(ctx context.Context) (map[provider.CustomMetricInfo]struct{}, error)
+	GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, selector labels.Selector) (*custom_metrics.MetricValue, error)
+	GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error)
 
-	ListExternalMetrics() (map[provider.ExternalMetricInfo]struct{}, error)
-	GetExternalMetric(name, namespace string, selector labels.Selector) (*external_metrics.ExternalMetricValueList, error)
+	ListExternalMetrics(ctx context.Context) (map[provider.ExternalMetricInfo]struct{}, error)
+	GetExternalMetric(ctx context.Context, name, namespace string, selector labels.Selector) (*external_metrics.ExternalMetricValueList, error)
 }
 
 type MetricsClientProvider interface {
-	NewClient(insecureTLSSkipVerify bool, backend v1alpha1.MetricsServiceBackend) (MetricsClient, error)
+	NewClient(source v1alpha1.MetricsSource) (MetricsClient, error)
 }
 
 type metricsClientProvider struct {
 	baseConfig *rest.Config
-	mapper     meta.RESTMapper
+	endpoints  *endpointsBalancers
+	// objects is used by the backends which need to list the objects described by the custom metrics.
+	objects objectLister
+	scalers *scalerConnections
 }
 
 type metricsClient struct {
-	customMetricsAvailableAPIsGetter cmClient.AvailableAPIsGetter
-	customMetricsClient              cmClient.CustomMetricsClient
+	sourceName string
+	config     *rest.Config
 
-	externalMetricsClient emClient.ExternalMetricsClient
-	discoveryClient       discovery.CachedDiscoveryInterface
-	mapper                meta.RESTMapper
+	// customMetricsClients holds a client for each version of the custom metrics API, the version used is the preferred
+	// one, as read during the last discovery.
+	customMetricsLock             sync.RWMutex
+	customMetricsClients          map[schema.GroupVersion]*customMetricsClient
+	customMetricsPreferredVersion *schema.GroupVersion
+
+	externalMetricsClient *externalMetricsClient
+	discoveryClient       rest.Interface
 	backend               v1alpha1.MetricsServiceBackend
 }
 
@@ -74,7 +82,7 @@ var _ MetricsClient = &metricsClient{}
 
 // adaptConfig update the original K8S client configuration so it can be used to connect to the
 // metric service.
-func adaptConfig(baseConfig *rest.Config, backend v1alpha1.MetricsServiceBackend, insecure bool) (*rest.Config, error) {
+func adaptConfig(baseConfig *rest.Config, backend v1alpha1.MetricsServiceBackend, insecure bool, balancer *endpointsBalancer) (*rest.Config, error) {
 	// Do not work on the original object
 	clientConfig := rest.CopyConfig(baseConfig)
 	if insecure {
@@ -82,51 +90,138 @@ func adaptConfig(baseConfig *rest.Config, backend v1alpha1.MetricsServiceBackend
 			Insecure: true,
 		}
 	}
+	if !insecure && len(backend.CABundle) > 0 {
+		clientConfig.TLSClientConfig.CAFile = ""
+		clientConfig.TLSClientConfig.CAData = backend.CABundle
+	}
 	clientConfig.Host = backend.URL()
+	if balancer != nil {
+		// Requests are sent to the endpoints IP addresses, certificates must still be verified against the service name.
+		clientConfig.TLSClientConfig.ServerName = backend.ServerName()
+		clientConfig.Wrap(balancer.wrap)
+	}
+	// Each request sent to an endpoint is traced and counted
+	clientConfig.Wrap(backendTransport)
 	return clientConfig, nil
 }
 
-func (mcp metricsClientProvider) NewClient(insecureTLSSkipVerify bool, backend v1alpha1.MetricsServiceBackend) (MetricsClient, error) {
-	config, err := adaptConfig(mcp.baseConfig, backend, insecureTLSSkipVerify)
+func (mcp metricsClientProvider) NewClient(source v1alpha1.MetricsSource) (MetricsClient, error) {
+	if !source.Spec.HasServiceBackend() || !source.Spec.MetricsServiceBackend.HasLoadBalancing() {
+		// The balancer of the service previously used by the metrics source, if any, is not needed anymore
+		mcp.endpoints.release(source.Name)
+	}
+	if source.Spec.Prometheus != nil {
+		return newPrometheusClient(source.Name, *source.Spec.Prometheus, source.Spec.InsecureSkipTLSVerify, mcp.objects)
+	}
+	if scaler := source.Spec.ExternalScaler; scaler != nil {
+		conn, release, err := mcp.scalers.get(*scaler, source.Spec.InsecureSkipTLSVerify)
+		if err != nil {
+			return nil, err
+		}
+		client := newScalerClient(source.Name, *scaler, conn)
+		client.release = release
+		return client, nil
+	}
+	if webhook := source.Spec.Webhook; webhook != nil {
+		return newWebhookClient(source.Name, *webhook, source.Spec.InsecureSkipTLSVerify, mcp.objects), nil
+	}
+	backend := source.Spec.MetricsServiceBackend
+	var balancer *endpointsBalancer
+	if backend.HasLoadBalancing() {
+		balancer = mcp.endpoints.get(source.Name, backend)
+	}
+	config, err := adaptConfig(mcp.baseConfig, backend, source.Spec.InsecureSkipTLSVerify, balancer)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate rest config for %s: %s", backend.URL(), err)
 	}
+	return newMetricsClient(config, source.Name, backend)
+}
+
+func newMetricsClient(config *rest.Config, sourceName string, backend v1alpha1.MetricsServiceBackend) (*metricsClient, error) {
 	discoveryClient, err := discovery.NewDiscoveryClientForConfig(config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create discovery client: %v", err)
 	}
-	cachedClient := cachedDiscovery.NewMemCacheClient(discoveryClient)
-	customMetricsAvailableAPIsGetter := cmClient.NewAvailableAPIsGetter(discoveryClient)
-	customMetricsClient := cmClient.NewForConfig(config, mcp.mapper, customMetricsAvailableAPIsGetter)
-	externalMetricsClient, err := emClient.NewForConfig(config)
+	externalMetricsClient, err := newExternalMetricsClient(config)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create external metrics client: %v", err)
 	}
 
 	return &metricsClient{
-		backend: backend,
+		sourceName: sourceName,
+		config:     config,
+		backend:    backend,
 
-		customMetricsAvailableAPIsGetter: customMetricsAvailableAPIsGetter,
-		customMetricsClient:              customMetricsClient,
+		customMetricsClients: make(map[schema.GroupVersion]*customMetricsClient),
 
 		externalMetricsClient: externalMetricsClient,
-		discoveryClient:       cachedClient,
-		mapper:                mcp.mapper,
-	}, err
+		discoveryClient:       discoveryClient.RESTClient(),
+	}, nil
 }
 
 func (c *metricsClient) GetBackend() v1alpha1.MetricsServiceBackend {
 	return c.backend
 }
 
-func (c *metricsClient) ListCustomMetricInfos() (map[provider.CustomMetricInfo]struct{}, error) {
-	version, err := c.customMetricsAvailableAPIsGetter.PreferredVersion()
+// discoverCustomMetricsVersion reads the preferred version of the custom metrics API served by the backend.
+func (c *metricsClient) discoverCustomMetricsVersion(ctx context.Context) (schema.GroupVersion, error) {
+	group := &metav1.APIGroup{}
+	if err := c.discoveryClient.Get().AbsPath("/apis", customMetricsAPI.SchemeGroupVersion.Group).Do(ctx).Into(group); err != nil {
+		return schema.GroupVersion{}, backendError(c.sourceName, err)
+	}
+	versions := append([]metav1.GroupVersionForDiscovery{group.PreferredVersion}, group.Versions...)
+	for _, version := range versions {
+		for _, supportedVersion := range cmClient.MetricVersions {
+			if version.Version == supportedVersion.Version {
+				return supportedVersion, nil
+			}
+		}
+	}
+	return schema.GroupVersion{}, sourceUnavailable(c.sourceName, "no supported version of %s served by %s", customMetricsAPI.SchemeGroupVersion.Group, c.backend.URL())
+}
+
+// getCustomMetricsClient returns a client for the preferred version of the custom metrics API. The errors returned
+// already hold the name of the metrics source.
+func (c *metricsClient) getCustomMetricsClient(ctx context.Context) (*customMetricsClient, error) {
+	c.customMetricsLock.RLock()
+	version := c.customMetricsPreferredVersion
+	c.customMetricsLock.RUnlock()
+	if version == nil {
+		preferredVersion, err := c.discoverCustomMetricsVersion(ctx)
+		if err != nil {
+			return nil, err
+		}
+		version = &preferredVersion
+	}
+	return c.customMetricsClientForVersion(*version)
+}
+
+func (c *metricsClient) customMetricsClientForVersion(version schema.GroupVersion) (*customMetricsClient, error) {
+	c.customMetricsLock.Lock()
+	defer c.customMetricsLock.Unlock()
+	c.customMetricsPreferredVersion = &version
+	if client, ok := c.customMetricsClients[version]; ok {
+		return client, nil
+	}
+	client, err := newCustomMetricsClient(c.config, version)
 	if err != nil {
-		return nil, err
+		return nil, backendError(c.sourceName, err)
 	}
-	resources, err := c.discoveryClient.ServerResourcesForGroupVersion(version.String())
+	c.customMetricsClients[version] = client
+	return client, nil
+}
+
+func (c *metricsClient) ListCustomMetricInfos(ctx context.Context) (map[provider.CustomMetricInfo]struct{}, error) {
+	version, err := c.discoverCustomMetricsVersion(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get resource for %s: %v", customMetricsAPI.SchemeGroupVersion, err)
+		return nil, err
+	}
+	if _, err := c.customMetricsClientForVersion(version); err != nil {
+		return nil, err
+	}
+	resources := &metav1.APIResourceList{}
+	if err := c.discoveryClient.Get().AbsPath("/apis", version.Group, version.Version).Do(ctx).Into(resources); err != nil {
+		return nil, backendError(c.sourceName, err)
 	}
 	metricInfos := make(map[provider.CustomMetricInfo]struct{})
 	for _, r := range resources.APIResources {
@@ -144,23 +239,14 @@ func (c *metricsClient) ListCustomMetricInfos() (map[provider.CustomMetricInfo]s
 	return metricInfos, nil
 }
 
-func (c *metricsClient) GetMetricByName(name types.NamespacedName, info provider.CustomMetricInfo, selector labels.Selector) (*custom_metrics.MetricValue, error) {
-	var object *v1beta2.MetricValue
-
-	var err error
-	if info.Namespaced {
-		object, err = c.customMetricsClient.NamespacedMetrics(name.Namespace).GetForObject(
-			schema.GroupKind{Group: info.GroupResource.Group, Kind: info.GroupResource.Resource},
-			name.Name, info.Metric, selector,
-		)
-	} else {
-		object, err = c.customMetricsClient.RootScopedMetrics().GetForObject(
-			schema.GroupKind{Group: info.GroupResource.Group, Kind: info.GroupResource.Resource},
-			name.Name, info.Metric, selector,
-		)
+func (c *metricsClient) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, selector labels.Selector) (*custom_metrics.MetricValue, error) {
+	client, err := c.getCustomMetricsClient(ctx)
+	if err != nil {
+		return nil, err
 	}
+	object, err := client.getForObject(ctx, name, info, selector)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get metric from backend: %v", err)
+		return nil, backendError(c.sourceName, err)
 	}
 	return &custom_metrics.MetricValue{
 		DescribedObject: custom_metrics.ObjectReference{
@@ -180,33 +266,14 @@ func (c *metricsClient) GetMetricByName(name types.NamespacedName, info provider
 	}, nil
 }
 
-func (c *metricsClient) GetMetricBySelector(namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
-	var objects *v1beta2.MetricValueList
-	var err error
-	kind, err := c.mapper.ResourceSingularizer(info.GroupResource.Resource)
+func (c *metricsClient) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	client, err := c.getCustomMetricsClient(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to singularize %s: %v", info.GroupResource.Resource, err)
-	}
-	klog.Infof("custom metric info: %#v", info)
-	if info.Namespaced {
-		objects, err = c.customMetricsClient.NamespacedMetrics(namespace).GetForObjects(
-			schema.GroupKind{
-				Group: info.GroupResource.Group,
-				Kind:  kind,
-			},
-			selector, info.Metric, metricSelector,
-		)
-	} else {
-		objects, err = c.customMetricsClient.RootScopedMetrics().GetForObjects(
-			schema.GroupKind{
-				Group: info.GroupResource.Group,
-				Kind:  kind,
-			},
-			selector, info.Metric, metricSelector,
-		)
+		return nil, err
 	}
+	objects, err := client.getForObjects(ctx, namespace, selector, info, metricSelector)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get metric from backend: %v", err)
+		return nil, backendError(c.sourceName, err)
 	}
 	values := make([]custom_metrics.MetricValue, len(objects.Items))
 	for i, v := range objects.Items {
@@ -232,11 +299,15 @@ func (c *metricsClient) GetMetricBySelector(namespace string, selector labels.Se
 	}, nil
 }
 
-func (c *metricsClient) ListExternalMetrics() (map[provider.ExternalMetricInfo]struct{}, error) {
+func (c *metricsClient) ListExternalMetrics(ctx context.Context) (map[provider.ExternalMetricInfo]struct{}, error) {
 	infos := make(map[provider.ExternalMetricInfo]struct{})
-	resources, err := c.discoveryClient.ServerResourcesForGroupVersion(externalMetricsAPI.SchemeGroupVersion.String())
+	resources := &metav1.APIResourceList{}
+	err := c.discoveryClient.Get().
+		AbsPath("/apis", externalMetricsAPI.SchemeGroupVersion.Group, externalMetricsAPI.SchemeGroupVersion.Version).
+		Do(ctx).
+		Into(resources)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get resource for %s: %v", externalMetricsAPI.SchemeGroupVersion, err)
+		return nil, backendError(c.sourceName, err)
 	}
 	for _, r := range resources.APIResources {
 		info := provider.ExternalMetricInfo{
@@ -247,10 +318,10 @@ func (c *metricsClient) ListExternalMetrics() (map[provider.ExternalMetricInfo]s
 	return infos, nil
 }
 
-func (c *metricsClient) GetExternalMetric(name, namespace string, selector labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
-	result, err := c.externalMetricsClient.NamespacedMetrics(namespace).List(name, selector)
+func (c *metricsClient) GetExternalMetric(ctx context.Context, name, namespace string, selector labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
+	result, err := c.externalMetricsClient.list(ctx, namespace, name, selector)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get metrics for external metric %s/%s: %v", namespace, name, err)
+		return nil, backendError(c.sourceName, err)
 	}
 	valueList := &external_metrics.ExternalMetricValueList{
 		Items: make([]external_metrics.ExternalMetricValue, len(result.Items)),
@@ -0,0 +1,148 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"k8s.io/metrics/pkg/apis/custom_metrics/v1beta2"
+)
+
+// fakeMetricsServer is a minimal implementation of a custom and external metrics server.
+func fakeMetricsServer(t *testing.T, cancelled chan<- struct{}) *httptest.Server {
+	t.Helper()
+	writeJSON := func(w http.ResponseWriter, obj interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		assert.NoError(t, json.NewEncoder(w).Encode(obj))
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/apis/custom.metrics.k8s.io", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, metav1.APIGroup{
+			TypeMeta: metav1.TypeMeta{Kind: "APIGroup", APIVersion: "v1"},
+			Name:     "custom.metrics.k8s.io",
+			Versions: []metav1.GroupVersionForDiscovery{
+				{GroupVersion: "custom.metrics.k8s.io/v1beta2", Version: "v1beta2"},
+				{GroupVersion: "custom.metrics.k8s.io/v1beta1", Version: "v1beta1"},
+			},
+			PreferredVersion: metav1.GroupVersionForDiscovery{GroupVersion: "custom.metrics.k8s.io/v1beta2", Version: "v1beta2"},
+		})
+	})
+	mux.HandleFunc("/apis/custom.metrics.k8s.io/v1beta2", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, metav1.APIResourceList{
+			TypeMeta:     metav1.TypeMeta{Kind: "APIResourceList", APIVersion: "v1"},
+			GroupVersion: "custom.metrics.k8s.io/v1beta2",
+			APIResources: []metav1.APIResource{
+				{Name: "pods/http_requests", Namespaced: true, Kind: "MetricValueList"},
+				{Name: "malformed", Namespaced: true, Kind: "MetricValueList"},
+			},
+		})
+	})
+	mux.HandleFunc("/apis/custom.metrics.k8s.io/v1beta2/namespaces/ns/pods/mypod/http_requests", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, v1beta2.MetricValueList{
+			TypeMeta: metav1.TypeMeta{Kind: "MetricValueList", APIVersion: "custom.metrics.k8s.io/v1beta2"},
+			Items: []v1beta2.MetricValue{{
+				DescribedObject: v1.ObjectReference{Kind: "Pod", Namespace: "ns", Name: "mypod"},
+				Metric:          v1beta2.MetricIdentifier{Name: "http_requests"},
+				Value:           resource.MustParse("42"),
+			}},
+		})
+	})
+	mux.HandleFunc("/apis/external.metrics.k8s.io/v1beta1/namespaces/ns/throttled_metric", func(w http.ResponseWriter, r *http.Request) {
+		status := apierrors.NewTooManyRequests("too many requests", 1).Status()
+		status.TypeMeta = metav1.TypeMeta{Kind: "Status", APIVersion: "v1"}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusTooManyRequests)
+		assert.NoError(t, json.NewEncoder(w).Encode(status))
+	})
+	mux.HandleFunc("/apis/external.metrics.k8s.io/v1beta1/namespaces/ns/slow_metric", func(w http.ResponseWriter, r *http.Request) {
+		// Block until the client goes away
+		<-r.Context().Done()
+		close(cancelled)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestMetricsClient(t *testing.T) {
+	cancelled := make(chan struct{})
+	server := fakeMetricsServer(t, cancelled)
+	defer server.Close()
+	client, err := newMetricsClient(&rest.Config{Host: server.URL}, "fake", v1alpha1.MetricsServiceBackend{Name: "fake"})
+	assert.NoError(t, err)
+
+	// Discovery
+	customMetrics, err := client.ListCustomMetricInfos(context.Background())
+	assert.NoError(t, err)
+	podMetric := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests"}
+	assert.Equal(t, map[provider.CustomMetricInfo]struct{}{podMetric: {}}, customMetrics)
+
+	// Get a value
+	value, err := client.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "ns", Name: "mypod"}, podMetric, labels.Everything())
+	assert.NoError(t, err)
+	assert.Equal(t, "mypod", value.DescribedObject.Name)
+	assert.Equal(t, int64(42), value.Value.Value())
+
+	// Status returned by the backend is preserved
+	_, err = client.GetExternalMetric(context.Background(), "throttled_metric", "ns", labels.Everything())
+	assert.True(t, apierrors.IsTooManyRequests(err))
+	assert.Contains(t, err.Error(), "metrics source fake")
+
+	// Backend requests are cancelled with the context
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = client.GetExternalMetric(ctx, "slow_metric", "ns", labels.Everything())
+	assert.Error(t, err)
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend request has not been cancelled")
+	}
+}
+
+func TestMetricsClient_Errors(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	podMetric := provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests"}
+
+	// The name of the metrics source is only added once to the errors
+	client, err := newMetricsClient(&rest.Config{Host: server.URL}, "fake", v1alpha1.MetricsServiceBackend{Name: "fake"})
+	assert.NoError(t, err)
+	_, err = client.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "ns", Name: "mypod"}, podMetric, labels.Everything())
+	assert.True(t, apierrors.IsNotFound(err))
+	assert.Equal(t, 1, strings.Count(err.Error(), "metrics source fake:"), err.Error())
+	_, err = client.GetMetricBySelector(context.Background(), "ns", labels.Everything(), podMetric, labels.Everything())
+	assert.True(t, apierrors.IsNotFound(err))
+	assert.Equal(t, 1, strings.Count(err.Error(), "metrics source fake:"), err.Error())
+	_, err = client.ListCustomMetricInfos(context.Background())
+	assert.Equal(t, 1, strings.Count(err.Error(), "metrics source fake:"), err.Error())
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/discovery/cached/memory"
+	"k8s.io/client-go/metadata"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/restmapper"
+)
+
+// objectLister lists the Kubernetes objects described by custom metrics. It is used by the backends which do not
+// implement the custom metrics API, to resolve the objects matched by a label selector.
+type objectLister interface {
+	// KindFor returns the kind of the given resource.
+	KindFor(resource schema.GroupResource) (schema.GroupVersionKind, error)
+	// Names returns the names of the objects of the given resource, in the given namespace, matched by the selector.
+	Names(ctx context.Context, resource schema.GroupResource, namespace string, selector labels.Selector) ([]string, error)
+}
+
+// Listing other resources than the ones below requires additional permissions.
+//+kubebuilder:rbac:groups="",resources=pods;namespaces;nodes,verbs=list
+//+kubebuilder:rbac:groups=apps,resources=deployments;statefulsets;replicasets;daemonsets,verbs=list
+
+// kubeObjects is an objectLister which reads the objects metadata from the Kubernetes API server.
+type kubeObjects struct {
+	config *rest.Config
+
+	once     sync.Once
+	err      error
+	mapper   meta.RESTMapper
+	metadata metadata.Interface
+}
+
+var _ objectLister = &kubeObjects{}
+
+func newKubeObjects(config *rest.Config) *kubeObjects {
+	return &kubeObjects{config: config}
+}
+
+// init creates the clients when they are used for the first time.
+func (k *kubeObjects) init() error {
+	k.once.Do(func() {
+		discoveryClient, err := discovery.NewDiscoveryClientForConfig(k.config)
+		if err != nil {
+			k.err = fmt.Errorf("failed to create discovery client: %v", err)
+			return
+		}
+		k.mapper = restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(discoveryClient))
+		k.metadata, err = metadata.NewForConfig(k.config)
+		if err != nil {
+			k.err = fmt.Errorf("failed to create metadata client: %v", err)
+		}
+	})
+	return k.err
+}
+
+func (k *kubeObjects) KindFor(resource schema.GroupResource) (schema.GroupVersionKind, error) {
+	if err := k.init(); err != nil {
+		return schema.GroupVersionKind{}, err
+	}
+	return k.mapper.KindFor(resource.WithVersion(""))
+}
+
+func (k *kubeObjects) Names(ctx context.Context, resource schema.GroupResource, namespace string, selector labels.Selector) ([]string, error) {
+	if err := k.init(); err != nil {
+		return nil, err
+	}
+	gvr, err := k.mapper.ResourceFor(resource.WithVersion(""))
+	if err != nil {
+		return nil, err
+	}
+	options := metav1.ListOptions{LabelSelector: selector.String()}
+	var objects *metav1.PartialObjectMetadataList
+	if namespace == "" {
+		objects, err = k.metadata.Resource(gvr).List(ctx, options)
+	} else {
+		objects, err = k.metadata.Resource(gvr).Namespace(namespace).List(ctx, options)
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(objects.Items))
+	for i, object := range objects.Items {
+		names[i] = object.Name
+	}
+	return names, nil
+}
@@ -0,0 +1,385 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	promapi "github.com/prometheus/client_golang/api"
+	promv1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	"github.com/prometheus/common/model"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/selection"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// customQuery is the data available in the template of a custom metric query.
+type customQuery struct {
+	Namespace     string
+	Names         string
+	LabelMatchers string
+}
+
+// externalQuery is the data available in the template of an external metric query.
+type externalQuery struct {
+	Namespace     string
+	LabelMatchers string
+}
+
+type customMetricRule struct {
+	query       *template.Template
+	objectLabel model.LabelName
+}
+
+// prometheusClient is a MetricsClient which gets the metrics values from the Prometheus HTTP API.
+type prometheusClient struct {
+	sourceName string
+	api        promv1.API
+	objects    objectLister
+	transport  *http.Transport
+
+	customMetrics   map[provider.CustomMetricInfo]customMetricRule
+	externalMetrics map[provider.ExternalMetricInfo]*template.Template
+}
+
+var _ MetricsClient = &prometheusClient{}
+
+func newPrometheusClient(sourceName string, backend v1alpha1.PrometheusBackend, insecure bool, objects objectLister) (*prometheusClient, error) {
+	transport := promapi.DefaultRoundTripper.(*http.Transport).Clone()
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} //nolint:gosec
+	}
+	client, err := promapi.NewClient(promapi.Config{Address: backend.URL, RoundTripper: backendTransport(transport)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Prometheus client for %s: %v", backend.URL, err)
+	}
+	c := &prometheusClient{
+		sourceName:      sourceName,
+		api:             promv1.NewAPI(client),
+		objects:         objects,
+		transport:       transport,
+		customMetrics:   make(map[provider.CustomMetricInfo]customMetricRule, len(backend.CustomMetrics)),
+		externalMetrics: make(map[provider.ExternalMetricInfo]*template.Template, len(backend.ExternalMetrics)),
+	}
+	for _, rule := range backend.CustomMetrics {
+		query, err := parseQuery(rule.Name, rule.Query)
+		if err != nil {
+			return nil, err
+		}
+		info := provider.CustomMetricInfo{
+			GroupResource: schema.ParseGroupResource(rule.Resource),
+			Namespaced:    rule.IsNamespaced(),
+			Metric:        rule.Name,
+		}
+		c.customMetrics[info] = customMetricRule{query: query, objectLabel: model.LabelName(rule.ObjectLabel)}
+	}
+	for _, rule := range backend.ExternalMetrics {
+		query, err := parseQuery(rule.Name, rule.Query)
+		if err != nil {
+			return nil, err
+		}
+		c.externalMetrics[provider.ExternalMetricInfo{Metric: rule.Name}] = query
+	}
+	return c, nil
+}
+
+// Close releases the idle connections to the Prometheus server.
+func (c *prometheusClient) Close() {
+	c.transport.CloseIdleConnections()
+}
+
+func parseQuery(name, query string) (*template.Template, error) {
+	t, err := template.New(name).Option("missingkey=error").Parse(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query for metric %s: %v", name, err)
+	}
+	return t, nil
+}
+
+func (c *prometheusClient) GetBackend() v1alpha1.MetricsServiceBackend {
+	return v1alpha1.MetricsServiceBackend{}
+}
+
+// ping checks that the Prometheus server is reachable.
+func (c *prometheusClient) ping(ctx context.Context) error {
+	_, err := c.api.Buildinfo(ctx)
+	return c.prometheusError(err)
+}
+
+func (c *prometheusClient) ListCustomMetricInfos(ctx context.Context) (map[provider.CustomMetricInfo]struct{}, error) {
+	if err := c.ping(ctx); err != nil {
+		return nil, err
+	}
+	infos := make(map[provider.CustomMetricInfo]struct{}, len(c.customMetrics))
+	for info := range c.customMetrics {
+		infos[info] = struct{}{}
+	}
+	return infos, nil
+}
+
+func (c *prometheusClient) ListExternalMetrics(ctx context.Context) (map[provider.ExternalMetricInfo]struct{}, error) {
+	if err := c.ping(ctx); err != nil {
+		return nil, err
+	}
+	infos := make(map[provider.ExternalMetricInfo]struct{}, len(c.externalMetrics))
+	for info := range c.externalMetrics {
+		infos[info] = struct{}{}
+	}
+	return infos, nil
+}
+
+// query runs a PromQL query, the result must be a vector.
+func (c *prometheusClient) query(ctx context.Context, t *template.Template, data interface{}) (model.Vector, error) {
+	query := &bytes.Buffer{}
+	if err := t.Execute(query, data); err != nil {
+		return nil, apierrors.NewInternalError(fmt.Errorf("metrics source %s: failed to render query for metric %s: %v", c.sourceName, t.Name(), err))
+	}
+	klog.V(4).Infof("metrics source %s: running query %s", c.sourceName, query.String())
+	result, warnings, err := c.api.Query(ctx, query.String(), time.Now())
+	if err != nil {
+		return nil, c.prometheusError(err)
+	}
+	for _, warning := range warnings {
+		klog.Warningf("metrics source %s: query for metric %s: %s", c.sourceName, t.Name(), warning)
+	}
+	vector, ok := result.(model.Vector)
+	if !ok {
+		return nil, apierrors.NewInternalError(fmt.Errorf("metrics source %s: query for metric %s returned a %s, expected a vector", c.sourceName, t.Name(), result.Type()))
+	}
+	return vector, nil
+}
+
+// customMetricValues runs the query of a custom metric for the given objects.
+func (c *prometheusClient) customMetricValues(ctx context.Context, namespace string, names []string, info provider.CustomMetricInfo, metricSelector labels.Selector) ([]custom_metrics.MetricValue, error) {
+	rule, ok := c.customMetrics[info]
+	if !ok {
+		return nil, metricNotFound("custom metric", info.Metric)
+	}
+	matchers, err := labelMatchers(metricSelector)
+	if err != nil {
+		return nil, apierrors.NewBadRequest(err.Error())
+	}
+	quotedNames := make([]string, len(names))
+	for i, name := range names {
+		quotedNames[i] = regexp.QuoteMeta(name)
+	}
+	// The regular expression is used in a PromQL string: its backslashes must be escaped, as in labelMatchers.
+	namesRegexp := strconv.Quote(strings.Join(quotedNames, "|"))
+	vector, err := c.query(ctx, rule.query, customQuery{
+		Namespace:     namespace,
+		Names:         namesRegexp[1 : len(namesRegexp)-1],
+		LabelMatchers: matchers,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	objectReference := custom_metrics.ObjectReference{Namespace: namespace}
+	if gvk, err := c.objects.KindFor(info.GroupResource); err == nil {
+		objectReference.Kind = gvk.Kind
+		objectReference.APIVersion = gvk.GroupVersion().String()
+	} else {
+		klog.V(2).Infof("metrics source %s: failed to get kind of %s: %v", c.sourceName, info.GroupResource, err)
+	}
+	expectedNames := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		expectedNames[name] = struct{}{}
+	}
+	values := make([]custom_metrics.MetricValue, 0, len(vector))
+	for _, sample := range vector {
+		name := string(sample.Metric[rule.objectLabel])
+		if _, ok := expectedNames[name]; !ok || !isValidSample(sample) {
+			continue
+		}
+		describedObject := objectReference
+		describedObject.Name = name
+		values = append(values, custom_metrics.MetricValue{
+			DescribedObject: describedObject,
+			Metric:          custom_metrics.MetricIdentifier{Name: info.Metric, Selector: labelSelector(metricSelector)},
+			Timestamp:       metav1.NewTime(sample.Timestamp.Time()),
+			Value:           quantity(sample.Value),
+		})
+	}
+	return values, nil
+}
+
+func (c *prometheusClient) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	values, err := c.customMetricValues(ctx, name.Namespace, []string{name.Name}, info, metricSelector)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, &apierrors.StatusError{
+			ErrStatus: metav1.Status{
+				Status:  metav1.StatusFailure,
+				Code:    http.StatusNotFound,
+				Reason:  metav1.StatusReasonNotFound,
+				Message: fmt.Sprintf("metrics source %s: no value for metric %s of %s %s", c.sourceName, info.Metric, info.GroupResource, name),
+			}}
+	}
+	return &values[0], nil
+}
+
+func (c *prometheusClient) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	names, err := c.objects.Names(ctx, info.GroupResource, namespace, selector)
+	if err != nil {
+		return nil, apierrors.NewInternalError(fmt.Errorf("metrics source %s: failed to list %s: %v", c.sourceName, info.GroupResource, err))
+	}
+	if len(names) == 0 {
+		return &custom_metrics.MetricValueList{}, nil
+	}
+	values, err := c.customMetricValues(ctx, namespace, names, info, metricSelector)
+	if err != nil {
+		return nil, err
+	}
+	return &custom_metrics.MetricValueList{Items: values}, nil
+}
+
+func (c *prometheusClient) GetExternalMetric(ctx context.Context, name, namespace string, metricSelector labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
+	query, ok := c.externalMetrics[provider.ExternalMetricInfo{Metric: name}]
+	if !ok {
+		return nil, metricNotFound("external metric", name)
+	}
+	matchers, err := labelMatchers(metricSelector)
+	if err != nil {
+		return nil, apierrors.NewBadRequest(err.Error())
+	}
+	vector, err := c.query(ctx, query, externalQuery{Namespace: namespace, LabelMatchers: matchers})
+	if err != nil {
+		return nil, err
+	}
+	values := make([]external_metrics.ExternalMetricValue, 0, len(vector))
+	for _, sample := range vector {
+		if !isValidSample(sample) {
+			continue
+		}
+		metricLabels := make(map[string]string, len(sample.Metric))
+		for k, v := range sample.Metric {
+			if k == model.MetricNameLabel {
+				continue
+			}
+			metricLabels[string(k)] = string(v)
+		}
+		values = append(values, external_metrics.ExternalMetricValue{
+			MetricName:   name,
+			MetricLabels: metricLabels,
+			Timestamp:    metav1.NewTime(sample.Timestamp.Time()),
+			Value:        quantity(sample.Value),
+		})
+	}
+	return &external_metrics.ExternalMetricValueList{Items: values}, nil
+}
+
+// prometheusError translates an error returned by the Prometheus API into a StatusError.
+func (c *prometheusClient) prometheusError(err error) error {
+	var promErr *promv1.Error
+	if !errors.As(err, &promErr) {
+		return backendError(c.sourceName, err)
+	}
+	status := metav1.Status{
+		Status:  metav1.StatusFailure,
+		Message: fmt.Sprintf("metrics source %s: %v", c.sourceName, promErr),
+	}
+	switch promErr.Type {
+	case promv1.ErrBadData:
+		status.Code, status.Reason = http.StatusBadRequest, metav1.StatusReasonBadRequest
+	case promv1.ErrTimeout, promv1.ErrCanceled:
+		status.Code, status.Reason = http.StatusGatewayTimeout, metav1.StatusReasonTimeout
+	case promv1.ErrServer:
+		status.Code, status.Reason = http.StatusServiceUnavailable, metav1.StatusReasonServiceUnavailable
+	default:
+		status.Code, status.Reason = http.StatusInternalServerError, metav1.StatusReasonInternalError
+	}
+	return &apierrors.StatusError{ErrStatus: status}
+}
+
+func isValidSample(sample *model.Sample) bool {
+	v := float64(sample.Value)
+	return !math.IsNaN(v) && !math.IsInf(v, 0)
+}
+
+func quantity(value model.SampleValue) resource.Quantity {
+	return *resource.NewMilliQuantity(int64(math.Round(float64(value)*1000)), resource.DecimalSI)
+}
+
+func labelSelector(selector labels.Selector) *metav1.LabelSelector {
+	if selector == nil || selector.Empty() {
+		return nil
+	}
+	labelSelector, err := metav1.ParseToLabelSelector(selector.String())
+	if err != nil {
+		return nil
+	}
+	return labelSelector
+}
+
+// labelMatchers converts a label selector into PromQL label matchers.
+func labelMatchers(selector labels.Selector) (string, error) {
+	if selector == nil {
+		return "", nil
+	}
+	requirements, _ := selector.Requirements()
+	matchers := make([]string, 0, len(requirements))
+	for _, r := range requirements {
+		values := r.Values().List()
+		var matcher string
+		switch r.Operator() {
+		case selection.Equals, selection.DoubleEquals:
+			matcher = fmt.Sprintf("%s=%s", r.Key(), strconv.Quote(values[0]))
+		case selection.NotEquals:
+			matcher = fmt.Sprintf("%s!=%s", r.Key(), strconv.Quote(values[0]))
+		case selection.In, selection.NotIn:
+			quoted := make([]string, len(values))
+			for i, v := range values {
+				quoted[i] = regexp.QuoteMeta(v)
+			}
+			operator := "=~"
+			if r.Operator() == selection.NotIn {
+				operator = "!~"
+			}
+			matcher = fmt.Sprintf("%s%s%s", r.Key(), operator, strconv.Quote(strings.Join(quoted, "|")))
+		case selection.Exists:
+			matcher = fmt.Sprintf(`%s!=""`, r.Key())
+		case selection.DoesNotExist:
+			matcher = fmt.Sprintf(`%s=""`, r.Key())
+		default:
+			return "", fmt.Errorf("operator %s is not supported in metric selectors", r.Operator())
+		}
+		matchers = append(matchers, matcher)
+	}
+	return strings.Join(matchers, ","), nil
+}
@@ -0,0 +1,236 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// fakePrometheus is a minimal implementation of the Prometheus HTTP API. It returns the same result for all the queries.
+type fakePrometheus struct {
+	*httptest.Server
+
+	lock    sync.Mutex
+	queries []string
+	// result is the vector returned by the queries.
+	result []map[string]interface{}
+	// errorType, if set, makes the queries fail.
+	errorType string
+}
+
+func newFakePrometheus(t *testing.T) *fakePrometheus {
+	t.Helper()
+	f := &fakePrometheus{}
+	writeJSON := func(w http.ResponseWriter, code int, obj interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		assert.NoError(t, json.NewEncoder(w).Encode(obj))
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/status/buildinfo", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"status": "success", "data": map[string]string{"version": "2.28.0"}})
+	})
+	mux.HandleFunc("/api/v1/query", func(w http.ResponseWriter, r *http.Request) {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		f.queries = append(f.queries, r.FormValue("query"))
+		if f.errorType != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]interface{}{"status": "error", "errorType": f.errorType, "error": "query failed"})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"status": "success",
+			"data":   map[string]interface{}{"resultType": "vector", "result": f.result},
+		})
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+func (f *fakePrometheus) lastQuery() string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if len(f.queries) == 0 {
+		return ""
+	}
+	return f.queries[len(f.queries)-1]
+}
+
+func sample(value string, metricLabels map[string]string) map[string]interface{} {
+	return map[string]interface{}{"metric": metricLabels, "value": []interface{}{1624521600, value}}
+}
+
+// fakeObjects is an objectLister which returns static objects.
+type fakeObjects struct {
+	names []string
+}
+
+func (f fakeObjects) KindFor(resource schema.GroupResource) (schema.GroupVersionKind, error) {
+	return schema.GroupVersionKind{Version: "v1", Kind: "Pod"}, nil
+}
+
+func (f fakeObjects) Names(_ context.Context, _ schema.GroupResource, _ string, _ labels.Selector) ([]string, error) {
+	return f.names, nil
+}
+
+var (
+	podsHTTPRequests = provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "pods"}, Namespaced: true, Metric: "http_requests"}
+	queueMessages    = provider.ExternalMetricInfo{Metric: "queue_messages"}
+)
+
+func newTestPrometheusClient(t *testing.T, url string, objects objectLister) *prometheusClient {
+	t.Helper()
+	client, err := newPrometheusClient("prometheus", v1alpha1.PrometheusBackend{
+		URL: url,
+		CustomMetrics: []v1alpha1.PrometheusCustomMetricRule{{
+			Name:        "http_requests",
+			Resource:    "pods",
+			Query:       `sum(rate(http_requests_total{namespace="{{.Namespace}}",pod=~"{{.Names}}"{{if .LabelMatchers}},{{.LabelMatchers}}{{end}}}[2m])) by (pod)`,
+			ObjectLabel: "pod",
+		}},
+		ExternalMetrics: []v1alpha1.PrometheusExternalMetricRule{{
+			Name:  "queue_messages",
+			Query: `sum(rabbitmq_queue_messages{ {{- .LabelMatchers -}} }) by (queue)`,
+		}},
+	}, false, objects)
+	assert.NoError(t, err)
+	return client
+}
+
+func TestPrometheusClient_Discovery(t *testing.T) {
+	prometheus := newFakePrometheus(t)
+	defer prometheus.Close()
+	client := newTestPrometheusClient(t, prometheus.URL, fakeObjects{})
+
+	customMetrics, err := client.ListCustomMetricInfos(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[provider.CustomMetricInfo]struct{}{podsHTTPRequests: {}}, customMetrics)
+	externalMetrics, err := client.ListExternalMetrics(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[provider.ExternalMetricInfo]struct{}{queueMessages: {}}, externalMetrics)
+
+	// Prometheus is not reachable
+	prometheus.Close()
+	_, err = client.ListCustomMetricInfos(context.Background())
+	assert.True(t, apierrors.IsServiceUnavailable(err), "ServiceUnavailable expected, got %v", err)
+}
+
+func TestPrometheusClient_CustomMetrics(t *testing.T) {
+	prometheus := newFakePrometheus(t)
+	defer prometheus.Close()
+	client := newTestPrometheusClient(t, prometheus.URL, fakeObjects{names: []string{"pod-a", "pod-b"}})
+	prometheus.result = []map[string]interface{}{
+		sample("1.5", map[string]string{"pod": "pod-a"}),
+		sample("NaN", map[string]string{"pod": "pod-b"}),
+		sample("3", map[string]string{"pod": "unknown-pod"}),
+	}
+
+	// By name
+	value, err := client.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "ns", Name: "pod-a"}, podsHTTPRequests, labels.Everything())
+	assert.NoError(t, err)
+	assert.Equal(t, `sum(rate(http_requests_total{namespace="ns",pod=~"pod-a"}[2m])) by (pod)`, prometheus.lastQuery())
+	assert.Equal(t, "pod-a", value.DescribedObject.Name)
+	assert.Equal(t, "Pod", value.DescribedObject.Kind)
+	assert.Equal(t, "http_requests", value.Metric.Name)
+	assert.Equal(t, int64(1500), value.Value.MilliValue())
+
+	// No value for the requested object
+	_, err = client.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "ns", Name: "pod-b"}, podsHTTPRequests, labels.Everything())
+	assert.True(t, apierrors.IsNotFound(err))
+
+	// By selector, with a metric selector
+	metricSelector, err := labels.Parse("method in (GET,POST),path!=healthz")
+	assert.NoError(t, err)
+	values, err := client.GetMetricBySelector(context.Background(), "ns", labels.Everything(), podsHTTPRequests, metricSelector)
+	assert.NoError(t, err)
+	assert.Equal(t, `sum(rate(http_requests_total{namespace="ns",pod=~"pod-a|pod-b",method=~"GET|POST",path!="healthz"}[2m])) by (pod)`, prometheus.lastQuery())
+	assert.Len(t, values.Items, 1)
+	assert.Equal(t, "pod-a", values.Items[0].DescribedObject.Name)
+
+	// Names are escaped in the PromQL string
+	prometheus.result = []map[string]interface{}{sample("2", map[string]string{"pod": "web.1"})}
+	value, err = client.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "ns", Name: "web.1"}, podsHTTPRequests, labels.Everything())
+	assert.NoError(t, err)
+	assert.Equal(t, `sum(rate(http_requests_total{namespace="ns",pod=~"web\\.1"}[2m])) by (pod)`, prometheus.lastQuery())
+	assert.Equal(t, "web.1", value.DescribedObject.Name)
+}
+
+func TestPrometheusClient_ExternalMetrics(t *testing.T) {
+	prometheus := newFakePrometheus(t)
+	defer prometheus.Close()
+	client := newTestPrometheusClient(t, prometheus.URL, fakeObjects{})
+	prometheus.result = []map[string]interface{}{
+		sample("42", map[string]string{"queue": "orders"}),
+	}
+
+	values, err := client.GetExternalMetric(context.Background(), "queue_messages", "ns", labels.SelectorFromSet(labels.Set{"queue": "orders"}))
+	assert.NoError(t, err)
+	assert.Equal(t, `sum(rabbitmq_queue_messages{queue="orders"}) by (queue)`, prometheus.lastQuery())
+	assert.Len(t, values.Items, 1)
+	assert.Equal(t, "queue_messages", values.Items[0].MetricName)
+	assert.Equal(t, map[string]string{"queue": "orders"}, values.Items[0].MetricLabels)
+	assert.Equal(t, int64(42), values.Items[0].Value.Value())
+	assert.Equal(t, metav1.Unix(1624521600, 0).UTC(), values.Items[0].Timestamp.UTC())
+
+	// Query errors are translated into status errors
+	prometheus.errorType = "bad_data"
+	_, err = client.GetExternalMetric(context.Background(), "queue_messages", "ns", labels.Everything())
+	assert.True(t, apierrors.IsBadRequest(err), "BadRequest expected, got %v", err)
+}
+
+func Test_labelMatchers(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     string
+		wantErr  bool
+	}{
+		{selector: "", want: ""},
+		{selector: "a=b", want: `a="b"`},
+		{selector: "a!=b", want: `a!="b"`},
+		{selector: "a in (b.c,d)", want: `a=~"b\\.c|d"`},
+		{selector: "a notin (b)", want: `a!~"b"`},
+		{selector: "a", want: `a!=""`},
+		{selector: "!a", want: `a=""`},
+		{selector: "a>1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			selector, err := labels.Parse(tt.selector)
+			assert.NoError(t, err)
+			got, err := labelMatchers(selector)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("labelMatchers() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"sort"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"k8s.io/klog"
+)
+
+// PendingRemoval is a removal of metrics which is held until it is confirmed by some consecutive discoveries.
+type PendingRemoval struct {
+	// Removed are the metrics which are not discovered anymore, but which are still served.
+	Removed []string
+	// PreviousCount is the number of metrics served by the source before the removal.
+	PreviousCount int
+	// Confirmations is the number of consecutive discoveries which have removed the metrics.
+	Confirmations int
+	// RequiredConfirmations is the number of consecutive discoveries required to apply the removal.
+	RequiredConfirmations int
+}
+
+// protectRemovals holds the removal of the metrics of a metrics source if a discovery removes all of them, or more
+// than the protection threshold: the metrics previously served are added back to the new metrics source until the
+// removal is confirmed by enough consecutive discoveries. Must be called with the lock held.
+func (r *Registry) protectRemovals(newMetricSource *cachedMetricSource, policy *v1alpha1.DiscoveryPolicy) {
+	sourceName := newMetricSource.sourceName
+	previous, ok := r.currentRoutes().sources[sourceName]
+	if !ok {
+		delete(r.pendingRemovals, sourceName)
+		return
+	}
+	removed := removedMetrics(previous, *newMetricSource)
+	previousCount := len(previous.customMetricInfos) + len(previous.externalMetricInfos)
+	if len(removed) == 0 ||
+		(len(removed) < previousCount && len(removed)*100 <= policy.RemovalProtectionPercent()*previousCount) {
+		delete(r.pendingRemovals, sourceName)
+		return
+	}
+
+	pending := PendingRemoval{
+		Removed:               removed,
+		PreviousCount:         previousCount,
+		Confirmations:         1,
+		RequiredConfirmations: policy.RequiredRemovalConfirmations(),
+	}
+	// A removal is only confirmed by the discoveries which remove the same metrics.
+	if current, ok := r.pendingRemovals[sourceName]; ok && equalStrings(current.Removed, removed) {
+		pending.Confirmations = current.Confirmations + 1
+	}
+	if pending.Confirmations >= pending.RequiredConfirmations {
+		klog.Infof("Removal of %d metrics out of %d from metrics source %s confirmed", len(removed), previousCount, sourceName)
+		delete(r.pendingRemovals, sourceName)
+		return
+	}
+	klog.Warningf(
+		"Discovery of metrics source %s removes %d metrics out of %d, previous metrics still served until the removal is confirmed (%d/%d)",
+		sourceName, len(removed), previousCount, pending.Confirmations, pending.RequiredConfirmations,
+	)
+	if r.pendingRemovals == nil {
+		r.pendingRemovals = make(map[string]PendingRemoval)
+	}
+	r.pendingRemovals[sourceName] = pending
+	// The previous metrics are served along with the discovered ones, the metrics added by the discovery are served
+	// right away.
+	for info := range previous.customMetricInfos {
+		newMetricSource.customMetricInfos[info] = struct{}{}
+	}
+	for info := range previous.externalMetricInfos {
+		newMetricSource.externalMetricInfos[info] = struct{}{}
+	}
+}
+
+// removedMetrics returns the sorted names of the metrics served by the old metrics source but not by the new one.
+func removedMetrics(old, new cachedMetricSource) []string {
+	var removed []string
+	for _, info := range getRemovedCustomMetrics(old.customMetricInfos, new.customMetricInfos) {
+		removed = append(removed, customMetricName(info))
+	}
+	for _, info := range getRemovedExternalMetrics(old.externalMetricInfos, new.externalMetricInfos) {
+		removed = append(removed, externalMetricName(info))
+	}
+	sort.Strings(removed)
+	return removed
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// PendingRemoval returns the removal of metrics held for a metrics source, if any.
+func (r *Registry) PendingRemoval(sourceName string) (PendingRemoval, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	pending, ok := r.pendingRemovals[sourceName]
+	if !ok {
+		return PendingRemoval{}, false
+	}
+	pending.Removed = append([]string(nil), pending.Removed...)
+	return pending, true
+}
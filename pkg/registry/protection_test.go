@@ -0,0 +1,101 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"testing"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestRegistry_protectRemovals(t *testing.T) {
+	fakeRegistry := newFakeRegistry().servedCustomMetrics("source1", "metric1", "metric2", "metric3", "metric4")
+	fakeClient := fakeRegistry.fakeClientProvider.clients["source1"]
+	resync := func(metrics ...string) int {
+		fakeClient.customMetrics = metrics
+		count, err := fakeRegistry.registry.AddOrUpdateSource(context.Background(), v1alpha1.MetricsSource{
+			ObjectMeta: metav1.ObjectMeta{Name: "source1"},
+			Spec: v1alpha1.MetricsSourceSpec{
+				MetricTypes:           v1alpha1.MetricTypes{v1alpha1.CustomMetrics},
+				MetricsServiceBackend: v1alpha1.MetricsServiceBackend{Name: "source1"},
+			},
+		})
+		assert.NoError(t, err)
+		return count
+	}
+	served := func() []string {
+		var metrics []string
+		for _, info := range fakeRegistry.registry.ListAllCustomMetrics() {
+			metrics = append(metrics, info.Metric)
+		}
+		return metrics
+	}
+
+	assert.Equal(t, 4, resync("metric1", "metric2", "metric3", "metric4"))
+	_, pending := fakeRegistry.registry.PendingRemoval("source1")
+	assert.False(t, pending)
+
+	// Half of the metrics removed is not more than the default threshold
+	assert.Equal(t, 2, resync("metric1", "metric2"))
+	assert.ElementsMatch(t, []string{"metric1", "metric2"}, served())
+	_, pending = fakeRegistry.registry.PendingRemoval("source1")
+	assert.False(t, pending)
+
+	// All the metrics are removed, new metrics are served right away
+	assert.Equal(t, 3, resync("metric5"))
+	assert.ElementsMatch(t, []string{"metric1", "metric2", "metric5"}, served())
+	removal, pending := fakeRegistry.registry.PendingRemoval("source1")
+	assert.True(t, pending)
+	assert.Equal(t, PendingRemoval{
+		Removed:               []string{"/metric1", "/metric2"},
+		PreviousCount:         2,
+		Confirmations:         1,
+		RequiredConfirmations: 3,
+	}, removal)
+
+	// The discovery recovers
+	assert.Equal(t, 3, resync("metric1", "metric2", "metric5"))
+	_, pending = fakeRegistry.registry.PendingRemoval("source1")
+	assert.False(t, pending)
+
+	// The confirmations are reset if another set of metrics is removed
+	assert.Equal(t, 3, resync("metric1"))
+	removal, _ = fakeRegistry.registry.PendingRemoval("source1")
+	assert.Equal(t, []string{"/metric2", "/metric5"}, removal.Removed)
+	assert.Equal(t, 1, removal.Confirmations)
+	assert.Equal(t, 3, resync("metric2"))
+	removal, _ = fakeRegistry.registry.PendingRemoval("source1")
+	assert.Equal(t, []string{"/metric1", "/metric5"}, removal.Removed)
+	assert.Equal(t, 1, removal.Confirmations)
+	assert.ElementsMatch(t, []string{"metric1", "metric2", "metric5"}, served())
+	assert.Equal(t, 3, resync("metric1", "metric2", "metric5"))
+
+	// The removal is applied once it has been confirmed by 3 consecutive discoveries
+	resync()
+	resync()
+	removal, pending = fakeRegistry.registry.PendingRemoval("source1")
+	assert.True(t, pending)
+	assert.Equal(t, 2, removal.Confirmations)
+	assert.ElementsMatch(t, []string{"metric1", "metric2", "metric5"}, served())
+	assert.Equal(t, 0, resync())
+	assert.Empty(t, served())
+	_, pending = fakeRegistry.registry.PendingRemoval("source1")
+	assert.False(t, pending)
+}
@@ -17,15 +17,14 @@ limitations under the License.
 package registry
 
 import (
+	"context"
 	"fmt"
-	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
 	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
-	"k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/api/meta"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/klog"
 )
@@ -36,16 +35,40 @@ type cachedMetricSource struct {
 	customMetricInfos   map[provider.CustomMetricInfo]struct{}
 	externalMetricInfos map[provider.ExternalMetricInfo]struct{}
 	client              MetricsClient
+	// breaker is the circuit breaker through which the requests are sent to the client.
+	breaker *circuitBreaker
+	// close, if not nil, releases the connections held by the client.
+	close func()
+	// syncTime is the time at which the metrics served by the source have been discovered.
+	syncTime time.Time
 }
 
-func NewRegistry(baseConfig *rest.Config, mapper meta.RESTMapper) *Registry {
+// closeClient releases the connections held by the client of the metrics source once it is replaced or deleted.
+func (c *cachedMetricSource) closeClient() {
+	if c.close != nil {
+		c.close()
+	}
+}
+
+// available returns false if the circuit breaker of the metrics source does not allow requests to be sent.
+func (c *cachedMetricSource) available() bool {
+	return c.breaker == nil || c.breaker.available()
+}
+
+func NewRegistry(baseConfig *rest.Config) *Registry {
+	endpoints := newEndpointsBalancers()
 	return &Registry{
-		cachedMetricsSourcesBySource: make(map[string]cachedMetricSource),
-		customMetrics:                make(map[provider.CustomMetricInfo]*cachedMetricSources),
-		externalMetrics:              make(map[provider.ExternalMetricInfo]*cachedMetricSources),
+		updates:   make(map[string]uint64),
+		endpoints: endpoints,
+		breakers:  newCircuitBreakers(),
+		limiters:  newSourceLimiters(),
+		caches:    newValueCaches(),
+		inFlight:  newSourcesInFlightRequests(),
 		clientProvider: metricsClientProvider{
 			baseConfig: baseConfig,
-			mapper:     mapper,
+			endpoints:  endpoints,
+			objects:    newKubeObjects(baseConfig),
+			scalers:    newScalerConnections(),
 		},
 	}
 }
@@ -53,88 +76,229 @@ func NewRegistry(baseConfig *rest.Config, mapper meta.RESTMapper) *Registry {
 type Registry struct {
 	clientProvider MetricsClientProvider
 
-	lock sync.RWMutex
+	// endpoints holds the ready endpoints of the services for which load balancing is enabled.
+	endpoints *endpointsBalancers
+
+	// breakers holds the circuit breakers of the metrics sources.
+	breakers *circuitBreakers
+
+	// limiters holds the rate limiters of the metrics sources.
+	limiters *sourceLimiters
+
+	// caches holds the value caches of the metrics sources.
+	caches *valueCaches
+
+	// inFlight holds the requests in progress of the metrics sources.
+	inFlight *sourcesInFlightRequests
 
-	// cachedMetricsSourcesBySource holds the current state of the metrics served by a metric backend.
-	// Key is the name of the metric source
-	cachedMetricsSourcesBySource map[string]cachedMetricSource
+	// lock serializes the updates of the metrics sources. Requests never take it, they read the routing table.
+	lock sync.Mutex
 
-	customMetrics   map[provider.CustomMetricInfo]*cachedMetricSources
-	externalMetrics map[provider.ExternalMetricInfo]*cachedMetricSources
+	// updates holds the latest update in progress of each metrics source.
+	updates     map[string]uint64
+	updateCount uint64
+
+	// history holds the last discoveries which have changed the metrics served by each metrics source.
+	history map[string][]v1alpha1.DiscoveryRecord
+
+	// pendingRemovals holds the removals of metrics which have not been confirmed yet.
+	pendingRemovals map[string]PendingRemoval
+
+	// onSourceChanges, if set, is called with the changes of the routes once a metrics source is updated or deleted.
+	onSourceChanges func(changes SourceChanges)
+
+	// routes holds the current *routingTable. It is replaced, with the lock held, each time a metrics source is updated
+	// or deleted.
+	routes atomic.Value
 }
 
-func (r *Registry) AddOrUpdateSource(source v1alpha1.MetricsSource) (int, error) {
+// currentRoutes returns the current snapshot of the metrics served by the metrics sources.
+func (r *Registry) currentRoutes() *routingTable {
+	if routes, ok := r.routes.Load().(*routingTable); ok {
+		return routes
+	}
+	return emptyRoutingTable
+}
+
+// UpdateEndpoints sets the ready endpoints, in the form host:port, to which the requests for the backend of a metrics
+// source are balanced.
+func (r *Registry) UpdateEndpoints(sourceName string, backend v1alpha1.MetricsServiceBackend, addresses []string) {
+	klog.V(2).Infof("Update endpoints of %s: %v", backend.URL(), addresses)
+	r.endpoints.get(sourceName, backend).setEndpoints(addresses)
+}
+
+// OnCircuitBreakerStateChange registers a function called each time the state of the circuit breaker of a metrics source
+// changes. It must be called before any source is added, and the function must not block.
+func (r *Registry) OnCircuitBreakerStateChange(f func(sourceName string, state v1alpha1.CircuitBreakerState)) {
+	r.breakers.onStateChange = f
+}
+
+// OnSourceChanges registers a function called with the changes of the routes each time a metrics source is updated or
+// deleted. It must be called before any source is added. The function is called without holding any lock.
+func (r *Registry) OnSourceChanges(f func(changes SourceChanges)) {
+	r.onSourceChanges = f
+}
+
+// notifySourceChanges calls the function registered with OnSourceChanges, if any.
+func (r *Registry) notifySourceChanges(changes *SourceChanges) {
+	if changes == nil || changes.IsEmpty() || r.onSourceChanges == nil {
+		return
+	}
+	r.onSourceChanges(*changes)
+}
+
+// CircuitBreakerState returns the state of the circuit breaker of a metrics source.
+func (r *Registry) CircuitBreakerState(sourceName string) v1alpha1.CircuitBreakerState {
+	return r.breakers.state(sourceName)
+}
+
+func (r *Registry) AddOrUpdateSource(ctx context.Context, source v1alpha1.MetricsSource) (int, error) {
 	klog.Infof("Update metrics source %s", source.Name)
-	// TODO: discuss if we should cache the client.
-	client, err := r.clientProvider.NewClient(source.Spec.InsecureSkipTLSVerify, source.Spec.MetricsServiceBackend)
+	update := r.startUpdate(source.Name)
+	// The client is closed, and the state created for the update is released, if the update is not applied.
+	var closeClient func()
+	applied := false
+	defer func() {
+		if applied {
+			return
+		}
+		if closeClient != nil {
+			closeClient()
+		}
+		r.discardUpdate(source.Name, update)
+	}()
+	// A new client is created for each update, it is only used by the requests once the update is applied.
+	client, err := r.clientProvider.NewClient(source)
 	if err != nil {
 		return 0, err
 	}
+	if c, ok := client.(closer); ok {
+		closeClient = c.Close
+	}
+	// The update is transactional: the new state of the metrics source is computed completely, and it is only applied
+	// if the discovery succeeds. Until then the current limiter and cache are left untouched.
+	breaker := r.breakers.get(source.Name, source.Spec.CircuitBreaker)
+	client = &circuitBreakerClient{MetricsClient: client, breaker: breaker}
+	// Requests rejected by the rate limits must not be seen as failures by the circuit breaker.
+	limiter := r.limiters.prepare(source.Name, source.Spec.RateLimits)
+	if limiter != nil {
+		client = &limitedClient{MetricsClient: client, limiter: limiter}
+	}
+	// Cached values are served without being rate limited, and even if the circuit breaker is open.
+	cache := r.caches.prepare(source.Name, source.Spec.Cache)
+	if cache != nil {
+		client = &cachedClient{MetricsClient: client, cache: cache}
+	}
+	client = &trackedClient{
+		MetricsClient: client,
+		sourceName:    source.Name,
+		inFlight:      r.inFlight.get(source.Name),
+		routed: func() bool {
+			_, ok := r.currentRoutes().sources[source.Name]
+			return ok
+		},
+	}
+	client = &instrumentedClient{MetricsClient: client, sourceName: source.Name}
 
-	r.lock.Lock()
-	defer r.lock.Unlock()
-
-	// Create a new metric source
+	// Discovery requests are sent without holding the lock: a slow metrics backend must not block the requests for the
+	// metrics served by the other sources.
 	newMetricSource := cachedMetricSource{
 		sourceName:          source.Name,
 		priority:            source.Spec.Priority,
 		client:              client,
+		breaker:             breaker,
+		close:               closeClient,
 		customMetricInfos:   make(map[provider.CustomMetricInfo]struct{}),
 		externalMetricInfos: make(map[provider.ExternalMetricInfo]struct{}),
 	}
+	if err := discover(ctx, source, &newMetricSource); err != nil {
+		return 0, err
+	}
+	newMetricSource.syncTime = time.Now()
 
-	// Read custom metrics available from this metric source
+	// Changes are notified once the lock is released
+	var changes *SourceChanges
+	defer func() { r.notifySourceChanges(changes) }()
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.updates[source.Name] != update {
+		// The metrics source has been updated or deleted while the discovery requests were in flight.
+		klog.Infof("Discard outdated update of metrics source %s", source.Name)
+		return len(newMetricSource.customMetricInfos) + len(newMetricSource.externalMetricInfos), nil
+	}
+	delete(r.updates, source.Name)
+	r.protectRemovals(&newMetricSource, source.Spec.Discovery)
+	metricsCount := len(newMetricSource.customMetricInfos) + len(newMetricSource.externalMetricInfos)
+
+	breaker.configure(source.Spec.CircuitBreaker)
+	r.limiters.set(source.Name, limiter)
+	r.caches.set(source.Name, cache)
+	sourceChanges := r.applySource(newMetricSource)
+	sourceChanges.RemovalAlertThreshold = source.Spec.Discovery.RemovalAlertPercent()
+	r.recordDiscovery(sourceChanges)
+	changes = &sourceChanges
+	applied = true
+	return metricsCount, nil
+}
+
+// discover reads the metrics available from a metrics source.
+func discover(ctx context.Context, source v1alpha1.MetricsSource, newMetricSource *cachedMetricSource) (err error) {
+	defer func(start time.Time) { observeDiscovery(source.Name, start, err) }(time.Now())
 	if source.Spec.MetricTypes.HasCustomMetrics() {
-		newMetricSource.customMetricInfos, err = client.ListCustomMetricInfos()
+		newMetricSource.customMetricInfos, err = newMetricSource.client.ListCustomMetricInfos(ctx)
 		if err != nil {
-			return 0, fmt.Errorf("failed to list custom metric api resources: %v", err)
+			return fmt.Errorf("failed to list custom metric api resources: %v", err)
 		}
 	}
-	if actualMetricSource, ok := r.cachedMetricsSourcesBySource[source.Name]; ok {
-		// Check if some metrics that were previously served have been removed from that MetricsSource
-		removedMetrics := getRemovedCustomMetrics(actualMetricSource.customMetricInfos, newMetricSource.customMetricInfos)
-		for _, removedMetric := range removedMetrics {
-			// This metric is more served by the metrics source
-			if empty := r.customMetrics[removedMetric].removeSource(source.Name); empty {
-				delete(r.customMetrics, removedMetric)
-			}
+	if source.Spec.MetricTypes.HasExternalMetrics() {
+		newMetricSource.externalMetricInfos, err = newMetricSource.client.ListExternalMetrics(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to list external metric api resources: %v", err)
 		}
 	}
-	for mInfo := range newMetricSource.customMetricInfos {
-		var ok bool
-		if _, ok = r.customMetrics[mInfo]; !ok {
-			r.customMetrics[mInfo] = newMetricsSources()
-		}
-		serviceList := r.customMetrics[mInfo]
-		serviceList.addOrUpdateSource(newMetricSource)
+	return nil
+}
+
+// applySource replaces the metrics served by a metrics source. Must be called with the lock held.
+func (r *Registry) applySource(newMetricSource cachedMetricSource) SourceChanges {
+	routes := r.currentRoutes()
+	newRoutes := routes.withSource(newMetricSource)
+	r.routes.Store(newRoutes)
+	observeRoutes(newMetricSource.sourceName, newRoutes)
+	if actualMetricSource, ok := routes.sources[newMetricSource.sourceName]; ok {
+		// The requests in progress with the previous client are not interrupted.
+		actualMetricSource.closeClient()
 	}
+	return diffRoutes(newMetricSource.sourceName, routes, newRoutes)
+}
 
-	if source.Spec.MetricTypes.HasExternalMetrics() {
-		newMetricSource.externalMetricInfos, err = client.ListExternalMetrics()
-		if err != nil {
-			return 0, fmt.Errorf("failed to list external metric api resources: %v", err)
-		}
+// startUpdate records that an update of a metrics source has started. Only the result of the latest update of a
+// metrics source is applied, and only if the metrics source has not been deleted in the meantime.
+func (r *Registry) startUpdate(sourceName string) uint64 {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.updateCount++
+	r.updates[sourceName] = r.updateCount
+	return r.updateCount
+}
+
+// discardUpdate releases the state of a metrics source created by an update which has not been applied, unless the
+// metrics source is still served or another update of the metrics source is in progress.
+func (r *Registry) discardUpdate(sourceName string, update uint64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.updates[sourceName] == update {
+		delete(r.updates, sourceName)
 	}
-	if actualMetricSource, ok := r.cachedMetricsSourcesBySource[source.Name]; ok {
-		removedMetrics := getRemovedExternalMetrics(actualMetricSource.externalMetricInfos, newMetricSource.externalMetricInfos)
-		for _, removedMetric := range removedMetrics {
-			if empty := r.externalMetrics[removedMetric].removeSource(source.Name); empty {
-				delete(r.externalMetrics, removedMetric)
-			}
-		}
+	if _, ok := r.updates[sourceName]; ok {
+		return
 	}
-	for mInfo := range newMetricSource.externalMetricInfos {
-		var ok bool
-		if _, ok = r.externalMetrics[mInfo]; !ok {
-			r.externalMetrics[mInfo] = newMetricsSources()
-		}
-		serviceList := r.externalMetrics[mInfo]
-		serviceList.addOrUpdateSource(newMetricSource)
+	if _, ok := r.currentRoutes().sources[sourceName]; ok {
+		return
 	}
-
-	// Update indexed cached metric sources
-	r.cachedMetricsSourcesBySource[source.Name] = newMetricSource
-	return len(newMetricSource.customMetricInfos) + len(newMetricSource.externalMetricInfos), nil
+	r.breakers.delete(sourceName)
+	r.inFlight.delete(sourceName)
+	r.endpoints.release(sourceName)
 }
 
 func getRemovedCustomMetrics(old map[provider.CustomMetricInfo]struct{}, new map[provider.CustomMetricInfo]struct{}) []provider.CustomMetricInfo {
@@ -159,80 +323,64 @@ func getRemovedExternalMetrics(old map[provider.ExternalMetricInfo]struct{}, new
 
 func (r *Registry) DeleteSource(sourceName string) {
 	klog.Infof("Delete metrics source %s", sourceName)
+	var changes SourceChanges
+	defer func() { r.notifySourceChanges(&changes) }()
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	// Delete related custom metrics
-	for k, v := range r.customMetrics {
-		if empty := v.removeSource(sourceName); empty {
-			delete(r.customMetrics, k)
-		}
-	}
-	// Delete related external metrics
-	for k, v := range r.externalMetrics {
-		if empty := v.removeSource(sourceName); empty {
-			delete(r.externalMetrics, k)
-		}
+	var removed *cachedMetricSource
+	changes, removed = r.removeRoutes(sourceName)
+	if removed != nil {
+		removed.closeClient()
 	}
-	delete(r.cachedMetricsSourcesBySource, sourceName)
+	r.breakers.delete(sourceName)
+	r.limiters.delete(sourceName)
+	r.caches.delete(sourceName)
+	r.inFlight.delete(sourceName)
+	r.endpoints.release(sourceName)
+	delete(r.history, sourceName)
+	delete(r.pendingRemovals, sourceName)
 }
 
 func (r *Registry) GetMetricsBackend(info provider.CustomMetricInfo) (MetricsClient, error) {
-	r.lock.RLock()
-	defer r.lock.RUnlock()
-	var services *cachedMetricSources
+	routes := r.currentRoutes()
+	var services cachedMetricSources
 	var metricsService cachedMetricSource
 	var ok bool
-	if services, ok = r.customMetrics[info]; !ok {
-		return nil, &errors.StatusError{
-			ErrStatus: metav1.Status{
-				Status:  metav1.StatusFailure,
-				Code:    http.StatusNotFound,
-				Reason:  metav1.StatusReasonNotFound,
-				Message: fmt.Sprintf("custom metric %s is not provided by any metrics backend", info.Metric),
-			}}
+	if services, ok = routes.customMetrics[info]; !ok {
+		return nil, metricNotFound("custom metric", info.Metric)
 	}
 	service, err := services.getBestMetricService()
 	if err != nil {
-		return nil, fmt.Errorf("not backend for metric: %v", info.Metric)
+		return nil, metricNotFound("custom metric", info.Metric)
 	}
-	if metricsService, ok = r.cachedMetricsSourcesBySource[service.sourceName]; !ok {
-		return nil, fmt.Errorf("properties for metric source %s is missing", service.sourceName)
+	if metricsService, ok = routes.sources[service.sourceName]; !ok {
+		return nil, sourceUnavailable(service.sourceName, "metrics source is not synced")
 	}
-	klog.Infof("custom metric %v served by %s", info, metricsService.client.GetBackend().URL())
 	return metricsService.client, nil
 }
 func (r *Registry) GetExternalMetricsBackend(info provider.ExternalMetricInfo) (MetricsClient, error) {
-	r.lock.RLock()
-	defer r.lock.RUnlock()
-	var services *cachedMetricSources
+	routes := r.currentRoutes()
+	var services cachedMetricSources
 	var metricsService cachedMetricSource
 	var ok bool
-	if services, ok = r.externalMetrics[info]; !ok {
-		return nil, &errors.StatusError{
-			ErrStatus: metav1.Status{
-				Status:  metav1.StatusFailure,
-				Code:    http.StatusNotFound,
-				Reason:  metav1.StatusReasonNotFound,
-				Message: fmt.Sprintf("external metric %s is not provided by any metrics backend", info.Metric),
-			}}
+	if services, ok = routes.externalMetrics[info]; !ok {
+		return nil, metricNotFound("external metric", info.Metric)
 	}
 	service, err := services.getBestMetricService()
 	if err != nil {
-		return nil, fmt.Errorf("not backend for metric: %v", info.Metric)
+		return nil, metricNotFound("external metric", info.Metric)
 	}
-	if metricsService, ok = r.cachedMetricsSourcesBySource[service.sourceName]; !ok {
-		return nil, fmt.Errorf("properties for metric service %s is missing", service.sourceName)
+	if metricsService, ok = routes.sources[service.sourceName]; !ok {
+		return nil, sourceUnavailable(service.sourceName, "metrics source is not synced")
 	}
-	klog.Infof("external metric %v served by %s", info, metricsService.client.GetBackend().URL())
 	return metricsService.client, nil
 }
 
 func (r *Registry) ListAllCustomMetrics() []provider.CustomMetricInfo {
-	r.lock.RLock()
-	defer r.lock.RUnlock()
-	infos := make([]provider.CustomMetricInfo, len(r.customMetrics))
+	routes := r.currentRoutes()
+	infos := make([]provider.CustomMetricInfo, len(routes.customMetrics))
 	count := 0
-	for k := range r.customMetrics {
+	for k := range routes.customMetrics {
 		infos[count] = k
 		count++
 	}
@@ -240,11 +388,10 @@ func (r *Registry) ListAllCustomMetrics() []provider.CustomMetricInfo {
 }
 
 func (r *Registry) ListAllExternalMetrics() []provider.ExternalMetricInfo {
-	r.lock.RLock()
-	defer r.lock.RUnlock()
-	infos := make([]provider.ExternalMetricInfo, len(r.externalMetrics))
+	routes := r.currentRoutes()
+	infos := make([]provider.ExternalMetricInfo, len(routes.externalMetrics))
 	count := 0
-	for k := range r.externalMetrics {
+	for k := range routes.externalMetrics {
 		infos[count] = k
 		count++
 	}
@@ -17,7 +17,9 @@ limitations under the License.
 package registry
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
 	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
@@ -133,6 +135,8 @@ func TestRegistry_AddOrUpdateSource(t *testing.T) {
 					Priority:              300, // priority of source1 is increased
 					MetricTypes:           v1alpha1.MetricTypes{v1alpha1.CustomMetrics},
 					MetricsServiceBackend: v1alpha1.MetricsServiceBackend{Name: "source1"},
+					// 2 metrics out of 3 are removed right away
+					Discovery: &v1alpha1.DiscoveryPolicy{RemovalConfirmations: int32Ptr(1)},
 				},
 			}},
 			metricsCount:          2,
@@ -175,6 +179,8 @@ func TestRegistry_AddOrUpdateSource(t *testing.T) {
 					Priority:              300, // priority of source1 is increased
 					MetricTypes:           v1alpha1.MetricTypes{v1alpha1.ExternalMetrics},
 					MetricsServiceBackend: v1alpha1.MetricsServiceBackend{Name: "source1"},
+					// 2 metrics out of 3 are removed right away
+					Discovery: &v1alpha1.DiscoveryPolicy{RemovalConfirmations: int32Ptr(1)},
 				},
 			}},
 			metricsCount:            2,
@@ -205,7 +211,7 @@ func TestRegistry_AddOrUpdateSource(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := tt.registry.AddOrUpdateSource(tt.args.source)
+			got, err := tt.registry.AddOrUpdateSource(context.Background(), tt.args.source)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("Registry.AddOrUpdateSource() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -306,3 +312,289 @@ func TestRegistry_DeleteSource(t *testing.T) {
 		})
 	}
 }
+
+func TestRegistry_AddOrUpdateSource_Cancelled(t *testing.T) {
+	fakeRegistry := newFakeRegistry().servedCustomMetrics("slowSource", "metric1")
+	slowClient := fakeRegistry.fakeClientProvider.clients["slowSource"]
+	slowClient.wait = make(chan struct{}) // never closed, the backend never answers
+	source := v1alpha1.MetricsSource{
+		ObjectMeta: metav1.ObjectMeta{Name: "slowSource"},
+		Spec: v1alpha1.MetricsSourceSpec{
+			MetricTypes:           v1alpha1.MetricTypes{v1alpha1.CustomMetrics},
+			MetricsServiceBackend: v1alpha1.MetricsServiceBackend{Name: "slowSource"},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := fakeRegistry.registry.AddOrUpdateSource(ctx, source)
+	assert.Error(t, err)
+	assert.Equal(t, 1, slowClient.Cancelled())
+	// The source has not been added
+	assert.Empty(t, fakeRegistry.registry.ListAllCustomMetrics())
+}
+
+func TestRegistry_AddOrUpdateSource_DiscoveryDoesNotBlockReads(t *testing.T) {
+	fakeRegistry := newFakeRegistry().
+		servedCustomMetrics("source1", "metric1").
+		servedCustomMetrics("slowSource", "metric2")
+	newSource := func(name string) v1alpha1.MetricsSource {
+		return v1alpha1.MetricsSource{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1alpha1.MetricsSourceSpec{
+				MetricTypes:           v1alpha1.MetricTypes{v1alpha1.CustomMetrics},
+				MetricsServiceBackend: v1alpha1.MetricsServiceBackend{Name: name},
+			},
+		}
+	}
+	_, err := fakeRegistry.registry.AddOrUpdateSource(context.Background(), newSource("source1"))
+	assert.NoError(t, err)
+
+	// The discovery of slowSource hangs
+	slowClient := fakeRegistry.fakeClientProvider.clients["slowSource"]
+	slowClient.wait = make(chan struct{})
+	updated := make(chan error)
+	go func() {
+		_, err := fakeRegistry.registry.AddOrUpdateSource(context.Background(), newSource("slowSource"))
+		updated <- err
+	}()
+	assert.Eventually(t, func() bool { return slowClient.Waiting() == 1 }, 5*time.Second, time.Millisecond)
+
+	// Reads are still served
+	read := make(chan error)
+	go func() {
+		_, err := fakeRegistry.registry.GetMetricsBackend(provider.CustomMetricInfo{Metric: "metric1"})
+		fakeRegistry.registry.ListAllCustomMetrics()
+		read <- err
+	}()
+	select {
+	case err := <-read:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("registry reads are blocked by the discovery of a metrics source")
+	}
+	// Another source can be updated
+	_, err = fakeRegistry.registry.AddOrUpdateSource(context.Background(), newSource("source1"))
+	assert.NoError(t, err)
+
+	close(slowClient.wait)
+	assert.NoError(t, <-updated)
+	assertMetricsExpectations(t, fakeRegistry.registry, []expectation{
+		{metricName: "metric1", metricType: v1alpha1.CustomMetrics, expectedSourceName: "source1"},
+		{metricName: "metric2", metricType: v1alpha1.CustomMetrics, expectedSourceName: "slowSource"},
+	})
+}
+
+func TestRegistry_AddOrUpdateSource_DeletedDuringDiscovery(t *testing.T) {
+	fakeRegistry := newFakeRegistry().servedCustomMetrics("slowSource", "metric1")
+	slowClient := fakeRegistry.fakeClientProvider.clients["slowSource"]
+	slowClient.wait = make(chan struct{})
+	source := v1alpha1.MetricsSource{
+		ObjectMeta: metav1.ObjectMeta{Name: "slowSource"},
+		Spec: v1alpha1.MetricsSourceSpec{
+			MetricTypes:           v1alpha1.MetricTypes{v1alpha1.CustomMetrics},
+			MetricsServiceBackend: v1alpha1.MetricsServiceBackend{Name: "slowSource"},
+		},
+	}
+	updated := make(chan error)
+	go func() {
+		_, err := fakeRegistry.registry.AddOrUpdateSource(context.Background(), source)
+		updated <- err
+	}()
+	assert.Eventually(t, func() bool { return slowClient.Waiting() == 1 }, 5*time.Second, time.Millisecond)
+
+	// The source is deleted while the discovery is in flight, it must not be added back
+	fakeRegistry.registry.DeleteSource("slowSource")
+	close(slowClient.wait)
+	assert.NoError(t, <-updated)
+	assert.Empty(t, fakeRegistry.registry.ListAllCustomMetrics())
+}
+
+func TestRegistry_AddOrUpdateSource_NotApplied(t *testing.T) {
+	newSource := func() v1alpha1.MetricsSource {
+		return v1alpha1.MetricsSource{
+			ObjectMeta: metav1.ObjectMeta{Name: "source1"},
+			Spec: v1alpha1.MetricsSourceSpec{
+				MetricTypes:           v1alpha1.MetricTypes{v1alpha1.CustomMetrics},
+				MetricsServiceBackend: v1alpha1.MetricsServiceBackend{Name: "source1", LoadBalancing: &v1alpha1.LoadBalancing{}},
+				CircuitBreaker:        &v1alpha1.CircuitBreaker{ConsecutiveFailures: int32Ptr(5)},
+			},
+		}
+	}
+	tests := []struct {
+		name   string
+		update func(t *testing.T, fakeRegistry *fakeRegistry)
+	}{
+		{
+			name: "source deleted while the discovery is in flight",
+			update: func(t *testing.T, fakeRegistry *fakeRegistry) {
+				client := fakeRegistry.fakeClientProvider.clients["source1"]
+				client.wait = make(chan struct{})
+				updated := make(chan error)
+				go func() {
+					_, err := fakeRegistry.registry.AddOrUpdateSource(context.Background(), newSource())
+					updated <- err
+				}()
+				assert.Eventually(t, func() bool { return client.Waiting() == 1 }, 5*time.Second, time.Millisecond)
+				fakeRegistry.registry.DeleteSource("source1")
+				close(client.wait)
+				assert.NoError(t, <-updated)
+			},
+		},
+		{
+			name: "first discovery fails",
+			update: func(t *testing.T, fakeRegistry *fakeRegistry) {
+				fakeRegistry.fakeClientProvider.clients["source1"].customMetricsErr = errors.NewServiceUnavailable("backend is down")
+				_, err := fakeRegistry.registry.AddOrUpdateSource(context.Background(), newSource())
+				assert.Error(t, err)
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeRegistry := newFakeRegistry().servedCustomMetrics("source1", "metric1")
+			// The endpoints of the backend are synced before the metrics source is updated
+			fakeRegistry.registry.UpdateEndpoints("source1", newSource().Spec.MetricsServiceBackend, []string{"10.0.0.1:6443"})
+			tt.update(t, fakeRegistry)
+			// The state created for the update is released
+			assert.Empty(t, fakeRegistry.registry.ListAllCustomMetrics())
+			assert.Empty(t, fakeRegistry.registry.updates)
+			assert.Empty(t, fakeRegistry.registry.breakers.breakers)
+			assert.Empty(t, fakeRegistry.registry.inFlight.requests)
+			assert.Empty(t, fakeRegistry.registry.endpoints.balancers)
+			assert.Empty(t, fakeRegistry.registry.endpoints.sources)
+		})
+	}
+}
+
+func TestRegistry_AddOrUpdateSource_ConcurrentDiscovery(t *testing.T) {
+	sources := []string{"source1", "source2", "source3", "source4"}
+	// The routes must not depend on the order in which the discoveries complete.
+	for _, completionOrder := range [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}, {2, 0, 3, 1}} {
+		fakeRegistry := newFakeRegistry().
+			servedCustomMetrics("source1", "metric1", "metric2").
+			servedCustomMetrics("source2", "metric1").
+			servedCustomMetrics("source3", "metric1", "metric2").
+			servedCustomMetrics("source4", "metric2")
+		updated := make(chan error)
+		for _, name := range sources {
+			fakeRegistry.fakeClientProvider.clients[name].wait = make(chan struct{})
+			source := v1alpha1.MetricsSource{
+				ObjectMeta: metav1.ObjectMeta{Name: name},
+				Spec: v1alpha1.MetricsSourceSpec{
+					MetricTypes:           v1alpha1.MetricTypes{v1alpha1.CustomMetrics},
+					MetricsServiceBackend: v1alpha1.MetricsServiceBackend{Name: name},
+				},
+			}
+			if name == "source4" {
+				source.Spec.Priority = 10
+			}
+			go func() {
+				_, err := fakeRegistry.registry.AddOrUpdateSource(context.Background(), source)
+				updated <- err
+			}()
+		}
+		for _, i := range completionOrder {
+			client := fakeRegistry.fakeClientProvider.clients[sources[i]]
+			assert.Eventually(t, func() bool { return client.Waiting() == 1 }, 5*time.Second, time.Millisecond)
+			close(client.wait)
+			assert.NoError(t, <-updated)
+		}
+		assertMetricsExpectations(t, fakeRegistry.registry, []expectation{
+			// Same priority, sources are sorted by name
+			{metricName: "metric1", metricType: v1alpha1.CustomMetrics, expectedSourceName: "source1"},
+			{metricName: "metric2", metricType: v1alpha1.CustomMetrics, expectedSourceName: "source4"},
+		})
+		assert.Equal(t, []string{"source1", "source2", "source3"}, fakeRegistry.registry.currentRoutes().sourceNames("metric1"))
+		assert.Equal(t, []string{"source4", "source1", "source3"}, fakeRegistry.registry.currentRoutes().sourceNames("metric2"))
+	}
+}
+
+func TestRegistry_AddOrUpdateSource_PartialFailure(t *testing.T) {
+	tests := []struct {
+		name   string
+		inject func(client *fakeMetricsClient)
+	}{
+		{
+			name: "custom metrics discovery fails",
+			inject: func(client *fakeMetricsClient) {
+				client.customMetricsErr = errors.NewServiceUnavailable("backend is down")
+			},
+		},
+		{
+			name: "external metrics discovery fails after custom metrics have been listed",
+			inject: func(client *fakeMetricsClient) {
+				client.externalMetricsErr = errors.NewServiceUnavailable("backend is down")
+			},
+		},
+		{
+			name:   "discovery is cancelled",
+			inject: func(client *fakeMetricsClient) { client.wait = make(chan struct{}) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeRegistry := newFakeRegistry().
+				servedCustomMetrics("source1", "metric1").
+				servedExternalMetrics("source1", "external1")
+			client := fakeRegistry.fakeClientProvider.clients["source1"]
+			source := v1alpha1.MetricsSource{
+				ObjectMeta: metav1.ObjectMeta{Name: "source1"},
+				Spec: v1alpha1.MetricsSourceSpec{
+					MetricTypes:           v1alpha1.MetricTypes{v1alpha1.CustomMetrics, v1alpha1.ExternalMetrics},
+					MetricsServiceBackend: v1alpha1.MetricsServiceBackend{Name: "source1"},
+					CircuitBreaker:        &v1alpha1.CircuitBreaker{ConsecutiveFailures: int32Ptr(5)},
+					RateLimits:            &v1alpha1.RateLimits{MaxInFlight: int32Ptr(10)},
+					Cache:                 &v1alpha1.ValueCache{MaxEntries: int32Ptr(10)},
+					Discovery:             &v1alpha1.DiscoveryPolicy{RemovalConfirmations: int32Ptr(1)},
+				},
+			}
+			_, err := fakeRegistry.registry.AddOrUpdateSource(context.Background(), source)
+			assert.NoError(t, err)
+			limiter := fakeRegistry.registry.limiters.limiters["source1"]
+			cache := fakeRegistry.registry.caches.caches["source1"]
+			breaker := fakeRegistry.registry.breakers.breakers["source1"]
+			initialState := []expectation{
+				{metricName: "metric1", metricType: v1alpha1.CustomMetrics, expectedSourceName: "source1"},
+				{metricName: "external1", metricType: v1alpha1.ExternalMetrics, expectedSourceName: "source1"},
+				{metricName: "metric2", metricType: v1alpha1.CustomMetrics, expectedError: errors.IsNotFound},
+				{metricName: "external2", metricType: v1alpha1.ExternalMetrics, expectedError: errors.IsNotFound},
+			}
+
+			// The metrics and the configuration of the source are updated, but the discovery fails
+			client.customMetrics, client.externalMetrics = []string{"metric2"}, []string{"external2"}
+			source.Spec.CircuitBreaker.ConsecutiveFailures = int32Ptr(3)
+			source.Spec.RateLimits.MaxInFlight = int32Ptr(20)
+			source.Spec.Cache.MaxEntries = int32Ptr(20)
+			tt.inject(client)
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err = fakeRegistry.registry.AddOrUpdateSource(ctx, source)
+			assert.Error(t, err)
+
+			// Nothing has been updated
+			assertMetricsExpectations(t, fakeRegistry.registry, initialState)
+			assert.ElementsMatch(t, fakeCustomMetricList("metric1"), fakeRegistry.registry.ListAllCustomMetrics())
+			assert.ElementsMatch(t, fakeExternalMetricList("external1"), fakeRegistry.registry.ListAllExternalMetrics())
+			assert.Equal(t, map[provider.CustomMetricInfo]struct{}{fakeCustomMetricList("metric1")[0]: {}}, fakeRegistry.registry.currentRoutes().sources["source1"].customMetricInfos)
+			assert.Same(t, limiter, fakeRegistry.registry.limiters.limiters["source1"])
+			assert.Same(t, cache, fakeRegistry.registry.caches.caches["source1"])
+			assert.Equal(t, 5, breaker.maxConsecutive)
+
+			// The update is fully applied once the discovery succeeds
+			client.customMetricsErr, client.externalMetricsErr, client.wait = nil, nil, nil
+			_, err = fakeRegistry.registry.AddOrUpdateSource(context.Background(), source)
+			assert.NoError(t, err)
+			assertMetricsExpectations(t, fakeRegistry.registry, []expectation{
+				{metricName: "metric1", metricType: v1alpha1.CustomMetrics, expectedError: errors.IsNotFound},
+				{metricName: "external1", metricType: v1alpha1.ExternalMetrics, expectedError: errors.IsNotFound},
+				{metricName: "metric2", metricType: v1alpha1.CustomMetrics, expectedSourceName: "source1"},
+				{metricName: "external2", metricType: v1alpha1.ExternalMetrics, expectedSourceName: "source1"},
+			})
+			assert.Equal(t, 20, fakeRegistry.registry.limiters.limiters["source1"].config.MaxInFlightRequests())
+			assert.Equal(t, 20, fakeRegistry.registry.caches.caches["source1"].maxEntries)
+			assert.Same(t, breaker, fakeRegistry.registry.breakers.breakers["source1"])
+			assert.Equal(t, 3, breaker.maxConsecutive)
+		})
+	}
+}
@@ -0,0 +1,70 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// RequestKey identifies a request for the values of a metric. Identical requests have equal keys, the key is used to
+// cache the values returned by the metrics sources and to coalesce identical concurrent requests.
+type RequestKey struct {
+	// Info is the custom metric requested, empty for external metrics.
+	Info provider.CustomMetricInfo
+	// ExternalMetric is the name of the external metric requested, empty for custom metrics.
+	ExternalMetric string
+	Namespace      string
+	// Name is the name of the described object when a custom metric is requested by name.
+	Name string
+	// Selector is the label selector of the described objects when a custom metric is requested by selector.
+	Selector       string
+	BySelector     bool
+	MetricSelector string
+}
+
+// CustomMetricByNameKey returns the key of a request for the value of a custom metric describing a single object.
+func CustomMetricByNameKey(name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) RequestKey {
+	return RequestKey{Info: info, Namespace: name.Namespace, Name: name.Name, MetricSelector: SelectorString(metricSelector)}
+}
+
+// CustomMetricBySelectorKey returns the key of a request for the values of a custom metric describing the objects
+// matching a label selector.
+func CustomMetricBySelectorKey(namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) RequestKey {
+	return RequestKey{
+		Info:           info,
+		Namespace:      namespace,
+		Selector:       SelectorString(selector),
+		BySelector:     true,
+		MetricSelector: SelectorString(metricSelector),
+	}
+}
+
+// ExternalMetricKey returns the key of a request for the values of an external metric.
+func ExternalMetricKey(name, namespace string, metricSelector labels.Selector) RequestKey {
+	return RequestKey{ExternalMetric: name, Namespace: namespace, MetricSelector: SelectorString(metricSelector)}
+}
+
+// SelectorString returns the string representation of a label selector, an empty string if the selector is nil or
+// matches everything.
+func SelectorString(selector labels.Selector) string {
+	if selector == nil || selector.Empty() {
+		return ""
+	}
+	return selector.String()
+}
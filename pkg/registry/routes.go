@@ -0,0 +1,113 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+)
+
+// routingTable is an immutable snapshot of the metrics served by the metrics sources. A new table is built each time a
+// metrics source is updated or deleted, so the requests can look up the metrics sources without taking any lock.
+type routingTable struct {
+	// sources holds the metrics sources, indexed by name. The metrics served by a source are the reverse index used to
+	// only rebuild the routes of the metrics served by the source when it is updated.
+	sources map[string]cachedMetricSource
+
+	customMetrics   map[provider.CustomMetricInfo]cachedMetricSources
+	externalMetrics map[provider.ExternalMetricInfo]cachedMetricSources
+}
+
+var emptyRoutingTable = &routingTable{
+	sources:         map[string]cachedMetricSource{},
+	customMetrics:   map[provider.CustomMetricInfo]cachedMetricSources{},
+	externalMetrics: map[provider.ExternalMetricInfo]cachedMetricSources{},
+}
+
+// copy returns a shallow copy of the table. The lists of metrics sources are shared and must not be modified.
+func (t *routingTable) copy() *routingTable {
+	c := &routingTable{
+		sources:         make(map[string]cachedMetricSource, len(t.sources)),
+		customMetrics:   make(map[provider.CustomMetricInfo]cachedMetricSources, len(t.customMetrics)),
+		externalMetrics: make(map[provider.ExternalMetricInfo]cachedMetricSources, len(t.externalMetrics)),
+	}
+	for k, v := range t.sources {
+		c.sources[k] = v
+	}
+	for k, v := range t.customMetrics {
+		c.customMetrics[k] = v
+	}
+	for k, v := range t.externalMetrics {
+		c.externalMetrics[k] = v
+	}
+	return c
+}
+
+// withSource returns a new table in which the metrics served by the given metrics source are replaced.
+func (t *routingTable) withSource(newMetricSource cachedMetricSource) *routingTable {
+	c := t.copy()
+	sourceName := newMetricSource.sourceName
+	if actualMetricSource, ok := t.sources[sourceName]; ok {
+		// Check if some metrics that were previously served have been removed from that MetricsSource
+		for _, removedMetric := range getRemovedCustomMetrics(actualMetricSource.customMetricInfos, newMetricSource.customMetricInfos) {
+			c.removeCustomMetricSource(removedMetric, sourceName)
+		}
+		for _, removedMetric := range getRemovedExternalMetrics(actualMetricSource.externalMetricInfos, newMetricSource.externalMetricInfos) {
+			c.removeExternalMetricSource(removedMetric, sourceName)
+		}
+	}
+	for mInfo := range newMetricSource.customMetricInfos {
+		c.customMetrics[mInfo] = c.customMetrics[mInfo].withSource(newMetricSource)
+	}
+	for mInfo := range newMetricSource.externalMetricInfos {
+		c.externalMetrics[mInfo] = c.externalMetrics[mInfo].withSource(newMetricSource)
+	}
+	c.sources[sourceName] = newMetricSource
+	return c
+}
+
+// withoutSource returns a new table without the metrics served by the given metrics source.
+func (t *routingTable) withoutSource(sourceName string) *routingTable {
+	actualMetricSource, ok := t.sources[sourceName]
+	if !ok {
+		return t
+	}
+	c := t.copy()
+	for mInfo := range actualMetricSource.customMetricInfos {
+		c.removeCustomMetricSource(mInfo, sourceName)
+	}
+	for mInfo := range actualMetricSource.externalMetricInfos {
+		c.removeExternalMetricSource(mInfo, sourceName)
+	}
+	delete(c.sources, sourceName)
+	return c
+}
+
+func (t *routingTable) removeCustomMetricSource(info provider.CustomMetricInfo, sourceName string) {
+	if sources := t.customMetrics[info].withoutSource(sourceName); len(sources) > 0 {
+		t.customMetrics[info] = sources
+	} else {
+		delete(t.customMetrics, info)
+	}
+}
+
+func (t *routingTable) removeExternalMetricSource(info provider.ExternalMetricInfo, sourceName string) {
+	if sources := t.externalMetrics[info].withoutSource(sourceName); len(sources) > 0 {
+		t.externalMetrics[info] = sources
+	} else {
+		delete(t.externalMetrics, info)
+	}
+}
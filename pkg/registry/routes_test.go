@@ -0,0 +1,310 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func newRoutesSource(name string, priority int, metricNames ...string) cachedMetricSource {
+	source := cachedMetricSource{
+		sourceName:          name,
+		priority:            priority,
+		customMetricInfos:   make(map[provider.CustomMetricInfo]struct{}),
+		externalMetricInfos: make(map[provider.ExternalMetricInfo]struct{}),
+	}
+	for _, metricName := range metricNames {
+		source.customMetricInfos[provider.CustomMetricInfo{Metric: metricName}] = struct{}{}
+		source.externalMetricInfos[provider.ExternalMetricInfo{Metric: metricName}] = struct{}{}
+	}
+	return source
+}
+
+// sourceNames returns the names of the metrics sources serving a custom metric, in order of preference.
+func (t *routingTable) sourceNames(metricName string) []string {
+	var names []string
+	for _, source := range t.customMetrics[provider.CustomMetricInfo{Metric: metricName}] {
+		names = append(names, source.sourceName)
+	}
+	return names
+}
+
+func TestRoutingTable(t *testing.T) {
+	v1 := emptyRoutingTable.
+		withSource(newRoutesSource("source1", 0, "metric1", "metric2")).
+		withSource(newRoutesSource("source2", 10, "metric2"))
+	assert.Equal(t, []string{"source1"}, v1.sourceNames("metric1"))
+	assert.Equal(t, []string{"source2", "source1"}, v1.sourceNames("metric2"))
+
+	// metric1 is no longer served by source1
+	v2 := v1.withSource(newRoutesSource("source1", 20, "metric2", "metric3"))
+	assert.Nil(t, v2.sourceNames("metric1"))
+	assert.Equal(t, []string{"source1", "source2"}, v2.sourceNames("metric2"))
+	assert.Equal(t, []string{"source1"}, v2.sourceNames("metric3"))
+	assert.Len(t, v2.externalMetrics, 2)
+
+	v3 := v2.withoutSource("source1")
+	assert.Equal(t, []string{"source2"}, v3.sourceNames("metric2"))
+	assert.Len(t, v3.customMetrics, 1)
+	assert.Len(t, v3.externalMetrics, 1)
+	assert.Len(t, v3.sources, 1)
+	assert.Same(t, v3, v3.withoutSource("unknown"))
+
+	// Snapshots are never modified.
+	assert.Equal(t, []string{"source1"}, v1.sourceNames("metric1"))
+	assert.Equal(t, []string{"source2", "source1"}, v1.sourceNames("metric2"))
+	assert.Equal(t, []string{"source1", "source2"}, v2.sourceNames("metric2"))
+	assert.Len(t, v2.sources, 2)
+	assert.Empty(t, emptyRoutingTable.sources)
+	assert.Empty(t, emptyRoutingTable.customMetrics)
+}
+
+// lockedRoutes mirrors the routing of the registry before it relied on snapshots: a single map updated in place and
+// protected by a RWMutex. It is the baseline of the benchmarks.
+type lockedRoutes struct {
+	lock          sync.RWMutex
+	sources       map[string]cachedMetricSource
+	customMetrics map[provider.CustomMetricInfo]*cachedMetricSources
+}
+
+func (l *lockedRoutes) addOrUpdateSource(source cachedMetricSource) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for mInfo := range source.customMetricInfos {
+		sources, ok := l.customMetrics[mInfo]
+		if !ok {
+			sources = &cachedMetricSources{}
+			l.customMetrics[mInfo] = sources
+		}
+		*sources = sources.withSource(source)
+	}
+	l.sources[source.sourceName] = source
+}
+
+func (l *lockedRoutes) lookup(info provider.CustomMetricInfo) (MetricsClient, bool) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	services, ok := l.customMetrics[info]
+	if !ok {
+		return nil, false
+	}
+	service, err := services.getBestMetricService()
+	if err != nil {
+		return nil, false
+	}
+	source, ok := l.sources[service.sourceName]
+	return source.client, ok
+}
+
+func (r *Registry) lookup(info provider.CustomMetricInfo) (MetricsClient, bool) {
+	routes := r.currentRoutes()
+	services, ok := routes.customMetrics[info]
+	if !ok {
+		return nil, false
+	}
+	service, err := services.getBestMetricService()
+	if err != nil {
+		return nil, false
+	}
+	source, ok := routes.sources[service.sourceName]
+	return source.client, ok
+}
+
+type benchmarkRoutes interface {
+	addOrUpdateSource(source cachedMetricSource)
+	lookup(info provider.CustomMetricInfo) (MetricsClient, bool)
+}
+
+type snapshotRoutes struct{ *Registry }
+
+func (s snapshotRoutes) addOrUpdateSource(source cachedMetricSource) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.applySource(source)
+}
+
+const benchmarkSources = 50
+
+// benchmarkSource returns a metrics source serving a share of the metrics, each metric being served by 2 sources.
+func benchmarkSource(i, metrics int) cachedMetricSource {
+	var names []string
+	for m := i; m < metrics; m += benchmarkSources / 2 {
+		names = append(names, fmt.Sprintf("metric%d", m))
+	}
+	return newRoutesSource(fmt.Sprintf("source%d", i), i%2, names...)
+}
+
+func benchmarkImplementations(metrics int) map[string]func() benchmarkRoutes {
+	populate := func(routes benchmarkRoutes) benchmarkRoutes {
+		for i := 0; i < benchmarkSources; i++ {
+			routes.addOrUpdateSource(benchmarkSource(i, metrics))
+		}
+		return routes
+	}
+	return map[string]func() benchmarkRoutes{
+		"snapshot": func() benchmarkRoutes {
+			return populate(snapshotRoutes{&Registry{}})
+		},
+		"rwmutex": func() benchmarkRoutes {
+			return populate(&lockedRoutes{
+				sources:       make(map[string]cachedMetricSource),
+				customMetrics: make(map[provider.CustomMetricInfo]*cachedMetricSources),
+			})
+		},
+	}
+}
+
+func benchmarkLookups(b *testing.B, routes benchmarkRoutes, metrics int) {
+	infos := make([]provider.CustomMetricInfo, metrics)
+	for i := range infos {
+		infos[i] = provider.CustomMetricInfo{Metric: fmt.Sprintf("metric%d", i)}
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, ok := routes.lookup(infos[i%metrics]); !ok {
+				b.Fatalf("no route for %v", infos[i%metrics])
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkRoutes_Lookup(b *testing.B) {
+	for _, metrics := range []int{1000, 10000} {
+		for name, newRoutes := range benchmarkImplementations(metrics) {
+			b.Run(fmt.Sprintf("%s/metrics=%d", name, metrics), func(b *testing.B) {
+				benchmarkLookups(b, newRoutes(), metrics)
+			})
+		}
+	}
+}
+
+// BenchmarkRoutes_LookupDuringUpdates measures the lookups while a metrics source is continuously updated.
+func BenchmarkRoutes_LookupDuringUpdates(b *testing.B) {
+	for _, metrics := range []int{1000, 10000} {
+		for name, newRoutes := range benchmarkImplementations(metrics) {
+			b.Run(fmt.Sprintf("%s/metrics=%d", name, metrics), func(b *testing.B) {
+				routes := newRoutes()
+				source := benchmarkSource(0, metrics)
+				stop, done := make(chan struct{}), make(chan struct{})
+				go func() {
+					defer close(done)
+					for {
+						select {
+						case <-stop:
+							return
+						default:
+							routes.addOrUpdateSource(source)
+						}
+					}
+				}()
+				benchmarkLookups(b, routes, metrics)
+				close(stop)
+				<-done
+			})
+		}
+	}
+}
+
+// BenchmarkRoutes_Update measures the cost of an update of a metrics source, which rebuilds the routing table.
+func BenchmarkRoutes_Update(b *testing.B) {
+	for _, metrics := range []int{1000, 10000} {
+		for name, newRoutes := range benchmarkImplementations(metrics) {
+			b.Run(fmt.Sprintf("%s/metrics=%d", name, metrics), func(b *testing.B) {
+				routes := newRoutes()
+				source := benchmarkSource(0, metrics)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					routes.addOrUpdateSource(source)
+				}
+			})
+		}
+	}
+}
+
+func TestRegistry_Routes(t *testing.T) {
+	syncTime := time.Date(2021, 6, 24, 7, 12, 19, 0, time.UTC)
+	source1 := newRoutesSource("source1", 0, "metric1", "metric2")
+	source1.syncTime = syncTime
+	// The custom metrics of newRoutesSource are root scoped
+	source1.customMetricInfos[provider.CustomMetricInfo{Metric: "namespaced", Namespaced: true}] = struct{}{}
+	// Metrics of the namespaces are requested in the namespace they describe
+	source1.customMetricInfos[provider.CustomMetricInfo{GroupResource: schema.GroupResource{Resource: "namespaces"}, Metric: "queue"}] = struct{}{}
+	source2 := newRoutesSource("source2", 10, "metric2")
+	source2.breaker = newCircuitBreaker("source2", &v1alpha1.CircuitBreaker{})
+	source2.breaker.setState(v1alpha1.CircuitBreakerOpen)
+	r := &Registry{}
+	r.routes.Store(emptyRoutingTable.withSource(source1).withSource(source2))
+
+	candidate1 := RouteSource{Name: "source1", CircuitBreaker: v1alpha1.CircuitBreakerClosed, Available: true, LastSync: syncTime}
+	candidate2 := RouteSource{Name: "source2", Priority: 10, CircuitBreaker: v1alpha1.CircuitBreakerOpen}
+	tests := []struct {
+		name   string
+		filter RoutesFilter
+		want   []string
+	}{
+		{
+			name: "All routes",
+			want: []string{"custom /metric1", "custom /metric2", "custom /namespaced(namespaced)", "custom namespaces/queue", "external metric1", "external metric2"},
+		},
+		{
+			name:   "By metric",
+			filter: RoutesFilter{Metric: "metric2"},
+			want:   []string{"custom /metric2", "external metric2"},
+		},
+		{
+			name:   "By source",
+			filter: RoutesFilter{Source: "source2"},
+			want:   []string{"custom /metric2", "external metric2"},
+		},
+		{
+			name:   "By namespace",
+			filter: RoutesFilter{Namespace: "default", Source: "source1"},
+			want:   []string{"custom /namespaced(namespaced)", "custom namespaces/queue", "external metric1", "external metric2"},
+		},
+		{
+			name:   "Unknown source",
+			filter: RoutesFilter{Source: "unknown"},
+			want:   []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, route := range r.Routes(tt.filter) {
+				got = append(got, route.API+" "+route.Metric)
+			}
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	// Metrics sources are listed in the order in which they are tried
+	routes := r.Routes(RoutesFilter{Metric: "metric2"})
+	assert.Equal(t, []RouteSource{candidate2, candidate1}, routes[0].Sources)
+	assert.Equal(t, []RouteSource{candidate2, candidate1}, routes[1].Sources)
+	assert.True(t, routes[1].Namespaced)
+}
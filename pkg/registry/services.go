@@ -19,15 +19,14 @@ package registry
 import (
 	"fmt"
 	"sort"
+
+	"k8s.io/klog"
 )
 
+// cachedMetricSources is a list of metrics sources, sorted by priority. Lists are shared by the routing table snapshots
+// and must not be modified once built.
 type cachedMetricSources []cachedMetricSource
 
-func newMetricsSources() *cachedMetricSources {
-	serviceList := make(cachedMetricSources, 0)
-	return &serviceList
-}
-
 func (c cachedMetricSources) Len() int {
 	return len(c)
 }
@@ -48,40 +47,44 @@ func (c cachedMetricSources) Swap(i, j int) {
 	c[i], c[j] = c[j], c[i]
 }
 
-func (c *cachedMetricSources) addOrUpdateSource(metricSource cachedMetricSource) {
-	found := -1
-	for i, s := range *c {
-		if s.sourceName == metricSource.sourceName {
-			found = i
-			break
+// withSource returns a new sorted list in which the given metrics source is added or replaced.
+func (c cachedMetricSources) withSource(metricSource cachedMetricSource) cachedMetricSources {
+	sources := make(cachedMetricSources, 0, len(c)+1)
+	for _, s := range c {
+		if s.sourceName != metricSource.sourceName {
+			sources = append(sources, s)
 		}
 	}
-	if found != -1 {
-		(*c)[found] = metricSource
-	} else {
-		*c = append(*c, metricSource)
-	}
-	sort.Sort(c)
+	sources = append(sources, metricSource)
+	sort.Sort(sources)
+	return sources
 }
 
-func (c *cachedMetricSources) removeSource(sourceName string) (empty bool) {
-	found := -1
-	for i, s := range *c {
-		if s.sourceName == sourceName {
-			found = i
+// withoutSource returns a new list without the given metrics source.
+func (c cachedMetricSources) withoutSource(sourceName string) cachedMetricSources {
+	sources := make(cachedMetricSources, 0, len(c))
+	for _, s := range c {
+		if s.sourceName != sourceName {
+			sources = append(sources, s)
 		}
 	}
-	if found != -1 {
-		*c = append((*c)[:found], (*c)[found+1:]...)
-		sort.Sort(c)
-	}
-	return c.Len() == 0
+	return sources
 }
 
-func (c *cachedMetricSources) getBestMetricService() (*cachedMetricSource, error) {
+func (c cachedMetricSources) getBestMetricService() (*cachedMetricSource, error) {
 	if c.Len() == 0 {
 		return nil, fmt.Errorf("no metric backend for metric")
 	}
-	service := (*c)[0]
+	// Fail over to the next metrics source if the circuit breaker of the preferred one is open.
+	for i, service := range c {
+		if service.available() {
+			if i > 0 {
+				klog.V(2).Infof("metrics source %s is not available, failing over to %s", c[0].sourceName, service.sourceName)
+			}
+			return &service, nil
+		}
+	}
+	// No metrics source is available, the request fails fast with the preferred one.
+	service := c[0]
 	return &service, nil
 }
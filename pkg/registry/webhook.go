@@ -0,0 +1,324 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+	"k8s.io/metrics/pkg/apis/custom_metrics"
+	"k8s.io/metrics/pkg/apis/external_metrics"
+)
+
+// maxWebhookResponseSize is the maximum size of a response read from a webhook.
+const maxWebhookResponseSize = 10 << 20
+
+const (
+	webhookCustomMetric   = "custom"
+	webhookExternalMetric = "external"
+)
+
+// webhookRequest is the body of the requests sent to a webhook to get the values of a metric.
+type webhookRequest struct {
+	// Type is the type of the metric, either custom or external.
+	Type string `json:"type"`
+	// Metric is the name of the metric.
+	Metric string `json:"metric"`
+	// Namespace of the request, empty for cluster scoped resources.
+	Namespace string `json:"namespace,omitempty"`
+	// Resource described by a custom metric, in the form resource.group
+	Resource string `json:"resource,omitempty"`
+	// Objects described by a custom metric.
+	Objects []webhookObject `json:"objects,omitempty"`
+	// Selector is the label selector used to select the described objects, if any.
+	Selector string `json:"selector,omitempty"`
+	// MetricSelector is the metric selector of the request, if any.
+	MetricSelector string `json:"metricSelector,omitempty"`
+}
+
+// webhookObject is a reference to an object described by a custom metric.
+type webhookObject struct {
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name"`
+}
+
+// webhookResponse is the body of the responses returned by a webhook.
+type webhookResponse struct {
+	Items []webhookValue `json:"items"`
+}
+
+type webhookValue struct {
+	// Object is the name of the object described by a custom metric.
+	Object string `json:"object,omitempty"`
+	// Labels of an external metric value.
+	Labels map[string]string `json:"labels,omitempty"`
+	// Value is a number or a quantity, for example 1.5 or "1500m"
+	Value resource.Quantity `json:"value"`
+}
+
+// webhookDiscovery is the body of the responses returned by the discovery endpoint of a webhook.
+type webhookDiscovery struct {
+	CustomMetrics   []v1alpha1.WebhookCustomMetric `json:"customMetrics,omitempty"`
+	ExternalMetrics []string                       `json:"externalMetrics,omitempty"`
+}
+
+// webhookClient is a MetricsClient which gets the metric values from an HTTP endpoint.
+type webhookClient struct {
+	sourceName string
+	backend    v1alpha1.WebhookBackend
+	httpClient *http.Client
+	objects    objectLister
+
+	// lock protects discovered.
+	lock sync.Mutex
+	// discovered holds the response of the discovery endpoint. A client is created for each discovery of the metrics
+	// source: the endpoint is read once, for both the custom and the external metrics.
+	discovered *webhookDiscovery
+}
+
+var _ MetricsClient = &webhookClient{}
+
+func newWebhookClient(sourceName string, backend v1alpha1.WebhookBackend, insecure bool, objects objectLister) *webhookClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} //nolint:gosec
+	}
+	return &webhookClient{
+		sourceName: sourceName,
+		backend:    backend,
+		httpClient: &http.Client{Transport: backendTransport(transport)},
+		objects:    objects,
+	}
+}
+
+// Close releases the idle connections to the webhook.
+func (c *webhookClient) Close() {
+	c.httpClient.CloseIdleConnections()
+}
+
+func (c *webhookClient) GetBackend() v1alpha1.MetricsServiceBackend {
+	return v1alpha1.MetricsServiceBackend{}
+}
+
+// do sends a request to the webhook and decodes the response into out.
+func (c *webhookClient) do(ctx context.Context, method, url string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return apierrors.NewInternalError(fmt.Errorf("metrics source %s: %v", c.sourceName, err))
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return apierrors.NewInternalError(fmt.Errorf("metrics source %s: %v", c.sourceName, err))
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return backendError(c.sourceName, err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxWebhookResponseSize))
+	if err != nil {
+		return backendError(c.sourceName, err)
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+		return backendError(c.sourceName, apierrors.NewGenericServerResponse(resp.StatusCode, method, schema.GroupResource{}, "", string(respBody), retryAfter, true))
+	}
+	if err := json.Unmarshal(respBody, out); err != nil {
+		return backendError(c.sourceName, fmt.Errorf("invalid response from %s: %v", url, err))
+	}
+	return nil
+}
+
+// discovery returns the metrics served by the webhook, either from its discovery endpoint or from the static lists.
+func (c *webhookClient) discovery(ctx context.Context) (webhookDiscovery, error) {
+	if c.backend.DiscoveryURL == "" {
+		return webhookDiscovery{CustomMetrics: c.backend.CustomMetrics, ExternalMetrics: c.backend.ExternalMetrics}, nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.discovered != nil {
+		return *c.discovered, nil
+	}
+	var discovery webhookDiscovery
+	if err := c.do(ctx, http.MethodGet, c.backend.DiscoveryURL, nil, &discovery); err != nil {
+		return webhookDiscovery{}, err
+	}
+	c.discovered = &discovery
+	return discovery, nil
+}
+
+func (c *webhookClient) ListCustomMetricInfos(ctx context.Context) (map[provider.CustomMetricInfo]struct{}, error) {
+	discovery, err := c.discovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	infos := make(map[provider.CustomMetricInfo]struct{}, len(discovery.CustomMetrics))
+	for _, metric := range discovery.CustomMetrics {
+		infos[provider.CustomMetricInfo{
+			GroupResource: schema.ParseGroupResource(metric.Resource),
+			Namespaced:    metric.IsNamespaced(),
+			Metric:        metric.Name,
+		}] = struct{}{}
+	}
+	return infos, nil
+}
+
+func (c *webhookClient) ListExternalMetrics(ctx context.Context) (map[provider.ExternalMetricInfo]struct{}, error) {
+	discovery, err := c.discovery(ctx)
+	if err != nil {
+		return nil, err
+	}
+	infos := make(map[provider.ExternalMetricInfo]struct{}, len(discovery.ExternalMetrics))
+	for _, metric := range discovery.ExternalMetrics {
+		infos[provider.ExternalMetricInfo{Metric: metric}] = struct{}{}
+	}
+	return infos, nil
+}
+
+// customMetricValues requests the values of a custom metric for the given objects.
+func (c *webhookClient) customMetricValues(ctx context.Context, namespace string, names []string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) ([]custom_metrics.MetricValue, error) {
+	objectReference := custom_metrics.ObjectReference{Namespace: namespace}
+	if gvk, err := c.objects.KindFor(info.GroupResource); err == nil {
+		objectReference.Kind = gvk.Kind
+		objectReference.APIVersion = gvk.GroupVersion().String()
+	} else {
+		klog.V(2).Infof("metrics source %s: failed to get kind of %s: %v", c.sourceName, info.GroupResource, err)
+	}
+	request := webhookRequest{
+		Type:           webhookCustomMetric,
+		Metric:         info.Metric,
+		Namespace:      namespace,
+		Resource:       info.GroupResource.String(),
+		Objects:        make([]webhookObject, len(names)),
+		Selector:       SelectorString(selector),
+		MetricSelector: SelectorString(metricSelector),
+	}
+	expectedNames := make(map[string]struct{}, len(names))
+	for i, name := range names {
+		request.Objects[i] = webhookObject{
+			APIVersion: objectReference.APIVersion,
+			Kind:       objectReference.Kind,
+			Namespace:  namespace,
+			Name:       name,
+		}
+		expectedNames[name] = struct{}{}
+	}
+	var response webhookResponse
+	if err := c.do(ctx, http.MethodPost, c.backend.URL, request, &response); err != nil {
+		return nil, err
+	}
+	now := metav1.NewTime(time.Now())
+	values := make([]custom_metrics.MetricValue, 0, len(response.Items))
+	for _, item := range response.Items {
+		if _, ok := expectedNames[item.Object]; !ok {
+			continue
+		}
+		describedObject := objectReference
+		describedObject.Name = item.Object
+		values = append(values, custom_metrics.MetricValue{
+			DescribedObject: describedObject,
+			Metric:          custom_metrics.MetricIdentifier{Name: info.Metric, Selector: labelSelector(metricSelector)},
+			Timestamp:       now,
+			Value:           item.Value,
+		})
+	}
+	return values, nil
+}
+
+func (c *webhookClient) GetMetricByName(ctx context.Context, name types.NamespacedName, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValue, error) {
+	values, err := c.customMetricValues(ctx, name.Namespace, []string{name.Name}, nil, info, metricSelector)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, &apierrors.StatusError{
+			ErrStatus: metav1.Status{
+				Status:  metav1.StatusFailure,
+				Code:    http.StatusNotFound,
+				Reason:  metav1.StatusReasonNotFound,
+				Message: fmt.Sprintf("metrics source %s: no value for metric %s of %s %s", c.sourceName, info.Metric, info.GroupResource, name),
+			}}
+	}
+	return &values[0], nil
+}
+
+func (c *webhookClient) GetMetricBySelector(ctx context.Context, namespace string, selector labels.Selector, info provider.CustomMetricInfo, metricSelector labels.Selector) (*custom_metrics.MetricValueList, error) {
+	names, err := c.objects.Names(ctx, info.GroupResource, namespace, selector)
+	if err != nil {
+		return nil, apierrors.NewInternalError(fmt.Errorf("metrics source %s: failed to list %s: %v", c.sourceName, info.GroupResource, err))
+	}
+	if len(names) == 0 {
+		return &custom_metrics.MetricValueList{}, nil
+	}
+	values, err := c.customMetricValues(ctx, namespace, names, selector, info, metricSelector)
+	if err != nil {
+		return nil, err
+	}
+	return &custom_metrics.MetricValueList{Items: values}, nil
+}
+
+func (c *webhookClient) GetExternalMetric(ctx context.Context, name, namespace string, metricSelector labels.Selector) (*external_metrics.ExternalMetricValueList, error) {
+	request := webhookRequest{
+		Type:           webhookExternalMetric,
+		Metric:         name,
+		Namespace:      namespace,
+		MetricSelector: SelectorString(metricSelector),
+	}
+	var response webhookResponse
+	if err := c.do(ctx, http.MethodPost, c.backend.URL, request, &response); err != nil {
+		return nil, err
+	}
+	now := metav1.NewTime(time.Now())
+	values := make([]external_metrics.ExternalMetricValue, len(response.Items))
+	for i, item := range response.Items {
+		values[i] = external_metrics.ExternalMetricValue{
+			MetricName:   name,
+			MetricLabels: item.Labels,
+			Timestamp:    now,
+			Value:        item.Value,
+		}
+	}
+	return &external_metrics.ExternalMetricValueList{Items: values}, nil
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/barkbay/custom-metrics-router/pkg/api/v1alpha1"
+	"github.com/kubernetes-sigs/custom-metrics-apiserver/pkg/provider"
+	"github.com/stretchr/testify/assert"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// fakeWebhook records the requests it receives and returns a static response.
+type fakeWebhook struct {
+	*httptest.Server
+
+	lock        sync.Mutex
+	lastRequest webhookRequest
+	// discoveries is the number of requests received by the discovery endpoint.
+	discoveries int
+	// statusCode, if set, is returned instead of the response.
+	statusCode int
+	response   string
+}
+
+func newFakeWebhook(t *testing.T) *fakeWebhook {
+	t.Helper()
+	f := &fakeWebhook{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodGet, r.Method)
+		f.lock.Lock()
+		f.discoveries++
+		f.lock.Unlock()
+		_, _ = w.Write([]byte(`{"customMetrics":[{"name":"jobs","resource":"deployments.apps"}],"externalMetrics":["queue_messages"]}`))
+	})
+	mux.HandleFunc("/values", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		f.lastRequest = webhookRequest{}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&f.lastRequest))
+		if f.statusCode != 0 {
+			http.Error(w, "backend failure", f.statusCode)
+			return
+		}
+		_, _ = w.Write([]byte(f.response))
+	})
+	f.Server = httptest.NewServer(mux)
+	return f
+}
+
+func (f *fakeWebhook) setResponse(statusCode int, response string) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.statusCode, f.response = statusCode, response
+}
+
+func (f *fakeWebhook) request() webhookRequest {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.lastRequest
+}
+
+func TestWebhookClient_Discovery(t *testing.T) {
+	webhook := newFakeWebhook(t)
+	defer webhook.Close()
+
+	// Static lists
+	client := newWebhookClient("webhook", v1alpha1.WebhookBackend{
+		URL:             webhook.URL + "/values",
+		CustomMetrics:   []v1alpha1.WebhookCustomMetric{{Name: "http_requests", Resource: "pods"}},
+		ExternalMetrics: []string{"queue_messages"},
+	}, false, fakeObjects{})
+	customMetrics, err := client.ListCustomMetricInfos(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[provider.CustomMetricInfo]struct{}{podsHTTPRequests: {}}, customMetrics)
+	externalMetrics, err := client.ListExternalMetrics(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[provider.ExternalMetricInfo]struct{}{queueMessages: {}}, externalMetrics)
+
+	// Discovery endpoint, static lists are ignored
+	client.backend.DiscoveryURL = webhook.URL + "/metrics"
+	customMetrics, err = client.ListCustomMetricInfos(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[provider.CustomMetricInfo]struct{}{
+		{GroupResource: schema.GroupResource{Group: "apps", Resource: "deployments"}, Namespaced: true, Metric: "jobs"}: {},
+	}, customMetrics)
+	externalMetrics, err = client.ListExternalMetrics(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, map[provider.ExternalMetricInfo]struct{}{queueMessages: {}}, externalMetrics)
+	// The discovery endpoint is read once for both the custom and the external metrics
+	assert.Equal(t, 1, webhook.discoveries)
+
+	// Webhook is not reachable
+	webhook.Close()
+	client = newWebhookClient("webhook", v1alpha1.WebhookBackend{URL: webhook.URL + "/values", DiscoveryURL: webhook.URL + "/metrics"}, false, fakeObjects{})
+	_, err = client.ListCustomMetricInfos(context.Background())
+	assert.True(t, apierrors.IsServiceUnavailable(err), "ServiceUnavailable expected, got %v", err)
+}
+
+func TestWebhookClient_CustomMetrics(t *testing.T) {
+	webhook := newFakeWebhook(t)
+	defer webhook.Close()
+	client := newWebhookClient("webhook", v1alpha1.WebhookBackend{URL: webhook.URL + "/values"}, false, fakeObjects{names: []string{"pod-a", "pod-b"}})
+	webhook.setResponse(0, `{"items":[{"object":"pod-a","value":1.5},{"object":"pod-b","value":"2k"},{"object":"unknown-pod","value":3}]}`)
+
+	// By name
+	value, err := client.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "ns", Name: "pod-a"}, podsHTTPRequests, labels.Everything())
+	assert.NoError(t, err)
+	assert.Equal(t, webhookRequest{
+		Type:      "custom",
+		Metric:    "http_requests",
+		Namespace: "ns",
+		Resource:  "pods",
+		Objects:   []webhookObject{{APIVersion: "v1", Kind: "Pod", Namespace: "ns", Name: "pod-a"}},
+	}, webhook.request())
+	assert.Equal(t, "pod-a", value.DescribedObject.Name)
+	assert.Equal(t, "Pod", value.DescribedObject.Kind)
+	assert.Equal(t, int64(1500), value.Value.MilliValue())
+
+	// By selector
+	selector := labels.SelectorFromSet(labels.Set{"app": "web"})
+	metricSelector := labels.SelectorFromSet(labels.Set{"method": "GET"})
+	values, err := client.GetMetricBySelector(context.Background(), "ns", selector, podsHTTPRequests, metricSelector)
+	assert.NoError(t, err)
+	assert.Equal(t, "app=web", webhook.request().Selector)
+	assert.Equal(t, "method=GET", webhook.request().MetricSelector)
+	assert.Len(t, webhook.request().Objects, 2)
+	assert.Len(t, values.Items, 2)
+	assert.Equal(t, int64(2000), values.Items[1].Value.Value())
+
+	// No value for the requested object
+	webhook.setResponse(0, `{"items":[]}`)
+	_, err = client.GetMetricByName(context.Background(), types.NamespacedName{Namespace: "ns", Name: "pod-a"}, podsHTTPRequests, labels.Everything())
+	assert.True(t, apierrors.IsNotFound(err), "NotFound expected, got %v", err)
+}
+
+func TestWebhookClient_ExternalMetrics(t *testing.T) {
+	webhook := newFakeWebhook(t)
+	defer webhook.Close()
+	client := newWebhookClient("webhook", v1alpha1.WebhookBackend{URL: webhook.URL + "/values"}, false, fakeObjects{})
+
+	tests := []struct {
+		name       string
+		statusCode int
+		response   string
+		wantValues map[string]int64
+		assertErr  func(error) bool
+	}{
+		{
+			name:       "values",
+			response:   `{"items":[{"labels":{"queue":"orders"},"value":42},{"labels":{"queue":"invoices"},"value":"3"}]}`,
+			wantValues: map[string]int64{"orders": 42, "invoices": 3},
+		},
+		{
+			name:       "status code is preserved",
+			statusCode: http.StatusServiceUnavailable,
+			assertErr:  apierrors.IsServiceUnavailable,
+		},
+		{
+			name:      "invalid value",
+			response:  `{"items":[{"value":"not a number"}]}`,
+			assertErr: apierrors.IsInternalError,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			webhook.setResponse(tt.statusCode, tt.response)
+			values, err := client.GetExternalMetric(context.Background(), "queue_messages", "ns", labels.Everything())
+			assert.Equal(t, webhookRequest{Type: "external", Metric: "queue_messages", Namespace: "ns"}, webhook.request())
+			if tt.assertErr != nil {
+				assert.True(t, tt.assertErr(err), "unexpected error: %v", err)
+				return
+			}
+			assert.NoError(t, err)
+			gotValues := make(map[string]int64)
+			for _, value := range values.Items {
+				assert.Equal(t, "queue_messages", value.MetricName)
+				gotValues[value.MetricLabels["queue"]] = value.Value.Value()
+			}
+			assert.Equal(t, tt.wantValues, gotValues)
+		})
+	}
+}
@@ -0,0 +1,193 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package tracing traces the requests for metric values, from the API request received by the router to the requests
+// sent to the metrics backends. Traces are exported to an OTLP/HTTP receiver, and the W3C trace context is propagated
+// in the requests sent to the metrics backends.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	instrumentationName = "github.com/barkbay/custom-metrics-router"
+	serviceName         = "metrics-router"
+)
+
+// Attributes of the spans.
+const (
+	MetricKey    = attribute.Key("metrics_router.metric")
+	APIKey       = attribute.Key("metrics_router.api")
+	SourceKey    = attribute.Key("metrics_router.source")
+	CoalescedKey = attribute.Key("metrics_router.coalesced")
+	CacheKey     = attribute.Key("metrics_router.cache")
+	NamespaceKey = semconv.K8SNamespaceNameKey
+)
+
+// Options configures the tracing.
+type Options struct {
+	// Endpoint is the URL of the OTLP/HTTP receiver, traces are sent to <Endpoint>/v1/traces. Tracing is disabled if
+	// empty.
+	Endpoint string
+	// SamplingRatio is the ratio of the traces sampled. It only applies to the requests received without a trace
+	// context, the sampling decision of the caller is respected otherwise.
+	SamplingRatio float64
+}
+
+// Setup configures the global tracer provider and propagator. The returned function flushes the spans not exported yet.
+func Setup(options Options) (func(context.Context) error, error) {
+	if options.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := newOTLPExporter(options.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %v", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(options.SamplingRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(serviceName))),
+	)
+	SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// SetTracerProvider sets the tracer provider used to trace the requests, and enables the propagation of the W3C trace
+// context.
+func SetTracerProvider(provider trace.TracerProvider) {
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+// Tracer returns the tracer of the router.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// End ends a span, the error, if any, is recorded.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Handler extracts the trace context from the headers of the requests received by the router.
+func Handler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		handler.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// Transport returns a RoundTripper which records a span for each HTTP request, and propagates the trace context in the
+// request headers. Requests retried by the client are recorded in their own span.
+func Transport(delegate http.RoundTripper) http.RoundTripper {
+	return &transport{delegate: delegate}
+}
+
+type transport struct {
+	delegate http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !trace.SpanContextFromContext(req.Context()).IsValid() {
+		// The request is not traced
+		return t.delegate.RoundTrip(req)
+	}
+	ctx, span := Tracer().Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.HTTPMethodKey.String(req.Method), semconv.HTTPURLKey.String(req.URL.String())),
+	)
+	// The request must not be altered by a RoundTripper
+	req = req.Clone(ctx)
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := t.delegate.RoundTrip(req)
+	if err == nil {
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(resp.StatusCode))
+		if resp.StatusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, resp.Status)
+		}
+	}
+	End(span, err)
+	return resp, err
+}
+
+// CloseIdleConnections closes the idle connections of the delegate RoundTripper, if it supports it.
+func (t *transport) CloseIdleConnections() {
+	if c, ok := t.delegate.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
+
+// UnaryClientInterceptor returns a gRPC interceptor which records a span for each call, and propagates the trace
+// context in the call metadata.
+func UnaryClientInterceptor() grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if !trace.SpanContextFromContext(ctx).IsValid() {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		ctx, span := Tracer().Start(ctx, "gRPC "+method, trace.WithSpanKind(trace.SpanKindClient))
+		md, _ := metadata.FromOutgoingContext(ctx)
+		md = md.Copy()
+		otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(md))
+		err := invoker(metadata.NewOutgoingContext(ctx, md), method, req, reply, cc, opts...)
+		span.SetAttributes(attribute.String("rpc.grpc.status_code", status.Code(err).String()))
+		End(span, err)
+		return err
+	}
+}
+
+// metadataCarrier adapts the gRPC metadata to a TextMapCarrier.
+type metadataCarrier metadata.MD
+
+var _ propagation.TextMapCarrier = metadataCarrier{}
+
+func (m metadataCarrier) Get(key string) string {
+	values := metadata.MD(m).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+func (m metadataCarrier) Set(key, value string) {
+	metadata.MD(m).Set(key, value)
+}
+
+func (m metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	return keys
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2021.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// withTracerProvider sets a tracer provider which records the spans in the returned exporter until the test is over.
+func withTracerProvider(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { SetTracerProvider(trace.NewNoopTracerProvider()) })
+	return exporter
+}
+
+func TestTransport(t *testing.T) {
+	exporter := withTracerProvider(t)
+	var traceparent string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceparent = req.Header.Get("traceparent")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: Transport(http.DefaultTransport)}
+
+	// Requests which are not traced are left untouched
+	resp, err := client.Get(server.URL)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	assert.Empty(t, traceparent)
+	assert.Empty(t, exporter.GetSpans())
+
+	ctx, parent := Tracer().Start(context.Background(), "parent")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	assert.NoError(t, err)
+	resp, err = client.Do(req)
+	assert.NoError(t, err)
+	resp.Body.Close()
+	parent.End()
+
+	spans := exporter.GetSpans()
+	assert.Len(t, spans, 2)
+	span := spans[0]
+	assert.Equal(t, "HTTP GET", span.Name)
+	assert.Equal(t, trace.SpanKindClient, span.SpanKind)
+	assert.Equal(t, parent.SpanContext().SpanID(), span.Parent.SpanID())
+	assert.Contains(t, span.Attributes, semconv.HTTPStatusCodeKey.Int(http.StatusServiceUnavailable))
+	assert.Equal(t, "503 Service Unavailable", span.Status.Description)
+	// The trace is continued by the backend
+	assert.Equal(t, "00-"+span.SpanContext.TraceID().String()+"-"+span.SpanContext.SpanID().String()+"-01", traceparent)
+}
+
+func TestHandler(t *testing.T) {
+	withTracerProvider(t)
+	var spanContext trace.SpanContext
+	handler := Handler(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		spanContext = trace.SpanContextFromContext(req.Context())
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/apis/external.metrics.k8s.io/v1beta1", nil)
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.True(t, spanContext.IsRemote())
+	assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", spanContext.TraceID().String())
+	assert.Equal(t, "b7ad6b7169203331", spanContext.SpanID().String())
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var requests []exportRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "/otlp/v1/traces", req.URL.Path)
+		assert.Equal(t, "application/json", req.Header.Get("Content-Type"))
+		var request exportRequest
+		assert.NoError(t, json.NewDecoder(req.Body).Decode(&request))
+		requests = append(requests, request)
+	}))
+	defer server.Close()
+	exporter, err := newOTLPExporter(server.URL + "/otlp/")
+	assert.NoError(t, err)
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	tracer := provider.Tracer("test")
+
+	ctx, parent := tracer.Start(context.Background(), "parent", trace.WithAttributes(
+		attribute.String("string", "value"),
+		attribute.Int("int", 42),
+		attribute.Bool("bool", true),
+		attribute.StringSlice("slice", []string{"a", "b"}),
+	))
+	_, child := tracer.Start(ctx, "child", trace.WithSpanKind(trace.SpanKindClient))
+	End(child, errors.New("backend is down"))
+	parent.End()
+	assert.NoError(t, provider.Shutdown(context.Background()))
+
+	assert.Len(t, requests, 2)
+	childSpan := requests[0].ResourceSpans[0].ScopeSpans[0].Spans[0]
+	assert.Equal(t, "test", requests[0].ResourceSpans[0].ScopeSpans[0].Scope.Name)
+	assert.Equal(t, "child", childSpan.Name)
+	assert.Equal(t, parent.SpanContext().TraceID().String(), childSpan.TraceID)
+	assert.Equal(t, parent.SpanContext().SpanID().String(), childSpan.ParentSpanID)
+	assert.Equal(t, 3, childSpan.Kind)
+	assert.Equal(t, spanStatus{Code: otlpStatusError, Message: "backend is down"}, childSpan.Status)
+	assert.Equal(t, "exception", childSpan.Events[0].Name)
+
+	parentSpan := requests[1].ResourceSpans[0].ScopeSpans[0].Spans[0]
+	assert.Empty(t, parentSpan.ParentSpanID)
+	str, i, b := "value", "42", true
+	a, bb := "a", "b"
+	assert.Equal(t, []keyValue{
+		{Key: "string", Value: anyValue{StringValue: &str}},
+		{Key: "int", Value: anyValue{IntValue: &i}},
+		{Key: "bool", Value: anyValue{BoolValue: &b}},
+		{Key: "slice", Value: anyValue{ArrayValue: &arrayValue{Values: []anyValue{{StringValue: &a}, {StringValue: &bb}}}}},
+	}, parentSpan.Attributes)
+
+	_, err = newOTLPExporter("otel-collector:4318")
+	assert.Error(t, err)
+}